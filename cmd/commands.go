@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"anonlink/internal/auth"
+	"anonlink/internal/database"
+	"anonlink/internal/encryption"
+	"anonlink/internal/files"
+)
+
+// runCommand runs an admin subcommand against the configured database and
+// storage instead of starting the server, and returns the exit code.
+func runCommand(authService *auth.Service, fileService *files.Service, args []string) int {
+	switch args[0] {
+	case "generate-key":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: anonlink generate-key <id>")
+			return 2
+		}
+		key := make([]byte, encryption.DataKeySize)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to generate key:", err)
+			return 1
+		}
+		fmt.Printf("%s %s\n", args[1], base64.StdEncoding.EncodeToString(key))
+		return 0
+
+	case "rewrap-keys":
+		n, err := fileService.RewrapDataKeys()
+		if n > 0 {
+			fmt.Printf("Re-wrapped %d data keys\n", n)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to re-wrap data keys:", err)
+			return 1
+		}
+		fmt.Println("All data keys are wrapped with the current master key")
+		return 0
+
+	case "set-quota":
+		return setQuota(authService, fileService, args[1:])
+
+	case "set-role":
+		return setRole(authService, args[1:])
+
+	case "create-invite":
+		return createInvite(authService, args[1:])
+
+	case "unlock":
+		return unlockUser(authService, args[1:])
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q (available: create-invite, generate-key, migrate, rewrap-keys, set-quota, set-role, unlock)\n", args[0])
+		return 2
+	}
+}
+
+// setQuota handles "set-quota <username> [bytes=N] [files=N] [file-size=N]".
+// -1 means unlimited and 0 goes back to the server default.
+func setQuota(authService *auth.Service, fileService *files.Service, args []string) int {
+	usage := "usage: anonlink set-quota <username> [bytes=N] [files=N] [file-size=N]"
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var overrides files.QuotaOverrides
+	for _, arg := range args[1:] {
+		name, value, _ := strings.Cut(arg, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		switch name {
+		case "bytes":
+			overrides.MaxBytes = &n
+		case "files":
+			overrides.MaxFiles = &n
+		case "file-size":
+			overrides.MaxFileSize = &n
+		default:
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+	}
+
+	user, err := authService.GetUserByUsername(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set quota: user %q not found\n", args[0])
+		return 1
+	}
+	if err := fileService.SetQuotaOverrides(user.ID, overrides); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set quota:", err)
+		return 1
+	}
+	fmt.Printf("Updated quota of %s\n", args[0])
+	return 0
+}
+
+// setRole handles "set-role <username> <role>", which is also how an
+// instance that already had users gets its first admin.
+func setRole(authService *auth.Service, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: anonlink set-role <username> <%s>\n", strings.Join(auth.Roles, "|"))
+		return 2
+	}
+
+	user, err := authService.GetUserByUsername(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set role: user %q not found\n", args[0])
+		return 1
+	}
+	if err := authService.SetRole(user.ID, args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set role:", err)
+		return 1
+	}
+	fmt.Printf("%s is now %s\n", args[0], args[1])
+	return 0
+}
+
+// createInvite handles "create-invite [uses=N] [expires=DURATION]" and
+// prints the code, which is the only time it is shown.
+func createInvite(authService *auth.Service, args []string) int {
+	usage := "usage: anonlink create-invite [uses=N] [expires=DURATION]"
+	uses, ttl := 1, auth.DefaultInviteTTL
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		var err error
+		switch name {
+		case "uses":
+			uses, err = strconv.Atoi(value)
+		case "expires":
+			ttl, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+	}
+
+	invite, code, err := authService.CreateInvite(0, uses, ttl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create invite:", err)
+		return 1
+	}
+	fmt.Println(code)
+	fmt.Fprintf(os.Stderr, "Invite %s... works %d time(s) until %s\n", invite.Prefix, invite.MaxUses, invite.ExpiresAt.Format(time.RFC3339))
+	return 0
+}
+
+// unlockUser handles "unlock <username>", which lifts a lock that wrong
+// passwords put on the account.
+func unlockUser(authService *auth.Service, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: anonlink unlock <username>")
+		return 2
+	}
+
+	user, err := authService.GetUserByUsername(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to unlock: user %q not found\n", args[0])
+		return 1
+	}
+	if err := authService.UnlockUser(user.ID, "the command line"); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to unlock:", err)
+		return 1
+	}
+	fmt.Printf("%s is unlocked\n", args[0])
+	return 0
+}
+
+// runMigrate handles "migrate status", "migrate up" and "migrate down [n]".
+func runMigrate(dsn string, args []string) int {
+	usage := "usage: anonlink migrate status | up | down [n]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	db, err := database.Open(dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		status, err := database.GetMigrationStatus(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to get migration status:", err)
+			return 1
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + *m.AppliedAt
+			}
+			fmt.Printf("%04d %-30s %s\n", m.Version, m.Name, applied)
+		}
+		return 0
+
+	case args[0] == "up" && len(args) == 1:
+		applied, err := database.MigrateUp(db)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to migrate:", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+		return 0
+
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Fprintln(os.Stderr, usage)
+				return 2
+			}
+		}
+		reverted, err := database.MigrateDown(db, steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to revert migrations:", err)
+			return 1
+		}
+		if len(reverted) == 0 {
+			fmt.Println("No migrations to revert")
+		}
+		return 0
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
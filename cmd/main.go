@@ -1,76 +1,179 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"anonlink/internal/audit"
 	"anonlink/internal/auth"
 	"anonlink/internal/config"
 	"anonlink/internal/database"
+	"anonlink/internal/encryption"
 	"anonlink/internal/files"
 	"anonlink/internal/handlers"
+	"anonlink/internal/mail"
+	"anonlink/internal/oidc"
+	"anonlink/internal/ratelimit"
+	"anonlink/internal/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	
 	cfg := config.Load()
 
-	
-	db, err := database.Init(cfg.DatabasePath)
+	// migrate has to run before Init, which would apply every pending
+	// migration on its own.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg.DatabaseURL, os.Args[2:]))
+	}
+
+	db, err := database.Init(cfg.DatabaseURL)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer db.Close()
 
-	
-	if err := os.MkdirAll(cfg.UploadsPath, 0755); err != nil {
-		log.Fatal("Failed to create uploads directory:", err)
+	store, err := newStorage(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
+
+	keys, err := newKeyProvider(cfg)
+	if err != nil {
+		log.Fatal("Failed to load encryption keys:", err)
+	}
+
+	if !auth.ValidRegistrationMode(cfg.RegistrationMode) {
+		log.Fatalf("Unknown REGISTRATION_MODE %q (available: %s)", cfg.RegistrationMode, strings.Join(auth.RegistrationModes, ", "))
+	}
+	registrationDomains := strings.FieldsFunc(cfg.RegistrationDomains, func(r rune) bool { return r == ',' || r == ' ' })
+	if cfg.RegistrationMode == auth.RegistrationDomain && len(registrationDomains) == 0 {
+		log.Fatal("REGISTRATION_MODE=domain needs REGISTRATION_DOMAINS")
+	}
+
+	mailer, err := newMailer(cfg)
+	if err != nil {
+		log.Fatal("Failed to configure SMTP:", err)
+	}
+
+	auditLog := audit.New(audit.NewSQLRepository(db))
+	users := auth.NewSQLUserRepository(db)
+	authenticators, err := newAuthenticators(cfg, users)
+	if err != nil {
+		log.Fatal("Failed to configure LDAP:", err)
 	}
 
-	
-	authService := auth.NewService(db, cfg.JWTSecret)
-	fileService := files.NewService(db, cfg.UploadsPath)
+	authService := auth.NewService(users, auth.NewSQLSessionRepository(db), auth.NewSQLAPITokenRepository(db), cfg.JWTSecret, auth.Options{
+		AccessTokenTTL:       cfg.AccessTokenTTL,
+		RefreshTokenTTL:      cfg.RefreshTokenTTL,
+		RequireTOTP:          cfg.Require2FA,
+		AutoProvision:        cfg.OIDCAutoProvision,
+		LinkExistingAccounts: cfg.OIDCLinkExisting,
+		Authenticators:       authenticators,
+		Registration: auth.RegistrationPolicy{
+			Mode:    cfg.RegistrationMode,
+			Domains: registrationDomains,
+		},
+		Mailer:               mailer,
+		LinkBaseURL:          cfg.FrontendURL,
+		EmailVerificationTTL: cfg.EmailVerifyTTL,
+		PasswordResetTTL:     cfg.PasswordResetTTL,
+		Lockout: auth.LockoutPolicy{
+			MaxAttempts: cfg.LoginMaxAttempts,
+			Base:        cfg.LockoutBase,
+			Max:         cfg.LockoutMax,
+		},
+		Audit: auditLog,
+	})
+	fileService := files.NewService(files.NewSQLFileRepository(db), store, files.Options{
+		Policy: files.ExpiryPolicy{
+			DefaultLifetime:  cfg.DefaultFileLifetime,
+			MaxLifetime:      cfg.MaxFileLifetime,
+			AllowNeverExpire: cfg.AllowNeverExpire,
+		},
+		AnonymousPolicy: files.ExpiryPolicy{
+			DefaultLifetime:  cfg.AnonymousDefaultLifetime,
+			MaxLifetime:      cfg.AnonymousMaxLifetime,
+			AllowNeverExpire: cfg.AnonymousAllowNeverExpire,
+		},
+		Quota: files.Quota{
+			MaxBytes:    cfg.MaxStoragePerUser,
+			MaxFiles:    cfg.MaxFilesPerUser,
+			MaxFileSize: cfg.MaxFileSize,
+		},
+		Keys: keys,
+	})
 
-	
-	h := handlers.New(authService, fileService)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(authService, fileService, os.Args[1:]))
+	}
+
+	oidcProvider, err := newOIDCProvider(cfg)
+	if err != nil {
+		log.Fatal("Failed to configure OIDC:", err)
+	}
+	if !cfg.LocalAuth && oidcProvider == nil && cfg.LDAPURL == "" {
+		log.Fatal("LOCAL_AUTH=false needs OIDC_ISSUER or LDAP_URL, or nobody could log in")
+	}
+
+	limits := ratelimit.NewSQLRepository(db)
+	h := handlers.New(authService, fileService, oidcProvider, auditLog, limits, cfg)
 
-	
 	go func() {
-		ticker := time.NewTicker(1 * time.Hour) 
+		ticker := time.NewTicker(1 * time.Hour)
 		defer ticker.Stop()
-		
+
 		for {
 			select {
 			case <-ticker.C:
 				if err := fileService.CleanupExpiredFiles(); err != nil {
 					log.Printf("Error cleaning up expired files: %v", err)
 				}
+				if err := fileService.CleanupExpiredUploads(); err != nil {
+					log.Printf("Error cleaning up expired uploads: %v", err)
+				}
+				if err := authService.CleanupExpiredSessions(); err != nil {
+					log.Printf("Error cleaning up expired sessions: %v", err)
+				}
+				if err := authService.CleanupExpiredEmailTokens(); err != nil {
+					log.Printf("Error cleaning up expired email tokens: %v", err)
+				}
+				if err := auditLog.Cleanup(cfg.AuditRetention); err != nil {
+					log.Printf("Error cleaning up the audit log: %v", err)
+				}
+				if _, err := limits.DeleteExpired(time.Now()); err != nil {
+					log.Printf("Error cleaning up expired rate limits: %v", err)
+				}
 			}
 		}
 	}()
 
-	
 	go func() {
-		time.Sleep(10 * time.Second) 
+		time.Sleep(10 * time.Second)
 		if err := fileService.CleanupExpiredFiles(); err != nil {
 			log.Printf("Error in initial cleanup: %v", err)
 		}
+		if err := fileService.CleanupExpiredUploads(); err != nil {
+			log.Printf("Error in initial upload cleanup: %v", err)
+		}
 	}()
 
-	
 	r := gin.Default()
 
-	
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Unlock-Token, Range, If-Range, If-None-Match, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		c.Header("Access-Control-Expose-Headers", "ETag, Content-Range, Accept-Ranges, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Anonlink-File-Id, Anonlink-Download-Token")
 
-		if c.Request.Method == "OPTIONS" {
+		if c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != "" {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
@@ -78,31 +181,128 @@ func main() {
 		c.Next()
 	})
 
-	
 	api := r.Group("/api/v1")
 	{
-		
-		api.POST("/register", h.Register)
-		api.POST("/login", h.Login)
+		api.GET("/auth/methods", h.GetAuthMethods)
+		if cfg.LocalAuth {
+			api.POST("/register", h.Register)
+		}
+		if cfg.LocalAuth || cfg.LDAPURL != "" {
+			api.POST("/login", h.Login)
+		}
+		if authService.EmailEnabled() {
+			api.POST("/verify-email", h.VerifyEmail)
+			api.POST("/unlock-account", h.UnlockAccount)
+			if cfg.LocalAuth {
+				api.POST("/password-reset", h.RequestPasswordReset)
+				api.POST("/password-reset/confirm", h.ConfirmPasswordReset)
+			}
+		}
+		if oidcProvider != nil {
+			api.GET("/auth/oidc/login", h.OIDCLogin)
+			api.GET("/auth/oidc/callback", h.OIDCCallback)
+		}
+		api.POST("/login/mfa", h.LoginMFA)
+		api.POST("/login/mfa/enroll", h.LoginMFAEnroll)
+		api.POST("/token/refresh", h.RefreshToken)
+
+		// Every protected route says what it needs: a scope, which API tokens
+		// must have been granted, or a login.
+		read := h.RequireScope(auth.ScopeFilesRead)
+		write := h.RequireScope(auth.ScopeFilesWrite)
+		links := h.RequireScope(auth.ScopeLinksManage)
+		login := h.RequireLogin()
+		verified := h.RequireVerifiedEmail()
+
+		// Read-only accounts may only read, except for looking after their
+		// own sign-in.
+		account := api.Group("/")
+		account.Use(h.AccountAuthMiddleware(), login)
+		{
+			account.POST("/logout", h.Logout)
+			account.POST("/logout/all", h.LogoutAll)
+			account.GET("/me/sessions", h.GetSessions)
+			account.DELETE("/me/sessions/:id", h.DeleteSession)
+			account.GET("/me/2fa", h.GetTOTPStatus)
+			account.POST("/me/2fa/enroll", h.EnrollTOTP)
+			account.POST("/me/2fa/confirm", h.ConfirmTOTP)
+			account.POST("/me/2fa/recovery-codes", h.RegenerateRecoveryCodes)
+			account.POST("/me/2fa/disable", h.DisableTOTP)
+			if authService.EmailEnabled() {
+				account.POST("/me/email/verify", h.ResendVerificationEmail)
+			}
+		}
 
-		
 		protected := api.Group("/")
 		protected.Use(h.AuthMiddleware())
 		{
-			
-			protected.POST("/upload", h.UploadFile)
-			protected.GET("/files", h.GetUserFiles)
-			protected.DELETE("/files/:id", h.DeleteFile)
-			protected.GET("/files/:id/download", h.DownloadFile)
-			protected.POST("/files/:id/regenerate-link", h.GenerateNewShareLink)
+			protected.GET("/me/tokens", login, h.GetAPITokens)
+			protected.POST("/me/tokens", login, h.CreateAPIToken)
+			protected.DELETE("/me/tokens/:id", login, h.DeleteAPIToken)
+			protected.GET("/me/invites", login, h.GetInvites)
+			protected.POST("/me/invites", login, h.CreateInvite)
+			protected.DELETE("/me/invites/:id", login, h.DeleteInvite)
+			protected.GET("/me/usage", read, h.GetUsage)
+			protected.POST("/upload", write, verified, h.UploadFile)
+			protected.GET("/files", read, h.GetUserFiles)
+			protected.PATCH("/files/:id", write, h.UpdateFile)
+			protected.DELETE("/files/:id", write, h.DeleteFile)
+			protected.GET("/files/:id/download", read, h.DownloadFile)
+			protected.HEAD("/files/:id/download", read, h.DownloadFile)
+			protected.POST("/files/:id/regenerate-link", links, h.GenerateNewShareLink)
+			protected.PUT("/files/:id/password", links, h.SetSharePassword)
+			protected.DELETE("/files/:id/password", links, h.RemoveSharePassword)
+			protected.GET("/files/:id/links", links, h.GetShareLinks)
+			protected.POST("/files/:id/links", links, h.CreateShareLink)
+			protected.PATCH("/files/:id/links/:linkId", links, h.UpdateShareLink)
+			protected.DELETE("/files/:id/links/:linkId", links, h.DeleteShareLink)
+		}
+
+		admin := protected.Group("/admin", login, h.RequireAdmin())
+		{
+			admin.GET("/users", h.AdminListUsers)
+			admin.GET("/users/:id", h.AdminGetUser)
+			admin.PATCH("/users/:id", h.AdminUpdateUser)
+			admin.DELETE("/users/:id", h.AdminDeleteUser)
+			admin.POST("/users/:id/unlock", h.AdminUnlockUser)
+			admin.GET("/files", h.AdminListFiles)
+			admin.DELETE("/files/:id", h.AdminDeleteFile)
+			admin.POST("/files/:id/expire", h.AdminExpireFile)
+			admin.GET("/invites", h.AdminListInvites)
+			admin.DELETE("/invites/:id", h.AdminDeleteInvite)
+			admin.GET("/stats", h.AdminGetStats)
+			admin.GET("/audit", h.AdminListAuditEvents)
+		}
+
+		tus := api.Group("/uploads/tus")
+		tus.Use(h.TusMiddleware())
+		{
+			tus.OPTIONS("", h.TusOptions)
+
+			tusProtected := tus.Group("")
+			tusProtected.Use(h.AuthMiddleware(), write)
+			tusProtected.POST("", verified, h.TusCreate)
+			tusProtected.HEAD("/:id", h.TusHead)
+			tusProtected.PATCH("/:id", h.TusPatch)
+			tusProtected.DELETE("/:id", h.TusDelete)
 		}
 
-		
 		api.GET("/download/:token", h.PublicDownload)
+		api.HEAD("/download/:token", h.PublicDownload)
+		api.POST("/download/:token", h.PasswordDownload)
+		api.POST("/download/:token/unlock", h.UnlockShare)
 		api.GET("/file-info/:token", h.GetFileInfo)
+
+		anonymous := api.Group("/")
+		anonymous.Use(h.RequireAnonymousUploads())
+		{
+			anonymous.POST("/anonymous/upload", h.AnonymousUpload)
+			anonymous.GET("/manage/:token", h.GetManagedFile)
+			anonymous.PATCH("/manage/:token", h.UpdateManagedFile)
+			anonymous.DELETE("/manage/:token", h.DeleteManagedFile)
+		}
 	}
 
-	
 	r.Static("/static", "./frontend/build/static")
 	r.StaticFile("/", "./frontend/build/index.html")
 	r.NoRoute(func(c *gin.Context) {
@@ -112,3 +312,112 @@ func main() {
 	log.Printf("Server starting on port %s", cfg.Port)
 	log.Fatal(r.Run(":" + cfg.Port))
 }
+
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.StorageBackend {
+	case "local":
+		return storage.NewLocal(cfg.UploadsPath)
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Bucket:          cfg.S3Bucket,
+			Prefix:          cfg.S3Prefix,
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			PathStyle:       cfg.S3PathStyle,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %q", cfg.StorageBackend)
+	}
+}
+
+// newAuthenticators lists the ways to check passwords: those stored here
+// unless LOCAL_AUTH is off, then the LDAP directory if there is one.
+func newAuthenticators(cfg *config.Config, users auth.UserRepository) ([]auth.Authenticator, error) {
+	authenticators := []auth.Authenticator{}
+	if cfg.LocalAuth {
+		authenticators = append(authenticators, auth.NewPasswordAuthenticator(users))
+	}
+	if cfg.LDAPURL == "" {
+		return authenticators, nil
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.LDAPCAFile != "" {
+		pem, err := os.ReadFile(cfg.LDAPCAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.LDAPCAFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: roots}
+	}
+
+	directory, err := auth.NewLDAPAuthenticator(auth.LDAPConfig{
+		URL:               cfg.LDAPURL,
+		StartTLS:          cfg.LDAPStartTLS,
+		TLSConfig:         tlsConfig,
+		BindDN:            cfg.LDAPBindDN,
+		BindPassword:      cfg.LDAPBindPassword,
+		BaseDN:            cfg.LDAPBaseDN,
+		UserFilter:        cfg.LDAPUserFilter,
+		GroupFilter:       cfg.LDAPGroupFilter,
+		GroupBaseDN:       cfg.LDAPGroupBaseDN,
+		UsernameAttribute: cfg.LDAPUsernameAttribute,
+		EmailAttribute:    cfg.LDAPEmailAttribute,
+		TrustEmail:        cfg.LDAPTrustEmail,
+	}, users)
+	if err != nil {
+		return nil, err
+	}
+	return append(authenticators, directory), nil
+}
+
+// newMailer returns nil when SMTP is not configured, which turns off email
+// verification and password resets.
+func newMailer(cfg *config.Config) (auth.Mailer, error) {
+	if cfg.SMTPHost == "" {
+		if cfg.RequireVerifiedEmail {
+			return nil, fmt.Errorf("REQUIRE_VERIFIED_EMAIL=true needs SMTP_HOST")
+		}
+		return nil, nil
+	}
+	if cfg.FrontendURL == "" {
+		return nil, fmt.Errorf("SMTP_HOST needs FRONTEND_URL for the links in emails")
+	}
+	return mail.New(mail.Config{
+		Host:         cfg.SMTPHost,
+		Port:         cfg.SMTPPort,
+		Username:     cfg.SMTPUsername,
+		Password:     cfg.SMTPPassword,
+		From:         cfg.SMTPFrom,
+		TLS:          cfg.SMTPTLS,
+		TemplatesDir: cfg.MailTemplatesDir,
+	})
+}
+
+// newOIDCProvider returns nil when single sign-on is not configured.
+func newOIDCProvider(cfg *config.Config) (*oidc.Provider, error) {
+	if cfg.OIDCIssuer == "" {
+		return nil, nil
+	}
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       cfg.OIDCIssuer,
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: cfg.OIDCClientSecret,
+		RedirectURL:  cfg.OIDCRedirectURL,
+		Scopes:       strings.Fields(cfg.OIDCScopes),
+	})
+}
+
+// newKeyProvider returns nil when encryption at rest is not configured, in
+// which case new uploads are stored in plaintext.
+func newKeyProvider(cfg *config.Config) (encryption.KeyProvider, error) {
+	if cfg.EncryptionKeyFile == "" {
+		return nil, nil
+	}
+	return encryption.LoadLocalKeys(cfg.EncryptionKeyFile)
+}
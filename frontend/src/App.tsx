@@ -8,6 +8,9 @@ import Navbar from './components/Navbar';
 import HomePage from './pages/HomePage';
 import LoginPage from './pages/LoginPage';
 import RegisterPage from './pages/RegisterPage';
+import ResetPasswordPage from './pages/ResetPasswordPage';
+import VerifyEmailPage from './pages/VerifyEmailPage';
+import UnlockAccountPage from './pages/UnlockAccountPage';
 import DashboardPage from './pages/DashboardPage';
 import PublicDownloadPage from './pages/PublicDownloadPage';
 import PrivateRoute from './components/PrivateRoute';
@@ -56,6 +59,9 @@ function App() {
                 <Route path="/" element={<HomePage />} />
                 <Route path="/login" element={<LoginPage />} />
                 <Route path="/register" element={<RegisterPage />} />
+                <Route path="/reset-password" element={<ResetPasswordPage />} />
+                <Route path="/verify-email" element={<VerifyEmailPage />} />
+                <Route path="/unlock-account" element={<UnlockAccountPage />} />
                 <Route path="/download/:token" element={<PublicDownloadPage />} />
                 <Route path="/dashboard" element={
                   <PrivateRoute>
@@ -1,11 +1,26 @@
 import React, { createContext, useContext, useState, useEffect } from 'react';
-import { User, authAPI } from '../services/api';
+import { User, LoginData, authAPI } from '../services/api';
+
+// MfaChallenge is what login and register hand back instead of logging in
+// when a two-factor code is needed.
+export interface MfaChallenge {
+  mfaToken: string;
+  enrollmentRequired: boolean;
+}
 
 interface AuthContextType {
   user: User | null;
   token: string | null;
-  login: (username: string, password: string) => Promise<void>;
-  register: (username: string, email: string, password: string) => Promise<void>;
+  login: (username: string, password: string) => Promise<MfaChallenge | null>;
+  register: (username: string, email: string, password: string, inviteCode?: string) => Promise<MfaChallenge | null>;
+  // completeMfa returns recovery codes when it also finished enrolling.
+  completeMfa: (mfaToken: string, code: string) => Promise<string[] | undefined>;
+  // acceptLogin takes the outcome of a login finished elsewhere, such as
+  // single sign-on.
+  acceptLogin: (data: LoginData) => MfaChallenge | null;
+  // updateUser replaces the stored user after the server changed it, such
+  // as when they verified their email address.
+  updateUser: (user: User) => void;
   logout: () => void;
   isAuthenticated: boolean;
   loading: boolean;
@@ -41,21 +56,32 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
       } catch (error) {
         console.error('Error parsing saved user data:', error);
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
         localStorage.removeItem('user');
       }
     }
     setLoading(false);
   }, []);
 
+  // finishLogin stores a new session, or returns the challenge to answer
+  // before there is one.
+  const finishLogin = (data: LoginData): MfaChallenge | null => {
+    if (data.mfa_required) {
+      return { mfaToken: data.mfa_token!, enrollmentRequired: !!data.enrollment_required };
+    }
+    setUser(data.user!);
+    setToken(data.token!);
+    localStorage.setItem('token', data.token!);
+    localStorage.setItem('refreshToken', data.refresh_token!);
+    localStorage.setItem('user', JSON.stringify(data.user));
+    return null;
+  };
+
   const login = async (username: string, password: string) => {
     try {
       const response = await authAPI.login(username, password);
       if (response.success && response.data) {
-        const { user, token } = response.data;
-        setUser(user);
-        setToken(token);
-        localStorage.setItem('token', token);
-        localStorage.setItem('user', JSON.stringify(user));
+        return finishLogin(response.data);
       } else {
         throw new Error(response.error || 'Login failed');
       }
@@ -64,15 +90,11 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     }
   };
 
-  const register = async (username: string, email: string, password: string) => {
+  const register = async (username: string, email: string, password: string, inviteCode?: string) => {
     try {
-      const response = await authAPI.register(username, email, password);
+      const response = await authAPI.register(username, email, password, inviteCode);
       if (response.success && response.data) {
-        const { user, token } = response.data;
-        setUser(user);
-        setToken(token);
-        localStorage.setItem('token', token);
-        localStorage.setItem('user', JSON.stringify(user));
+        return finishLogin(response.data);
       } else {
         throw new Error(response.error || 'Registration failed');
       }
@@ -81,11 +103,40 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     }
   };
 
+  const completeMfa = async (mfaToken: string, code: string) => {
+    try {
+      const response = await authAPI.completeMfa(mfaToken, code);
+      if (response.success && response.data) {
+        finishLogin(response.data);
+        return response.data.recovery_codes;
+      } else {
+        throw new Error(response.error || 'Login failed');
+      }
+    } catch (error: any) {
+      throw new Error(error.response?.data?.error || error.message || 'Login failed');
+    }
+  };
+
+  const updateUser = (updated: User) => {
+    setUser(updated);
+    localStorage.setItem('user', JSON.stringify(updated));
+  };
+
   const logout = () => {
+    const forget = () => {
+      localStorage.removeItem('token');
+      localStorage.removeItem('refreshToken');
+      localStorage.removeItem('user');
+    };
     setUser(null);
     setToken(null);
-    localStorage.removeItem('token');
-    localStorage.removeItem('user');
+    // Ending the session on the server is best effort; the tokens are
+    // forgotten locally either way, once the request has used them.
+    if (localStorage.getItem('refreshToken')) {
+      authAPI.logout().catch(() => {}).then(forget);
+    } else {
+      forget();
+    }
   };
 
   const value: AuthContextType = {
@@ -93,6 +144,9 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     token,
     login,
     register,
+    completeMfa,
+    acceptLogin: finishLogin,
+    updateUser,
     logout,
     isAuthenticated: !!user && !!token,
     loading,
@@ -9,6 +9,8 @@ import {
   Grid,
   Stack,
   Chip,
+  Alert,
+  Button,
 } from '@mui/material';
 import { 
   CloudUpload, 
@@ -19,7 +21,7 @@ import {
 } from '@mui/icons-material';
 import { useAuth } from '../contexts/AuthContext';
 import { useSnackbar } from '../contexts/SnackbarContext';
-import { FileItem, filesAPI } from '../services/api';
+import { FileItem, authAPI, filesAPI } from '../services/api';
 import FileUpload from '../components/FileUpload';
 import FileList from '../components/FileList';
 
@@ -28,6 +30,22 @@ const DashboardPage: React.FC = () => {
   const { showSnackbar } = useSnackbar();
   const [files, setFiles] = useState<FileItem[]>([]);
   const [loading, setLoading] = useState(true);
+  const [emailVerification, setEmailVerification] = useState(false);
+
+  useEffect(() => {
+    authAPI.getMethods()
+      .then((response) => setEmailVerification(!!response.data?.email_verification))
+      .catch(() => {});
+  }, []);
+
+  const resendVerification = async () => {
+    try {
+      const response = await authAPI.resendVerification();
+      showSnackbar(response.message || 'We sent you a new link', 'success');
+    } catch (error: any) {
+      showSnackbar(error.response?.data?.error || 'Failed to send the email', 'error');
+    }
+  };
 
   const loadFiles = async () => {
     try {
@@ -99,6 +117,15 @@ const DashboardPage: React.FC = () => {
   return (
     <Box sx={{ minHeight: '100vh', background: 'linear-gradient(180deg, #f8fafc 0%, #ffffff 100%)' }}>
       <Container maxWidth="lg" sx={{ py: 4 }}>
+        {emailVerification && user && !user.email_verified && (
+          <Alert
+            severity="info"
+            sx={{ mb: 4, borderRadius: 2 }}
+            action={<Button color="inherit" size="small" onClick={resendVerification}>Resend link</Button>}
+          >
+            Please confirm your email address with the link we sent to {user.email}.
+          </Alert>
+        )}
         <Box sx={{ mb: 6 }}>
           <Stack direction="row" alignItems="center" spacing={2} sx={{ mb: 2 }}>
             <Typography variant="h3" sx={{ fontWeight: 800, color: '#1e293b' }}>
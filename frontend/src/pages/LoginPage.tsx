@@ -11,35 +11,112 @@ import {
   Stack,
   Chip,
 } from '@mui/material';
-import { Link as RouterLink, useNavigate } from 'react-router-dom';
+import { Link as RouterLink, useLocation, useNavigate } from 'react-router-dom';
 import { Security, Login } from '@mui/icons-material';
-import { useAuth } from '../contexts/AuthContext';
+import { MfaChallenge, useAuth } from '../contexts/AuthContext';
 import { useSnackbar } from '../contexts/SnackbarContext';
+import { AuthMethods, LoginData, TOTPEnrollment, authAPI } from '../services/api';
 
 const LoginPage: React.FC = () => {
   const [username, setUsername] = useState('');
   const [password, setPassword] = useState('');
   const [loading, setLoading] = useState(false);
+  const location = useLocation();
+  // Registering can also end in a two-factor challenge, which is passed on
+  // to this page.
+  const [challenge, setChallenge] = useState<MfaChallenge | null>(
+    (location.state as { mfa?: MfaChallenge } | null)?.mfa ?? null
+  );
+  const [code, setCode] = useState('');
+  const [enrollment, setEnrollment] = useState<TOTPEnrollment | null>(null);
+  const [recoveryCodes, setRecoveryCodes] = useState<string[] | null>(null);
+  // Keeps the user here after enrolling until they have seen their
+  // recovery codes.
+  const holdRedirect = React.useRef(false);
+  const [methods, setMethods] = useState<AuthMethods>({
+    local: true,
+    ldap: false,
+    registration: 'open',
+    email_verification: false,
+    password_reset: false,
+  });
+  const passwordLogin = methods.local || methods.ldap;
   
-  const { login, isAuthenticated } = useAuth();
+  const { login, completeMfa, acceptLogin, isAuthenticated } = useAuth();
   const { showSnackbar } = useSnackbar();
   const navigate = useNavigate();
 
   React.useEffect(() => {
-    if (isAuthenticated) {
+    authAPI.getMethods()
+      .then((response) => response.data && setMethods(response.data))
+      .catch(() => {});
+  }, []);
+
+  // Single sign-on sends the browser back here with the outcome in the URL
+  // fragment.
+  React.useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    const error = params.get('error');
+    const result = params.get('oidc');
+    if (!error && !result) {
+      return;
+    }
+    window.history.replaceState(null, '', window.location.pathname);
+
+    if (error) {
+      showSnackbar(error, 'error');
+      return;
+    }
+    try {
+      const json = Uint8Array.from(atob(result!.replace(/-/g, '+').replace(/_/g, '/')), (c) => c.charCodeAt(0));
+      const next = acceptLogin(JSON.parse(new TextDecoder().decode(json)) as LoginData);
+      if (next) {
+        setChallenge(next);
+      } else {
+        showSnackbar('Welcome back!', 'success');
+      }
+    } catch {
+      showSnackbar('Single sign-on failed', 'error');
+    }
+  }, []);
+
+  React.useEffect(() => {
+    if (isAuthenticated && !holdRedirect.current) {
       navigate('/dashboard');
     }
   }, [isAuthenticated, navigate]);
 
+  React.useEffect(() => {
+    if (challenge?.enrollmentRequired && !enrollment) {
+      authAPI.enrollMfa(challenge.mfaToken)
+        .then((response) => setEnrollment(response.data ?? null))
+        .catch((error: any) => showSnackbar(error.response?.data?.error || 'Could not set up two-factor authentication', 'error'));
+    }
+  }, [challenge, enrollment, showSnackbar]);
+
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
     setLoading(true);
 
     try {
-      await login(username, password);
+      if (challenge) {
+        holdRedirect.current = challenge.enrollmentRequired;
+        const codes = await completeMfa(challenge.mfaToken, code);
+        if (codes) {
+          setRecoveryCodes(codes);
+          return;
+        }
+      } else {
+        const next = await login(username, password);
+        if (next) {
+          setChallenge(next);
+          return;
+        }
+      }
       showSnackbar('Welcome back!', 'success');
       navigate('/dashboard');
     } catch (error: any) {
+      holdRedirect.current = false;
       showSnackbar(error.message || 'Login failed', 'error');
     } finally {
       setLoading(false);
@@ -103,8 +180,59 @@ const LoginPage: React.FC = () => {
             />
           </Box>
           
-          {/* Form */}
+          {recoveryCodes ? (
+            <Box textAlign="center">
+              <Typography variant="body1" sx={{ mb: 2 }}>
+                Two-factor authentication is set up. Store these recovery codes somewhere safe;
+                each one gets you in once if you lose your authenticator.
+              </Typography>
+              <Box component="pre" sx={{ fontFamily: 'monospace', fontSize: '1.1rem', mb: 3 }}>
+                {recoveryCodes.join('\n')}
+              </Box>
+              <Button variant="contained" size="large" onClick={() => navigate('/dashboard')}>
+                Continue
+              </Button>
+            </Box>
+          ) : (
+          /* Form */
           <Box component="form" onSubmit={handleSubmit}>
+            {challenge ? (
+              <>
+                {enrollment && (
+                  <Box sx={{ mb: 2 }}>
+                    <Typography variant="body2" color="text.secondary" sx={{ mb: 1 }}>
+                      This server requires two-factor authentication. Add this key to your
+                      authenticator app, then enter the code it shows.
+                    </Typography>
+                    <Typography sx={{ fontFamily: 'monospace', wordBreak: 'break-all' }}>
+                      {enrollment.secret}
+                    </Typography>
+                    <Link href={enrollment.uri} variant="body2">
+                      Open in authenticator app
+                    </Link>
+                  </Box>
+                )}
+                <TextField
+                  margin="normal"
+                  required
+                  fullWidth
+                  id="code"
+                  label={challenge.enrollmentRequired ? 'Authentication code' : 'Authentication or recovery code'}
+                  name="code"
+                  autoComplete="one-time-code"
+                  autoFocus
+                  value={code}
+                  onChange={(e) => setCode(e.target.value)}
+                  sx={{
+                    mb: 4,
+                    '& .MuiOutlinedInput-root': {
+                      borderRadius: 2,
+                    },
+                  }}
+                />
+              </>
+            ) : passwordLogin && (
+            <>
             <TextField
               margin="normal"
               required
@@ -135,13 +263,23 @@ const LoginPage: React.FC = () => {
               value={password}
               onChange={(e) => setPassword(e.target.value)}
               sx={{
-                mb: 4,
+                mb: methods.password_reset ? 1 : 4,
                 '& .MuiOutlinedInput-root': {
                   borderRadius: 2,
                 },
               }}
             />
+            {methods.password_reset && (
+              <Box textAlign="right" sx={{ mb: 3 }}>
+                <Link component={RouterLink} to="/reset-password" variant="body2" sx={{ color: '#667eea' }}>
+                  Forgot password?
+                </Link>
+              </Box>
+            )}
+            </>
+            )}
             
+            {(challenge || passwordLogin) && (
             <Button
               type="submit"
               fullWidth
@@ -174,10 +312,24 @@ const LoginPage: React.FC = () => {
                   <span>Signing In...</span>
                 </Stack>
               ) : (
-                'Sign In'
+                challenge ? 'Verify' : 'Sign In'
               )}
             </Button>
+            )}
+
+            {!challenge && methods.oidc && (
+              <Button
+                fullWidth
+                variant="outlined"
+                size="large"
+                href={authAPI.oidcLoginUrl}
+                sx={{ py: 1.5, fontWeight: 700, borderRadius: 3, mb: 3 }}
+              >
+                Sign in with {methods.oidc.name}
+              </Button>
+            )}
             
+            {methods.local && methods.registration !== 'closed' && (
             <Box textAlign="center">
               <Typography variant="body2" color="text.secondary" sx={{ mb: 1 }}>
                 Don't have an account?
@@ -197,7 +349,9 @@ const LoginPage: React.FC = () => {
                 Create one for free
               </Link>
             </Box>
+            )}
           </Box>
+          )}
         </Paper>
       </Container>
     </Box>
@@ -11,16 +11,20 @@ import {
   Stack,
   Chip,
 } from '@mui/material';
-import { Link as RouterLink, useNavigate } from 'react-router-dom';
+import { Link as RouterLink, useNavigate, useSearchParams } from 'react-router-dom';
 import { PersonAdd, Security } from '@mui/icons-material';
 import { useAuth } from '../contexts/AuthContext';
 import { useSnackbar } from '../contexts/SnackbarContext';
+import { authAPI, AuthMethods } from '../services/api';
 
 const RegisterPage: React.FC = () => {
   const [username, setUsername] = useState('');
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
   const [confirmPassword, setConfirmPassword] = useState('');
+  const [searchParams] = useSearchParams();
+  const [inviteCode, setInviteCode] = useState(searchParams.get('invite') || '');
+  const [registration, setRegistration] = useState<AuthMethods['registration']>('open');
   const [loading, setLoading] = useState(false);
   
   const { register, isAuthenticated } = useAuth();
@@ -33,6 +37,22 @@ const RegisterPage: React.FC = () => {
     }
   }, [isAuthenticated, navigate]);
 
+  // Without local accounts, everyone signs in through single sign-on, and
+  // with registration closed only existing accounts can sign in.
+  React.useEffect(() => {
+    authAPI.getMethods()
+      .then((response) => {
+        if (response.data && (!response.data.local || response.data.registration === 'closed')) {
+          navigate('/login', { replace: true });
+          return;
+        }
+        if (response.data) {
+          setRegistration(response.data.registration);
+        }
+      })
+      .catch(() => {});
+  }, [navigate]);
+
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
     
@@ -49,7 +69,12 @@ const RegisterPage: React.FC = () => {
     setLoading(true);
 
     try {
-      await register(username, email, password);
+      const challenge = await register(username, email, password, inviteCode.trim());
+      if (challenge) {
+        showSnackbar('Your account is ready. Set up two-factor authentication to sign in.', 'info');
+        navigate('/login', { state: { mfa: challenge } });
+        return;
+      }
       showSnackbar('Welcome to Anonlink! Your account is ready.', 'success');
       navigate('/dashboard');
     } catch (error: any) {
@@ -212,6 +237,27 @@ const RegisterPage: React.FC = () => {
                 },
               }}
             />
+            {(registration === 'invite' || registration === 'domain') && (
+              <TextField
+                margin="normal"
+                required={registration === 'invite'}
+                fullWidth
+                name="inviteCode"
+                label="Invite Code"
+                id="inviteCode"
+                value={inviteCode}
+                onChange={(e) => setInviteCode(e.target.value)}
+                helperText={registration === 'invite'
+                  ? 'Registration is by invitation only'
+                  : 'Only needed if your email address is not at an allowed domain'}
+                sx={{
+                  mb: 4,
+                  '& .MuiOutlinedInput-root': {
+                    borderRadius: 2,
+                  },
+                }}
+              />
+            )}
             
             <Button
               type="submit"
@@ -0,0 +1,183 @@
+import React, { useState } from 'react';
+import {
+  Container,
+  Paper,
+  TextField,
+  Button,
+  Typography,
+  Box,
+  Link,
+  CircularProgress,
+} from '@mui/material';
+import { Link as RouterLink, useNavigate } from 'react-router-dom';
+import { LockReset } from '@mui/icons-material';
+import { useSnackbar } from '../contexts/SnackbarContext';
+import { authAPI } from '../services/api';
+
+// ResetPasswordPage asks for the email address to send a reset link to, or,
+// opened from that link, for the new password. The link carries its token
+// in the fragment so that it never reaches a server log.
+const ResetPasswordPage: React.FC = () => {
+  const token = new URLSearchParams(window.location.hash.slice(1)).get('token');
+  const [email, setEmail] = useState('');
+  const [password, setPassword] = useState('');
+  const [confirmPassword, setConfirmPassword] = useState('');
+  const [sent, setSent] = useState(false);
+  const [loading, setLoading] = useState(false);
+
+  const { showSnackbar } = useSnackbar();
+  const navigate = useNavigate();
+
+  const handleRequest = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setLoading(true);
+    try {
+      await authAPI.requestPasswordReset(email);
+      setSent(true);
+    } catch (error: any) {
+      showSnackbar(error.response?.data?.error || 'Failed to send the email', 'error');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const handleReset = async (e: React.FormEvent) => {
+    e.preventDefault();
+    if (password !== confirmPassword) {
+      showSnackbar('Passwords do not match', 'error');
+      return;
+    }
+    if (password.length < 6) {
+      showSnackbar('Password must be at least 6 characters', 'error');
+      return;
+    }
+
+    setLoading(true);
+    try {
+      await authAPI.resetPassword(token!, password);
+      showSnackbar('Your password has been changed, sign in with the new one', 'success');
+      navigate('/login', { replace: true });
+    } catch (error: any) {
+      showSnackbar(error.response?.data?.error || 'Failed to reset password', 'error');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const fieldSx = {
+    mb: 2,
+    '& .MuiOutlinedInput-root': {
+      borderRadius: 2,
+    },
+  };
+
+  return (
+    <Box sx={{
+      minHeight: '100vh',
+      background: 'linear-gradient(180deg, #f8fafc 0%, #ffffff 100%)',
+      display: 'flex',
+      alignItems: 'center',
+      py: 4,
+    }}>
+      <Container component="main" maxWidth="sm">
+        <Paper
+          elevation={0}
+          sx={{
+            p: 6,
+            borderRadius: 4,
+            border: '1px solid rgba(0, 0, 0, 0.05)',
+            boxShadow: '0 20px 60px rgba(0,0,0,0.1)',
+          }}
+        >
+          <Box textAlign="center" sx={{ mb: 4 }}>
+            <Box
+              sx={{
+                width: 64,
+                height: 64,
+                borderRadius: 3,
+                background: 'linear-gradient(135deg, #667eea 0%, #764ba2 100%)',
+                display: 'flex',
+                alignItems: 'center',
+                justifyContent: 'center',
+                mx: 'auto',
+                mb: 3,
+              }}
+            >
+              <LockReset sx={{ color: 'white', fontSize: 32 }} />
+            </Box>
+            <Typography variant="h4" sx={{ fontWeight: 800, color: '#1e293b', mb: 1 }}>
+              {token ? 'Choose a new password' : 'Forgot your password?'}
+            </Typography>
+            <Typography color="text.secondary">
+              {token
+                ? 'This signs you out everywhere else.'
+                : sent
+                  ? 'If there is an account with that address, we sent it a link. Check your inbox.'
+                  : 'Enter the email address of your account and we will send you a link.'}
+            </Typography>
+          </Box>
+
+          {token ? (
+            <Box component="form" onSubmit={handleReset}>
+              <TextField
+                margin="normal"
+                required
+                fullWidth
+                label="New Password"
+                type="password"
+                autoComplete="new-password"
+                autoFocus
+                value={password}
+                onChange={(e) => setPassword(e.target.value)}
+                helperText="At least 6 characters"
+                sx={fieldSx}
+              />
+              <TextField
+                margin="normal"
+                required
+                fullWidth
+                label="Confirm Password"
+                type="password"
+                autoComplete="new-password"
+                value={confirmPassword}
+                onChange={(e) => setConfirmPassword(e.target.value)}
+                sx={{ ...fieldSx, mb: 4 }}
+              />
+              <Button type="submit" fullWidth variant="contained" size="large" disabled={loading}
+                sx={{ py: 1.5, fontWeight: 700, borderRadius: 3, mb: 3 }}>
+                {loading ? <CircularProgress size={24} sx={{ color: 'white' }} /> : 'Change Password'}
+              </Button>
+            </Box>
+          ) : !sent && (
+            <Box component="form" onSubmit={handleRequest}>
+              <TextField
+                margin="normal"
+                required
+                fullWidth
+                label="Email Address"
+                type="email"
+                autoComplete="email"
+                autoFocus
+                value={email}
+                onChange={(e) => setEmail(e.target.value)}
+                sx={{ ...fieldSx, mb: 4 }}
+              />
+              <Button type="submit" fullWidth variant="contained" size="large" disabled={loading}
+                sx={{ py: 1.5, fontWeight: 700, borderRadius: 3, mb: 3 }}>
+                {loading ? <CircularProgress size={24} sx={{ color: 'white' }} /> : 'Send Reset Link'}
+              </Button>
+            </Box>
+          )}
+
+          <Box textAlign="center">
+            <Link component={RouterLink} to="/login" sx={{ color: '#667eea', fontWeight: 600 }}>
+              Back to sign in
+            </Link>
+          </Box>
+        </Paper>
+      </Container>
+    </Box>
+  );
+};
+
+export default ResetPasswordPage;
@@ -0,0 +1,95 @@
+import React, { useEffect, useRef, useState } from 'react';
+import {
+  Container,
+  Paper,
+  Button,
+  Typography,
+  Box,
+  CircularProgress,
+} from '@mui/material';
+import { Link as RouterLink } from 'react-router-dom';
+import { LockOpen, ErrorOutline } from '@mui/icons-material';
+import { authAPI } from '../services/api';
+
+// UnlockAccountPage is where the link in the email about a locked account
+// leads. Like the other email links, it carries its token in the fragment.
+const UnlockAccountPage: React.FC = () => {
+  const [status, setStatus] = useState<'unlocking' | 'unlocked' | 'failed'>('unlocking');
+  const [error, setError] = useState('');
+  const started = useRef(false);
+
+  useEffect(() => {
+    if (started.current) {
+      return;
+    }
+    started.current = true;
+
+    const token = new URLSearchParams(window.location.hash.slice(1)).get('token');
+    if (!token) {
+      setError('The link is incomplete, copy the whole link from the email.');
+      setStatus('failed');
+      return;
+    }
+    authAPI.unlockAccount(token)
+      .then(() => setStatus('unlocked'))
+      .catch((err: any) => {
+        setError(err.response?.data?.error || 'Failed to unlock your account');
+        setStatus('failed');
+      });
+  }, []);
+
+  return (
+    <Box sx={{
+      minHeight: '100vh',
+      background: 'linear-gradient(180deg, #f8fafc 0%, #ffffff 100%)',
+      display: 'flex',
+      alignItems: 'center',
+      py: 4,
+    }}>
+      <Container component="main" maxWidth="sm">
+        <Paper
+          elevation={0}
+          sx={{
+            p: 6,
+            borderRadius: 4,
+            textAlign: 'center',
+            border: '1px solid rgba(0, 0, 0, 0.05)',
+            boxShadow: '0 20px 60px rgba(0,0,0,0.1)',
+          }}
+        >
+          {status === 'unlocking' && <CircularProgress />}
+          {status === 'unlocked' && (
+            <>
+              <LockOpen sx={{ fontSize: 56, color: '#10b981', mb: 2 }} />
+              <Typography variant="h4" sx={{ fontWeight: 800, color: '#1e293b', mb: 1 }}>
+                Account unlocked
+              </Typography>
+              <Typography color="text.secondary" sx={{ mb: 4 }}>
+                You can sign in again. If you have forgotten your password, reset it instead of guessing.
+              </Typography>
+            </>
+          )}
+          {status === 'failed' && (
+            <>
+              <ErrorOutline sx={{ fontSize: 56, color: '#ef4444', mb: 2 }} />
+              <Typography variant="h4" sx={{ fontWeight: 800, color: '#1e293b', mb: 1 }}>
+                Unlocking failed
+              </Typography>
+              <Typography color="text.secondary" sx={{ mb: 4 }}>
+                {error} The lock also runs out on its own after a while.
+              </Typography>
+            </>
+          )}
+          {status !== 'unlocking' && (
+            <Button component={RouterLink} to="/login" variant="contained"
+              sx={{ fontWeight: 700, borderRadius: 3 }}>
+              Sign in
+            </Button>
+          )}
+        </Paper>
+      </Container>
+    </Box>
+  );
+};
+
+export default UnlockAccountPage;
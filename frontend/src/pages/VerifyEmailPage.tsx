@@ -0,0 +1,102 @@
+import React, { useEffect, useRef, useState } from 'react';
+import {
+  Container,
+  Paper,
+  Button,
+  Typography,
+  Box,
+  CircularProgress,
+} from '@mui/material';
+import { Link as RouterLink } from 'react-router-dom';
+import { MarkEmailRead, ErrorOutline } from '@mui/icons-material';
+import { useAuth } from '../contexts/AuthContext';
+import { authAPI } from '../services/api';
+
+// VerifyEmailPage is where the link in a verification email leads. The
+// token is in the fragment, and is sent to the server once.
+const VerifyEmailPage: React.FC = () => {
+  const [status, setStatus] = useState<'verifying' | 'verified' | 'failed'>('verifying');
+  const [error, setError] = useState('');
+  const { user, updateUser, isAuthenticated } = useAuth();
+  const started = useRef(false);
+
+  useEffect(() => {
+    if (started.current) {
+      return;
+    }
+    started.current = true;
+
+    const token = new URLSearchParams(window.location.hash.slice(1)).get('token');
+    if (!token) {
+      setError('The link is incomplete, copy the whole link from the email.');
+      setStatus('failed');
+      return;
+    }
+    authAPI.verifyEmail(token)
+      .then((response) => {
+        if (response.data && user && response.data.id === user.id) {
+          updateUser(response.data);
+        }
+        setStatus('verified');
+      })
+      .catch((err: any) => {
+        setError(err.response?.data?.error || 'Failed to verify your email address');
+        setStatus('failed');
+      });
+  }, [user, updateUser]);
+
+  return (
+    <Box sx={{
+      minHeight: '100vh',
+      background: 'linear-gradient(180deg, #f8fafc 0%, #ffffff 100%)',
+      display: 'flex',
+      alignItems: 'center',
+      py: 4,
+    }}>
+      <Container component="main" maxWidth="sm">
+        <Paper
+          elevation={0}
+          sx={{
+            p: 6,
+            borderRadius: 4,
+            textAlign: 'center',
+            border: '1px solid rgba(0, 0, 0, 0.05)',
+            boxShadow: '0 20px 60px rgba(0,0,0,0.1)',
+          }}
+        >
+          {status === 'verifying' && <CircularProgress />}
+          {status === 'verified' && (
+            <>
+              <MarkEmailRead sx={{ fontSize: 56, color: '#10b981', mb: 2 }} />
+              <Typography variant="h4" sx={{ fontWeight: 800, color: '#1e293b', mb: 1 }}>
+                Email address verified
+              </Typography>
+              <Typography color="text.secondary" sx={{ mb: 4 }}>
+                Thanks for confirming your address.
+              </Typography>
+            </>
+          )}
+          {status === 'failed' && (
+            <>
+              <ErrorOutline sx={{ fontSize: 56, color: '#ef4444', mb: 2 }} />
+              <Typography variant="h4" sx={{ fontWeight: 800, color: '#1e293b', mb: 1 }}>
+                Verification failed
+              </Typography>
+              <Typography color="text.secondary" sx={{ mb: 4 }}>
+                {error} You can ask for a new link on your dashboard.
+              </Typography>
+            </>
+          )}
+          {status !== 'verifying' && (
+            <Button component={RouterLink} to={isAuthenticated ? '/dashboard' : '/login'} variant="contained"
+              sx={{ fontWeight: 700, borderRadius: 3 }}>
+              {isAuthenticated ? 'Go to dashboard' : 'Sign in'}
+            </Button>
+          )}
+        </Paper>
+      </Container>
+    </Box>
+  );
+};
+
+export default VerifyEmailPage;
@@ -15,13 +15,53 @@ api.interceptors.request.use((config) => {
   return config;
 });
 
+const clearSession = () => {
+  localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
+  localStorage.removeItem('user');
+};
+
+// Access tokens are short-lived. Concurrent requests that fail with 401 share
+// a single refresh, because each refresh token only works once.
+let refreshing: Promise<string> | null = null;
+
+const refreshAccessToken = () => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refreshToken');
+    refreshing = (refreshToken
+      ? axios.post<ApiResponse<TokenPair>>(`${API_BASE_URL}/token/refresh`, { refresh_token: refreshToken })
+          .then((response) => {
+            const { token, refresh_token } = response.data.data!;
+            localStorage.setItem('token', token);
+            localStorage.setItem('refreshToken', refresh_token);
+            return token;
+          })
+      : Promise.reject(new Error('Not logged in'))
+    ).finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};
+
 // Handle auth errors
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response?.status === 401) {
-      localStorage.removeItem('token');
-      localStorage.removeItem('user');
+  async (error) => {
+    const request = error.config;
+    if (error.response?.status === 401 && request && !request._retried && localStorage.getItem('refreshToken')) {
+      request._retried = true;
+      try {
+        const token = await refreshAccessToken();
+        request.headers.Authorization = `Bearer ${token}`;
+        return api(request);
+      } catch {
+        // Fall through to logging out below.
+      }
+    }
+    // A 401 from the login endpoints is just a wrong password or code.
+    if (error.response?.status === 401 && !/^\/(login|register)/.test(request?.url || '')) {
+      clearSession();
       window.location.href = '/login';
     }
     return Promise.reject(error);
@@ -32,6 +72,11 @@ export interface User {
   id: number;
   username: string;
   email: string;
+  role: 'admin' | 'user' | 'read-only';
+  suspended: boolean;
+  email_verified: boolean;
+  failed_logins: number;
+  locked_until?: string;
   created_at: string;
 }
 
@@ -56,23 +101,140 @@ export interface ApiResponse<T = any> {
   error?: string;
 }
 
+export interface TokenPair {
+  token: string;
+  refresh_token: string;
+  expires_in: number;
+}
+
+// LoginData is either a logged in session or, with mfa_required, a challenge
+// to finish at /login/mfa.
+export interface LoginData extends Partial<TokenPair> {
+  user?: User;
+  mfa_required?: boolean;
+  mfa_token?: string;
+  enrollment_required?: boolean;
+  recovery_codes?: string[];
+}
+
+export interface TOTPEnrollment {
+  secret: string;
+  uri: string;
+}
+
+// AuthMethods are the ways to log in this server offers.
+export interface AuthMethods {
+  local: boolean;
+  // ldap logins use the same form as local ones, but cannot register.
+  ldap: boolean;
+  oidc?: { name: string };
+  // registration is who may register: open, closed, invite or domain.
+  registration: 'open' | 'closed' | 'invite' | 'domain';
+  // email_verification and password_reset are on when the server can send
+  // email.
+  email_verification: boolean;
+  password_reset: boolean;
+}
+
+export interface Session {
+  id: string;
+  user_agent: string;
+  ip_address: string;
+  expires_at: string;
+  last_used_at: string;
+  created_at: string;
+  current: boolean;
+}
+
 export const authAPI = {
-  register: async (username: string, email: string, password: string) => {
-    const response = await api.post<ApiResponse<{ user: User; token: string }>>('/register', {
+  getMethods: async () => {
+    const response = await api.get<ApiResponse<AuthMethods>>('/auth/methods');
+    return response.data;
+  },
+
+  // Single sign-on is a page to navigate to, not a request: the identity
+  // provider takes over and sends the browser back to /login.
+  oidcLoginUrl: `${API_BASE_URL}/auth/oidc/login`,
+
+  register: async (username: string, email: string, password: string, inviteCode?: string) => {
+    const response = await api.post<ApiResponse<LoginData>>('/register', {
       username,
       email,
       password,
+      invite_code: inviteCode || undefined,
     });
     return response.data;
   },
 
   login: async (username: string, password: string) => {
-    const response = await api.post<ApiResponse<{ user: User; token: string }>>('/login', {
+    const response = await api.post<ApiResponse<LoginData>>('/login', {
       username,
       password,
     });
     return response.data;
   },
+
+  completeMfa: async (mfaToken: string, code: string) => {
+    const response = await api.post<ApiResponse<LoginData>>('/login/mfa', {
+      mfa_token: mfaToken,
+      code,
+    });
+    return response.data;
+  },
+
+  enrollMfa: async (mfaToken: string) => {
+    const response = await api.post<ApiResponse<TOTPEnrollment>>('/login/mfa/enroll', {
+      mfa_token: mfaToken,
+    });
+    return response.data;
+  },
+
+  logout: async () => {
+    const response = await api.post<ApiResponse>('/logout');
+    return response.data;
+  },
+
+  logoutAll: async () => {
+    const response = await api.post<ApiResponse<{ sessions: number }>>('/logout/all');
+    return response.data;
+  },
+
+  // The links in verification, reset and unlock emails carry a token for
+  // these.
+  verifyEmail: async (token: string) => {
+    const response = await api.post<ApiResponse<User>>('/verify-email', { token });
+    return response.data;
+  },
+
+  resendVerification: async () => {
+    const response = await api.post<ApiResponse>('/me/email/verify');
+    return response.data;
+  },
+
+  requestPasswordReset: async (email: string) => {
+    const response = await api.post<ApiResponse>('/password-reset', { email });
+    return response.data;
+  },
+
+  resetPassword: async (token: string, password: string) => {
+    const response = await api.post<ApiResponse>('/password-reset/confirm', { token, password });
+    return response.data;
+  },
+
+  unlockAccount: async (token: string) => {
+    const response = await api.post<ApiResponse>('/unlock-account', { token });
+    return response.data;
+  },
+
+  getSessions: async () => {
+    const response = await api.get<ApiResponse<Session[]>>('/me/sessions');
+    return response.data;
+  },
+
+  revokeSession: async (sessionId: string) => {
+    const response = await api.delete<ApiResponse>(`/me/sessions/${sessionId}`);
+    return response.data;
+  },
 };
 
 export const filesAPI = {
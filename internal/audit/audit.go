@@ -0,0 +1,98 @@
+// Package audit records security events, such as failed logins and account
+// lockouts, so that administrators can see who tried what and when.
+package audit
+
+import (
+	"log"
+	"time"
+)
+
+// The kinds of event in the log.
+const (
+	LoginFailed = "login_failed"
+	// LoginBlocked is a login to an account that is locked.
+	LoginBlocked        = "login_blocked"
+	AccountLocked       = "account_locked"
+	AccountUnlocked     = "account_unlocked"
+	RegisterFailed      = "register_failed"
+	SharePasswordFailed = "share_password_failed"
+	// IPBlocked is an IP address being made to wait after failing too
+	// often. What it tries while it waits is not recorded.
+	IPBlocked = "ip_blocked"
+
+	// What administrators do to other people's accounts and files. The
+	// administrator is the event's actor.
+	RoleChanged     = "role_changed"
+	UserSuspended   = "user_suspended"
+	UserUnsuspended = "user_unsuspended"
+	UserDeleted     = "user_deleted"
+	FileDeleted     = "file_deleted"
+	FileExpired     = "file_expired"
+)
+
+type Event struct {
+	ID   int64  `json:"id"`
+	Type string `json:"event"`
+	// UserID is 0 if the event is not about an account, or about one that
+	// does not exist, in which case Username is what was tried.
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	// ActorID and ActorUsername are who did it, if that is not the user
+	// the event is about, such as the administrator who suspended them.
+	ActorID       int    `json:"actor_id,omitempty"`
+	ActorUsername string `json:"actor_username,omitempty"`
+	IPAddress     string `json:"ip_address,omitempty"`
+	// Detail says more about the event in words, such as how long an
+	// account was locked for.
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Filter selects events for List. Zero fields match everything.
+type Filter struct {
+	Type      string
+	UserID    int
+	ActorID   int
+	IPAddress string
+}
+
+// Log records events in a Repository. A nil Log records nothing, so that
+// code which records events works without one.
+type Log struct {
+	repo Repository
+}
+
+func New(repo Repository) *Log {
+	return &Log{repo: repo}
+}
+
+// Record adds event to the log. Failing to is only logged, so that a
+// problem with the audit log does not lock everyone out.
+func (l *Log) Record(event Event) {
+	if l == nil {
+		return
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if err := l.repo.Record(&event); err != nil {
+		log.Printf("Failed to record %s event: %v", event.Type, err)
+	}
+}
+
+// List returns a page of the events that match filter, newest first.
+func (l *Log) List(filter Filter, limit, offset int) ([]*Event, error) {
+	if l == nil {
+		return []*Event{}, nil
+	}
+	return l.repo.List(filter, limit, offset)
+}
+
+// Cleanup deletes the events older than retention.
+func (l *Log) Cleanup(retention time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	_, err := l.repo.DeleteBefore(time.Now().Add(-retention))
+	return err
+}
@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+// Repository stores audit events. SQLRepository is the real one;
+// MemoryRepository keeps events in memory.
+type Repository interface {
+	// Record stores event and sets its ID.
+	Record(event *Event) error
+	// List returns a page of the events that match filter, newest first.
+	List(filter Filter, limit, offset int) ([]*Event, error)
+	DeleteBefore(t time.Time) (int, error)
+}
+
+// SQLRepository is the Repository backed by the application database.
+type SQLRepository struct {
+	db *database.DB
+}
+
+var _ Repository = (*SQLRepository)(nil)
+
+func NewSQLRepository(db *database.DB) *SQLRepository {
+	return &SQLRepository{db: db}
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (r *SQLRepository) Record(event *Event) error {
+	var userID sql.NullInt64
+	if event.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(event.UserID), Valid: true}
+	}
+	var actorID sql.NullInt64
+	if event.ActorID != 0 {
+		actorID = sql.NullInt64{Int64: int64(event.ActorID), Valid: true}
+	}
+	query := `INSERT INTO audit_log (event, user_id, username, actor_id, actor_username, ip_address, detail, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`
+	err := r.db.QueryRow(query, event.Type, userID, event.Username, actorID, event.ActorUsername, event.IPAddress,
+		event.Detail, formatTimestamp(event.CreatedAt)).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) List(filter Filter, limit, offset int) ([]*Event, error) {
+	var where []string
+	var args []interface{}
+	if filter.Type != "" {
+		where = append(where, "event = ?")
+		args = append(args, filter.Type)
+	}
+	if filter.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.ActorID != 0 {
+		where = append(where, "actor_id = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.IPAddress != "" {
+		where = append(where, "ip_address = ?")
+		args = append(args, filter.IPAddress)
+	}
+
+	query := `SELECT id, event, COALESCE(user_id, 0), username, COALESCE(actor_id, 0), actor_username, ip_address, detail, created_at FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	rows, err := r.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		event := &Event{}
+		err := rows.Scan(&event.ID, &event.Type, &event.UserID, &event.Username, &event.ActorID,
+			&event.ActorUsername, &event.IPAddress, &event.Detail, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r *SQLRepository) DeleteBefore(t time.Time) (int, error) {
+	result, err := r.db.Exec(`DELETE FROM audit_log WHERE created_at < ?`, formatTimestamp(t))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete audit events: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return int(n), nil
+}
+
+// MemoryRepository is a Repository that keeps events in memory, for tests
+// and throwaway instances. It is safe for concurrent use.
+type MemoryRepository struct {
+	mu     sync.Mutex
+	nextID int64
+	events []*Event
+}
+
+var _ Repository = (*MemoryRepository)(nil)
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{nextID: 1}
+}
+
+func (r *MemoryRepository) Record(event *Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.ID = r.nextID
+	r.nextID++
+	stored := *event
+	r.events = append(r.events, &stored)
+	return nil
+}
+
+func (r *MemoryRepository) List(filter Filter, limit, offset int) ([]*Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := []*Event{}
+	for _, e := range r.events {
+		if (filter.Type == "" || e.Type == filter.Type) &&
+			(filter.UserID == 0 || e.UserID == filter.UserID) &&
+			(filter.ActorID == 0 || e.ActorID == filter.ActorID) &&
+			(filter.IPAddress == "" || e.IPAddress == filter.IPAddress) {
+			event := *e
+			events = append(events, &event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID > events[j].ID })
+	if offset >= len(events) {
+		return []*Event{}, nil
+	}
+	events = events[offset:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (r *MemoryRepository) DeleteBefore(t time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.events[:0]
+	for _, e := range r.events {
+		if !e.CreatedAt.Before(t) {
+			kept = append(kept, e)
+		}
+	}
+	n := len(r.events) - len(kept)
+	r.events = kept
+	return n, nil
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"anonlink/internal/database"
+	"anonlink/internal/database/dbtest"
+)
+
+// eachRepository runs test against a MemoryRepository and against a
+// SQLRepository on every database dialect available.
+func eachRepository(t *testing.T, test func(t *testing.T, repo Repository)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryRepository())
+	})
+	dbtest.Each(t, func(t *testing.T, db *database.DB) {
+		test(t, NewSQLRepository(db))
+	})
+}
+
+func TestRepository(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		now := time.Now().In(time.FixedZone("UTC+2", 2*60*60))
+		events := []Event{
+			{Type: LoginFailed, Username: "ghost", IPAddress: "10.0.0.1", CreatedAt: now.Add(-48 * time.Hour)},
+			{Type: LoginFailed, UserID: 7, Username: "alice", IPAddress: "10.0.0.1", Detail: "1 in a row", CreatedAt: now},
+			{Type: AccountLocked, UserID: 7, Username: "alice", IPAddress: "10.0.0.2", CreatedAt: now},
+			{Type: IPBlocked, IPAddress: "10.0.0.1", CreatedAt: now},
+			{Type: UserSuspended, UserID: 7, Username: "alice", ActorID: 1, ActorUsername: "root", IPAddress: "10.0.0.3", CreatedAt: now},
+		}
+		for i := range events {
+			if err := repo.Record(&events[i]); err != nil {
+				t.Fatalf("Record: %v", err)
+			}
+			if events[i].ID == 0 {
+				t.Fatal("Record did not set the ID")
+			}
+		}
+
+		all, err := repo.List(Filter{}, 10, 0)
+		if err != nil || len(all) != 5 {
+			t.Fatalf("List = %d events, %v", len(all), err)
+		}
+		if all[0].ID != events[4].ID || all[4].ID != events[0].ID {
+			t.Errorf("List is not newest first: %d ... %d", all[0].ID, all[4].ID)
+		}
+		if e := all[0]; e.UserID != 7 || e.ActorID != 1 || e.ActorUsername != "root" {
+			t.Errorf("List returned %+v, want the actor", e)
+		}
+		if e := all[3]; e.Type != LoginFailed || e.UserID != 7 || e.Username != "alice" || e.Detail != "1 in a row" ||
+			e.CreatedAt.Sub(now).Abs() > time.Second {
+			t.Errorf("List returned %+v", e)
+		}
+
+		for _, tt := range []struct {
+			filter Filter
+			want   int
+		}{
+			{Filter{Type: LoginFailed}, 2},
+			{Filter{UserID: 7}, 3},
+			{Filter{ActorID: 1}, 1},
+			{Filter{ActorID: 7}, 0},
+			{Filter{IPAddress: "10.0.0.1"}, 3},
+			{Filter{Type: LoginFailed, IPAddress: "10.0.0.1", UserID: 7}, 1},
+			{Filter{Type: "nothing"}, 0},
+		} {
+			if got, err := repo.List(tt.filter, 10, 0); err != nil || len(got) != tt.want {
+				t.Errorf("List(%+v) = %d events, %v; want %d", tt.filter, len(got), err, tt.want)
+			}
+		}
+
+		page, err := repo.List(Filter{}, 2, 1)
+		if err != nil || len(page) != 2 || page[0].ID != events[3].ID {
+			t.Errorf("List(limit 2, offset 1) = %v, %v", page, err)
+		}
+		if page, err := repo.List(Filter{}, 2, 10); err != nil || len(page) != 0 {
+			t.Errorf("List past the end = %v, %v", page, err)
+		}
+
+		if n, err := repo.DeleteBefore(now.Add(-time.Hour)); err != nil || n != 1 {
+			t.Errorf("DeleteBefore = %d, %v; want 1", n, err)
+		}
+		if all, _ := repo.List(Filter{}, 10, 0); len(all) != 4 {
+			t.Errorf("%d events left, want 4", len(all))
+		}
+	})
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Record(Event{Type: LoginFailed})
+	if events, err := l.List(Filter{}, 10, 0); err != nil || len(events) != 0 {
+		t.Errorf("List = %v, %v", events, err)
+	}
+	if err := l.Cleanup(time.Hour); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Roles say what a user may do. The first account on an instance is an
+// admin; everyone after that is a user until an admin says otherwise.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+	// RoleReadOnly may look at and download their files, but not upload,
+	// change or share anything.
+	RoleReadOnly = "read-only"
+)
+
+var Roles = []string{RoleAdmin, RoleUser, RoleReadOnly}
+
+var (
+	ErrInvalidRole      = fmt.Errorf("unknown role (available: %s)", strings.Join(Roles, ", "))
+	ErrAccountSuspended = errors.New("account is suspended")
+)
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) ListUsers() ([]*User, error) {
+	return s.users.ListUsers()
+}
+
+// SetRole changes the user's role. Their sessions end, since their access
+// tokens carry the old one.
+func (s *Service) SetRole(userID int, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	if err := s.users.SetRole(userID, role); err != nil {
+		return err
+	}
+	_, err := s.sessions.DeleteUserSessions(userID)
+	return err
+}
+
+// SetSuspended suspends the user or lifts their suspension. Suspended users
+// are logged out everywhere and cannot log in or use their API tokens.
+func (s *Service) SetSuspended(userID int, suspended bool) error {
+	if err := s.users.SetSuspended(userID, suspended); err != nil {
+		return err
+	}
+	if !suspended {
+		return nil
+	}
+	_, err := s.sessions.DeleteUserSessions(userID)
+	return err
+}
+
+// DeleteUser deletes the account with its sessions and API tokens. Their
+// files have to be deleted first, with the files Service.
+func (s *Service) DeleteUser(userID int) error {
+	if _, err := s.users.GetUserByID(userID); err != nil {
+		return err
+	}
+	if _, err := s.sessions.DeleteUserSessions(userID); err != nil {
+		return err
+	}
+	tokens, err := s.tokens.ListAPITokens(userID)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := s.tokens.DeleteAPIToken(userID, token.ID); err != nil && !errors.Is(err, ErrAPITokenNotFound) {
+			return err
+		}
+	}
+	return s.users.DeleteUser(userID)
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes limit what a personal access token can be used for. Logins are not
+// limited by scope, but routes that manage the account itself only accept
+// logins.
+const (
+	ScopeFilesRead   = "files:read"
+	ScopeFilesWrite  = "files:write"
+	ScopeLinksManage = "links:manage"
+)
+
+var Scopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeLinksManage}
+
+// APITokenPrefix starts every personal access token, which keeps them apart
+// from JWTs and makes leaked ones easy to search for.
+const APITokenPrefix = "anl_"
+
+// lastUsedResolution is how stale LastUsedAt may get before a request
+// updates it, so that busy tokens do not cost a write on every request.
+const lastUsedResolution = time.Minute
+
+var (
+	ErrAPITokenNotFound = errors.New("API token not found")
+	ErrInvalidAPIToken  = errors.New("invalid API token")
+)
+
+// APIToken is a named, long-lived credential for scripts, limited to Scopes.
+// Only a hash of the token is stored; Prefix is kept so people can tell
+// their tokens apart.
+type APIToken struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIToken issues a personal access token for the user. The token
+// itself is only returned here.
+func (s *Service) CreateAPIToken(userID int, name string, scopes []string, expiresAt *time.Time) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, "", errors.New("name must be between 1 and 100 characters")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required (available: %s)", strings.Join(Scopes, ", "))
+	}
+	seen := make(map[string]bool)
+	var deduped []string
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q (available: %s)", scope, strings.Join(Scopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			deduped = append(deduped, scope)
+		}
+	}
+	if expiresAt != nil {
+		if !expiresAt.After(time.Now()) {
+			return nil, "", errors.New("expiry must be in the future")
+		}
+		t := expiresAt.UTC().Truncate(time.Second)
+		expiresAt = &t
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	secret := APITokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	token := &APIToken{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    secret[:len(APITokenPrefix)+6],
+		Scopes:    deduped,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.tokens.CreateAPIToken(token, hashToken(secret)); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+func (s *Service) ListAPITokens(userID int) ([]*APIToken, error) {
+	return s.tokens.ListAPITokens(userID)
+}
+
+func (s *Service) DeleteAPIToken(userID int, tokenID string) error {
+	return s.tokens.DeleteAPIToken(userID, tokenID)
+}
+
+// ValidateAPIToken returns the user a personal access token belongs to,
+// together with the token, and records that it was used.
+func (s *Service) ValidateAPIToken(secret string) (*User, *APIToken, error) {
+	if !strings.HasPrefix(secret, APITokenPrefix) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	token, err := s.tokens.GetAPITokenByHash(hashToken(secret))
+	if errors.Is(err, ErrAPITokenNotFound) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+
+	user, err := s.users.GetUserByID(token.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Suspended {
+		return nil, nil, ErrAccountSuspended
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedResolution {
+		if err := s.tokens.TouchAPIToken(token.ID, now); err != nil {
+			return nil, nil, err
+		}
+		token.LastUsedAt = &now
+	}
+	return user, token, nil
+}
@@ -1,88 +1,219 @@
 package auth
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"time"
 
+	"anonlink/internal/audit"
+
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Service struct {
-	db        *sql.DB
+	users     UserRepository
+	sessions  SessionRepository
+	tokens    APITokenRepository
 	jwtSecret []byte
+
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	requireTOTP     bool
+	autoProvision   bool
+	linkExisting    bool
+	authenticators  []Authenticator
+	registration    RegistrationPolicy
+
+	mailer           Mailer
+	linkBaseURL      string
+	verificationTTL  time.Duration
+	passwordResetTTL time.Duration
+
+	lockout LockoutPolicy
+	audit   *audit.Log
+}
+
+// Options are the settings of a Service.
+type Options struct {
+	// AccessTokenTTL is how long an access token is accepted. Logging out
+	// ends a session immediately, but keeping this short limits how long a
+	// leaked token is useful.
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a session survives without being
+	// refreshed.
+	RefreshTokenTTL time.Duration
+	// RequireTOTP makes everyone set up two-factor authentication the next
+	// time they log in.
+	RequireTOTP bool
+	// AutoProvision creates an account for anyone who logs in with single
+	// sign-on without having one.
+	AutoProvision bool
+	// LinkExistingAccounts lets a single sign-on login be linked by its
+	// verified email address to any account, including those with a
+	// password of their own and administrators'. Otherwise only accounts
+	// that have neither are.
+	LinkExistingAccounts bool
+	// Authenticators check the username and password given to Login, in
+	// order. The default is to check passwords stored here.
+	Authenticators []Authenticator
+	// Registration says who may create an account with Register. The
+	// default is anyone.
+	Registration RegistrationPolicy
+	// Mailer sends verification and password reset emails. Without one,
+	// neither is available.
+	Mailer Mailer
+	// LinkBaseURL is where the web app is served, for the links in emails.
+	LinkBaseURL string
+	// EmailVerificationTTL and PasswordResetTTL are how long the links in
+	// those emails work.
+	EmailVerificationTTL time.Duration
+	PasswordResetTTL     time.Duration
+	// Lockout says when wrong passwords lock an account. The default is
+	// never.
+	Lockout LockoutPolicy
+	// Audit is where failed logins and lockouts are recorded, if anywhere.
+	Audit *audit.Log
 }
 
 type User struct {
 	ID        int    `json:"id"`
 	Username  string `json:"username"`
 	Email     string `json:"email"`
-	CreatedAt string `json:"created_at"`
+	Role      string `json:"role"`
+	Suspended bool   `json:"suspended"`
+	// EmailVerified is set once the user has opened the link mailed to
+	// them, or their identity provider vouched for the address.
+	EmailVerified bool `json:"email_verified"`
+	// FailedLogins counts the wrong passwords entered since the last
+	// successful login, and LockedUntil is when the lock they led to ends.
+	FailedLogins int        `json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	CreatedAt    string     `json:"created_at"`
 }
 
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-func NewService(db *sql.DB, jwtSecret string) *Service {
+func NewService(users UserRepository, sessions SessionRepository, tokens APITokenRepository, jwtSecret string, opts Options) *Service {
+	authenticators := opts.Authenticators
+	if authenticators == nil {
+		authenticators = []Authenticator{NewPasswordAuthenticator(users)}
+	}
+
 	return &Service{
-		db:        db,
+		users:     users,
+		sessions:  sessions,
+		tokens:    tokens,
 		jwtSecret: []byte(jwtSecret),
+
+		accessTokenTTL:  opts.AccessTokenTTL,
+		refreshTokenTTL: opts.RefreshTokenTTL,
+		requireTOTP:     opts.RequireTOTP,
+		autoProvision:   opts.AutoProvision,
+		linkExisting:    opts.LinkExistingAccounts,
+		authenticators:  authenticators,
+		registration:    opts.Registration,
+
+		mailer:           opts.Mailer,
+		linkBaseURL:      opts.LinkBaseURL,
+		verificationTTL:  opts.EmailVerificationTTL,
+		passwordResetTTL: opts.PasswordResetTTL,
+
+		lockout: opts.Lockout,
+		audit:   opts.Audit,
 	}
 }
 
-func (s *Service) Register(username, email, password string) (*User, error) {
-	
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// Register creates an account if the registration policy allows it. The
+// invite code is needed in invite mode, and lets people outside the allowed
+// domains in in domain mode; using it counts against the invite.
+func (s *Service) Register(username, email, password, inviteCode string) (*User, error) {
+	useInvite, err := s.registration.check(email, inviteCode)
 	if err != nil {
-		return nil, fmt.Errorf("failed to hash password: %w", err)
+		return nil, err
 	}
 
-	
-	query := `INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)`
-	result, err := s.db.Exec(query, username, email, hashedPassword)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user ID: %w", err)
+	if useInvite {
+		return s.users.CreateInvitedUser(username, email, string(hashedPassword), hashToken(inviteCode), time.Now().UTC())
 	}
-
-	return s.GetUserByID(int(userID))
+	return s.users.CreateUser(username, email, string(hashedPassword))
 }
 
-func (s *Service) Login(username, password string) (*User, string, error) {
-	user, hashedPassword, err := s.getUserWithPassword(username)
-	if err != nil {
-		return nil, "", fmt.Errorf("invalid credentials")
+// Login asks each authenticator in turn whether the password is right. It
+// fails with ErrInvalidCredentials if none accepts it, or with the first
+// other error, such as a directory being down. Wrong passwords count
+// against the account with that username, also when another authenticator
+// failed, and a locked account fails with an AccountLockedError without its
+// password being checked.
+func (s *Service) Login(username, password string, client ClientInfo) (*LoginResult, error) {
+	account, _, err := s.users.GetUserByUsername(username)
+	if errors.Is(err, ErrUserNotFound) {
+		account = nil
+	} else if err != nil {
+		return nil, err
 	}
-
-	
-	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
-		return nil, "", fmt.Errorf("invalid credentials")
+	if account != nil && account.lockedAt(time.Now()) {
+		s.audit.Record(audit.Event{
+			Type:      audit.LoginBlocked,
+			UserID:    account.ID,
+			Username:  account.Username,
+			IPAddress: client.IPAddress,
+			Detail:    "account is locked",
+		})
+		return nil, &AccountLockedError{UserID: account.ID, Until: *account.LockedUntil}
 	}
 
-	
-	token, err := s.GenerateToken(user)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to generate token: %w", err)
+	var failure error
+	rejected := false
+	for _, authenticator := range s.authenticators {
+		user, err := authenticator.Authenticate(username, password)
+		if err == nil {
+			if user.FailedLogins > 0 {
+				if err := s.users.ResetFailedLogins(user.ID); err != nil {
+					return nil, err
+				}
+			}
+			return s.LoginAs(user, client)
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			rejected = true
+		} else if failure == nil {
+			failure = err
+		}
 	}
 
-	return user, token, nil
+	// A password that was turned down counts even if another authenticator
+	// could not be asked, or taking a directory down would make guessing
+	// free. Only the lock it may lead to is worth reporting over the error.
+	if rejected || failure == nil {
+		err := s.loginFailed(account, username, client)
+		if !errors.Is(err, ErrInvalidCredentials) || failure == nil {
+			return nil, err
+		}
+	}
+	return nil, failure
 }
 
-func (s *Service) GenerateToken(user *User) (string, error) {
+// GenerateToken issues an access token for one of the user's sessions.
+func (s *Service) GenerateToken(user *User, sessionID string) (string, error) {
 	claims := Claims{
-		UserID:   user.ID,
-		Username: user.Username,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.accessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -94,13 +225,16 @@ func (s *Service) GenerateToken(user *User) (string, error) {
 func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return s.jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		if err := s.activeSession(claims); err != nil {
+			return nil, err
+		}
 		return claims, nil
 	}
 
@@ -108,22 +242,10 @@ func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
 }
 
 func (s *Service) GetUserByID(id int) (*User, error) {
-	user := &User{}
-	query := `SELECT id, username, email, created_at FROM users WHERE id = ?`
-	err := s.db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
-	if err != nil {
-		return nil, fmt.Errorf("user not found: %w", err)
-	}
-	return user, nil
+	return s.users.GetUserByID(id)
 }
 
-func (s *Service) getUserWithPassword(username string) (*User, string, error) {
-	user := &User{}
-	var hashedPassword string
-	query := `SELECT id, username, email, created_at, password_hash FROM users WHERE username = ?`
-	err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &hashedPassword)
-	if err != nil {
-		return nil, "", fmt.Errorf("user not found: %w", err)
-	}
-	return user, hashedPassword, nil
+func (s *Service) GetUserByUsername(username string) (*User, error) {
+	user, _, err := s.users.GetUserByUsername(username)
+	return user, err
 }
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"anonlink/internal/audit"
+)
+
+var testClient = ClientInfo{UserAgent: "test", IPAddress: "192.0.2.1"}
+
+// newTestService is a Service on memory repositories, returned along with
+// them and its audit log.
+func newTestService(t *testing.T, opts Options) (*Service, repositories, *audit.MemoryRepository) {
+	t.Helper()
+	repos := memoryRepositories()
+	events := audit.NewMemoryRepository()
+	if opts.AccessTokenTTL == 0 {
+		opts.AccessTokenTTL = 15 * time.Minute
+	}
+	if opts.RefreshTokenTTL == 0 {
+		opts.RefreshTokenTTL = 24 * time.Hour
+	}
+	opts.Audit = audit.New(events)
+	return NewService(repos.users, repos.sessions, repos.tokens, "test-secret", opts), repos, events
+}
+
+func countEvents(t *testing.T, events *audit.MemoryRepository, eventType string) int {
+	t.Helper()
+	list, err := events.List(audit.Filter{Type: eventType}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(list)
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if _, err := s.Register("alice", "other@example.com", "whatever", ""); !errors.Is(err, ErrUserExists) {
+		t.Errorf("second Register: err = %v, want ErrUserExists", err)
+	}
+
+	result, err := s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if result.User.ID != user.ID || result.Tokens == nil {
+		t.Fatalf("Login = %+v", result)
+	}
+	claims, err := s.ValidateToken(result.Tokens.AccessToken)
+	if err != nil || claims.UserID != user.ID {
+		t.Fatalf("ValidateToken = %+v, %v", claims, err)
+	}
+
+	if _, err := s.Login("alice", "wrong", testClient); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: err = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := s.Login("nobody", "correct horse", testClient); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown user: err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+	if _, err := s.Register("alice", "alice@example.com", "correct horse", ""); err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := s.Refresh(result.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if refreshed.RefreshToken == result.Tokens.RefreshToken {
+		t.Error("Refresh handed out the same refresh token")
+	}
+
+	// The first refresh token has been used, so presenting it again ends the
+	// session, taking the newer tokens with it.
+	if _, err := s.Refresh(result.Tokens.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reused refresh token: err = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := s.ValidateToken(refreshed.AccessToken); err == nil {
+		t.Error("access token still valid after its session ended")
+	}
+
+	result, err = s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.ValidateToken(result.Tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Logout(claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ValidateToken(result.Tokens.AccessToken); err == nil {
+		t.Error("access token still valid after logging out")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	s, repos, events := newTestService(t, Options{
+		Lockout: LockoutPolicy{MaxAttempts: 3, Base: time.Minute, Max: time.Hour},
+	})
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < 3; i++ {
+		if _, err := s.Login("alice", "wrong", testClient); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("wrong password %d: err = %v, want ErrInvalidCredentials", i, err)
+		}
+	}
+	_, err = s.Login("alice", "wrong", testClient)
+	var locked *AccountLockedError
+	if !errors.As(err, &locked) || !locked.NewlyLocked || locked.UserID != user.ID {
+		t.Fatalf("third wrong password: err = %v, want a new AccountLockedError", err)
+	}
+	if wait := time.Until(locked.Until); wait <= 0 || wait > time.Minute {
+		t.Errorf("locked for %v, want a minute", wait)
+	}
+
+	// While locked, not even the right password gets in.
+	_, err = s.Login("alice", "correct horse", testClient)
+	if !errors.As(err, &locked) || locked.NewlyLocked {
+		t.Fatalf("right password while locked: err = %v, want an AccountLockedError", err)
+	}
+
+	if n := countEvents(t, events, audit.LoginFailed); n != 3 {
+		t.Errorf("%d failed logins in the audit log, want 3", n)
+	}
+	if n := countEvents(t, events, audit.AccountLocked); n != 1 {
+		t.Errorf("%d lockouts in the audit log, want 1", n)
+	}
+	if n := countEvents(t, events, audit.LoginBlocked); n != 1 {
+		t.Errorf("%d blocked logins in the audit log, want 1", n)
+	}
+
+	if err := s.UnlockUser(user.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Login("alice", "correct horse", testClient); err != nil {
+		t.Fatalf("Login after unlocking: %v", err)
+	}
+	if u, _ := repos.users.GetUserByID(user.ID); u.FailedLogins != 0 || u.LockedUntil != nil {
+		t.Errorf("after unlocking: %+v", u)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.CreateAPIToken(user.ID, "ci", []string{"nonsense"}, nil); err == nil {
+		t.Error("CreateAPIToken accepted an unknown scope")
+	}
+	token, secret, err := s.CreateAPIToken(user.ID, "ci", []string{ScopeFilesRead, ScopeFilesRead}, nil)
+	if err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	if len(token.Scopes) != 1 {
+		t.Errorf("scopes %v, want duplicates removed", token.Scopes)
+	}
+
+	got, gotToken, err := s.ValidateAPIToken(secret)
+	if err != nil || got.ID != user.ID || gotToken.ID != token.ID || gotToken.LastUsedAt == nil {
+		t.Fatalf("ValidateAPIToken = %v, %+v, %v", got, gotToken, err)
+	}
+	if _, _, err := s.ValidateAPIToken(secret + "x"); !errors.Is(err, ErrInvalidAPIToken) {
+		t.Errorf("wrong secret: err = %v, want ErrInvalidAPIToken", err)
+	}
+
+	if err := s.SetSuspended(user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ValidateAPIToken(secret); !errors.Is(err, ErrAccountSuspended) {
+		t.Errorf("suspended user: err = %v, want ErrAccountSuspended", err)
+	}
+}
+
+// brokenAuthenticator stands in for a directory that cannot be reached.
+type brokenAuthenticator struct{}
+
+var errDirectoryDown = errors.New("directory is down")
+
+func (brokenAuthenticator) Authenticate(username, password string) (*User, error) {
+	return nil, errDirectoryDown
+}
+
+func TestLoginCountsFailuresWhenAnAuthenticatorFails(t *testing.T) {
+	repos := memoryRepositories()
+	s := NewService(repos.users, repos.sessions, repos.tokens, "test-secret", Options{
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		Authenticators:  []Authenticator{brokenAuthenticator{}, NewPasswordAuthenticator(repos.users)},
+		Lockout:         LockoutPolicy{MaxAttempts: 3, Base: time.Minute, Max: time.Hour},
+	})
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Login("alice", "correct horse", testClient); err != nil {
+		t.Fatalf("right password with the directory down: %v", err)
+	}
+
+	for i := 1; i < 3; i++ {
+		if _, err := s.Login("alice", "wrong", testClient); !errors.Is(err, errDirectoryDown) {
+			t.Fatalf("wrong password %d: err = %v, want the directory error", i, err)
+		}
+		if u, _ := repos.users.GetUserByID(user.ID); u.FailedLogins != i {
+			t.Fatalf("after wrong password %d: %d failed logins counted", i, u.FailedLogins)
+		}
+	}
+	if _, err := s.Login("alice", "wrong", testClient); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("third wrong password: err = %v, want ErrAccountLocked", err)
+	}
+
+	// With nothing but the broken authenticator there is no verdict on the
+	// password, only the error.
+	s.authenticators = []Authenticator{brokenAuthenticator{}}
+	if _, err := s.Login("bob", "whatever", testClient); !errors.Is(err, errDirectoryDown) {
+		t.Errorf("only a broken authenticator: err = %v, want the directory error", err)
+	}
+}
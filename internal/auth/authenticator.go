@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks a username and password for Service.Login.
+type Authenticator interface {
+	// Authenticate returns the user the credentials belong to. It fails
+	// with ErrInvalidCredentials if it does not know them.
+	Authenticate(username, password string) (*User, error)
+}
+
+// PasswordAuthenticator checks passwords against the bcrypt hashes stored
+// with the users.
+type PasswordAuthenticator struct {
+	users UserRepository
+}
+
+var _ Authenticator = (*PasswordAuthenticator)(nil)
+
+func NewPasswordAuthenticator(users UserRepository) *PasswordAuthenticator {
+	return &PasswordAuthenticator{users: users}
+}
+
+// Authenticate never accepts users without a password hash, who log in
+// some other way.
+func (a *PasswordAuthenticator) Authenticate(username, password string) (*User, error) {
+	user, hashedPassword, err := a.users.GetUserByUsername(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
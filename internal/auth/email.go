@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	emailPurposeVerify = "verify"
+	emailPurposeReset  = "reset"
+)
+
+var (
+	ErrEmailDisabled        = errors.New("sending email is not configured")
+	ErrEmailAlreadyVerified = errors.New("email address is already verified")
+	ErrInvalidEmailToken    = errors.New("the link is invalid, expired or already used")
+)
+
+// Mailer sends an email rendered from a template, such as the
+// mail.Mailer.
+type Mailer interface {
+	Send(to, template string, data interface{}) error
+}
+
+// EmailEnabled reports whether verification and password reset emails can
+// be sent.
+func (s *Service) EmailEnabled() bool {
+	return s.mailer != nil
+}
+
+// SendVerificationEmail mails the user a link that confirms their address.
+// A new link replaces the ones sent before.
+func (s *Service) SendVerificationEmail(userID int) error {
+	if s.mailer == nil {
+		return ErrEmailDisabled
+	}
+	user, err := s.users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	return s.sendEmailToken(user, emailPurposeVerify, "verify-email.txt", "/verify-email", s.verificationTTL)
+}
+
+func (s *Service) VerifyEmail(token string) (*User, error) {
+	return s.users.VerifyEmail(hashToken(token), time.Now())
+}
+
+// RequestPasswordReset mails a reset link to the account with that address.
+// To not give away which addresses have accounts, it quietly does nothing
+// if there is none, or if the account has no password to reset because its
+// user logs in with single sign-on or LDAP.
+func (s *Service) RequestPasswordReset(email string) error {
+	if s.mailer == nil {
+		return ErrEmailDisabled
+	}
+	user, err := s.users.GetUserByEmail(email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Suspended {
+		return nil
+	}
+	_, passwordHash, err := s.users.GetUserByUsername(user.Username)
+	if err != nil {
+		return err
+	}
+	if passwordHash == "" {
+		return nil
+	}
+	return s.sendEmailToken(user, emailPurposeReset, "password-reset.txt", "/reset-password", s.passwordResetTTL)
+}
+
+// ResetPassword sets a new password with the token from a reset email and
+// logs the user out everywhere.
+func (s *Service) ResetPassword(token, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user, err := s.users.ResetPassword(hashToken(token), string(hashedPassword), time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = s.sessions.DeleteUserSessions(user.ID)
+	return err
+}
+
+func (s *Service) CleanupExpiredEmailTokens() error {
+	_, err := s.users.DeleteExpiredEmailTokens(time.Now())
+	return err
+}
+
+// sendEmailToken stores a new token and mails a link to path on the web app
+// with it. The token goes in the fragment, so it does not end up in server
+// logs or Referer headers.
+func (s *Service) sendEmailToken(user *User, purpose, template, path string, ttl time.Duration) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	if err := s.users.CreateEmailToken(user.ID, purpose, user.Email, hashToken(token), time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	return s.mailer.Send(user.Email, template, map[string]string{
+		"Username": user.Username,
+		"Link":     s.linkBaseURL + path + "#token=" + token,
+		"ValidFor": humanDuration(ttl),
+	})
+}
+
+// humanDuration writes durations like the TTLs in the configuration in
+// words, such as "48 hours" or "30 minutes".
+func humanDuration(d time.Duration) string {
+	unit, n := "minute", int(d.Round(time.Minute)/time.Minute)
+	if d >= time.Hour && d%time.Hour == 0 {
+		unit, n = "hour", int(d/time.Hour)
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"anonlink/internal/audit"
+)
+
+// fakeMailer keeps the links it is asked to send.
+type fakeMailer struct {
+	links []string
+}
+
+func (m *fakeMailer) Send(to, template string, data interface{}) error {
+	m.links = append(m.links, data.(map[string]string)["Link"])
+	return nil
+}
+
+// token returns the token in the last link sent.
+func (m *fakeMailer) token(t *testing.T) string {
+	t.Helper()
+	if len(m.links) == 0 {
+		t.Fatal("no email sent")
+	}
+	link, err := url.Parse(m.links[len(m.links)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := strings.CutPrefix(link.Fragment, "token=")
+	if !ok || token == "" {
+		t.Fatalf("link %s has no token in its fragment", link)
+	}
+	if link.RawQuery != "" {
+		t.Errorf("link %s has a query string that ends up in server logs", link)
+	}
+	return token
+}
+
+// clockedUsers is a UserRepository that keeps the hashes of the email
+// tokens it stores and redeems them later than the service asks, to let
+// them expire.
+type clockedUsers struct {
+	UserRepository
+	hashes []string
+	later  time.Duration
+}
+
+func (r *clockedUsers) CreateEmailToken(userID int, purpose, email, tokenHash string, expiresAt time.Time) error {
+	r.hashes = append(r.hashes, tokenHash)
+	return r.UserRepository.CreateEmailToken(userID, purpose, email, tokenHash, expiresAt)
+}
+
+func (r *clockedUsers) VerifyEmail(tokenHash string, now time.Time) (*User, error) {
+	return r.UserRepository.VerifyEmail(tokenHash, now.Add(r.later))
+}
+
+func (r *clockedUsers) ResetPassword(tokenHash, passwordHash string, now time.Time) (*User, error) {
+	return r.UserRepository.ResetPassword(tokenHash, passwordHash, now.Add(r.later))
+}
+
+func (r *clockedUsers) UnlockAccount(tokenHash string, now time.Time) (*User, error) {
+	return r.UserRepository.UnlockAccount(tokenHash, now.Add(r.later))
+}
+
+func newEmailTestService(t *testing.T) (*Service, *clockedUsers, *fakeMailer) {
+	t.Helper()
+	repos := memoryRepositories()
+	users := &clockedUsers{UserRepository: repos.users}
+	mailer := &fakeMailer{}
+	s := NewService(users, repos.sessions, repos.tokens, "test-secret", Options{
+		AccessTokenTTL:       15 * time.Minute,
+		RefreshTokenTTL:      24 * time.Hour,
+		Audit:                audit.New(audit.NewMemoryRepository()),
+		Mailer:               mailer,
+		LinkBaseURL:          "https://anonlink.example",
+		EmailVerificationTTL: 48 * time.Hour,
+		PasswordResetTTL:     time.Hour,
+	})
+	return s, users, mailer
+}
+
+// emailToken is one kind of link the service mails, from sending it to
+// using it.
+type emailToken struct {
+	name string
+	path string
+	ttl  time.Duration
+	send func(s *Service, user *User) error
+	use  func(s *Service, token string) error
+}
+
+var emailTokens = []emailToken{
+	{
+		name: "verification",
+		path: "/verify-email",
+		ttl:  48 * time.Hour,
+		send: func(s *Service, user *User) error { return s.SendVerificationEmail(user.ID) },
+		use: func(s *Service, token string) error {
+			_, err := s.VerifyEmail(token)
+			return err
+		},
+	},
+	{
+		name: "reset",
+		path: "/reset-password",
+		ttl:  time.Hour,
+		send: func(s *Service, user *User) error { return s.RequestPasswordReset(user.Email) },
+		use:  func(s *Service, token string) error { return s.ResetPassword(token, "new password") },
+	},
+	{
+		name: "unlock",
+		path: "/unlock-account",
+		ttl:  unlockLinkTTL,
+		send: func(s *Service, user *User) error { return s.SendUnlockEmail(user.ID) },
+		use: func(s *Service, token string) error {
+			_, err := s.UnlockAccount(token, ClientInfo{})
+			return err
+		},
+	},
+}
+
+func TestEmailTokensStoredHashed(t *testing.T) {
+	for _, kind := range emailTokens {
+		t.Run(kind.name, func(t *testing.T) {
+			s, users, mailer := newEmailTestService(t)
+			user := mustCreateUser(t, users, "alice")
+
+			if err := kind.send(s, user); err != nil {
+				t.Fatalf("sending: %v", err)
+			}
+			if link := mailer.links[0]; !strings.HasPrefix(link, "https://anonlink.example"+kind.path+"#") {
+				t.Errorf("link %s, want one to %s", link, kind.path)
+			}
+			token := mailer.token(t)
+			if len(users.hashes) != 1 || users.hashes[0] != hashToken(token) {
+				t.Fatalf("stored %q, want only the hash of %q", users.hashes, token)
+			}
+			// Someone who reads the database cannot use what is stored.
+			if err := kind.use(s, users.hashes[0]); !errors.Is(err, ErrInvalidEmailToken) {
+				t.Errorf("using the stored hash: err = %v, want ErrInvalidEmailToken", err)
+			}
+		})
+	}
+}
+
+func TestEmailTokensExpire(t *testing.T) {
+	for _, kind := range emailTokens {
+		t.Run(kind.name, func(t *testing.T) {
+			s, users, mailer := newEmailTestService(t)
+			user := mustCreateUser(t, users, "alice")
+
+			if err := kind.send(s, user); err != nil {
+				t.Fatalf("sending: %v", err)
+			}
+			users.later = kind.ttl + time.Minute
+			if err := kind.use(s, mailer.token(t)); !errors.Is(err, ErrInvalidEmailToken) {
+				t.Errorf("after %s: err = %v, want ErrInvalidEmailToken", users.later, err)
+			}
+
+			if err := kind.send(s, user); err != nil {
+				t.Fatalf("sending again: %v", err)
+			}
+			users.later = kind.ttl - time.Minute
+			if err := kind.use(s, mailer.token(t)); err != nil {
+				t.Errorf("after %s: %v", users.later, err)
+			}
+		})
+	}
+}
+
+func TestEmailTokensWorkOnce(t *testing.T) {
+	for _, kind := range emailTokens {
+		t.Run(kind.name, func(t *testing.T) {
+			s, users, mailer := newEmailTestService(t)
+			user := mustCreateUser(t, users, "alice")
+
+			if err := kind.send(s, user); err != nil {
+				t.Fatalf("sending: %v", err)
+			}
+			token := mailer.token(t)
+			if err := kind.use(s, token); err != nil {
+				t.Fatalf("first use: %v", err)
+			}
+			if err := kind.use(s, token); !errors.Is(err, ErrInvalidEmailToken) {
+				t.Errorf("second use: err = %v, want ErrInvalidEmailToken", err)
+			}
+		})
+	}
+}
+
+func TestEmailTokensForOtherPurposes(t *testing.T) {
+	s, users, mailer := newEmailTestService(t)
+	user := mustCreateUser(t, users, "alice")
+
+	if err := s.SendUnlockEmail(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	token := mailer.token(t)
+	if _, err := s.VerifyEmail(token); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("unlock token used to verify: err = %v, want ErrInvalidEmailToken", err)
+	}
+	if err := s.ResetPassword(token, "new password"); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("unlock token used to reset: err = %v, want ErrInvalidEmailToken", err)
+	}
+	if _, err := s.UnlockAccount(token, ClientInfo{}); err != nil {
+		t.Errorf("unlock token used to unlock: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+// Email tokens are kept by the UserRepository, since using one changes the
+// user in the same transaction.
+
+func (r *SQLUserRepository) SetEmailVerified(userID int, verified bool) error {
+	return r.updateUser(`UPDATE users SET email_verified = ? WHERE id = ?`, verified, userID)
+}
+
+func (r *SQLUserRepository) CreateEmailToken(userID int, purpose, email, tokenHash string, expiresAt time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?`, userID, purpose); err != nil {
+		return fmt.Errorf("failed to replace email token: %w", err)
+	}
+	query := `INSERT INTO email_tokens (token_hash, user_id, purpose, email, expires_at, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, tokenHash, userID, purpose, email, formatTimestamp(expiresAt), formatTimestamp(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to create email token: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (r *SQLUserRepository) VerifyEmail(tokenHash string, now time.Time) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, email, err := useEmailToken(tx, tokenHash, emailPurposeVerify, now)
+	if err != nil {
+		return nil, err
+	}
+	query := `UPDATE users SET email_verified = ? WHERE id = ? AND LOWER(email) = LOWER(?)`
+	result, err := tx.Exec(query, true, userID, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify email: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, ErrInvalidEmailToken
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	return r.GetUserByID(userID)
+}
+
+func (r *SQLUserRepository) ResetPassword(tokenHash, passwordHash string, now time.Time) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, _, err := useEmailToken(tx, tokenHash, emailPurposeReset, now)
+	if err != nil {
+		return nil, err
+	}
+	// Proving access to the account's email address is as good as the
+	// unlock link, so a new password lifts any lock as well.
+	query := `UPDATE users SET password_hash = ?, failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL
+	          WHERE id = ?`
+	if _, err := tx.Exec(query, passwordHash, userID); err != nil {
+		return nil, fmt.Errorf("failed to reset password: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to reset password: %w", err)
+	}
+
+	return r.GetUserByID(userID)
+}
+
+// useEmailToken deletes the token, so that it works only once, and returns
+// whose it was and the address it was sent to.
+func useEmailToken(tx *database.Tx, tokenHash, purpose string, now time.Time) (int, string, error) {
+	var userID int
+	var email string
+	query := `DELETE FROM email_tokens WHERE token_hash = ? AND purpose = ? AND expires_at > ? RETURNING user_id, email`
+	err := tx.QueryRow(query, tokenHash, purpose, formatTimestamp(now)).Scan(&userID, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", ErrInvalidEmailToken
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to use email token: %w", err)
+	}
+	return userID, email, nil
+}
+
+func (r *SQLUserRepository) DeleteExpiredEmailTokens(now time.Time) (int, error) {
+	result, err := r.db.Exec(`DELETE FROM email_tokens WHERE expires_at <= ?`, formatTimestamp(now))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired email tokens: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return int(n), nil
+}
+
+type memoryEmailToken struct {
+	userID    int
+	purpose   string
+	email     string
+	expiresAt time.Time
+}
+
+func (r *MemoryUserRepository) SetEmailVerified(userID int, verified bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.EmailVerified = verified
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateEmailToken(userID int, purpose, email, tokenHash string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, token := range r.emailTokens {
+		if token.userID == userID && token.purpose == purpose {
+			delete(r.emailTokens, hash)
+		}
+	}
+	r.emailTokens[tokenHash] = &memoryEmailToken{userID: userID, purpose: purpose, email: email, expiresAt: expiresAt}
+	return nil
+}
+
+func (r *MemoryUserRepository) VerifyEmail(tokenHash string, now time.Time) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, token, err := r.useEmailToken(tokenHash, emailPurposeVerify, now)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(u.Email, token.email) {
+		return nil, ErrInvalidEmailToken
+	}
+	u.EmailVerified = true
+	user := u.User
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) ResetPassword(tokenHash, passwordHash string, now time.Time) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, _, err := r.useEmailToken(tokenHash, emailPurposeReset, now)
+	if err != nil {
+		return nil, err
+	}
+	u.passwordHash = passwordHash
+	u.resetFailedLogins()
+	user := u.User
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) useEmailToken(tokenHash, purpose string, now time.Time) (*memoryUser, *memoryEmailToken, error) {
+	token, ok := r.emailTokens[tokenHash]
+	if !ok || token.purpose != purpose || !token.expiresAt.After(now) {
+		return nil, nil, ErrInvalidEmailToken
+	}
+	delete(r.emailTokens, tokenHash)
+	u, err := r.user(token.userID)
+	if err != nil {
+		return nil, nil, ErrInvalidEmailToken
+	}
+	return u, token, nil
+}
+
+func (r *MemoryUserRepository) DeleteExpiredEmailTokens(now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for hash, token := range r.emailTokens {
+		if !token.expiresAt.After(now) {
+			delete(r.emailTokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoLinkedAccount   = errors.New("no account is linked to this identity")
+	ErrIdentityNoEmail   = errors.New("the identity provider did not share an email address")
+	ErrIdentityEmailUsed = errors.New("an account with this email address already exists; it can only be linked once the identity provider has verified the address")
+	ErrInvalidOIDCState  = errors.New("invalid or expired single sign-on state")
+
+	// ErrIdentityAccountProtected is a first login with the email address of
+	// an account that is not linked on the provider's word alone.
+	ErrIdentityAccountProtected = errors.New("an account with this email address already exists and has a password or administrator rights, so it is not linked automatically")
+)
+
+// ExternalIdentity is a user as an outside identity provider knows them.
+// Issuer and Subject identify them; the rest is only used to find or create
+// their account the first time.
+type ExternalIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	// Username is the username they would like, if the provider has one.
+	Username string
+}
+
+// LoginWithIdentity logs in the user linked to identity. On their first
+// login they are linked to the account with their verified email address,
+// as LinkExistingAccounts allows, or get a new account if AutoProvision is
+// set.
+func (s *Service) LoginWithIdentity(identity ExternalIdentity, client ClientInfo) (*LoginResult, error) {
+	user, err := resolveIdentity(s.users, identity, s.autoProvision, s.linkExisting)
+	if err != nil {
+		return nil, err
+	}
+	return s.LoginAs(user, client)
+}
+
+// resolveIdentity finds the user linked to identity, linking or, if
+// provision is set, creating one the first time. Accounts with a password
+// or administrator rights are only linked if linkAny is set: whoever can
+// get an address past the provider should not get those.
+func resolveIdentity(users UserRepository, identity ExternalIdentity, provision, linkAny bool) (*User, error) {
+	user, err := users.GetUserByIdentity(identity.Issuer, identity.Subject)
+	if !errors.Is(err, ErrUserNotFound) {
+		return user, err
+	}
+
+	if identity.Email == "" {
+		return nil, ErrIdentityNoEmail
+	}
+	user, err = users.GetUserByEmail(identity.Email)
+	if err == nil {
+		// Only the provider vouching for the address shows that this is the
+		// same person.
+		if !identity.EmailVerified {
+			return nil, ErrIdentityEmailUsed
+		}
+		if !linkAny {
+			_, hash, err := users.GetUserByUsername(user.Username)
+			if err != nil {
+				return nil, err
+			}
+			if hash != "" || user.Role == RoleAdmin {
+				return nil, ErrIdentityAccountProtected
+			}
+		}
+		if err := users.LinkIdentity(user.ID, identity.Issuer, identity.Subject); err != nil {
+			return nil, err
+		}
+		if !user.EmailVerified {
+			if err := users.SetEmailVerified(user.ID, true); err != nil {
+				return nil, err
+			}
+			user.EmailVerified = true
+		}
+		return user, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	if !provision {
+		return nil, ErrNoLinkedAccount
+	}
+	return provisionUser(users, identity)
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// provisionUser creates an account for identity, named after the username
+// it asks for or its email address, with a number added if that is taken.
+func provisionUser(users UserRepository, identity ExternalIdentity) (*User, error) {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = usernameUnsafe.ReplaceAllString(base, "")
+	if len(base) < 3 {
+		base = "user" + base
+	}
+
+	for i := 1; i <= 100; i++ {
+		username := truncate(base, 20)
+		if i > 1 {
+			suffix := strconv.Itoa(i)
+			username = truncate(base, 20-len(suffix)) + suffix
+		}
+
+		if _, _, err := users.GetUserByUsername(username); err == nil {
+			continue
+		} else if !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+
+		user, err := users.CreateLinkedUser(username, identity.Email, identity.Issuer, identity.Subject)
+		if errors.Is(err, ErrUserExists) {
+			continue
+		}
+		if err != nil || !identity.EmailVerified {
+			return user, err
+		}
+		if err := users.SetEmailVerified(user.ID, true); err != nil {
+			return nil, err
+		}
+		user.EmailVerified = true
+		return user, nil
+	}
+	return nil, fmt.Errorf("failed to find a free username for %q", base)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// OIDCState is what the browser carries through a single sign-on login, so
+// that the callback can check it belongs to a login this server started
+// for that browser.
+type OIDCState struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+type oidcStateClaims struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func (s *Service) oidcStateKey() []byte {
+	key := sha256.Sum256(append([]byte("oidc-state:"), s.jwtSecret...))
+	return key[:]
+}
+
+func (s *Service) GenerateOIDCStateToken(state OIDCState, ttl time.Duration) (string, error) {
+	claims := oidcStateClaims{
+		Nonce:    state.Nonce,
+		Verifier: state.Verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   state.State,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(s.oidcStateKey())
+}
+
+func (s *Service) ParseOIDCStateToken(tokenString string) (*OIDCState, error) {
+	claims := &oidcStateClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return s.oidcStateKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidOIDCState
+	}
+	return &OIDCState{State: claims.Subject, Nonce: claims.Nonce, Verifier: claims.Verifier}, nil
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveIdentity(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, users UserRepository) {
+		mustCreateUser(t, users, "root") // the first account, which is the admin
+		// An account from another provider, without a password of its own.
+		existing, err := users.CreateUser("alice", "alice@example.com", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity := ExternalIdentity{Issuer: "https://idp.example", Subject: "1", Email: existing.Email, Username: "alice"}
+
+		// Anyone can claim an address at a provider that does not check it,
+		// so that is no reason to hand them the account.
+		if _, err := resolveIdentity(users, identity, true, false); !errors.Is(err, ErrIdentityEmailUsed) {
+			t.Fatalf("unverified email of an account: err = %v, want ErrIdentityEmailUsed", err)
+		}
+
+		identity.EmailVerified = true
+		user, err := resolveIdentity(users, identity, false, false)
+		if err != nil {
+			t.Fatalf("verified email of an account: %v", err)
+		}
+		if user.ID != existing.ID || !user.EmailVerified {
+			t.Errorf("linked %+v, want %d with the email verified", user, existing.ID)
+		}
+
+		// Once linked, the address no longer matters.
+		identity.Email, identity.EmailVerified = "changed@example.org", false
+		if user, err := resolveIdentity(users, identity, false, false); err != nil || user.ID != existing.ID {
+			t.Errorf("linked identity = %+v, %v; want %d", user, err, existing.ID)
+		}
+	})
+}
+
+// A verified address is not enough to take over an account that has a
+// password, or an admin's, unless linking those is asked for.
+func TestResolveIdentityProtectedAccounts(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, users UserRepository) {
+		admin, err := users.CreateUser("root", "root@example.com", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := users.SetRole(admin.ID, RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		withPassword := mustCreateUser(t, users, "alice")
+
+		for _, existing := range []*User{withPassword, admin} {
+			identity := ExternalIdentity{Issuer: "https://idp.example", Subject: existing.Username, Email: existing.Email, EmailVerified: true}
+			if _, err := resolveIdentity(users, identity, true, false); !errors.Is(err, ErrIdentityAccountProtected) {
+				t.Errorf("%s: err = %v, want ErrIdentityAccountProtected", existing.Username, err)
+			}
+			if _, err := users.GetUserByIdentity(identity.Issuer, identity.Subject); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("%s: the identity was linked anyway: %v", existing.Username, err)
+			}
+
+			user, err := resolveIdentity(users, identity, false, true)
+			if err != nil || user.ID != existing.ID {
+				t.Errorf("%s with linkAny = %+v, %v; want the account", existing.Username, user, err)
+			}
+		}
+	})
+}
+
+func TestResolveIdentityProvisioning(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, users UserRepository) {
+		mustCreateUser(t, users, "bob")
+		identity := ExternalIdentity{Issuer: "https://idp.example", Subject: "2", Email: "bob@elsewhere.example", Username: "bob"}
+
+		if _, err := resolveIdentity(users, identity, false, false); !errors.Is(err, ErrNoLinkedAccount) {
+			t.Errorf("without provisioning: err = %v, want ErrNoLinkedAccount", err)
+		}
+
+		user, err := resolveIdentity(users, identity, true, false)
+		if err != nil {
+			t.Fatalf("provisioning: %v", err)
+		}
+		if user.Username != "bob2" || user.Email != identity.Email || user.EmailVerified {
+			t.Errorf("provisioned %+v, want bob2 with an unverified email", user)
+		}
+		if _, hash, err := users.GetUserByUsername("bob2"); err != nil || hash != "" {
+			t.Errorf("provisioned account has password hash %q, %v", hash, err)
+		}
+
+		identity.Subject, identity.Email = "3", ""
+		if _, err := resolveIdentity(users, identity, true, false); !errors.Is(err, ErrIdentityNoEmail) {
+			t.Errorf("no email: err = %v, want ErrIdentityNoEmail", err)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Invites are kept by the UserRepository, since registering with one has to
+// use it up in the same transaction that creates the user.
+
+const inviteColumns = `id, COALESCE(user_id, 0), prefix, max_uses, uses, expires_at, created_at`
+
+func scanInvite(row rowScanner) (*Invite, error) {
+	invite := &Invite{}
+	err := row.Scan(&invite.ID, &invite.CreatedBy, &invite.Prefix, &invite.MaxUses, &invite.Uses,
+		&invite.ExpiresAt, &invite.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+func (r *SQLUserRepository) CreateInvitedUser(username, email, passwordHash, inviteHash string, now time.Time) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE invites SET uses = uses + 1 WHERE code_hash = ? AND uses < max_uses AND expires_at > ?`
+	result, err := tx.Exec(query, inviteHash, formatTimestamp(now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to use invite: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, ErrInvalidInvite
+	}
+
+	userID, err := insertUser(tx, username, email, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return r.GetUserByID(userID)
+}
+
+func (r *SQLUserRepository) CreateInvite(invite *Invite, codeHash string) error {
+	invite.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	var createdBy interface{}
+	if invite.CreatedBy != 0 {
+		createdBy = invite.CreatedBy
+	}
+	query := `INSERT INTO invites (id, user_id, prefix, code_hash, max_uses, expires_at, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := r.db.Exec(query, invite.ID, createdBy, invite.Prefix, codeHash, invite.MaxUses,
+		formatTimestamp(invite.ExpiresAt), formatTimestamp(invite.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create invite: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) GetInvite(inviteID string) (*Invite, error) {
+	invite, err := scanInvite(r.db.QueryRow(`SELECT `+inviteColumns+` FROM invites WHERE id = ?`, inviteID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invite: %w", err)
+	}
+	return invite, nil
+}
+
+func (r *SQLUserRepository) ListInvites(userID int) ([]*Invite, error) {
+	return r.listInvites(`SELECT `+inviteColumns+` FROM invites WHERE user_id = ? ORDER BY created_at DESC`, userID)
+}
+
+func (r *SQLUserRepository) ListAllInvites() ([]*Invite, error) {
+	return r.listInvites(`SELECT ` + inviteColumns + ` FROM invites ORDER BY created_at DESC`)
+}
+
+func (r *SQLUserRepository) listInvites(query string, args ...interface{}) ([]*Invite, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invites: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []*Invite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invite: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (r *SQLUserRepository) DeleteInvite(inviteID string) error {
+	result, err := r.db.Exec(`DELETE FROM invites WHERE id = ?`, inviteID)
+	if err != nil {
+		return fmt.Errorf("failed to delete invite: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+type memoryInvite struct {
+	Invite
+	codeHash string
+}
+
+func (r *MemoryUserRepository) CreateInvitedUser(username, email, passwordHash, inviteHash string, now time.Time) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var invite *memoryInvite
+	for _, i := range r.invites {
+		if i.codeHash == inviteHash && i.Uses < i.MaxUses && i.ExpiresAt.After(now) {
+			invite = i
+		}
+	}
+	if invite == nil {
+		return nil, ErrInvalidInvite
+	}
+
+	user, err := r.createUser(username, email, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	invite.Uses++
+	return user, nil
+}
+
+func (r *MemoryUserRepository) CreateInvite(invite *Invite, codeHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invite.CreatedAt = time.Now().UTC()
+	r.invites[invite.ID] = &memoryInvite{Invite: *invite, codeHash: codeHash}
+	return nil
+}
+
+func (r *MemoryUserRepository) GetInvite(inviteID string) (*Invite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.invites[inviteID]
+	if !ok {
+		return nil, ErrInviteNotFound
+	}
+	invite := i.Invite
+	return &invite, nil
+}
+
+func (r *MemoryUserRepository) ListInvites(userID int) ([]*Invite, error) {
+	return r.listInvites(func(i *memoryInvite) bool { return i.CreatedBy == userID })
+}
+
+func (r *MemoryUserRepository) ListAllInvites() ([]*Invite, error) {
+	return r.listInvites(func(*memoryInvite) bool { return true })
+}
+
+func (r *MemoryUserRepository) listInvites(match func(*memoryInvite) bool) ([]*Invite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invites := []*Invite{}
+	for _, i := range r.invites {
+		if match(i) {
+			invite := i.Invite
+			invites = append(invites, &invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.After(invites[j].CreatedAt) })
+	return invites, nil
+}
+
+func (r *MemoryUserRepository) DeleteInvite(inviteID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.invites[inviteID]; !ok {
+		return ErrInviteNotFound
+	}
+	delete(r.invites, inviteID)
+	return nil
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Registration modes say who may create an account.
+const (
+	RegistrationOpen   = "open"
+	RegistrationClosed = "closed"
+	// RegistrationInvite only lets in people with an invite code.
+	RegistrationInvite = "invite"
+	// RegistrationDomain only lets in email addresses at the allowed
+	// domains, and anyone with an invite code.
+	RegistrationDomain = "domain"
+)
+
+var RegistrationModes = []string{RegistrationOpen, RegistrationClosed, RegistrationInvite, RegistrationDomain}
+
+const (
+	// DefaultInviteTTL is how long an invite works if its creator does not
+	// say.
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	MaxInviteTTL     = 90 * 24 * time.Hour
+	MaxInviteUses    = 1000
+)
+
+var (
+	ErrRegistrationClosed    = errors.New("registration is closed")
+	ErrInviteRequired        = errors.New("an invite code is required to register")
+	ErrInvalidInvite         = errors.New("the invite code is invalid, expired or used up")
+	ErrEmailDomainNotAllowed = errors.New("registration is not open to this email domain")
+	ErrInviteNotFound        = errors.New("invite not found")
+)
+
+// RegistrationPolicy is who may register. An empty Mode is open.
+type RegistrationPolicy struct {
+	Mode string
+	// Domains are the email domains RegistrationDomain lets in.
+	Domains []string
+}
+
+func ValidRegistrationMode(mode string) bool {
+	for _, m := range RegistrationModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// check reports whether registering needs to use up the invite code.
+func (p RegistrationPolicy) check(email, inviteCode string) (bool, error) {
+	switch p.Mode {
+	case RegistrationClosed:
+		return false, ErrRegistrationClosed
+	case RegistrationInvite:
+		if inviteCode == "" {
+			return false, ErrInviteRequired
+		}
+		return true, nil
+	case RegistrationDomain:
+		if inviteCode != "" {
+			return true, nil
+		}
+		if !p.allowsEmail(email) {
+			return false, ErrEmailDomainNotAllowed
+		}
+	}
+	return false, nil
+}
+
+// allowsEmail matches the domain exactly, so example.com does not let in
+// addresses at mail.example.com.
+func (p RegistrationPolicy) allowsEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	for _, domain := range p.Domains {
+		if strings.EqualFold(email[at+1:], domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Invite lets MaxUses people register until ExpiresAt. Only a hash of the
+// code is stored; Prefix is kept so people can tell their invites apart.
+type Invite struct {
+	ID string `json:"id"`
+	// CreatedBy is 0 for invites created on the command line.
+	CreatedBy int       `json:"created_by"`
+	Prefix    string    `json:"prefix"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateInvite issues an invite code that maxUses people can register with
+// for ttl. The code is only returned here, it cannot be looked up later.
+func (s *Service) CreateInvite(createdBy, maxUses int, ttl time.Duration) (*Invite, string, error) {
+	if maxUses < 1 || maxUses > MaxInviteUses {
+		return nil, "", fmt.Errorf("uses must be between 1 and %d", MaxInviteUses)
+	}
+	if ttl <= 0 || ttl > MaxInviteTTL {
+		return nil, "", fmt.Errorf("expiry must be within %d days", int(MaxInviteTTL.Hours()/24))
+	}
+
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("failed to generate invite code: %w", err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	invite := &Invite{
+		ID:        uuid.New().String(),
+		CreatedBy: createdBy,
+		Prefix:    code[:6],
+		MaxUses:   maxUses,
+		ExpiresAt: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+	if err := s.users.CreateInvite(invite, hashToken(code)); err != nil {
+		return nil, "", err
+	}
+	return invite, code, nil
+}
+
+// ListInvites returns the invites the user created, newest first.
+func (s *Service) ListInvites(userID int) ([]*Invite, error) {
+	return s.users.ListInvites(userID)
+}
+
+// ListAllInvites returns everyone's invites, newest first.
+func (s *Service) ListAllInvites() ([]*Invite, error) {
+	return s.users.ListAllInvites()
+}
+
+// DeleteInvite deletes one of the user's invites, so nobody else can
+// register with it.
+func (s *Service) DeleteInvite(userID int, inviteID string) error {
+	invite, err := s.users.GetInvite(inviteID)
+	if err != nil {
+		return err
+	}
+	if invite.CreatedBy != userID {
+		return ErrInviteNotFound
+	}
+	return s.users.DeleteInvite(inviteID)
+}
+
+// RevokeInvite deletes anyone's invite.
+func (s *Service) RevokeInvite(inviteID string) error {
+	return s.users.DeleteInvite(inviteID)
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegistrationClosed(t *testing.T) {
+	s, repos, _ := newTestService(t, Options{Registration: RegistrationPolicy{Mode: RegistrationClosed}})
+	invite, code, err := s.CreateInvite(0, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not even with an invite.
+	for _, c := range []string{"", code} {
+		if _, err := s.Register("alice", "alice@example.com", "correct horse", c); !errors.Is(err, ErrRegistrationClosed) {
+			t.Errorf("invite code %q: err = %v, want ErrRegistrationClosed", c, err)
+		}
+	}
+	if _, _, err := repos.users.GetUserByUsername("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("account created anyway: %v", err)
+	}
+	if got, err := repos.users.GetInvite(invite.ID); err != nil || got.Uses != 0 {
+		t.Errorf("invite = %+v, %v; want it unused", got, err)
+	}
+}
+
+func TestRegistrationByInvite(t *testing.T) {
+	s, repos, _ := newTestService(t, Options{Registration: RegistrationPolicy{Mode: RegistrationInvite}})
+	invite, code, err := s.CreateInvite(0, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uses := func() int {
+		t.Helper()
+		got, err := repos.users.GetInvite(invite.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Uses
+	}
+
+	if _, err := s.Register("alice", "alice@example.com", "correct horse", ""); !errors.Is(err, ErrInviteRequired) {
+		t.Errorf("no code: err = %v, want ErrInviteRequired", err)
+	}
+	if _, err := s.Register("alice", "alice@example.com", "correct horse", code+"x"); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("wrong code: err = %v, want ErrInvalidInvite", err)
+	}
+
+	if _, err := s.Register("alice", "alice@example.com", "correct horse", code); err != nil {
+		t.Fatalf("with the code: %v", err)
+	}
+	if n := uses(); n != 1 {
+		t.Errorf("invite used %d times, want 1", n)
+	}
+	// A registration that fails for another reason does not use it up.
+	if _, err := s.Register("alice", "other@example.com", "correct horse", code); !errors.Is(err, ErrUserExists) {
+		t.Errorf("taken username: err = %v, want ErrUserExists", err)
+	}
+	if n := uses(); n != 1 {
+		t.Errorf("invite used %d times after a failed registration, want 1", n)
+	}
+
+	if _, err := s.Register("bob", "bob@example.com", "correct horse", code); err != nil {
+		t.Fatalf("second use: %v", err)
+	}
+	if _, err := s.Register("carol", "carol@example.com", "correct horse", code); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("used up: err = %v, want ErrInvalidInvite", err)
+	}
+	if n := uses(); n != 2 {
+		t.Errorf("invite used %d times, want 2", n)
+	}
+
+	expired := &Invite{ID: "expired", Prefix: "expire", MaxUses: 5, ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := repos.users.CreateInvite(expired, hashToken("expired-code")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("carol", "carol@example.com", "correct horse", "expired-code"); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("expired: err = %v, want ErrInvalidInvite", err)
+	}
+}
+
+func TestRegistrationByDomain(t *testing.T) {
+	s, _, _ := newTestService(t, Options{Registration: RegistrationPolicy{Mode: RegistrationDomain, Domains: []string{"example.com", "example.org"}}})
+
+	for _, email := range []string{"alice@example.com", "bob@EXAMPLE.org"} {
+		if _, err := s.Register(email[:3], email, "correct horse", ""); err != nil {
+			t.Errorf("%s: %v", email, err)
+		}
+	}
+	for _, email := range []string{"carol@elsewhere.example", "carol@mail.example.com", "carol@example.com.evil.example", "example.com@elsewhere.example"} {
+		if _, err := s.Register("carol", email, "correct horse", ""); !errors.Is(err, ErrEmailDomainNotAllowed) {
+			t.Errorf("%s: err = %v, want ErrEmailDomainNotAllowed", email, err)
+		}
+	}
+
+	// An invite lets in anyone, but it has to be a real one.
+	if _, err := s.Register("carol", "carol@elsewhere.example", "correct horse", "made-up"); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("made-up invite: err = %v, want ErrInvalidInvite", err)
+	}
+	_, code, err := s.CreateInvite(0, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("carol", "carol@elsewhere.example", "correct horse", code); err != nil {
+		t.Errorf("invite from outside the domains: %v", err)
+	}
+}
+
+func TestCreateInviteLimits(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+	for _, c := range []struct {
+		uses int
+		ttl  time.Duration
+	}{
+		{0, time.Hour},
+		{MaxInviteUses + 1, time.Hour},
+		{1, 0},
+		{1, MaxInviteTTL + time.Hour},
+	} {
+		if _, _, err := s.CreateInvite(0, c.uses, c.ttl); err == nil {
+			t.Errorf("CreateInvite(%d uses, %v) succeeded", c.uses, c.ttl)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig describes a directory to check passwords against.
+type LDAPConfig struct {
+	// URL is an ldap:// or ldaps:// URL.
+	URL      string
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS. Nil means the system's
+	// roots and the host name from URL.
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the account that looks users up. Without
+	// one, the lookup is anonymous.
+	BindDN       string
+	BindPassword string
+
+	BaseDN string
+	// UserFilter finds the entry for a username; every %s is replaced with
+	// the escaped username, as in "(uid=%s)".
+	UserFilter string
+	// GroupFilter, if set, has to find something under GroupBaseDN (BaseDN
+	// unless set) for a user to be allowed in; every %s is replaced with
+	// the escaped DN of their entry, as in
+	// "(&(objectClass=groupOfNames)(cn=anonlink)(member=%s))".
+	GroupFilter       string
+	GroupBaseDN       string
+	UsernameAttribute string
+	EmailAttribute    string
+	// TrustEmail counts the directory's email addresses as verified, so that
+	// a first login is linked to the existing account with the same address,
+	// whoever it belongs to. Leave it off unless the directory checks addresses:
+	// otherwise anyone who can set theirs could take over an admin's account.
+	TrustEmail bool
+}
+
+// LDAPAuthenticator checks passwords by binding as the user's directory
+// entry. Directory users get an account here on their first login, linked
+// to their entry and without a password of its own.
+type LDAPAuthenticator struct {
+	cfg   LDAPConfig
+	users UserRepository
+}
+
+var _ Authenticator = (*LDAPAuthenticator)(nil)
+
+func NewLDAPAuthenticator(cfg LDAPConfig, users UserRepository) (*LDAPAuthenticator, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("ldap url is required")
+	}
+	if cfg.BaseDN == "" {
+		return nil, errors.New("ldap base dn is required")
+	}
+	if !strings.Contains(cfg.UserFilter, "%s") {
+		return nil, fmt.Errorf("ldap user filter %q has no %%s for the username", cfg.UserFilter)
+	}
+	if cfg.GroupFilter != "" && !strings.Contains(cfg.GroupFilter, "%s") {
+		return nil, fmt.Errorf("ldap group filter %q has no %%s for the user", cfg.GroupFilter)
+	}
+	if cfg.GroupBaseDN == "" {
+		cfg.GroupBaseDN = cfg.BaseDN
+	}
+	if cfg.UsernameAttribute == "" {
+		cfg.UsernameAttribute = "uid"
+	}
+	if cfg.EmailAttribute == "" {
+		cfg.EmailAttribute = "mail"
+	}
+	return &LDAPAuthenticator{cfg: cfg, users: users}, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(username, password string) (*User, error) {
+	// A bind with a DN and no password is an anonymous bind, which most
+	// directories accept.
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := a.bindService(conn); err != nil {
+		return nil, err
+	}
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind failed: %w", err)
+	}
+
+	if a.cfg.GroupFilter != "" {
+		// The user may not be allowed to read groups themselves.
+		if err := a.bindService(conn); err != nil {
+			return nil, err
+		}
+		if err := a.checkGroup(conn, entry.DN); err != nil {
+			return nil, err
+		}
+	}
+
+	name := entry.GetAttributeValue(a.cfg.UsernameAttribute)
+	if name == "" {
+		name = username
+	}
+	return resolveIdentity(a.users, ExternalIdentity{
+		Issuer:        "ldap:" + strings.ToLower(a.cfg.BaseDN),
+		Subject:       strings.ToLower(entry.DN),
+		Email:         entry.GetAttributeValue(a.cfg.EmailAttribute),
+		EmailVerified: a.cfg.TrustEmail,
+		Username:      name,
+	}, true, a.cfg.TrustEmail)
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	opts := []ldap.DialOpt{ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout})}
+	if a.cfg.TLSConfig != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(a.cfg.TLSConfig))
+	}
+	conn, err := ldap.DialURL(a.cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("ldap connection failed: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if a.cfg.StartTLS {
+		tlsConfig := &tls.Config{}
+		if a.cfg.TLSConfig != nil {
+			tlsConfig = a.cfg.TLSConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			u, _ := url.Parse(a.cfg.URL)
+			tlsConfig.ServerName = u.Hostname()
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) bindService(conn *ldap.Conn) error {
+	var err error
+	if a.cfg.BindDN != "" {
+		err = conn.Bind(a.cfg.BindDN, a.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return fmt.Errorf("ldap service bind failed: %w", err)
+	}
+	return nil
+}
+
+func (a *LDAPAuthenticator) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(a.cfg.UserFilter, "%s", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		filter, []string{a.cfg.UsernameAttribute, a.cfg.EmailAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldap search failed: %w", err)
+	}
+	// A filter that matches several entries is ambiguous, not a login.
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+func (a *LDAPAuthenticator) checkGroup(conn *ldap.Conn, userDN string) error {
+	filter := strings.ReplaceAll(a.cfg.GroupFilter, "%s", ldap.EscapeFilter(userDN))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		filter, []string{"1.1"}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return fmt.Errorf("ldap group search failed: %w", err)
+	}
+	if result == nil || len(result.Entries) == 0 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
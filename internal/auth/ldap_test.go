@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testServiceDN       = "cn=service,dc=example,dc=org"
+	testServicePassword = "service password"
+)
+
+// ldapEntry is an entry in the test directory. Entries with a password can
+// be bound as.
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// fakeLDAP is an in-process directory that answers binds and searches, which
+// is all LDAPAuthenticator uses. Only the service account may search.
+type fakeLDAP struct {
+	entries []ldapEntry
+
+	mu          sync.Mutex
+	connections int
+	binds       []string
+	filters     []string
+}
+
+func newFakeLDAP(t *testing.T) (*fakeLDAP, string) {
+	t.Helper()
+	f := &fakeLDAP{entries: []ldapEntry{
+		{dn: testServiceDN, password: testServicePassword},
+		{dn: "uid=alice,ou=people,dc=example,dc=org", password: "alice password", attrs: map[string][]string{
+			"objectClass": {"person"}, "uid": {"alice"}, "mail": {"alice@example.org"},
+		}},
+		{dn: "uid=bob,ou=people,dc=example,dc=org", password: "bob password", attrs: map[string][]string{
+			"objectClass": {"person"}, "uid": {"bob"}, "mail": {"bob@example.org"},
+		}},
+		// Two people sharing an address, so that looking them up by it finds
+		// both.
+		{dn: "uid=carol,ou=people,dc=example,dc=org", password: "carol password", attrs: map[string][]string{
+			"objectClass": {"person"}, "uid": {"carol"}, "mail": {"shared@example.org"},
+		}},
+		{dn: "uid=dave,ou=people,dc=example,dc=org", password: "dave password", attrs: map[string][]string{
+			"objectClass": {"person"}, "uid": {"dave"}, "mail": {"shared@example.org"},
+		}},
+		{dn: "cn=anonlink,ou=groups,dc=example,dc=org", attrs: map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"anonlink"},
+			"member": {"uid=alice,ou=people,dc=example,dc=org", "uid=carol,ou=people,dc=example,dc=org"},
+		}},
+	}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f, "ldap://" + listener.Addr().String()
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			f.mu.Lock()
+			f.binds = append(f.binds, dn)
+			f.mu.Unlock()
+
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == "" && password == "" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range f.entries {
+				if strings.EqualFold(e.dn, dn) && e.password != "" && e.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			if code == ldap.LDAPResultSuccess {
+				bound = dn
+			} else {
+				bound = ""
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			responses = f.search(op, bound)
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeLDAP) search(op *ber.Packet, bound string) []*ber.Packet {
+	base, _ := op.Children[0].Value.(string)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	if s, err := ldap.DecompileFilter(filter); err == nil {
+		f.mu.Lock()
+		f.filters = append(f.filters, s)
+		f.mu.Unlock()
+	}
+	if !strings.EqualFold(bound, testServiceDN) {
+		return []*ber.Packet{ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)}
+	}
+
+	var responses []*ber.Packet
+	for _, e := range f.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), ","+strings.ToLower(base)) || !matchFilter(filter, e) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		for name, values := range e.attrs {
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attr.AppendChild(set)
+			attrs.AppendChild(attr)
+		}
+		entry.AppendChild(attrs)
+		responses = append(responses, entry)
+	}
+	return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// matchFilter evaluates the parts of the filter syntax the tests use.
+func matchFilter(filter *ber.Packet, e ldapEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchFilter(filter.Children[0], e)
+	case ldap.FilterPresent:
+		return len(e.attrs[filter.Data.String()]) > 0
+	case ldap.FilterEqualityMatch:
+		name := filter.Children[0].Data.String()
+		value := filter.Children[1].Data.String()
+		for attr, values := range e.attrs {
+			if strings.EqualFold(attr, name) {
+				for _, v := range values {
+					if strings.EqualFold(v, value) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return result
+}
+
+func newTestLDAPAuthenticator(t *testing.T, url string, configure func(*LDAPConfig)) (*LDAPAuthenticator, UserRepository) {
+	t.Helper()
+	cfg := LDAPConfig{
+		URL:          url,
+		BindDN:       testServiceDN,
+		BindPassword: testServicePassword,
+		BaseDN:       "dc=example,dc=org",
+		UserFilter:   "(&(objectClass=person)(|(uid=%s)(mail=%s)))",
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	users := memoryRepositories().users
+	a, err := NewLDAPAuthenticator(cfg, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, users
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	_, url := newFakeLDAP(t)
+	a, users := newTestLDAPAuthenticator(t, url, nil)
+
+	user, err := a.Authenticate("alice", "alice password")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.org" || user.EmailVerified {
+		t.Errorf("provisioned %+v, want alice with an unverified email", user)
+	}
+	// The account only ever logs in through the directory.
+	if _, hash, err := users.GetUserByUsername("alice"); err != nil || hash != "" {
+		t.Errorf("provisioned account has password hash %q, %v", hash, err)
+	}
+
+	again, err := a.Authenticate("ALICE@example.org", "alice password")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second login by email = %+v, %v; want the same account", again, err)
+	}
+}
+
+// Whoever can set their address in the directory must not get the account
+// here that has it, unless the directory is trusted with addresses.
+func TestLDAPEmailLinking(t *testing.T) {
+	_, url := newFakeLDAP(t)
+	a, users := newTestLDAPAuthenticator(t, url, nil)
+	admin, err := users.CreateUser("root", "alice@example.org", "hash-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetRole(admin.ID, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Authenticate("alice", "alice password"); !errors.Is(err, ErrIdentityEmailUsed) {
+		t.Fatalf("address of an existing account: err = %v, want ErrIdentityEmailUsed", err)
+	}
+	if _, err := users.GetUserByIdentity("ldap:dc=example,dc=org", "uid=alice,ou=people,dc=example,dc=org"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("the directory entry was linked anyway: %v", err)
+	}
+
+	trusting, _ := newTestLDAPAuthenticator(t, url, func(cfg *LDAPConfig) { cfg.TrustEmail = true })
+	trusting.users = users
+	user, err := trusting.Authenticate("alice", "alice password")
+	if err != nil {
+		t.Fatalf("with TrustEmail: %v", err)
+	}
+	if user.ID != admin.ID || !user.EmailVerified {
+		t.Errorf("with TrustEmail logged in as %+v, want %d with the email verified", user, admin.ID)
+	}
+}
+
+func TestLDAPAuthenticateRejects(t *testing.T) {
+	f, url := newFakeLDAP(t)
+	a, _ := newTestLDAPAuthenticator(t, url, nil)
+
+	for _, tt := range []struct {
+		name, username, password string
+	}{
+		{"wrong password", "alice", "bob password"},
+		{"unknown user", "mallory", "alice password"},
+		{"ambiguous match", "shared@example.org", "carol password"},
+		{"filter injection", "*)(uid=*", "alice password"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.Authenticate(tt.username, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("err = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	injected := f.filters[len(f.filters)-1]
+	if want := `(uid=\2a\29\28uid=\2a)`; !strings.Contains(injected, want) {
+		t.Errorf("filter %q does not contain the escaped username %q", injected, want)
+	}
+	for _, dn := range f.binds {
+		if strings.Contains(dn, "carol") || strings.Contains(dn, "dave") {
+			t.Errorf("bound as %q although the username matched two entries", dn)
+		}
+	}
+}
+
+func TestLDAPEmptyPassword(t *testing.T) {
+	f, url := newFakeLDAP(t)
+	a, _ := newTestLDAPAuthenticator(t, url, nil)
+
+	if _, err := a.Authenticate("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("err = %v, want ErrInvalidCredentials", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connections != 0 {
+		t.Errorf("connected to the directory %d times for an empty password", f.connections)
+	}
+}
+
+func TestLDAPGroupFilter(t *testing.T) {
+	_, url := newFakeLDAP(t)
+	a, _ := newTestLDAPAuthenticator(t, url, func(cfg *LDAPConfig) {
+		cfg.GroupFilter = "(&(objectClass=groupOfNames)(cn=anonlink)(member=%s))"
+		cfg.GroupBaseDN = "ou=groups,dc=example,dc=org"
+	})
+
+	if _, err := a.Authenticate("alice", "alice password"); err != nil {
+		t.Errorf("group member: %v", err)
+	}
+	if _, err := a.Authenticate("bob", "bob password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("not a group member: err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLDAPUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ldap://" + listener.Addr().String()
+	listener.Close()
+	a, _ := newTestLDAPAuthenticator(t, url, nil)
+
+	_, err = a.Authenticate("alice", "alice password")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("err = %v, want a connection error", err)
+	}
+
+	// A service account that cannot bind is a misconfiguration, not a wrong
+	// password.
+	_, url = newFakeLDAP(t)
+	a, _ = newTestLDAPAuthenticator(t, url, func(cfg *LDAPConfig) { cfg.BindPassword = "wrong" })
+	_, err = a.Authenticate("alice", "alice password")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("service bind failing: err = %v, want an error other than ErrInvalidCredentials", err)
+	}
+}
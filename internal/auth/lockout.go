@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/ratelimit"
+)
+
+const (
+	emailPurposeUnlock = "unlock"
+	// unlockLinkTTL is how long the link in the email about a locked account
+	// works. The lock itself usually runs out sooner.
+	unlockLinkTTL = 24 * time.Hour
+	// failedLoginMemory is how long a wrong password counts towards a lock.
+	failedLoginMemory = 24 * time.Hour
+)
+
+var ErrAccountLocked = errors.New("account is temporarily locked")
+
+// LockoutPolicy says when too many wrong passwords lock an account. The
+// MaxAttempts-th wrong password in a row locks it for Base, and every one
+// after that for twice as long as the one before, up to Max. A MaxAttempts
+// of 0 never locks anyone out.
+type LockoutPolicy struct {
+	MaxAttempts int
+	Base        time.Duration
+	Max         time.Duration
+}
+
+// AccountLockedError is what Login fails with for a locked account. It
+// matches ErrAccountLocked.
+type AccountLockedError struct {
+	UserID int
+	Until  time.Time
+	// NewlyLocked is set if it was this login that locked the account.
+	NewlyLocked bool
+}
+
+func (e *AccountLockedError) Error() string {
+	return ErrAccountLocked.Error()
+}
+
+func (e *AccountLockedError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// lockedAt reports whether the account is locked at now.
+func (u *User) lockedAt(now time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(now)
+}
+
+// loginFailed records a wrong password for username and counts it against
+// the account, if there is one, locking it once there have been too many.
+// It returns the error Login fails with.
+func (s *Service) loginFailed(account *User, username string, client ClientInfo) error {
+	event := audit.Event{Type: audit.LoginFailed, Username: username, IPAddress: client.IPAddress}
+	if account == nil {
+		event.Detail = "unknown user"
+		s.audit.Record(event)
+		return ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	failures, err := s.users.AddFailedLogin(account.ID, now.Add(-failedLoginMemory), now)
+	if err != nil {
+		return err
+	}
+	event.UserID = account.ID
+	event.Detail = fmt.Sprintf("%d in a row", failures)
+	s.audit.Record(event)
+
+	delay := ratelimit.Delay(failures, s.lockout.MaxAttempts, s.lockout.Base, s.lockout.Max)
+	if delay <= 0 {
+		return ErrInvalidCredentials
+	}
+	until := now.Add(delay)
+	if err := s.users.LockUser(account.ID, until); err != nil {
+		return err
+	}
+	s.audit.Record(audit.Event{
+		Type:      audit.AccountLocked,
+		UserID:    account.ID,
+		Username:  account.Username,
+		IPAddress: client.IPAddress,
+		Detail:    fmt.Sprintf("for %s after %d wrong passwords", delay, failures),
+	})
+	return &AccountLockedError{UserID: account.ID, Until: until, NewlyLocked: true}
+}
+
+// SendUnlockEmail tells the user their account has been locked, with a link
+// that unlocks it.
+func (s *Service) SendUnlockEmail(userID int) error {
+	if s.mailer == nil {
+		return ErrEmailDisabled
+	}
+	user, err := s.users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	return s.sendEmailToken(user, emailPurposeUnlock, "account-locked.txt", "/unlock-account", unlockLinkTTL)
+}
+
+// UnlockAccount unlocks an account with the token from the email
+// SendUnlockEmail sent.
+func (s *Service) UnlockAccount(token string, client ClientInfo) (*User, error) {
+	user, err := s.users.UnlockAccount(hashToken(token), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.audit.Record(audit.Event{
+		Type:      audit.AccountUnlocked,
+		UserID:    user.ID,
+		Username:  user.Username,
+		IPAddress: client.IPAddress,
+		Detail:    "with the link from the email",
+	})
+	return user, nil
+}
+
+// UnlockUser lifts the user's lock and forgets their failed logins. by says
+// who did it, for the audit log.
+func (s *Service) UnlockUser(userID int, by string) error {
+	user, err := s.users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.users.ResetFailedLogins(userID); err != nil {
+		return err
+	}
+	s.audit.Record(audit.Event{
+		Type:     audit.AccountUnlocked,
+		UserID:   user.ID,
+		Username: user.Username,
+		Detail:   "by " + by,
+	})
+	return nil
+}
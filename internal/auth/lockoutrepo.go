@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (r *SQLUserRepository) AddFailedLogin(userID int, since, now time.Time) (int, error) {
+	var failures int
+	query := `UPDATE users SET failed_logins = CASE WHEN last_failed_login_at >= ? THEN failed_logins + 1 ELSE 1 END,
+	          last_failed_login_at = ? WHERE id = ? RETURNING failed_logins`
+	err := r.db.QueryRow(query, formatTimestamp(since), formatTimestamp(now), userID).Scan(&failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to record failed login: %w", err)
+	}
+	return failures, nil
+}
+
+func (r *SQLUserRepository) LockUser(userID int, until time.Time) error {
+	return r.updateUser(`UPDATE users SET locked_until = ? WHERE id = ?`, formatTimestamp(until), userID)
+}
+
+func (r *SQLUserRepository) ResetFailedLogins(userID int) error {
+	query := `UPDATE users SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL WHERE id = ?`
+	return r.updateUser(query, userID)
+}
+
+func (r *SQLUserRepository) UnlockAccount(tokenHash string, now time.Time) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, _, err := useEmailToken(tx, tokenHash, emailPurposeUnlock, now)
+	if err != nil {
+		return nil, err
+	}
+	query := `UPDATE users SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL WHERE id = ?`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return nil, fmt.Errorf("failed to unlock account: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to unlock account: %w", err)
+	}
+
+	return r.GetUserByID(userID)
+}
+
+func (r *MemoryUserRepository) AddFailedLogin(userID int, since, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return 0, err
+	}
+	if u.lastFailedLogin.Before(since) {
+		u.FailedLogins = 0
+	}
+	u.FailedLogins++
+	u.lastFailedLogin = now
+	return u.FailedLogins, nil
+}
+
+func (r *MemoryUserRepository) LockUser(userID int, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	until = until.UTC()
+	u.LockedUntil = &until
+	return nil
+}
+
+func (r *MemoryUserRepository) ResetFailedLogins(userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.resetFailedLogins()
+	return nil
+}
+
+func (r *MemoryUserRepository) UnlockAccount(tokenHash string, now time.Time) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, _, err := r.useEmailToken(tokenHash, emailPurposeUnlock, now)
+	if err != nil {
+		return nil, err
+	}
+	u.resetFailedLogins()
+	user := u.User
+	return &user, nil
+}
+
+func (u *memoryUser) resetFailedLogins() {
+	u.FailedLogins = 0
+	u.lastFailedLogin = time.Time{}
+	u.LockedUntil = nil
+}
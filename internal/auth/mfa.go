@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	totpIssuer = "Anonlink"
+	// mfaChallengeTTL is how long someone who got the password right has to
+	// come up with the second factor.
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidMFAToken    = errors.New("invalid or expired two-factor challenge")
+	ErrInvalidMFACode     = errors.New("invalid two-factor code")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotPending     = errors.New("two-factor authentication has not been set up")
+	ErrTOTPRequired       = errors.New("two-factor authentication is required on this server")
+)
+
+// LoginResult is the outcome of a successful first login step. Either
+// Tokens is set, or MFAToken is and the login has to be finished with
+// CompleteMFA.
+type LoginResult struct {
+	User   *User
+	Tokens *Tokens
+
+	MFAToken string
+	// MustEnroll is set along with MFAToken when two-factor authentication
+	// is required but the user has not set it up yet. They get a secret
+	// from EnrollTOTPForChallenge and finish with a code for it.
+	MustEnroll bool
+	// RecoveryCodes is set when finishing the login also finished enrolling.
+	RecoveryCodes []string
+}
+
+// MFAChallenge is what an MFA token stands for.
+type MFAChallenge struct {
+	UserID int
+	Enroll bool
+}
+
+type mfaClaims struct {
+	Enroll bool `json:"enroll,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// LoginAs logs in a user whose identity is already established, applying
+// the same two-factor rules as Login.
+func (s *Service) LoginAs(user *User, client ClientInfo) (*LoginResult, error) {
+	if user.Suspended {
+		return nil, ErrAccountSuspended
+	}
+
+	totp, err := s.users.GetTOTP(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if totp.Enabled || s.requireTOTP {
+		token, err := s.generateMFAToken(user.ID, !totp.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate token: %w", err)
+		}
+		return &LoginResult{User: user, MFAToken: token, MustEnroll: !totp.Enabled}, nil
+	}
+
+	tokens, err := s.CreateSession(user, client)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, Tokens: tokens}, nil
+}
+
+// MFA tokens are signed with their own key, like unlock tokens, so that they
+// can never be used as an access token.
+func (s *Service) mfaKey() []byte {
+	key := sha256.Sum256(append([]byte("mfa-challenge:"), s.jwtSecret...))
+	return key[:]
+}
+
+func (s *Service) generateMFAToken(userID int, enroll bool) (string, error) {
+	claims := mfaClaims{
+		Enroll: enroll,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(userID),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(s.mfaKey())
+}
+
+func (s *Service) ParseMFAToken(tokenString string) (*MFAChallenge, error) {
+	claims := &mfaClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return s.mfaKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidMFAToken
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	return &MFAChallenge{UserID: userID, Enroll: claims.Enroll}, nil
+}
+
+// CompleteMFA finishes a login that LoginAs answered with an MFA token. code
+// is a TOTP code or, unless the user is still enrolling, a recovery code.
+func (s *Service) CompleteMFA(mfaToken, code string, client ClientInfo) (*LoginResult, error) {
+	challenge, err := s.ParseMFAToken(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.users.GetUserByID(challenge.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidMFAToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Suspended {
+		return nil, ErrAccountSuspended
+	}
+
+	result := &LoginResult{User: user}
+	if challenge.Enroll {
+		result.RecoveryCodes, err = s.ConfirmTOTP(user.ID, code)
+	} else {
+		err = s.verifySecondFactor(user.ID, code)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Tokens, err = s.CreateSession(user, client)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// EnrollTOTPForChallenge starts enrolling the user behind an MFA token that
+// says they must.
+func (s *Service) EnrollTOTPForChallenge(mfaToken string) (*TOTPEnrollment, error) {
+	challenge, err := s.ParseMFAToken(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	if !challenge.Enroll {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	user, err := s.users.GetUserByID(challenge.UserID)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	return s.EnrollTOTP(user)
+}
+
+func (s *Service) GetTOTPStatus(userID int) (*TOTPStatus, error) {
+	totp, err := s.users.GetTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	status := &TOTPStatus{Enabled: totp.Enabled, Required: s.requireTOTP}
+	if totp.Enabled {
+		if status.RecoveryCodesLeft, err = s.users.CountRecoveryCodes(userID); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// EnrollTOTP gives the user a new secret to put into their authenticator
+// app. It only takes effect once ConfirmTOTP has seen a code for it.
+func (s *Service) EnrollTOTP(user *User) (*TOTPEnrollment, error) {
+	totp, err := s.users.GetTOTP(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if totp.Enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.SetTOTPSecret(user.ID, secret); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{Secret: secret, URI: totpURI(totpIssuer, user.Username, secret)}, nil
+}
+
+// ConfirmTOTP turns on two-factor authentication once the user proves their
+// app has the secret, and returns their recovery codes.
+func (s *Service) ConfirmTOTP(userID int, code string) ([]string, error) {
+	totp, err := s.users.GetTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	if totp.Enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if totp.Secret == "" {
+		return nil, ErrTOTPNotPending
+	}
+	if err := s.useTOTPCode(userID, totp.Secret, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.EnableTOTP(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off, which takes a current
+// code or a recovery code.
+func (s *Service) DisableTOTP(userID int, code string) error {
+	if s.requireTOTP {
+		return ErrTOTPRequired
+	}
+	if err := s.verifySecondFactor(userID, code); err != nil {
+		return err
+	}
+	return s.users.DisableTOTP(userID)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, which takes a
+// current TOTP code.
+func (s *Service) RegenerateRecoveryCodes(userID int, code string) ([]string, error) {
+	totp, err := s.users.GetTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !totp.Enabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err := s.useTOTPCode(userID, totp.Secret, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *Service) verifySecondFactor(userID int, code string) error {
+	totp, err := s.users.GetTOTP(userID)
+	if err != nil {
+		return err
+	}
+	if !totp.Enabled {
+		return ErrTOTPNotEnabled
+	}
+
+	if err := s.useTOTPCode(userID, totp.Secret, code); !errors.Is(err, ErrInvalidMFACode) {
+		return err
+	}
+	used, err := s.users.UseRecoveryCode(userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// useTOTPCode accepts a code at most once, so that one seen over someone's
+// shoulder cannot be used again.
+func (s *Service) useTOTPCode(userID int, secret, code string) error {
+	step, ok := checkTOTP(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	fresh, err := s.users.UseTOTPStep(userID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// Recovery codes look like "k3n9x-4pq2m": 50 random bits in Crockford's
+// base32, which leaves out the letters that are easy to confuse.
+const recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+		}
+		var b strings.Builder
+		for j, c := range raw {
+			if j == 5 {
+				b.WriteByte('-')
+			}
+			b.WriteByte(recoveryCodeAlphabet[c&31])
+		}
+		code := b.String()
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,771 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("username or email already taken")
+)
+
+// UserRepository stores user accounts. SQLUserRepository is the real one;
+// MemoryUserRepository keeps users in memory.
+type UserRepository interface {
+	// CreateUser fails with ErrUserExists if the username or email is taken.
+	CreateUser(username, email, passwordHash string) (*User, error)
+	GetUserByID(id int) (*User, error)
+	// GetUserByUsername returns the user together with their password hash.
+	GetUserByUsername(username string) (*User, string, error)
+	// GetUserByEmail ignores case.
+	GetUserByEmail(email string) (*User, error)
+	// ListUsers returns every user, oldest first.
+	ListUsers() ([]*User, error)
+	SetRole(userID int, role string) error
+	SetSuspended(userID int, suspended bool) error
+	// DeleteUser deletes the user along with their recovery codes, linked
+	// identities, invites and email tokens.
+	DeleteUser(userID int) error
+
+	// GetUserByIdentity finds the user an identity at an outside identity
+	// provider is linked to.
+	GetUserByIdentity(issuer, subject string) (*User, error)
+	LinkIdentity(userID int, issuer, subject string) error
+	// CreateLinkedUser creates a user without a password, linked to an
+	// identity they log in with instead. It fails with ErrUserExists like
+	// CreateUser.
+	CreateLinkedUser(username, email, issuer, subject string) (*User, error)
+
+	GetTOTP(userID int) (*TOTPState, error)
+	// SetTOTPSecret stores a secret that is waiting to be confirmed,
+	// replacing any earlier one.
+	SetTOTPSecret(userID int, secret string) error
+	// EnableTOTP marks the stored secret as confirmed and replaces the
+	// user's recovery codes.
+	EnableTOTP(userID int, recoveryCodeHashes []string) error
+	// DisableTOTP forgets the secret and the recovery codes.
+	DisableTOTP(userID int) error
+	// UseTOTPStep records that a code for step was accepted. It reports false
+	// if a code for that step or a later one has been accepted before.
+	UseTOTPStep(userID int, step int64) (bool, error)
+	ReplaceRecoveryCodes(userID int, hashes []string) error
+	// UseRecoveryCode removes the recovery code with that hash and reports
+	// whether there was one.
+	UseRecoveryCode(userID int, hash string) (bool, error)
+	CountRecoveryCodes(userID int) (int, error)
+
+	// CreateInvitedUser is CreateUser for someone registering with an
+	// invite code. It uses up one use of the invite with that hash, and
+	// fails with ErrInvalidInvite if there is none that is unexpired at now
+	// and not used up. Nothing changes unless both the invite and the user
+	// work out.
+	CreateInvitedUser(username, email, passwordHash, inviteHash string, now time.Time) (*User, error)
+	CreateInvite(invite *Invite, codeHash string) error
+	GetInvite(inviteID string) (*Invite, error)
+	// ListInvites returns the invites the user created, newest first.
+	ListInvites(userID int) ([]*Invite, error)
+	ListAllInvites() ([]*Invite, error)
+	DeleteInvite(inviteID string) error
+
+	SetEmailVerified(userID int, verified bool) error
+	// CreateEmailToken stores a token mailed to email for purpose,
+	// replacing the user's earlier ones for the same purpose.
+	CreateEmailToken(userID int, purpose, email, tokenHash string, expiresAt time.Time) error
+	// VerifyEmail uses up the verification token with that hash and marks
+	// the address it was sent to as verified, if it is still the user's.
+	// It fails with ErrInvalidEmailToken if there is no such token that is
+	// unexpired at now.
+	VerifyEmail(tokenHash string, now time.Time) (*User, error)
+	// ResetPassword uses up the password reset token with that hash and
+	// sets the user's password, failing like VerifyEmail.
+	ResetPassword(tokenHash, passwordHash string, now time.Time) (*User, error)
+	DeleteExpiredEmailTokens(now time.Time) (int, error)
+
+	// AddFailedLogin counts a failed login at now and returns how many there
+	// have been since the last successful one, forgetting those if the one
+	// before was earlier than since.
+	AddFailedLogin(userID int, since, now time.Time) (int, error)
+	LockUser(userID int, until time.Time) error
+	// ResetFailedLogins forgets the user's failed logins and lifts any lock.
+	ResetFailedLogins(userID int) error
+	// UnlockAccount uses up the unlock token with that hash and resets the
+	// user's failed logins, failing like VerifyEmail.
+	UnlockAccount(tokenHash string, now time.Time) (*User, error)
+}
+
+// TOTPState is a user's two-factor setup. Secret is empty if there is none,
+// and Enabled is false until the secret has been confirmed with a code.
+type TOTPState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// SQLUserRepository is the UserRepository backed by the application
+// database.
+type SQLUserRepository struct {
+	db *database.DB
+}
+
+var _ UserRepository = (*SQLUserRepository)(nil)
+
+func NewSQLUserRepository(db *database.DB) *SQLUserRepository {
+	return &SQLUserRepository{db: db}
+}
+
+func (r *SQLUserRepository) CreateUser(username, email, passwordHash string) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, err := insertUser(tx, username, email, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return r.GetUserByID(userID)
+}
+
+func insertUser(tx *database.Tx, username, email, passwordHash string) (int, error) {
+	var exists int
+	query := `SELECT COUNT(*) FROM users WHERE username = ? OR email = ?`
+	if err := tx.QueryRow(query, username, email).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+	if exists > 0 {
+		return 0, ErrUserExists
+	}
+
+	// The first account on a new instance administers it.
+	var userID int
+	query = `INSERT INTO users (username, email, password_hash, role)
+	         VALUES (?, ?, ?, CASE WHEN EXISTS (SELECT 1 FROM users) THEN ? ELSE ? END) RETURNING id`
+	if err := tx.QueryRow(query, username, email, passwordHash, RoleUser, RoleAdmin).Scan(&userID); err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+	return userID, nil
+}
+
+const userColumns = `id, username, email, role, suspended, email_verified, failed_logins, locked_until, created_at`
+
+func scanUser(row rowScanner, extra ...interface{}) (*User, error) {
+	user := &User{}
+	var lockedUntil sql.NullTime
+	dest := append([]interface{}{&user.ID, &user.Username, &user.Email, &user.Role, &user.Suspended, &user.EmailVerified,
+		&user.FailedLogins, &lockedUntil, &user.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		user.LockedUntil = &lockedUntil.Time
+	}
+	return user, nil
+}
+
+func (r *SQLUserRepository) GetUserByID(id int) (*User, error) {
+	user, err := scanUser(r.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+func (r *SQLUserRepository) GetUserByUsername(username string) (*User, string, error) {
+	var hashedPassword string
+	query := `SELECT ` + userColumns + `, password_hash FROM users WHERE username = ?`
+	user, err := scanUser(r.db.QueryRow(query, username), &hashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrUserNotFound
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, hashedPassword, nil
+}
+
+func (r *SQLUserRepository) GetUserByEmail(email string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE LOWER(email) = LOWER(?)`
+	user, err := scanUser(r.db.QueryRow(query, email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+func (r *SQLUserRepository) ListUsers() ([]*User, error) {
+	rows, err := r.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r *SQLUserRepository) SetRole(userID int, role string) error {
+	return r.updateUser(`UPDATE users SET role = ? WHERE id = ?`, role, userID)
+}
+
+func (r *SQLUserRepository) SetSuspended(userID int, suspended bool) error {
+	return r.updateUser(`UPDATE users SET suspended = ? WHERE id = ?`, suspended, userID)
+}
+
+func (r *SQLUserRepository) updateUser(query string, args ...interface{}) error {
+	result, err := r.db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// DeleteUser deletes the rows that refer to the user explicitly, since
+// SQLite does not enforce the foreign keys.
+func (r *SQLUserRepository) DeleteUser(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"recovery_codes", "user_identities", "invites", "email_tokens"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, userID); err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+	}
+	result, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return tx.Commit()
+}
+
+func (r *SQLUserRepository) GetUserByIdentity(issuer, subject string) (*User, error) {
+	var userID int
+	query := `SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`
+	err := r.db.QueryRow(query, issuer, subject).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return r.GetUserByID(userID)
+}
+
+func (r *SQLUserRepository) LinkIdentity(userID int, issuer, subject string) error {
+	query := `INSERT INTO user_identities (user_id, issuer, subject) VALUES (?, ?, ?)`
+	if _, err := r.db.Exec(query, userID, issuer, subject); err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) CreateLinkedUser(username, email, issuer, subject string) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// An empty password hash never matches a password.
+	userID, err := insertUser(tx, username, email, "")
+	if err != nil {
+		return nil, err
+	}
+	query := `INSERT INTO user_identities (user_id, issuer, subject) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(query, userID, issuer, subject); err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return r.GetUserByID(userID)
+}
+
+func (r *SQLUserRepository) GetTOTP(userID int) (*TOTPState, error) {
+	state := &TOTPState{}
+	var secret sql.NullString
+	query := `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?`
+	err := r.db.QueryRow(query, userID).Scan(&secret, &state.Enabled, &state.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get two-factor settings: %w", err)
+	}
+	state.Secret = secret.String
+	return state, nil
+}
+
+func (r *SQLUserRepository) SetTOTPSecret(userID int, secret string) error {
+	query := `UPDATE users SET totp_secret = ?, totp_enabled = ?, totp_last_step = 0 WHERE id = ?`
+	if _, err := r.db.Exec(query, secret, false, userID); err != nil {
+		return fmt.Errorf("failed to save two-factor secret: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled = ? WHERE id = ?`, true, userID); err != nil {
+		return fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLUserRepository) DisableTOTP(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET totp_secret = NULL, totp_enabled = ?, totp_last_step = 0 WHERE id = ?`
+	if _, err := tx.Exec(query, false, userID); err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	if err := replaceRecoveryCodes(tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLUserRepository) UseTOTPStep(userID int, step int64) (bool, error) {
+	result, err := r.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to record two-factor code: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+func (r *SQLUserRepository) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, hashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *database.Tx, userID int, hashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hash); err != nil {
+			return fmt.Errorf("failed to save recovery code: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) UseRecoveryCode(userID int, hash string) (bool, error) {
+	result, err := r.db.Exec(`DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?`, userID, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+func (r *SQLUserRepository) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?`, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return count, nil
+}
+
+// MemoryUserRepository is a UserRepository that keeps users in memory, for
+// tests and throwaway instances. It is safe for concurrent use.
+type MemoryUserRepository struct {
+	mu         sync.Mutex
+	nextID     int
+	users      map[int]*memoryUser
+	identities map[identityKey]int
+	invites    map[string]*memoryInvite
+	// emailTokens are keyed by their hash.
+	emailTokens map[string]*memoryEmailToken
+}
+
+type identityKey struct {
+	issuer, subject string
+}
+
+type memoryUser struct {
+	User
+	passwordHash    string
+	totp            TOTPState
+	recoveryCodes   map[string]bool
+	lastFailedLogin time.Time
+}
+
+var _ UserRepository = (*MemoryUserRepository)(nil)
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		nextID:      1,
+		users:       make(map[int]*memoryUser),
+		identities:  make(map[identityKey]int),
+		invites:     make(map[string]*memoryInvite),
+		emailTokens: make(map[string]*memoryEmailToken),
+	}
+}
+
+func (r *MemoryUserRepository) CreateUser(username, email, passwordHash string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.createUser(username, email, passwordHash)
+}
+
+func (r *MemoryUserRepository) createUser(username, email, passwordHash string) (*User, error) {
+	for _, u := range r.users {
+		if u.Username == username || u.Email == email {
+			return nil, ErrUserExists
+		}
+	}
+
+	role := RoleUser
+	if len(r.users) == 0 {
+		role = RoleAdmin
+	}
+	u := &memoryUser{
+		User: User{
+			ID:        r.nextID,
+			Username:  username,
+			Email:     email,
+			Role:      role,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		},
+		passwordHash: passwordHash,
+	}
+	r.users[u.ID] = u
+	r.nextID++
+
+	user := u.User
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) GetUserByID(id int) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := u.User
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) GetUserByUsername(username string) (*User, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if u.Username == username {
+			user := u.User
+			return &user, u.passwordHash, nil
+		}
+	}
+	return nil, "", ErrUserNotFound
+}
+
+func (r *MemoryUserRepository) GetUserByEmail(email string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if strings.EqualFold(u.Email, email) {
+			user := u.User
+			return &user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (r *MemoryUserRepository) ListUsers() ([]*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := []*User{}
+	for _, u := range r.users {
+		user := u.User
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (r *MemoryUserRepository) SetRole(userID int, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.Role = role
+	return nil
+}
+
+func (r *MemoryUserRepository) SetSuspended(userID int, suspended bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.Suspended = suspended
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteUser(userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.user(userID); err != nil {
+		return err
+	}
+	delete(r.users, userID)
+	for key, id := range r.identities {
+		if id == userID {
+			delete(r.identities, key)
+		}
+	}
+	for id, invite := range r.invites {
+		if invite.CreatedBy == userID {
+			delete(r.invites, id)
+		}
+	}
+	for hash, token := range r.emailTokens {
+		if token.userID == userID {
+			delete(r.emailTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) GetUserByIdentity(issuer, subject string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(r.identities[identityKey{issuer, subject}])
+	if err != nil {
+		return nil, err
+	}
+	user := u.User
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) LinkIdentity(userID int, issuer, subject string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.user(userID); err != nil {
+		return err
+	}
+	key := identityKey{issuer, subject}
+	if _, ok := r.identities[key]; ok {
+		return fmt.Errorf("failed to link identity: already linked")
+	}
+	r.identities[key] = userID
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateLinkedUser(username, email, issuer, subject string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := identityKey{issuer, subject}
+	if _, ok := r.identities[key]; ok {
+		return nil, fmt.Errorf("failed to link identity: already linked")
+	}
+	user, err := r.createUser(username, email, "")
+	if err != nil {
+		return nil, err
+	}
+	r.identities[key] = user.ID
+	return user, nil
+}
+
+func (r *MemoryUserRepository) user(id int) (*memoryUser, error) {
+	u, ok := r.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (r *MemoryUserRepository) GetTOTP(userID int) (*TOTPState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	state := u.totp
+	return &state, nil
+}
+
+func (r *MemoryUserRepository) SetTOTPSecret(userID int, secret string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.totp = TOTPState{Secret: secret}
+	return nil
+}
+
+func (r *MemoryUserRepository) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.totp.Enabled = true
+	u.setRecoveryCodes(recoveryCodeHashes)
+	return nil
+}
+
+func (r *MemoryUserRepository) DisableTOTP(userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.totp = TOTPState{}
+	u.recoveryCodes = nil
+	return nil
+}
+
+func (r *MemoryUserRepository) UseTOTPStep(userID int, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return false, err
+	}
+	if u.totp.LastStep >= step {
+		return false, nil
+	}
+	u.totp.LastStep = step
+	return true, nil
+}
+
+func (r *MemoryUserRepository) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return err
+	}
+	u.setRecoveryCodes(hashes)
+	return nil
+}
+
+func (r *MemoryUserRepository) UseRecoveryCode(userID int, hash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return false, err
+	}
+	if !u.recoveryCodes[hash] {
+		return false, nil
+	}
+	delete(u.recoveryCodes, hash)
+	return true, nil
+}
+
+func (r *MemoryUserRepository) CountRecoveryCodes(userID int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, err := r.user(userID)
+	if err != nil {
+		return 0, err
+	}
+	return len(u.recoveryCodes), nil
+}
+
+func (u *memoryUser) setRecoveryCodes(hashes []string) {
+	u.recoveryCodes = make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		u.recoveryCodes[hash] = true
+	}
+}
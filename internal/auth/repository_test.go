@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"anonlink/internal/database"
+	"anonlink/internal/database/dbtest"
+)
+
+// repositories are the ones a Service needs, all backed by the same store.
+type repositories struct {
+	users    UserRepository
+	sessions SessionRepository
+	tokens   APITokenRepository
+}
+
+func memoryRepositories() repositories {
+	return repositories{
+		users:    NewMemoryUserRepository(),
+		sessions: NewMemorySessionRepository(),
+		tokens:   NewMemoryAPITokenRepository(),
+	}
+}
+
+// eachRepositories runs test against the memory repositories and against
+// the SQL ones on every database dialect available, so that they are held
+// to the same behaviour.
+func eachRepositories(t *testing.T, test func(t *testing.T, repos repositories)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, memoryRepositories())
+	})
+	dbtest.Each(t, func(t *testing.T, db *database.DB) {
+		test(t, repositories{
+			users:    NewSQLUserRepository(db),
+			sessions: NewSQLSessionRepository(db),
+			tokens:   NewSQLAPITokenRepository(db),
+		})
+	})
+}
+
+func eachUserRepository(t *testing.T, test func(t *testing.T, repo UserRepository)) {
+	eachRepositories(t, func(t *testing.T, repos repositories) {
+		test(t, repos.users)
+	})
+}
+
+// notUTC is a zone timestamps passed to repositories must not leak into the
+// comparisons with stored ones.
+var notUTC = time.FixedZone("UTC+5", 5*60*60)
+
+func mustCreateUser(t *testing.T, repo UserRepository, username string) *User {
+	t.Helper()
+	user, err := repo.CreateUser(username, username+"@example.com", "hash-"+username)
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	return user
+}
+
+func TestCreateUser(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, repo UserRepository) {
+		first := mustCreateUser(t, repo, "alice")
+		second := mustCreateUser(t, repo, "bob")
+		if first.ID == 0 || second.ID == 0 || first.ID == second.ID {
+			t.Fatalf("user IDs %d and %d", first.ID, second.ID)
+		}
+		if first.Role != RoleAdmin || second.Role != RoleUser {
+			t.Errorf("roles %q and %q, want the first user to be the admin", first.Role, second.Role)
+		}
+
+		user, hash, err := repo.GetUserByUsername("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != second.ID || hash != "hash-bob" {
+			t.Errorf("GetUserByUsername(bob) = %d, %q", user.ID, hash)
+		}
+
+		if _, err := repo.CreateUser("alice", "other@example.com", "x"); !errors.Is(err, ErrUserExists) {
+			t.Errorf("duplicate username: err = %v, want ErrUserExists", err)
+		}
+		if _, err := repo.CreateUser("carol", "bob@example.com", "x"); !errors.Is(err, ErrUserExists) {
+			t.Errorf("duplicate email: err = %v, want ErrUserExists", err)
+		}
+		if _, err := repo.GetUserByID(second.ID + 100); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("GetUserByID of a missing user: err = %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestCreateInvitedUser(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, repo UserRepository) {
+		now := time.Now().In(notUTC)
+		admin := mustCreateUser(t, repo, "admin")
+		invite := &Invite{ID: "inv1", CreatedBy: admin.ID, Prefix: "abcd", MaxUses: 2, ExpiresAt: now.Add(time.Hour)}
+		if err := repo.CreateInvite(invite, "code-hash"); err != nil {
+			t.Fatal(err)
+		}
+
+		user, err := repo.CreateInvitedUser("alice", "alice@example.com", "hash", "code-hash", now)
+		if err != nil {
+			t.Fatalf("CreateInvitedUser: %v", err)
+		}
+		if user.Username != "alice" || user.Role != RoleUser {
+			t.Errorf("created %+v", user)
+		}
+
+		// A taken username must not use up the invite.
+		if _, err := repo.CreateInvitedUser("alice", "other@example.com", "hash", "code-hash", now); !errors.Is(err, ErrUserExists) {
+			t.Errorf("taken username: err = %v, want ErrUserExists", err)
+		}
+		if got, err := repo.GetInvite("inv1"); err != nil || got.Uses != 1 {
+			t.Fatalf("invite uses after a failed registration = %v (err %v), want 1", got, err)
+		}
+
+		if _, err := repo.CreateInvitedUser("bob", "bob@example.com", "hash", "wrong-hash", now); !errors.Is(err, ErrInvalidInvite) {
+			t.Errorf("unknown invite: err = %v, want ErrInvalidInvite", err)
+		}
+		if _, err := repo.CreateInvitedUser("bob", "bob@example.com", "hash", "code-hash", now.Add(2*time.Hour)); !errors.Is(err, ErrInvalidInvite) {
+			t.Errorf("expired invite: err = %v, want ErrInvalidInvite", err)
+		}
+		if _, err := repo.CreateInvitedUser("bob", "bob@example.com", "hash", "code-hash", now); err != nil {
+			t.Fatalf("second use: %v", err)
+		}
+		if _, err := repo.CreateInvitedUser("carol", "carol@example.com", "hash", "code-hash", now); !errors.Is(err, ErrInvalidInvite) {
+			t.Errorf("used up invite: err = %v, want ErrInvalidInvite", err)
+		}
+		if _, _, err := repo.GetUserByUsername("carol"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("user created with a used up invite: err = %v", err)
+		}
+	})
+}
+
+func TestEmailTokens(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, repo UserRepository) {
+		now := time.Now().In(notUTC)
+		user := mustCreateUser(t, repo, "alice")
+
+		if err := repo.CreateEmailToken(user.ID, emailPurposeVerify, user.Email, "verify-hash", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.ResetPassword("verify-hash", "new-hash", now); !errors.Is(err, ErrInvalidEmailToken) {
+			t.Errorf("verification token used for a reset: err = %v, want ErrInvalidEmailToken", err)
+		}
+		if _, err := repo.VerifyEmail("verify-hash", now.Add(61*time.Minute)); !errors.Is(err, ErrInvalidEmailToken) {
+			t.Errorf("expired token: err = %v, want ErrInvalidEmailToken", err)
+		}
+		verified, err := repo.VerifyEmail("verify-hash", now.Add(59*time.Minute))
+		if err != nil {
+			t.Fatalf("VerifyEmail: %v", err)
+		}
+		if !verified.EmailVerified {
+			t.Error("email not verified")
+		}
+		if _, err := repo.VerifyEmail("verify-hash", now); !errors.Is(err, ErrInvalidEmailToken) {
+			t.Errorf("token used twice: err = %v, want ErrInvalidEmailToken", err)
+		}
+
+		// A new token replaces the earlier one for the same purpose.
+		if err := repo.CreateEmailToken(user.ID, emailPurposeReset, user.Email, "reset-1", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.CreateEmailToken(user.ID, emailPurposeReset, user.Email, "reset-2", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.ResetPassword("reset-1", "new-hash", now); !errors.Is(err, ErrInvalidEmailToken) {
+			t.Errorf("replaced token: err = %v, want ErrInvalidEmailToken", err)
+		}
+		if _, err := repo.ResetPassword("reset-2", "new-hash", now); err != nil {
+			t.Fatalf("ResetPassword: %v", err)
+		}
+		if _, hash, _ := repo.GetUserByUsername("alice"); hash != "new-hash" {
+			t.Errorf("password hash %q after reset", hash)
+		}
+
+		if err := repo.CreateEmailToken(user.ID, emailPurposeVerify, user.Email, "stale", now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.CreateEmailToken(user.ID, emailPurposeReset, user.Email, "fresh", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := repo.DeleteExpiredEmailTokens(now.Add(30 * time.Minute)); err != nil || n != 1 {
+			t.Errorf("DeleteExpiredEmailTokens = %d, %v, want 1", n, err)
+		}
+	})
+}
+
+func TestFailedLogins(t *testing.T) {
+	eachUserRepository(t, func(t *testing.T, repo UserRepository) {
+		now := time.Now().In(notUTC)
+		user := mustCreateUser(t, repo, "alice")
+
+		for want := 1; want <= 3; want++ {
+			n, err := repo.AddFailedLogin(user.ID, now.Add(-time.Hour), now)
+			if err != nil || n != want {
+				t.Fatalf("AddFailedLogin = %d, %v, want %d", n, err, want)
+			}
+		}
+		// The last failure was before since, so counting starts over.
+		later := now.Add(2 * time.Hour)
+		if n, err := repo.AddFailedLogin(user.ID, later.Add(-time.Hour), later); err != nil || n != 1 {
+			t.Fatalf("AddFailedLogin after a while = %d, %v, want 1", n, err)
+		}
+
+		until := now.Add(10 * time.Minute)
+		if err := repo.LockUser(user.ID, until); err != nil {
+			t.Fatal(err)
+		}
+		locked, err := repo.GetUserByID(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked.LockedUntil == nil || locked.LockedUntil.Sub(until).Abs() > time.Second {
+			t.Fatalf("LockedUntil = %v, want %v", locked.LockedUntil, until.UTC())
+		}
+
+		if err := repo.CreateEmailToken(user.ID, emailPurposeUnlock, user.Email, "unlock", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		unlocked, err := repo.UnlockAccount("unlock", now)
+		if err != nil {
+			t.Fatalf("UnlockAccount: %v", err)
+		}
+		if unlocked.LockedUntil != nil || unlocked.FailedLogins != 0 {
+			t.Errorf("after unlocking: %+v", unlocked)
+		}
+	})
+}
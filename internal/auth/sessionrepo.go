@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// SessionRepository stores login sessions together with the hash of the
+// refresh token each one currently accepts, and the hashes it accepted
+// before. SQLSessionRepository is the real one; MemorySessionRepository
+// keeps sessions in memory.
+type SessionRepository interface {
+	CreateSession(session *Session, refreshTokenHash string) error
+	GetSession(id string) (*Session, error)
+	// ListSessions returns the user's sessions that have not expired by now,
+	// most recently used first.
+	ListSessions(userID int, now time.Time) ([]*Session, error)
+	// RotateRefreshToken moves the unexpired session whose refresh token
+	// hashes to oldHash on to newHash and extends it to expiresAt. Presenting
+	// a hash that was already rotated away deletes its session and fails with
+	// ErrRefreshTokenReused; anything else unknown fails with
+	// ErrSessionNotFound.
+	RotateRefreshToken(oldHash, newHash string, now, expiresAt time.Time) (*Session, error)
+	DeleteSession(id string) error
+	DeleteUserSessions(userID int) (int, error)
+	DeleteExpiredSessions(now time.Time) (int, error)
+}
+
+// SQLSessionRepository is the SessionRepository backed by the application
+// database.
+type SQLSessionRepository struct {
+	db *database.DB
+}
+
+var _ SessionRepository = (*SQLSessionRepository)(nil)
+
+func NewSQLSessionRepository(db *database.DB) *SQLSessionRepository {
+	return &SQLSessionRepository{db: db}
+}
+
+const sessionColumns = `id, user_id, user_agent, ip_address, expires_at, last_used_at, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (*Session, error) {
+	session := &Session{}
+	err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IPAddress,
+		&session.ExpiresAt, &session.LastUsedAt, &session.CreatedAt)
+	return session, err
+}
+
+func (r *SQLSessionRepository) CreateSession(session *Session, refreshTokenHash string) error {
+	now := formatTimestamp(time.Now())
+	query := `INSERT INTO sessions (id, user_id, refresh_token_hash, user_agent, ip_address, expires_at, last_used_at, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := r.db.Exec(query, session.ID, session.UserID, refreshTokenHash, session.UserAgent, session.IPAddress,
+		formatTimestamp(session.ExpiresAt), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLSessionRepository) GetSession(id string) (*Session, error) {
+	session, err := scanSession(r.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+func (r *SQLSessionRepository) ListSessions(userID int, now time.Time) ([]*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE user_id = ? AND expires_at > ?
+	          ORDER BY last_used_at DESC`
+	rows, err := r.db.Query(query, userID, formatTimestamp(now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *SQLSessionRepository) RotateRefreshToken(oldHash, newHash string, now, expiresAt time.Time) (*Session, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The conditional update is what makes rotation safe against two
+	// requests racing with the same token: only one of them sees the row.
+	var sessionID string
+	query := `UPDATE sessions SET refresh_token_hash = ?, expires_at = ?, last_used_at = ?
+	          WHERE refresh_token_hash = ? AND expires_at > ? RETURNING id`
+	err = tx.QueryRow(query, newHash, formatTimestamp(expiresAt), formatTimestamp(now), oldHash, formatTimestamp(now)).Scan(&sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRow(`SELECT session_id FROM used_refresh_tokens WHERE token_hash = ?`, oldHash).Scan(&sessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSessionNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up refresh token: %w", err)
+		}
+		if _, err := deleteSessions(tx, `id = ?`, sessionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	query = `INSERT INTO used_refresh_tokens (token_hash, session_id, used_at) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(query, oldHash, sessionID, formatTimestamp(now)); err != nil {
+		return nil, fmt.Errorf("failed to record refresh token: %w", err)
+	}
+
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return session, nil
+}
+
+func (r *SQLSessionRepository) DeleteSession(id string) error {
+	_, err := r.deleteSessions(`id = ?`, id)
+	return err
+}
+
+func (r *SQLSessionRepository) DeleteUserSessions(userID int) (int, error) {
+	return r.deleteSessions(`user_id = ?`, userID)
+}
+
+func (r *SQLSessionRepository) DeleteExpiredSessions(now time.Time) (int, error) {
+	return r.deleteSessions(`expires_at < ?`, formatTimestamp(now))
+}
+
+func (r *SQLSessionRepository) deleteSessions(where string, arg interface{}) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	deleted, err := deleteSessions(tx, where, arg)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return deleted, nil
+}
+
+// deleteSessions deletes the sessions matching where, along with the refresh
+// tokens they used before. SQLite does not enforce the foreign key, so the
+// tokens are deleted explicitly.
+func deleteSessions(tx *database.Tx, where string, arg interface{}) (int, error) {
+	query := `DELETE FROM used_refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE ` + where + `)`
+	if _, err := tx.Exec(query, arg); err != nil {
+		return 0, fmt.Errorf("failed to delete refresh tokens: %w", err)
+	}
+	result, err := tx.Exec(`DELETE FROM sessions WHERE `+where, arg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return int(deleted), nil
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// MemorySessionRepository is a SessionRepository that keeps sessions in
+// memory, for tests and throwaway instances. It is safe for concurrent use.
+type MemorySessionRepository struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+	// used maps refresh token hashes that were rotated away to their session.
+	used map[string]string
+}
+
+type memorySession struct {
+	Session
+	refreshTokenHash string
+}
+
+var _ SessionRepository = (*MemorySessionRepository)(nil)
+
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{
+		sessions: make(map[string]*memorySession),
+		used:     make(map[string]string),
+	}
+}
+
+func (r *MemorySessionRepository) CreateSession(session *Session, refreshTokenHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &memorySession{Session: *session, refreshTokenHash: refreshTokenHash}
+	s.CreatedAt = time.Now().UTC()
+	s.LastUsedAt = s.CreatedAt
+	r.sessions[session.ID] = s
+	return nil
+}
+
+func (r *MemorySessionRepository) GetSession(id string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	session := s.Session
+	return &session, nil
+}
+
+func (r *MemorySessionRepository) ListSessions(userID int, now time.Time) ([]*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sessions []*Session
+	for _, s := range r.sessions {
+		if s.UserID == userID && s.ExpiresAt.After(now) {
+			session := s.Session
+			sessions = append(sessions, &session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (r *MemorySessionRepository) RotateRefreshToken(oldHash, newHash string, now, expiresAt time.Time) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sessionID, ok := r.used[oldHash]; ok {
+		r.deleteLocked(sessionID)
+		return nil, ErrRefreshTokenReused
+	}
+	for id, s := range r.sessions {
+		if s.refreshTokenHash != oldHash || !s.ExpiresAt.After(now) {
+			continue
+		}
+		r.used[oldHash] = id
+		s.refreshTokenHash = newHash
+		s.ExpiresAt = expiresAt
+		s.LastUsedAt = now
+		session := s.Session
+		return &session, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (r *MemorySessionRepository) DeleteSession(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deleteLocked(id)
+	return nil
+}
+
+func (r *MemorySessionRepository) DeleteUserSessions(userID int) (int, error) {
+	return r.deleteWhere(func(s *memorySession) bool { return s.UserID == userID }), nil
+}
+
+func (r *MemorySessionRepository) DeleteExpiredSessions(now time.Time) (int, error) {
+	return r.deleteWhere(func(s *memorySession) bool { return s.ExpiresAt.Before(now) }), nil
+}
+
+func (r *MemorySessionRepository) deleteWhere(match func(*memorySession) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deleted := 0
+	for id, s := range r.sessions {
+		if match(s) {
+			r.deleteLocked(id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (r *MemorySessionRepository) deleteLocked(id string) {
+	delete(r.sessions, id)
+	for hash, sessionID := range r.used {
+		if sessionID == id {
+			delete(r.used, hash)
+		}
+	}
+}
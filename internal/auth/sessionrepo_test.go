@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionRepository(t *testing.T) {
+	eachRepositories(t, func(t *testing.T, repos repositories) {
+		now := time.Now().In(notUTC)
+		alice := mustCreateUser(t, repos.users, "alice")
+		bob := mustCreateUser(t, repos.users, "bob")
+
+		for _, s := range []struct {
+			session *Session
+			hash    string
+		}{
+			{&Session{ID: "s1", UserID: alice.ID, UserAgent: "laptop", ExpiresAt: now.Add(time.Hour)}, "h1"},
+			{&Session{ID: "s2", UserID: alice.ID, UserAgent: "phone", ExpiresAt: now.Add(-time.Hour)}, "h2"},
+			{&Session{ID: "s3", UserID: bob.ID, ExpiresAt: now.Add(time.Hour)}, "h3"},
+		} {
+			if err := repos.sessions.CreateSession(s.session, s.hash); err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+		}
+
+		sessions, err := repos.sessions.ListSessions(alice.ID, now)
+		if err != nil || len(sessions) != 1 || sessions[0].ID != "s1" || sessions[0].UserAgent != "laptop" {
+			t.Fatalf("ListSessions = %v, %v; want only s1", sessions, err)
+		}
+
+		rotated, err := repos.sessions.RotateRefreshToken("h1", "h1b", now, now.Add(2*time.Hour))
+		if err != nil || rotated.ID != "s1" {
+			t.Fatalf("RotateRefreshToken = %v, %v", rotated, err)
+		}
+		if rotated.ExpiresAt.Sub(now.Add(2*time.Hour)).Abs() > time.Second {
+			t.Errorf("ExpiresAt = %v after rotating, want %v", rotated.ExpiresAt, now.Add(2*time.Hour).UTC())
+		}
+		if _, err := repos.sessions.RotateRefreshToken("h2", "h2b", now, now.Add(time.Hour)); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("rotating an expired session: err = %v, want ErrSessionNotFound", err)
+		}
+		if _, err := repos.sessions.RotateRefreshToken("unknown", "x", now, now.Add(time.Hour)); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("rotating an unknown token: err = %v, want ErrSessionNotFound", err)
+		}
+
+		// Presenting the old token again ends the session.
+		if _, err := repos.sessions.RotateRefreshToken("h1", "h1c", now, now.Add(time.Hour)); !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("reused token: err = %v, want ErrRefreshTokenReused", err)
+		}
+		if _, err := repos.sessions.GetSession("s1"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("session survived a reused token: err = %v", err)
+		}
+		if _, err := repos.sessions.RotateRefreshToken("h1b", "h1d", now, now.Add(time.Hour)); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("rotating the token of an ended session: err = %v, want ErrSessionNotFound", err)
+		}
+
+		if n, err := repos.sessions.DeleteExpiredSessions(now); err != nil || n != 1 {
+			t.Errorf("DeleteExpiredSessions = %d, %v; want 1", n, err)
+		}
+		if n, err := repos.sessions.DeleteUserSessions(bob.ID); err != nil || n != 1 {
+			t.Errorf("DeleteUserSessions = %d, %v; want 1", n, err)
+		}
+		if _, err := repos.sessions.GetSession("s3"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("GetSession after DeleteUserSessions: err = %v", err)
+		}
+	})
+}
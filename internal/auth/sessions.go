@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// maxUserAgentLength caps what is kept of the User-Agent a session was
+// created with; it is only there to help people recognise their devices.
+const maxUserAgentLength = 256
+
+// Session is one login. It lives as long as its refresh token keeps being
+// used before RefreshTokenTTL runs out, and ends when it is logged out, when
+// a refresh token it already rotated away is presented again, or when its
+// user logs out everywhere.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Current marks the session the listing was requested from.
+	Current bool `json:"current"`
+}
+
+// ClientInfo describes where a login came from.
+type ClientInfo struct {
+	UserAgent string
+	IPAddress string
+}
+
+// Tokens is what a client gets for logging in or refreshing: a short-lived
+// access token for the Authorization header and the refresh token to get
+// the next one with. Every refresh token works once.
+type Tokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// CreateSession starts a new session for user and issues its first tokens.
+func (s *Service) CreateSession(user *User, client ClientInfo) (*Tokens, error) {
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	session := &Session{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		UserAgent: userAgent,
+		IPAddress: client.IPAddress,
+		ExpiresAt: time.Now().Add(s.refreshTokenTTL),
+	}
+	if err := s.sessions.CreateSession(session, hashToken(refreshToken)); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(user, session.ID, refreshToken)
+}
+
+// Refresh trades a refresh token for a new pair of tokens. A refresh token
+// that was already traded in means it has been copied, so the session it
+// belongs to is ended and ErrRefreshTokenReused returned; the legitimate
+// holder has to log in again.
+func (s *Service) Refresh(refreshToken string) (*Tokens, error) {
+	newToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session, err := s.sessions.RotateRefreshToken(hashToken(refreshToken), hashToken(newToken), now, now.Add(s.refreshTokenTTL))
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.users.GetUserByID(session.UserID)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && user.Suspended) {
+		s.sessions.DeleteSession(session.ID)
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(user, session.ID, newToken)
+}
+
+func (s *Service) issueTokens(user *User, sessionID, refreshToken string) (*Tokens, error) {
+	accessToken, err := s.GenerateToken(user, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return &Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Logout ends a session. Its access tokens stop working right away.
+func (s *Service) Logout(sessionID string) error {
+	return s.sessions.DeleteSession(sessionID)
+}
+
+// LogoutAll ends every session of the user and returns how many there were.
+func (s *Service) LogoutAll(userID int) (int, error) {
+	return s.sessions.DeleteUserSessions(userID)
+}
+
+// ListSessions returns the user's active sessions, marking currentID.
+func (s *Service) ListSessions(userID int, currentID string) ([]*Session, error) {
+	sessions, err := s.sessions.ListSessions(userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Current = session.ID == currentID
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions. Sessions of other users are
+// reported as ErrSessionNotFound.
+func (s *Service) RevokeSession(userID int, sessionID string) error {
+	session, err := s.sessions.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID {
+		return ErrSessionNotFound
+	}
+	return s.sessions.DeleteSession(sessionID)
+}
+
+func (s *Service) CleanupExpiredSessions() error {
+	_, err := s.sessions.DeleteExpiredSessions(time.Now())
+	return err
+}
+
+// activeSession checks that the session an access token was issued for still
+// exists, which is what makes logging out take effect before the token
+// expires.
+func (s *Service) activeSession(claims *Claims) error {
+	if claims.SessionID == "" {
+		return errors.New("token has no session")
+	}
+	session, err := s.sessions.GetSession(claims.SessionID)
+	if err != nil {
+		return err
+	}
+	if session.UserID != claims.UserID || time.Now().After(session.ExpiresAt) {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func generateRefreshToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashToken is how refresh tokens and API tokens are stored. They are random
+// enough that a plain SHA-256 is all it takes.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
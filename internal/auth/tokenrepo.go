@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+// APITokenRepository stores personal access tokens by the hash of their
+// secret. SQLAPITokenRepository is the real one; MemoryAPITokenRepository
+// keeps tokens in memory.
+type APITokenRepository interface {
+	CreateAPIToken(token *APIToken, tokenHash string) error
+	GetAPITokenByHash(tokenHash string) (*APIToken, error)
+	// ListAPITokens returns the user's tokens, newest first.
+	ListAPITokens(userID int) ([]*APIToken, error)
+	// DeleteAPIToken fails with ErrAPITokenNotFound unless the user has a
+	// token with that ID.
+	DeleteAPIToken(userID int, tokenID string) error
+	TouchAPIToken(tokenID string, usedAt time.Time) error
+}
+
+// SQLAPITokenRepository is the APITokenRepository backed by the application
+// database.
+type SQLAPITokenRepository struct {
+	db *database.DB
+}
+
+var _ APITokenRepository = (*SQLAPITokenRepository)(nil)
+
+func NewSQLAPITokenRepository(db *database.DB) *SQLAPITokenRepository {
+	return &SQLAPITokenRepository{db: db}
+}
+
+const apiTokenColumns = `id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at`
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	token := &APIToken{}
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &scopes,
+		&expiresAt, &lastUsedAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, nil
+}
+
+func (r *SQLAPITokenRepository) CreateAPIToken(token *APIToken, tokenHash string) error {
+	var expiresAt interface{}
+	if token.ExpiresAt != nil {
+		expiresAt = formatTimestamp(*token.ExpiresAt)
+	}
+	token.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	query := `INSERT INTO api_tokens (id, user_id, name, prefix, token_hash, scopes, expires_at, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := r.db.Exec(query, token.ID, token.UserID, token.Name, token.Prefix, tokenHash,
+		strings.Join(token.Scopes, " "), expiresAt, formatTimestamp(token.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create API token: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLAPITokenRepository) GetAPITokenByHash(tokenHash string) (*APIToken, error) {
+	token, err := scanAPIToken(r.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = ?`, tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPITokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API token: %w", err)
+	}
+	return token, nil
+}
+
+func (r *SQLAPITokenRepository) ListAPITokens(userID int) ([]*APIToken, error) {
+	rows, err := r.db.Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (r *SQLAPITokenRepository) DeleteAPIToken(userID int, tokenID string) error {
+	result, err := r.db.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete API token: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+func (r *SQLAPITokenRepository) TouchAPIToken(tokenID string, usedAt time.Time) error {
+	if _, err := r.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, formatTimestamp(usedAt), tokenID); err != nil {
+		return fmt.Errorf("failed to update API token: %w", err)
+	}
+	return nil
+}
+
+// MemoryAPITokenRepository is an APITokenRepository that keeps tokens in
+// memory, for tests and throwaway instances. It is safe for concurrent use.
+type MemoryAPITokenRepository struct {
+	mu     sync.Mutex
+	tokens map[string]*memoryAPIToken
+}
+
+type memoryAPIToken struct {
+	APIToken
+	tokenHash string
+}
+
+var _ APITokenRepository = (*MemoryAPITokenRepository)(nil)
+
+func NewMemoryAPITokenRepository() *MemoryAPITokenRepository {
+	return &MemoryAPITokenRepository{tokens: make(map[string]*memoryAPIToken)}
+}
+
+func (r *MemoryAPITokenRepository) CreateAPIToken(token *APIToken, tokenHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token.CreatedAt = time.Now().UTC()
+	t := &memoryAPIToken{APIToken: *token, tokenHash: tokenHash}
+	t.Scopes = append([]string(nil), token.Scopes...)
+	r.tokens[token.ID] = t
+	return nil
+}
+
+func (r *MemoryAPITokenRepository) GetAPITokenByHash(tokenHash string) (*APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, t := range r.tokens {
+		if t.tokenHash == tokenHash {
+			return t.copy(), nil
+		}
+	}
+	return nil, ErrAPITokenNotFound
+}
+
+func (r *MemoryAPITokenRepository) ListAPITokens(userID int) ([]*APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tokens []*APIToken
+	for _, t := range r.tokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t.copy())
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (r *MemoryAPITokenRepository) DeleteAPIToken(userID int, tokenID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tokens[tokenID]
+	if !ok || t.UserID != userID {
+		return ErrAPITokenNotFound
+	}
+	delete(r.tokens, tokenID)
+	return nil
+}
+
+func (r *MemoryAPITokenRepository) TouchAPIToken(tokenID string, usedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.tokens[tokenID]; ok {
+		t.LastUsedAt = &usedAt
+	}
+	return nil
+}
+
+func (t *memoryAPIToken) copy() *APIToken {
+	token := t.APIToken
+	token.Scopes = append([]string(nil), t.Scopes...)
+	if t.ExpiresAt != nil {
+		expiresAt := *t.ExpiresAt
+		token.ExpiresAt = &expiresAt
+	}
+	if t.LastUsedAt != nil {
+		lastUsedAt := *t.LastUsedAt
+		token.LastUsedAt = &lastUsedAt
+	}
+	return &token
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAPITokenRepository(t *testing.T) {
+	eachRepositories(t, func(t *testing.T, repos repositories) {
+		alice := mustCreateUser(t, repos.users, "alice")
+		bob := mustCreateUser(t, repos.users, "bob")
+		expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+		token := &APIToken{ID: "t1", UserID: alice.ID, Name: "ci", Prefix: "anl_abcdef",
+			Scopes: []string{ScopeFilesRead, ScopeFilesWrite}, ExpiresAt: &expiresAt}
+		if err := repos.tokens.CreateAPIToken(token, "hash1"); err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+
+		got, err := repos.tokens.GetAPITokenByHash("hash1")
+		if err != nil {
+			t.Fatalf("GetAPITokenByHash: %v", err)
+		}
+		if got.ID != "t1" || got.UserID != alice.ID || len(got.Scopes) != 2 || !got.HasScope(ScopeFilesWrite) {
+			t.Errorf("GetAPITokenByHash = %+v", got)
+		}
+		if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expiresAt) || got.LastUsedAt != nil {
+			t.Errorf("ExpiresAt = %v, LastUsedAt = %v", got.ExpiresAt, got.LastUsedAt)
+		}
+		if _, err := repos.tokens.GetAPITokenByHash("other"); !errors.Is(err, ErrAPITokenNotFound) {
+			t.Errorf("unknown hash: err = %v, want ErrAPITokenNotFound", err)
+		}
+
+		usedAt := time.Now().In(notUTC)
+		if err := repos.tokens.TouchAPIToken("t1", usedAt); err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := repos.tokens.ListAPITokens(alice.ID)
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("ListAPITokens = %v, %v", tokens, err)
+		}
+		if tokens[0].LastUsedAt == nil || tokens[0].LastUsedAt.Sub(usedAt).Abs() > time.Second {
+			t.Errorf("LastUsedAt = %v, want %v", tokens[0].LastUsedAt, usedAt.UTC())
+		}
+
+		if err := repos.tokens.DeleteAPIToken(bob.ID, "t1"); !errors.Is(err, ErrAPITokenNotFound) {
+			t.Errorf("deleting someone else's token: err = %v, want ErrAPITokenNotFound", err)
+		}
+		if err := repos.tokens.DeleteAPIToken(alice.ID, "t1"); err != nil {
+			t.Fatal(err)
+		}
+		if tokens, err := repos.tokens.ListAPITokens(alice.ID); err != nil || len(tokens) != 0 {
+			t.Errorf("ListAPITokens after deleting = %v, %v", tokens, err)
+		}
+	})
+}
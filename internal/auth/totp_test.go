@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codeAt is the code the user's authenticator app shows step steps from
+// now.
+func codeAt(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, totpStep(time.Now())+step)
+}
+
+// The SHA-1 test vectors of RFC 6238 appendix B, which have 8 digits, cut
+// down to the 6 used here.
+func TestTOTPCodeVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for _, v := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		want := v.code[len(v.code)-totpDigits:]
+		if got := totpCode(key, totpStep(time.Unix(v.unix, 0))); got != want {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestCheckTOTPSkew(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code := totpCode([]byte("12345678901234567890"), current+offset)
+		step, ok := checkTOTP(secret, code, now)
+		if want := offset >= -totpSkew && offset <= totpSkew; ok != want {
+			t.Errorf("code %d steps away: accepted = %v, want %v", offset, ok, want)
+		} else if ok && step != current+offset {
+			t.Errorf("code %d steps away: step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	// Codes are read off a screen, so spacing and a lowercase secret are
+	// fine, but nothing else is.
+	if _, ok := checkTOTP(strings.ToLower(secret), "050 471", now); !ok {
+		t.Error("spaced code not accepted")
+	}
+	for _, code := range []string{"", "05047", "0504711", "abcdef"} {
+		if _, ok := checkTOTP(secret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := checkTOTP("not base32!", "050471", now); ok {
+		t.Error("code accepted for a broken secret")
+	}
+}
+
+// enrollTOTP turns on two-factor authentication for user and returns their
+// secret and recovery codes.
+func enrollTOTP(t *testing.T, s *Service, user *User) (string, []string) {
+	t.Helper()
+	enrollment, err := s.EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := s.ConfirmTOTP(user.ID, codeAt(t, enrollment.Secret, -1))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("%d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	return enrollment.Secret, codes
+}
+
+func TestTOTPRejectsReplay(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := enrollTOTP(t, s, user)
+
+	// The code confirming enrollment was the previous step's, so it cannot
+	// be used again, and neither can any before it.
+	if err := s.verifySecondFactor(user.ID, codeAt(t, secret, -1)); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("code used for enrolling: err = %v, want ErrInvalidMFACode", err)
+	}
+	if err := s.verifySecondFactor(user.ID, codeAt(t, secret, 0)); err != nil {
+		t.Fatalf("current code: %v", err)
+	}
+	if err := s.verifySecondFactor(user.ID, codeAt(t, secret, 0)); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("current code again: err = %v, want ErrInvalidMFACode", err)
+	}
+	if err := s.verifySecondFactor(user.ID, codeAt(t, secret, -1)); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("earlier code after a later one: err = %v, want ErrInvalidMFACode", err)
+	}
+	if err := s.verifySecondFactor(user.ID, codeAt(t, secret, 1)); err != nil {
+		t.Errorf("next code: %v", err)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, codes := enrollTOTP(t, s, user)
+
+	// However the user types it in.
+	if err := s.verifySecondFactor(user.ID, " "+strings.ToUpper(codes[0])); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if err := s.verifySecondFactor(user.ID, codes[0]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("recovery code again: err = %v, want ErrInvalidMFACode", err)
+	}
+	if err := s.verifySecondFactor(user.ID, strings.ReplaceAll(codes[1], "-", "")); err != nil {
+		t.Errorf("recovery code without the dash: %v", err)
+	}
+	status, err := s.GetTOTPStatus(user.ID)
+	if err != nil || status.RecoveryCodesLeft != recoveryCodeCount-2 {
+		t.Errorf("GetTOTPStatus = %+v, %v; want %d codes left", status, err, recoveryCodeCount-2)
+	}
+
+	// Regenerating them makes the rest useless.
+	secret, _ := s.users.GetTOTP(user.ID)
+	fresh, err := s.RegenerateRecoveryCodes(user.ID, codeAt(t, secret.Secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifySecondFactor(user.ID, codes[2]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("old recovery code after regenerating: err = %v, want ErrInvalidMFACode", err)
+	}
+	if err := s.verifySecondFactor(user.ID, fresh[0]); err != nil {
+		t.Errorf("new recovery code: %v", err)
+	}
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	s, _, _ := newTestService(t, Options{})
+	user, err := s.Register("alice", "alice@example.com", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, codes := enrollTOTP(t, s, user)
+
+	// The password alone only gets a challenge, which is no access token.
+	result, err := s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if result.Tokens != nil || result.MFAToken == "" || result.MustEnroll {
+		t.Fatalf("Login = %+v, want only an MFA token", result)
+	}
+	if _, err := s.ValidateToken(result.MFAToken); err == nil {
+		t.Error("the MFA token passes as an access token")
+	}
+
+	if _, err := s.CompleteMFA(result.MFAToken, "000000", testClient); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("wrong code: err = %v, want ErrInvalidMFACode", err)
+	}
+	if _, err := s.CompleteMFA("nonsense", codeAt(t, secret, 0), testClient); !errors.Is(err, ErrInvalidMFAToken) {
+		t.Errorf("bad MFA token: err = %v, want ErrInvalidMFAToken", err)
+	}
+	done, err := s.CompleteMFA(result.MFAToken, codeAt(t, secret, 0), testClient)
+	if err != nil {
+		t.Fatalf("CompleteMFA: %v", err)
+	}
+	if claims, err := s.ValidateToken(done.Tokens.AccessToken); err != nil || claims.UserID != user.ID {
+		t.Errorf("ValidateToken = %+v, %v", claims, err)
+	}
+
+	// A recovery code does instead of a TOTP code.
+	result, err = s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CompleteMFA(result.MFAToken, codes[0], testClient); err != nil {
+		t.Errorf("CompleteMFA with a recovery code: %v", err)
+	}
+
+	// Suspension between the two steps stops the login.
+	result, err = s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.users.SetSuspended(user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CompleteMFA(result.MFAToken, codes[1], testClient); !errors.Is(err, ErrAccountSuspended) {
+		t.Errorf("CompleteMFA after suspension: err = %v, want ErrAccountSuspended", err)
+	}
+}
+
+func TestRequiredTOTPEnrollsOnLogin(t *testing.T) {
+	s, _, _ := newTestService(t, Options{RequireTOTP: true})
+	if _, err := s.Register("alice", "alice@example.com", "correct horse", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Login("alice", "correct horse", testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tokens != nil || !result.MustEnroll {
+		t.Fatalf("Login = %+v, want an enrollment challenge", result)
+	}
+	enrollment, err := s.EnrollTOTPForChallenge(result.MFAToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := s.CompleteMFA(result.MFAToken, codeAt(t, enrollment.Secret, 0), testClient)
+	if err != nil {
+		t.Fatalf("CompleteMFA: %v", err)
+	}
+	if done.Tokens == nil || len(done.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("CompleteMFA = %+v, want tokens and recovery codes", done)
+	}
+	if err := s.DisableTOTP(done.User.ID, codeAt(t, enrollment.Secret, 1)); !errors.Is(err, ErrTOTPRequired) {
+		t.Errorf("DisableTOTP: err = %v, want ErrTOTPRequired", err)
+	}
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Unlock tokens prove that someone entered the password of a protected share
+// link. They are signed with a key derived from the JWT secret so that they
+// can never be mistaken for a login token.
+//
+// Besides the download token they carry a fingerprint of the password they
+// were issued for, so that changing or removing the password makes them
+// worthless.
+type unlockClaims struct {
+	Password string `json:"pwd"`
+	jwt.RegisteredClaims
+}
+
+func (s *Service) unlockKey() []byte {
+	key := sha256.Sum256(append([]byte("share-unlock:"), s.jwtSecret...))
+	return key[:]
+}
+
+func (s *Service) GenerateUnlockToken(downloadToken, passwordFingerprint string, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	claims := unlockClaims{
+		Password: passwordFingerprint,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   downloadToken,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(s.unlockKey())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ValidateUnlockToken checks that tokenString unlocks downloadToken while it
+// is protected by the password with passwordFingerprint.
+func (s *Service) ValidateUnlockToken(tokenString, downloadToken, passwordFingerprint string) error {
+	claims := &unlockClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return s.unlockKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return err
+	}
+	if !token.Valid || claims.Subject != downloadToken || claims.Password != passwordFingerprint {
+		return errors.New("invalid unlock token")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnlockToken(t *testing.T) {
+	s, repos, _ := newTestService(t, Options{})
+	token, expiresAt, err := s.GenerateUnlockToken("download", "fingerprint", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiresAt) > time.Minute || time.Until(expiresAt) < 50*time.Second {
+		t.Errorf("expires at %v", expiresAt)
+	}
+	if err := s.ValidateUnlockToken(token, "download", "fingerprint"); err != nil {
+		t.Errorf("ValidateUnlockToken: %v", err)
+	}
+
+	if err := s.ValidateUnlockToken(token, "other", "fingerprint"); err == nil {
+		t.Error("token unlocked another download token")
+	}
+	if err := s.ValidateUnlockToken(token, "download", "changed"); err == nil {
+		t.Error("token outlived its password")
+	}
+	if err := s.ValidateUnlockToken(token, "download", ""); err == nil {
+		t.Error("token unlocked the link without a password")
+	}
+	if _, err := s.ValidateToken(token); err == nil {
+		t.Error("the unlock token passes as an access token")
+	}
+
+	expired, _, err := s.GenerateUnlockToken("download", "fingerprint", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ValidateUnlockToken(expired, "download", "fingerprint"); err == nil {
+		t.Error("expired token accepted")
+	}
+	other := NewService(repos.users, repos.sessions, repos.tokens, "other-secret", Options{})
+	if err := other.ValidateUnlockToken(token, "download", "fingerprint"); err == nil {
+		t.Error("token accepted under another secret")
+	}
+}
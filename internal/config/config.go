@@ -2,6 +2,9 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -9,14 +12,218 @@ type Config struct {
 	DatabasePath string
 	UploadsPath  string
 	JWTSecret    string
+
+	// DatabaseURL selects the database: a postgres:// URL, or the path of a
+	// SQLite database (DatabasePath unless set).
+	DatabaseURL string
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	Require2FA        bool
+	TOTPMaxAttempts   int
+	TOTPAttemptWindow time.Duration
+
+	// LoginMaxAttempts is how many wrong passwords in a row lock an
+	// account, for LockoutBase at first and twice as long every time after
+	// that, up to LockoutMax.
+	LoginMaxAttempts int
+	LockoutBase      time.Duration
+	LockoutMax       time.Duration
+	// IPMaxAttempts is how many failed logins, registrations and share link
+	// passwords from one IP address make it wait the same way.
+	IPMaxAttempts int
+	// AuditRetention is how long the audit log keeps events.
+	AuditRetention time.Duration
+
+	// LocalAuth allows registering and logging in with a password. With it
+	// off, users log in through OIDC.
+	LocalAuth bool
+	// FrontendURL is where the web app is served, if not by this server.
+	// Links in emails point there, so email needs it either way.
+	FrontendURL string
+
+	// RegistrationMode is who may register: open, closed, invite or domain.
+	RegistrationMode string
+	// RegistrationDomains are the email domains domain mode lets in.
+	RegistrationDomains string
+	// UserInvites lets users who are not admins create invite codes.
+	UserInvites bool
+
+	// SMTP settings for verification and password reset emails, which are
+	// off unless SMTPHost is set.
+	SMTPHost         string
+	SMTPPort         int
+	SMTPUsername     string
+	SMTPPassword     string
+	SMTPFrom         string
+	SMTPTLS          string
+	MailTemplatesDir string
+	EmailVerifyTTL   time.Duration
+	PasswordResetTTL time.Duration
+	// RequireVerifiedEmail keeps users from uploading until they have
+	// verified their email address.
+	RequireVerifiedEmail bool
+
+	OIDCIssuer        string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCRedirectURL   string
+	OIDCScopes        string
+	OIDCProviderName  string
+	OIDCAutoProvision bool
+	OIDCLinkExisting  bool
+
+	LDAPURL               string
+	LDAPStartTLS          bool
+	LDAPCAFile            string
+	LDAPBindDN            string
+	LDAPBindPassword      string
+	LDAPBaseDN            string
+	LDAPUserFilter        string
+	LDAPGroupFilter       string
+	LDAPGroupBaseDN       string
+	LDAPUsernameAttribute string
+	LDAPEmailAttribute    string
+	LDAPTrustEmail        bool
+
+	StorageBackend    string
+	S3Bucket          string
+	S3Prefix          string
+	S3Endpoint        string
+	S3Region          string
+	S3PathStyle       bool
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	DownloadMode  string
+	PresignExpiry time.Duration
+
+	EncryptionKeyFile string
+
+	PartialUploadExpiry time.Duration
+
+	MaxFileSize       int64
+	MaxFilesPerUser   int64
+	MaxStoragePerUser int64
+
+	DefaultFileLifetime time.Duration
+	MaxFileLifetime     time.Duration
+	AllowNeverExpire    bool
+
+	SharePasswordMaxAttempts int
+	SharePasswordWindow      time.Duration
+	UnlockTokenTTL           time.Duration
+
+	AnonymousUploads          bool
+	AnonymousMaxFileSize      int64
+	AnonymousDefaultLifetime  time.Duration
+	AnonymousMaxLifetime      time.Duration
+	AnonymousAllowNeverExpire bool
+	AnonymousUploadsPerWindow int
+	AnonymousUploadWindow     time.Duration
 }
 
 func Load() *Config {
+	uploadsPath := getEnv("UPLOADS_PATH", "./uploads")
+	databasePath := getEnv("DATABASE_PATH", "./anonlink.db")
+
 	return &Config{
 		Port:         getEnv("PORT", "8080"),
-		DatabasePath: getEnv("DATABASE_PATH", "./anonlink.db"),
-		UploadsPath:  getEnv("UPLOADS_PATH", "./uploads"),
+		DatabasePath: databasePath,
+		UploadsPath:  uploadsPath,
 		JWTSecret:    getEnv("JWT_SECRET", "your-secret-key-here-change-this"),
+
+		DatabaseURL: getEnv("DATABASE_URL", databasePath),
+
+		AccessTokenTTL:  getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+		Require2FA:        getEnvBool("REQUIRE_2FA", false),
+		TOTPMaxAttempts:   getEnvInt("TOTP_MAX_ATTEMPTS", 5),
+		TOTPAttemptWindow: getEnvDuration("TOTP_ATTEMPT_WINDOW", 15*time.Minute),
+
+		LoginMaxAttempts: getEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LockoutBase:      getEnvDuration("LOCKOUT_BASE", time.Minute),
+		LockoutMax:       getEnvDuration("LOCKOUT_MAX", time.Hour),
+		IPMaxAttempts:    getEnvInt("IP_MAX_ATTEMPTS", 20),
+		AuditRetention:   getEnvDuration("AUDIT_RETENTION", 90*24*time.Hour),
+
+		LocalAuth:   getEnvBool("LOCAL_AUTH", true),
+		FrontendURL: strings.TrimSuffix(getEnv("FRONTEND_URL", ""), "/"),
+
+		RegistrationMode:    getEnv("REGISTRATION_MODE", "open"),
+		RegistrationDomains: getEnv("REGISTRATION_DOMAINS", ""),
+		UserInvites:         getEnvBool("USER_INVITES", true),
+
+		SMTPHost:             getEnv("SMTP_HOST", ""),
+		SMTPPort:             getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:         getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:         getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:             getEnv("SMTP_FROM", ""),
+		SMTPTLS:              getEnv("SMTP_TLS", "starttls"),
+		MailTemplatesDir:     getEnv("MAIL_TEMPLATES_DIR", ""),
+		EmailVerifyTTL:       getEnvDuration("EMAIL_VERIFY_TTL", 48*time.Hour),
+		PasswordResetTTL:     getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+		RequireVerifiedEmail: getEnvBool("REQUIRE_VERIFIED_EMAIL", false),
+
+		OIDCIssuer:        getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:      getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:   getEnv("OIDC_REDIRECT_URL", ""),
+		OIDCScopes:        getEnv("OIDC_SCOPES", "openid email profile"),
+		OIDCProviderName:  getEnv("OIDC_PROVIDER_NAME", "SSO"),
+		OIDCAutoProvision: getEnvBool("OIDC_AUTO_PROVISION", true),
+		OIDCLinkExisting:  getEnvBool("OIDC_LINK_EXISTING_ACCOUNTS", false),
+
+		LDAPURL:               getEnv("LDAP_URL", ""),
+		LDAPStartTLS:          getEnvBool("LDAP_START_TLS", false),
+		LDAPCAFile:            getEnv("LDAP_CA_FILE", ""),
+		LDAPBindDN:            getEnv("LDAP_BIND_DN", ""),
+		LDAPBindPassword:      getEnv("LDAP_BIND_PASSWORD", ""),
+		LDAPBaseDN:            getEnv("LDAP_BASE_DN", ""),
+		LDAPUserFilter:        getEnv("LDAP_USER_FILTER", "(uid=%s)"),
+		LDAPGroupFilter:       getEnv("LDAP_GROUP_FILTER", ""),
+		LDAPGroupBaseDN:       getEnv("LDAP_GROUP_BASE_DN", ""),
+		LDAPUsernameAttribute: getEnv("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		LDAPEmailAttribute:    getEnv("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		LDAPTrustEmail:        getEnvBool("LDAP_TRUST_EMAIL", false),
+
+		StorageBackend:    getEnv("STORAGE_BACKEND", "local"),
+		S3Bucket:          getEnv("S3_BUCKET", ""),
+		S3Prefix:          getEnv("S3_PREFIX", ""),
+		S3Endpoint:        getEnv("S3_ENDPOINT", ""),
+		S3Region:          getEnv("S3_REGION", "us-east-1"),
+		S3PathStyle:       getEnvBool("S3_PATH_STYLE", false),
+		S3AccessKeyID:     getEnv("S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+
+		DownloadMode:  getEnv("DOWNLOAD_MODE", "stream"),
+		PresignExpiry: getEnvDuration("PRESIGN_EXPIRY", 15*time.Minute),
+
+		EncryptionKeyFile: getEnv("ENCRYPTION_KEY_FILE", ""),
+
+		PartialUploadExpiry: getEnvDuration("PARTIAL_UPLOAD_EXPIRY", 24*time.Hour),
+
+		MaxFileSize:       int64(getEnvInt("MAX_FILE_SIZE", 10*1024*1024)),
+		MaxFilesPerUser:   int64(getEnvInt("MAX_FILES_PER_USER", -1)),
+		MaxStoragePerUser: int64(getEnvInt("MAX_STORAGE_PER_USER", -1)),
+
+		DefaultFileLifetime: getEnvDuration("DEFAULT_FILE_LIFETIME", 24*time.Hour),
+		MaxFileLifetime:     getEnvDuration("MAX_FILE_LIFETIME", 30*24*time.Hour),
+		AllowNeverExpire:    getEnvBool("ALLOW_NEVER_EXPIRE", false),
+
+		SharePasswordMaxAttempts: getEnvInt("SHARE_PASSWORD_MAX_ATTEMPTS", 5),
+		SharePasswordWindow:      getEnvDuration("SHARE_PASSWORD_WINDOW", 15*time.Minute),
+		UnlockTokenTTL:           getEnvDuration("UNLOCK_TOKEN_TTL", 10*time.Minute),
+
+		AnonymousUploads:          getEnvBool("ANONYMOUS_UPLOADS", false),
+		AnonymousMaxFileSize:      int64(getEnvInt("ANONYMOUS_MAX_FILE_SIZE", 5*1024*1024)),
+		AnonymousDefaultLifetime:  getEnvDuration("ANONYMOUS_DEFAULT_LIFETIME", 24*time.Hour),
+		AnonymousMaxLifetime:      getEnvDuration("ANONYMOUS_MAX_LIFETIME", 24*time.Hour),
+		AnonymousAllowNeverExpire: getEnvBool("ANONYMOUS_ALLOW_NEVER_EXPIRE", false),
+		AnonymousUploadsPerWindow: getEnvInt("ANONYMOUS_UPLOADS_PER_WINDOW", 10),
+		AnonymousUploadWindow:     getEnvDuration("ANONYMOUS_UPLOAD_WINDOW", time.Hour),
 	}
 }
 
@@ -26,3 +233,24 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -3,61 +3,163 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func Init(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// DB is a connection pool that accepts queries written for SQLite, with ?
+// placeholders, and rewrites them for the dialect of the database behind it.
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// Tx is a transaction on a DB, rewriting queries the same way.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+// Open connects to the database described by dsn without touching its
+// schema. postgres:// and postgresql:// URLs select PostgreSQL; anything
+// else is the path of a SQLite database, optionally prefixed with
+// sqlite://.
+func Open(dsn string) (*DB, error) {
+	driver, dialect := "sqlite3", SQLite
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		driver, dialect = "postgres", Postgres
+	} else {
+		dsn = sqliteDSN(strings.TrimPrefix(dsn, "sqlite://"))
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	if err := createTables(db); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+	return &DB{DB: db, Dialect: dialect}, nil
+}
+
+// sqliteOptions are added to SQLite DSNs that do not set them. Writers wait
+// for each other instead of failing with "database is locked", and take the
+// write lock when their transaction begins rather than on their first write,
+// where SQLite could only fail one of two readers trying to upgrade. WAL
+// lets readers go on while somebody writes.
+var sqliteOptions = []struct{ name, value string }{
+	{"_busy_timeout", "10000"},
+	{"_txlock", "immediate"},
+	{"_journal_mode", "WAL"},
+}
+
+func sqliteDSN(dsn string) string {
+	_, query, _ := strings.Cut(dsn, "?")
+	params, _ := url.ParseQuery(query)
+	var add []string
+	for _, o := range sqliteOptions {
+		if !params.Has(o.name) {
+			add = append(add, o.name+"="+o.value)
+		}
+	}
+	if len(add) == 0 {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + strings.Join(add, "&")
+}
+
+// Init opens the database and applies any pending migrations.
+func Init(dsn string) (*DB, error) {
+	db, err := Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := MigrateUp(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	return db, nil
 }
 
-func createTables(db *sql.DB) error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS files (
-			id TEXT PRIMARY KEY,
-			user_id INTEGER NOT NULL,
-			filename TEXT NOT NULL,
-			original_filename TEXT NOT NULL,
-			file_size INTEGER NOT NULL,
-			mime_type TEXT NOT NULL,
-			download_token TEXT UNIQUE NOT NULL,
-			download_count INTEGER DEFAULT 0,
-			max_downloads INTEGER DEFAULT -1,
-			expires_at DATETIME,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_files_user_id ON files (user_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_files_download_token ON files (download_token)`,
-		`CREATE INDEX IF NOT EXISTS idx_files_created_at ON files (created_at)`,
-	}
-
-	for _, query := range queries {
-		if _, err := db.Exec(query); err != nil {
-			return fmt.Errorf("failed to execute query: %s, error: %w", query, err)
-		}
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(rebind(db.Dialect, query), args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(rebind(db.Dialect, query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(rebind(db.Dialect, query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.Dialect}, nil
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(rebind(tx.dialect, query), args...)
+}
+
+// rebind turns the ? placeholders in query into $1, $2, ... for PostgreSQL.
+// Question marks inside quoted strings and identifiers are left alone.
+func rebind(dialect Dialect, query string) string {
+	if dialect != Postgres || !strings.Contains(query, "?") {
+		return query
 	}
 
-	return nil
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
 }
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{`SELECT 1`, `SELECT 1`},
+		{`SELECT * FROM users WHERE id = ? AND email = ?`, `SELECT * FROM users WHERE id = $1 AND email = $2`},
+		{`SELECT '?' FROM "weird?" WHERE a = ?`, `SELECT '?' FROM "weird?" WHERE a = $1`},
+		{`UPDATE t SET note = 'it''s ?' WHERE id = ?`, `UPDATE t SET note = 'it''s ?' WHERE id = $1`},
+	}
+	for _, tt := range tests {
+		if got := rebind(Postgres, tt.query); got != tt.want {
+			t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+		if got := rebind(SQLite, tt.query); got != tt.query {
+			t.Errorf("rebind for SQLite changed %q to %q", tt.query, got)
+		}
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"./anonlink.db", "./anonlink.db?_busy_timeout=10000&_txlock=immediate&_journal_mode=WAL"},
+		{"file:test.db?cache=shared", "file:test.db?cache=shared&_busy_timeout=10000&_txlock=immediate&_journal_mode=WAL"},
+		{"test.db?_busy_timeout=1&_journal_mode=DELETE", "test.db?_busy_timeout=1&_journal_mode=DELETE&_txlock=immediate"},
+		{"test.db?_busy_timeout=1&_txlock=deferred&_journal_mode=DELETE", "test.db?_busy_timeout=1&_txlock=deferred&_journal_mode=DELETE"},
+	}
+	for _, tt := range tests {
+		if got := sqliteDSN(tt.dsn); got != tt.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+// TestSQLiteConcurrentTransactions checks that transactions that read before
+// they write wait for each other. With SQLite's default deferred
+// transactions, all but one of them would fail as busy when they upgrade
+// their read lock, whatever the busy timeout.
+func TestSQLiteConcurrentTransactions(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || !strings.EqualFold(mode, "wal") {
+		t.Errorf("journal mode %q, %v; want WAL", mode, err)
+	}
+	if _, err := db.Exec(`CREATE TABLE counter (n INTEGER NOT NULL); INSERT INTO counter VALUES (0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	increment := func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var n int
+		if err := tx.QueryRow(`SELECT n FROM counter`).Scan(&n); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE counter SET n = ?`, n+1); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = increment()
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("transaction %d: %v", i, err)
+		}
+	}
+	var n int
+	if err := db.QueryRow(`SELECT n FROM counter`).Scan(&n); err != nil || n != len(errs) {
+		t.Errorf("counter = %d, %v; want %d", n, err, len(errs))
+	}
+}
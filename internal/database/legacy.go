@@ -0,0 +1,130 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Before schema migrations, Init created missing tables and patched existing
+// ones in place. adoptLegacySchema finishes that patching for a database that
+// was last opened by such a version, so that the initial migration, which
+// only creates what is missing, leaves it matching a fresh database.
+func adoptLegacySchema(db *DB) error {
+	var tables int
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'files'`
+	if err := db.QueryRow(query).Scan(&tables); err != nil {
+		return fmt.Errorf("failed to inspect database: %w", err)
+	}
+	if tables == 0 {
+		return nil
+	}
+
+	if err := addColumns(db); err != nil {
+		return fmt.Errorf("failed to add columns: %w", err)
+	}
+
+	if err := allowAnonymousFiles(db); err != nil {
+		return fmt.Errorf("failed to upgrade files table: %w", err)
+	}
+
+	return nil
+}
+
+// filesTable is the files table as of the initial migration.
+const filesTable = `CREATE TABLE IF NOT EXISTS files (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER,
+			filename TEXT NOT NULL,
+			original_filename TEXT NOT NULL,
+			file_size INTEGER NOT NULL,
+			mime_type TEXT NOT NULL,
+			content_hash TEXT,
+			download_token TEXT UNIQUE NOT NULL,
+			download_count INTEGER DEFAULT 0,
+			max_downloads INTEGER DEFAULT -1,
+			expires_at DATETIME,
+			share_password_hash TEXT,
+			manage_token_hash TEXT,
+			encrypted BOOLEAN NOT NULL DEFAULT 0,
+			encrypted_metadata TEXT,
+			wrapped_data_key TEXT,
+			blob_hash TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`
+
+// addColumns brings tables created by older versions up to date, since
+// CREATE TABLE IF NOT EXISTS in the initial migration leaves existing tables
+// untouched.
+func addColumns(db *DB) error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"users", "quota_bytes", "INTEGER"},
+		{"users", "quota_files", "INTEGER"},
+		{"users", "quota_file_size", "INTEGER"},
+		{"files", "content_hash", "TEXT"},
+		{"files", "share_password_hash", "TEXT"},
+		{"files", "manage_token_hash", "TEXT"},
+		{"files", "encrypted", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"files", "encrypted_metadata", "TEXT"},
+		{"files", "wrapped_data_key", "TEXT"},
+		{"files", "blob_hash", "TEXT"},
+	}
+
+	for _, column := range columns {
+		var count int
+		query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+		if err := db.QueryRow(query, column.table, column.name).Scan(&count); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", column.table, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, column.definition)
+		if _, err := db.Exec(alter); err != nil {
+			return fmt.Errorf("failed to execute query: %s, error: %w", alter, err)
+		}
+	}
+
+	return nil
+}
+
+// allowAnonymousFiles drops the NOT NULL constraint that older versions put
+// on files.user_id. SQLite cannot alter a constraint in place, so the table
+// is rebuilt once.
+func allowAnonymousFiles(db *DB) error {
+	var notNull bool
+	query := `SELECT "notnull" FROM pragma_table_info('files') WHERE name = 'user_id'`
+	if err := db.QueryRow(query).Scan(&notNull); err != nil {
+		return fmt.Errorf("failed to inspect table files: %w", err)
+	}
+	if !notNull {
+		return nil
+	}
+
+	columns := `id, user_id, filename, original_filename, file_size, mime_type, content_hash,
+		download_token, download_count, max_downloads, expires_at, share_password_hash,
+		manage_token_hash, created_at`
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		strings.Replace(filesTable, "IF NOT EXISTS files", "files_new", 1),
+		`INSERT INTO files_new (` + columns + `) SELECT ` + columns + ` FROM files`,
+		`DROP TABLE files`,
+		`ALTER TABLE files_new RENAME TO files`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("failed to execute query: %s, error: %w", query, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// Migration is one schema change, read from a pair of files
+// migrations/<dialect>/<version>_<name>.up.sql and .down.sql. Every dialect
+// has the same list of migrations.
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version   int     `json:"version"`
+	Name      string  `json:"name"`
+	AppliedAt *string `json:"applied_at,omitempty"`
+}
+
+func loadMigrations(dialect Dialect) ([]*Migration, error) {
+	dir := "migrations/" + string(dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		base, direction, ok := cutDirection(entry.Name())
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", entry.Name())
+		}
+		versionText, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionText)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with a positive version number", entry.Name())
+		}
+
+		content, err := fs.ReadFile(migrationFiles, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func cutDirection(filename string) (base, direction string, ok bool) {
+	if base, ok := strings.CutSuffix(filename, ".up.sql"); ok {
+		return base, "up", true
+	}
+	if base, ok := strings.CutSuffix(filename, ".down.sql"); ok {
+		return base, "down", true
+	}
+	return "", "", false
+}
+
+// migrationsLock is the PostgreSQL advisory lock that keeps replicas
+// starting at the same time from migrating concurrently.
+const migrationsLock = 7262
+
+func hasMigrationsTable(db *DB) (bool, error) {
+	var exists int
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`
+	if db.Dialect == Postgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'`
+	}
+	if err := db.QueryRow(query).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to inspect database: %w", err)
+	}
+	return exists > 0, nil
+}
+
+func ensureMigrationsTable(db *DB) error {
+	exists, err := hasMigrationsTable(db)
+	if err != nil || exists {
+		return err
+	}
+
+	if db.Dialect == Postgres {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+		if err := lockMigrations(tx); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+		)`)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// SQLite databases from before migrations have their tables but nothing
+	// that says which version they are at.
+	if err := adoptLegacySchema(db); err != nil {
+		return fmt.Errorf("failed to upgrade pre-migration schema: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// lockMigrations makes tx wait until no other process is migrating the
+// database. SQLite already serialises writers, so it only matters for
+// PostgreSQL.
+func lockMigrations(tx *Tx) error {
+	if tx.dialect != Postgres {
+		return nil
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationsLock); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	return nil
+}
+
+// MigrateUp applies all pending migrations in order, each in its own
+// transaction, and returns the ones it applied.
+func MigrateUp(db *DB) ([]*Migration, error) {
+	migrations, err := loadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	var applied []*Migration
+	for _, m := range migrations {
+		done, err := runMigration(db, m, true)
+		if err != nil {
+			return applied, err
+		}
+		if done {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and
+// returns the ones it reverted.
+func MigrateDown(db *DB, steps int) ([]*Migration, error) {
+	migrations, err := loadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	var reverted []*Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := migrations[i]
+		done, err := runMigration(db, m, false)
+		if err != nil {
+			return reverted, err
+		}
+		if done {
+			reverted = append(reverted, m)
+		}
+	}
+	return reverted, nil
+}
+
+// runMigration applies (up) or reverts (down) m unless that has already
+// happened, reporting whether it did anything. The schema change and its
+// bookkeeping commit together, so a failed migration leaves no trace.
+func runMigration(db *DB, m *Migration, up bool) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockMigrations(tx); err != nil {
+		return false, err
+	}
+
+	var applied int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.Version).Scan(&applied); err != nil {
+		return false, fmt.Errorf("failed to check migration %d: %w", m.Version, err)
+	}
+	if (applied > 0) == up {
+		return false, nil
+	}
+
+	script := m.up
+	bookkeeping := `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`
+	args := []interface{}{m.Version, m.Name}
+	if !up {
+		if m.down == "" {
+			return false, fmt.Errorf("migration %d_%s cannot be reverted", m.Version, m.Name)
+		}
+		script = m.down
+		bookkeeping = `DELETE FROM schema_migrations WHERE version = ?`
+		args = args[:1]
+	}
+
+	if _, err := tx.Exec(script); err != nil {
+		return false, fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+	}
+	if _, err := tx.Exec(bookkeeping, args...); err != nil {
+		return false, fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit migration %d: %w", m.Version, err)
+	}
+	return true, nil
+}
+
+// GetMigrationStatus lists every known migration and when it was applied.
+// Unlike MigrateUp and MigrateDown it leaves the database untouched.
+func GetMigrationStatus(db *DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+func appliedMigrations(db *DB) (map[int]string, error) {
+	appliedAt := make(map[int]string)
+	exists, err := hasMigrationsTable(db)
+	if err != nil || !exists {
+		return appliedAt, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
+		}
+		appliedAt[version] = at
+	}
+	return appliedAt, rows.Err()
+}
@@ -0,0 +1,69 @@
+package database_test
+
+import (
+	"testing"
+
+	"anonlink/internal/database"
+	"anonlink/internal/database/dbtest"
+)
+
+func userTables(t *testing.T, db *database.DB) int {
+	t.Helper()
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name <> 'schema_migrations'`
+	if db.Dialect == database.Postgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables
+		         WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`
+	}
+	var n int
+	if err := db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	for _, dialect := range dbtest.Dialects {
+		t.Run(string(dialect), func(t *testing.T) {
+			db := dbtest.OpenEmpty(t, dialect)
+
+			applied, err := database.MigrateUp(db)
+			if err != nil {
+				t.Fatalf("MigrateUp: %v", err)
+			}
+			status, err := database.GetMigrationStatus(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) == 0 || len(applied) != len(status) {
+				t.Fatalf("applied %d migrations of %d", len(applied), len(status))
+			}
+			for _, s := range status {
+				if s.AppliedAt == nil {
+					t.Errorf("migration %d_%s is not applied", s.Version, s.Name)
+				}
+			}
+			if again, err := database.MigrateUp(db); err != nil || len(again) != 0 {
+				t.Fatalf("second MigrateUp applied %d migrations, err %v", len(again), err)
+			}
+
+			// Going down one step at a time checks every down script
+			// against the schema of the version it belongs to.
+			for i := len(status) - 1; i >= 0; i-- {
+				reverted, err := database.MigrateDown(db, 1)
+				if err != nil {
+					t.Fatalf("MigrateDown: %v", err)
+				}
+				if len(reverted) != 1 || reverted[0].Version != status[i].Version {
+					t.Fatalf("MigrateDown reverted %v, want migration %d", reverted, status[i].Version)
+				}
+			}
+			if n := userTables(t, db); n != 0 {
+				t.Errorf("%d tables left after reverting every migration", n)
+			}
+
+			if _, err := database.MigrateUp(db); err != nil {
+				t.Fatalf("MigrateUp after MigrateDown: %v", err)
+			}
+		})
+	}
+}
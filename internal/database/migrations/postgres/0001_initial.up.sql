@@ -0,0 +1,73 @@
+CREATE TABLE IF NOT EXISTS users (
+	id BIGSERIAL PRIMARY KEY,
+	username TEXT UNIQUE NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	quota_bytes BIGINT,
+	quota_files BIGINT,
+	quota_file_size BIGINT,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),
+	updated_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	id TEXT PRIMARY KEY,
+	user_id BIGINT REFERENCES users (id) ON DELETE CASCADE,
+	filename TEXT NOT NULL,
+	original_filename TEXT NOT NULL,
+	file_size BIGINT NOT NULL,
+	mime_type TEXT NOT NULL,
+	content_hash TEXT,
+	download_token TEXT UNIQUE NOT NULL,
+	download_count BIGINT DEFAULT 0,
+	max_downloads BIGINT DEFAULT -1,
+	expires_at TIMESTAMP,
+	share_password_hash TEXT,
+	manage_token_hash TEXT,
+	encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+	encrypted_metadata TEXT,
+	wrapped_data_key TEXT,
+	blob_hash TEXT,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	storage_key TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	ref_count BIGINT NOT NULL DEFAULT 0,
+	wrapped_data_key TEXT,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE TABLE IF NOT EXISTS share_links (
+	id TEXT PRIMARY KEY,
+	file_id TEXT NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+	token TEXT UNIQUE NOT NULL,
+	label TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMP,
+	max_downloads BIGINT DEFAULT -1,
+	download_count BIGINT DEFAULT 0,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	password_hash TEXT,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+	id TEXT PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	upload_length BIGINT NOT NULL,
+	upload_offset BIGINT NOT NULL DEFAULT 0,
+	filename TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_user_id ON files (user_id);
+CREATE INDEX IF NOT EXISTS idx_files_download_token ON files (download_token);
+CREATE INDEX IF NOT EXISTS idx_files_created_at ON files (created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_files_manage_token_hash ON files (manage_token_hash);
+CREATE INDEX IF NOT EXISTS idx_files_blob_hash ON files (blob_hash);
+CREATE INDEX IF NOT EXISTS idx_share_links_file_id ON share_links (file_id);
+CREATE INDEX IF NOT EXISTS idx_uploads_expires_at ON uploads (expires_at);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),
+	UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities (user_id);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS invites (
+	id TEXT PRIMARY KEY,
+	user_id BIGINT REFERENCES users (id) ON DELETE CASCADE,
+	prefix TEXT NOT NULL,
+	code_hash TEXT UNIQUE NOT NULL,
+	max_uses INTEGER NOT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS idx_invites_user_id ON invites (user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS audit_log;
+ALTER TABLE users DROP COLUMN locked_until;
+ALTER TABLE users DROP COLUMN last_failed_login_at;
+ALTER TABLE users DROP COLUMN failed_logins;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS uploads;
+DROP TABLE IF EXISTS share_links;
+DROP TABLE IF EXISTS blobs;
+DROP TABLE IF EXISTS files;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,76 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	quota_bytes INTEGER,
+	quota_files INTEGER,
+	quota_file_size INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER,
+	filename TEXT NOT NULL,
+	original_filename TEXT NOT NULL,
+	file_size INTEGER NOT NULL,
+	mime_type TEXT NOT NULL,
+	content_hash TEXT,
+	download_token TEXT UNIQUE NOT NULL,
+	download_count INTEGER DEFAULT 0,
+	max_downloads INTEGER DEFAULT -1,
+	expires_at DATETIME,
+	share_password_hash TEXT,
+	manage_token_hash TEXT,
+	encrypted BOOLEAN NOT NULL DEFAULT 0,
+	encrypted_metadata TEXT,
+	wrapped_data_key TEXT,
+	blob_hash TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	storage_key TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	ref_count INTEGER NOT NULL DEFAULT 0,
+	wrapped_data_key TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS share_links (
+	id TEXT PRIMARY KEY,
+	file_id TEXT NOT NULL,
+	token TEXT UNIQUE NOT NULL,
+	label TEXT NOT NULL DEFAULT '',
+	expires_at DATETIME,
+	max_downloads INTEGER DEFAULT -1,
+	download_count INTEGER DEFAULT 0,
+	revoked BOOLEAN NOT NULL DEFAULT 0,
+	password_hash TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	upload_length INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	filename TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_user_id ON files (user_id);
+CREATE INDEX IF NOT EXISTS idx_files_download_token ON files (download_token);
+CREATE INDEX IF NOT EXISTS idx_files_created_at ON files (created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_files_manage_token_hash ON files (manage_token_hash);
+CREATE INDEX IF NOT EXISTS idx_files_blob_hash ON files (blob_hash);
+CREATE INDEX IF NOT EXISTS idx_share_links_file_id ON share_links (file_id);
+CREATE INDEX IF NOT EXISTS idx_uploads_expires_at ON uploads (expires_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS used_refresh_tokens;
+DROP TABLE IF EXISTS sessions;
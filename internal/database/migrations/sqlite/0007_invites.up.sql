@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS invites (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER,
+	prefix TEXT NOT NULL,
+	code_hash TEXT UNIQUE NOT NULL,
+	max_uses INTEGER NOT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_invites_user_id ON invites (user_id);
@@ -0,0 +1,9 @@
+-- Resumable uploads are kept in storage one chunk per PATCH, so that any
+-- instance can take the next chunk. This is the order to put them back in.
+CREATE TABLE IF NOT EXISTS upload_chunks (
+	upload_id TEXT NOT NULL,
+	upload_offset INTEGER NOT NULL,
+	storage_key TEXT NOT NULL,
+	PRIMARY KEY (upload_id, upload_offset),
+	FOREIGN KEY (upload_id) REFERENCES uploads (id) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+-- Counters of the rate limits on logins, share link passwords, TOTP codes,
+-- anonymous uploads and emails, kept here so that replicas share them.
+CREATE TABLE IF NOT EXISTS rate_limits (
+	scope TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	expires_at DATETIME NOT NULL,
+	blocked_until DATETIME,
+	PRIMARY KEY (scope, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_expires_at ON rate_limits (expires_at);
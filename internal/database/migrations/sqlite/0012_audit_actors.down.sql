@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_audit_log_actor_id;
+ALTER TABLE audit_log DROP COLUMN actor_username;
+ALTER TABLE audit_log DROP COLUMN actor_id;
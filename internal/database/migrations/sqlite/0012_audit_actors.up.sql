@@ -0,0 +1,6 @@
+-- Who did what an event records, when that is not the user
+-- it is about, such as an administrator suspending them.
+ALTER TABLE audit_log ADD COLUMN actor_id INTEGER;
+ALTER TABLE audit_log ADD COLUMN actor_username TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON audit_log (actor_id);
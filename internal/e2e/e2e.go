@@ -0,0 +1,294 @@
+// Package e2e is the reference implementation of the format used for
+// end-to-end encrypted uploads. Clients encrypt before uploading and keep the
+// key in the URL fragment, so the server only ever handles ciphertext and
+// never needs this package itself.
+//
+// Content is split into chunks of ChunkSize bytes, each sealed with
+// AES-256-GCM under a key derived from the file key. The nonce is the chunk
+// index plus a flag marking the final chunk, which makes reordering,
+// dropping or truncating chunks detectable. The stream starts with a short
+// header that is authenticated along with every chunk:
+//
+//	magic "ANE1" | chunk size (uint32, big endian) | chunk 0 | chunk 1 | ...
+//
+// Metadata (filename and MIME type) is JSON sealed under a second derived key
+// with a random nonce, and travels as base64url(nonce | ciphertext).
+package e2e
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	KeySize   = 32
+	ChunkSize = 64 * 1024
+
+	magic      = "ANE1"
+	headerSize = len(magic) + 4
+	tagSize    = 16
+	nonceSize  = 12
+)
+
+var (
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrInvalidFormat = errors.New("not an encrypted stream")
+	ErrDecrypt       = errors.New("decryption failed")
+)
+
+// Key is a file key. Its String form is what goes into the URL fragment.
+type Key [KeySize]byte
+
+func NewKey() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+func ParseKey(s string) (Key, error) {
+	var k Key
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(raw) != KeySize {
+		return Key{}, ErrInvalidKey
+	}
+	copy(k[:], raw)
+	return k, nil
+}
+
+func (k Key) String() string {
+	return base64.RawURLEncoding.EncodeToString(k[:])
+}
+
+func (k Key) aead(purpose string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k[:])
+	mac.Write([]byte("anonlink e2e " + purpose))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Metadata is what the server would otherwise store in the clear.
+type Metadata struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+}
+
+func EncryptMetadata(k Key, m Metadata) (string, error) {
+	aead, err := k.aead("metadata")
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptMetadata(k Key, encrypted string) (Metadata, error) {
+	var m Metadata
+	aead, err := k.aead("metadata")
+	if err != nil {
+		return m, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < nonceSize+tagSize {
+		return m, ErrInvalidFormat
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return m, ErrDecrypt
+	}
+	if err := json.Unmarshal(plaintext, &m); err != nil {
+		return m, fmt.Errorf("%w: %s", ErrDecrypt, err)
+	}
+	return m, nil
+}
+
+// EncryptedSize returns the size of the stream NewWriter produces for size
+// bytes of plaintext.
+func EncryptedSize(size int64) int64 {
+	chunks := size/ChunkSize + 1
+	if size > 0 && size%ChunkSize == 0 {
+		chunks--
+	}
+	return int64(headerSize) + size + chunks*tagSize
+}
+
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+// NewWriter returns a writer that encrypts to w. Close must be called to
+// write the final chunk; it does not close w.
+func NewWriter(w io.Writer, k Key) (io.WriteCloser, error) {
+	aead, err := k.aead("content")
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[len(magic):], ChunkSize)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &writer{w: w, aead: aead, header: header, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("e2e: write after close")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so that the
+		// last chunk is always the one Close marks as final.
+		if len(e.buf) == ChunkSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):ChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+func (e *writer) flush(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.index, final), e.buf, e.header)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  []byte
+	next   []byte
+	plain  []byte
+	index  uint64
+	done   bool
+}
+
+// NewReader returns a reader that decrypts the stream in r. It fails with
+// ErrDecrypt if the stream was tampered with or cut short.
+func NewReader(r io.Reader, k Key) (io.Reader, error) {
+	aead, err := k.aead("content")
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidFormat
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return nil, ErrInvalidFormat
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(magic):])
+	if chunkSize == 0 || chunkSize > 16*1024*1024 {
+		return nil, ErrInvalidFormat
+	}
+
+	d := &reader{r: r, aead: aead, header: header, chunk: make([]byte, int(chunkSize)+tagSize)}
+	// Keep one byte of lookahead to know whether a chunk is the last one.
+	d.next = make([]byte, 0, 1)
+	return d, nil
+}
+
+func (d *reader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *reader) readChunk() error {
+	n := copy(d.chunk, d.next)
+	m, err := io.ReadFull(d.r, d.chunk[n:])
+	n += m
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	final := n < len(d.chunk)
+	if !final {
+		d.next = d.next[:1]
+		if _, err := io.ReadFull(d.r, d.next); err == io.EOF {
+			final = true
+			d.next = d.next[:0]
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return ErrDecrypt
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.index, final), d.chunk[:n], d.header)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.index++
+	d.plain = plain
+	d.done = final
+	return nil
+}
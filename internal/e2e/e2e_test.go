@@ -0,0 +1,210 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+const sealedChunkSize = ChunkSize + tagSize
+
+func encrypt(t *testing.T, k Key, plaintext []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, k)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(k Key, stream []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(stream), k)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func newKey(t *testing.T) Key {
+	t.Helper()
+	k, err := NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	return k
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := newKey(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize, 3*ChunkSize + 1} {
+		plaintext := randomBytes(t, size)
+		stream := encrypt(t, k, plaintext)
+		if int64(len(stream)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: stream is %d bytes, EncryptedSize says %d", size, len(stream), EncryptedSize(int64(size)))
+		}
+
+		got, err := decrypt(k, stream)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: decrypted plaintext differs", size)
+		}
+	}
+}
+
+func TestRoundTripInSmallWrites(t *testing.T) {
+	k := newKey(t)
+	plaintext := randomBytes(t, 2*ChunkSize+100)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decrypt(k, buf.Bytes())
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("decrypted plaintext differs")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	k := newKey(t)
+	stream := encrypt(t, k, randomBytes(t, 2*ChunkSize+10))
+	chunk := func(i int) []byte {
+		start := headerSize + i*sealedChunkSize
+		end := start + sealedChunkSize
+		if end > len(stream) {
+			end = len(stream)
+		}
+		return stream[start:end]
+	}
+
+	tests := []struct {
+		name   string
+		stream func() []byte
+	}{
+		{"flipped bit", func() []byte {
+			s := append([]byte(nil), stream...)
+			s[headerSize+ChunkSize/2] ^= 1
+			return s
+		}},
+		{"flipped bit in header", func() []byte {
+			s := append([]byte(nil), stream...)
+			s[len(magic)+3] ^= 1
+			return s
+		}},
+		{"truncated final chunk", func() []byte {
+			return stream[:len(stream)-1]
+		}},
+		{"final chunk dropped", func() []byte {
+			return stream[:headerSize+2*sealedChunkSize]
+		}},
+		{"chunks reordered", func() []byte {
+			s := append([]byte(nil), stream[:headerSize]...)
+			s = append(s, chunk(1)...)
+			s = append(s, chunk(0)...)
+			return append(s, chunk(2)...)
+		}},
+		{"extra chunk appended", func() []byte {
+			return append(append([]byte(nil), stream...), chunk(2)...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decrypt(k, tt.stream())
+			if err == nil {
+				t.Fatal("decrypt succeeded")
+			}
+			if !errors.Is(err, ErrDecrypt) && !errors.Is(err, ErrInvalidFormat) {
+				t.Errorf("err = %v, want ErrDecrypt or ErrInvalidFormat", err)
+			}
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	stream := encrypt(t, newKey(t), []byte("hello"))
+	if _, err := decrypt(newKey(t), stream); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("decrypt with the wrong key: err = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestNotAStream(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("plain text, not encrypted")), newKey(t)); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("err = %v, want ErrInvalidFormat", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	k := newKey(t)
+	m := Metadata{Filename: "report \"final\".pdf", MimeType: "application/pdf"}
+
+	encrypted, err := EncryptMetadata(k, m)
+	if err != nil {
+		t.Fatalf("EncryptMetadata: %v", err)
+	}
+	got, err := DecryptMetadata(k, encrypted)
+	if err != nil {
+		t.Fatalf("DecryptMetadata: %v", err)
+	}
+	if got != m {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+
+	if _, err := DecryptMetadata(newKey(t), encrypted); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong key: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := DecryptMetadata(k, "not base64!"); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("garbage: err = %v, want ErrInvalidFormat", err)
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	k := newKey(t)
+	parsed, err := ParseKey(k.String())
+	if err != nil {
+		t.Fatalf("ParseKey: %v", err)
+	}
+	if parsed != k {
+		t.Error("ParseKey(k.String()) != k")
+	}
+	if _, err := ParseKey("short"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("ParseKey(short): err = %v, want ErrInvalidKey", err)
+	}
+}
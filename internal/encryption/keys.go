@@ -0,0 +1,122 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrUnknownMasterKey = errors.New("data key was wrapped with an unknown master key")
+
+// KeyProvider wraps and unwraps data keys with a master key that never
+// leaves it. Wrapped keys record which master key they were made with, so a
+// provider can keep unwrapping under old keys after a rotation.
+type KeyProvider interface {
+	// WrapKey encrypts dataKey under the current master key.
+	WrapKey(dataKey []byte) (string, error)
+	// UnwrapKey decrypts a key produced by WrapKey under any known master key.
+	UnwrapKey(wrapped string) ([]byte, error)
+	// NeedsRewrap reports whether wrapped was made with a master key other
+	// than the current one.
+	NeedsRewrap(wrapped string) bool
+}
+
+// LocalKeys is a KeyProvider backed by master keys read from a file, one per
+// line as "<id> <base64 key>". The first key is the current one; the others
+// are only kept around to unwrap data keys that have not been re-wrapped yet.
+// Blank lines and lines starting with # are ignored.
+type LocalKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func LoadLocalKeys(path string) (*LocalKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer f.Close()
+
+	lk := &LocalKeys{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("key file line %d: expected \"<id> <base64 key>\"", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != DataKeySize {
+			return nil, fmt.Errorf("key file line %d: key must be %d bytes of base64", line, DataKeySize)
+		}
+		if _, ok := lk.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("key file line %d: duplicate key id %q", line, fields[0])
+		}
+
+		lk.keys[fields[0]] = key
+		if lk.current == "" {
+			lk.current = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if lk.current == "" {
+		return nil, errors.New("key file contains no keys")
+	}
+
+	return lk, nil
+}
+
+// WrapKey returns "<id>:<base64url(nonce | sealed key)>", with the id also
+// authenticated so a wrapped key cannot be passed off under another id.
+func (lk *LocalKeys) WrapKey(dataKey []byte) (string, error) {
+	aead, err := newAEAD(lk.keys[lk.current])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(lk.current))
+	return lk.current + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (lk *LocalKeys) UnwrapKey(wrapped string) ([]byte, error) {
+	id, encoded, ok := strings.Cut(wrapped, ":")
+	if !ok {
+		return nil, ErrInvalidFormat
+	}
+	masterKey, ok := lk.keys[id]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < nonceSize+tagSize {
+		return nil, ErrInvalidFormat
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(id))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dataKey, nil
+}
+
+func (lk *LocalKeys) NeedsRewrap(wrapped string) bool {
+	id, _, _ := strings.Cut(wrapped, ":")
+	return id != lk.current
+}
@@ -0,0 +1,123 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a key file with a fresh master key for each id, the
+// first one current, and returns its path.
+func writeKeyFile(t *testing.T, masterKeys map[string][]byte, ids ...string) string {
+	t.Helper()
+	var lines []string
+	for _, id := range ids {
+		if _, ok := masterKeys[id]; !ok {
+			masterKeys[id] = newKey(t)
+		}
+		lines = append(lines, id+" "+base64.StdEncoding.EncodeToString(masterKeys[id]))
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# master keys\n\n" + strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadKeys(t *testing.T, path string) *LocalKeys {
+	t.Helper()
+	keys, err := LoadLocalKeys(path)
+	if err != nil {
+		t.Fatalf("LoadLocalKeys: %v", err)
+	}
+	return keys
+}
+
+func TestLocalKeysRotation(t *testing.T) {
+	masterKeys := make(map[string][]byte)
+	old := loadKeys(t, writeKeyFile(t, masterKeys, "2023"))
+	rotated := loadKeys(t, writeKeyFile(t, masterKeys, "2024", "2023"))
+	fresh := loadKeys(t, writeKeyFile(t, masterKeys, "2024"))
+
+	dataKey := newKey(t)
+	wrapped, err := old.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(wrapped, "2023:") || strings.Contains(wrapped, base64.RawURLEncoding.EncodeToString(dataKey)) {
+		t.Fatalf("wrapped key %q", wrapped)
+	}
+	if old.NeedsRewrap(wrapped) || !rotated.NeedsRewrap(wrapped) {
+		t.Error("NeedsRewrap does not follow the current key")
+	}
+
+	// The rotated provider still reads keys wrapped under the old master
+	// key, and wraps new ones under the current one.
+	unwrapped, err := rotated.UnwrapKey(wrapped)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("UnwrapKey after rotation = %x, %v", unwrapped, err)
+	}
+	rewrapped, err := rotated.WrapKey(unwrapped)
+	if err != nil || !strings.HasPrefix(rewrapped, "2024:") || rotated.NeedsRewrap(rewrapped) {
+		t.Fatalf("WrapKey after rotation = %q, %v", rewrapped, err)
+	}
+
+	if got, err := fresh.UnwrapKey(rewrapped); err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("UnwrapKey with only the new key = %x, %v", got, err)
+	}
+	if _, err := fresh.UnwrapKey(wrapped); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("UnwrapKey of an old key without the old master key: err = %v, want ErrUnknownMasterKey", err)
+	}
+	if _, err := old.UnwrapKey(rewrapped); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("UnwrapKey of a new key with only the old master key: err = %v, want ErrUnknownMasterKey", err)
+	}
+}
+
+func TestLocalKeysRejectTampering(t *testing.T) {
+	masterKeys := make(map[string][]byte)
+	keys := loadKeys(t, writeKeyFile(t, masterKeys, "a", "b"))
+	wrapped, err := keys.WrapKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sealed, _ := strings.Cut(wrapped, ":")
+
+	// The id is authenticated, so a key cannot be passed off as another's.
+	if _, err := keys.UnwrapKey("b:" + sealed); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("relabelled key: err = %v, want ErrDecrypt", err)
+	}
+	raw, _ := base64.RawURLEncoding.DecodeString(sealed)
+	raw[len(raw)-1] ^= 1
+	if _, err := keys.UnwrapKey("a:" + base64.RawURLEncoding.EncodeToString(raw)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("flipped bit: err = %v, want ErrDecrypt", err)
+	}
+	for _, bad := range []string{"no-separator", "a:!!!", "a:" + sealed[:10]} {
+		if _, err := keys.UnwrapKey(bad); !errors.Is(err, ErrInvalidFormat) {
+			t.Errorf("UnwrapKey(%q): err = %v, want ErrInvalidFormat", bad, err)
+		}
+	}
+}
+
+func TestLoadLocalKeysRejectsBadFiles(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, DataKeySize))
+	for name, content := range map[string]string{
+		"empty":        "# nothing here\n",
+		"no key":       "a\n",
+		"short key":    "a " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+		"colon in id":  "a:b " + key + "\n",
+		"duplicate id": "a " + key + "\na " + key + "\n",
+	} {
+		path := filepath.Join(t.TempDir(), "keys")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadLocalKeys(path); err == nil {
+			t.Errorf("%s: LoadLocalKeys succeeded", name)
+		}
+	}
+}
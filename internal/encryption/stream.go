@@ -0,0 +1,254 @@
+// Package encryption implements envelope encryption for stored blobs. Every
+// file gets its own random data key; the data key is wrapped by a
+// KeyProvider and stored next to the file's metadata, so rotating the master
+// key only means re-wrapping data keys, never rewriting blobs.
+//
+// Blobs are split into segments of SegmentSize bytes, each sealed on its own
+// with AES-256-GCM. The nonce is the segment index plus a flag for the final
+// segment, so segments cannot be reordered, dropped or cut off, and any
+// segment can be decrypted without reading the ones before it:
+//
+//	magic "ANS1" | segment size (uint32, big endian) | segment 0 | segment 1 | ...
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	DataKeySize = 32
+	SegmentSize = 64 * 1024
+
+	magic      = "ANS1"
+	headerSize = len(magic) + 4
+	tagSize    = 16
+	nonceSize  = 12
+)
+
+var (
+	ErrInvalidFormat = errors.New("not an encrypted blob")
+	ErrDecrypt       = errors.New("decryption failed")
+)
+
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func header() []byte {
+	h := make([]byte, headerSize)
+	copy(h, magic)
+	binary.BigEndian.PutUint32(h[len(magic):], SegmentSize)
+	return h
+}
+
+func segmentNonce(index int64, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// PlaintextSize returns the size of the plaintext in a blob of size bytes.
+func PlaintextSize(size int64) (int64, error) {
+	body := size - int64(headerSize)
+	if body < tagSize {
+		return 0, ErrInvalidFormat
+	}
+	segments := (body + SegmentSize + tagSize - 1) / (SegmentSize + tagSize)
+	plain := body - segments*tagSize
+	if plain < 0 {
+		return 0, ErrInvalidFormat
+	}
+	return plain, nil
+}
+
+type encrypter struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	header []byte
+	plain  []byte
+	out    []byte
+	index  int64
+	done   bool
+}
+
+// Encrypt returns a reader that yields src encrypted under key.
+func Encrypt(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	h := header()
+	return &encrypter{
+		src:    src,
+		aead:   aead,
+		header: h,
+		plain:  make([]byte, 0, SegmentSize+1),
+		out:    append([]byte(nil), h...),
+	}, nil
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encrypter) seal() error {
+	// Read one byte past the segment to find out whether it is the last.
+	n, err := io.ReadFull(e.src, e.plain[len(e.plain):SegmentSize+1])
+	e.plain = e.plain[:len(e.plain)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	final := len(e.plain) <= SegmentSize
+	segment := e.plain
+	if !final {
+		segment = e.plain[:SegmentSize]
+	}
+	e.out = e.aead.Seal(e.out[:0], segmentNonce(e.index, final), segment, e.header)
+	e.index++
+	e.done = final
+
+	if !final {
+		e.plain[0] = e.plain[SegmentSize]
+		e.plain = e.plain[:1]
+	}
+	return nil
+}
+
+type decrypter struct {
+	src      io.ReadSeeker
+	aead     cipher.AEAD
+	header   []byte
+	size     int64
+	segments int64
+	offset   int64
+	loaded   int64
+	plain    []byte
+	sealed   []byte
+}
+
+// Decrypt returns a ReadSeeker over the plaintext of the blob in src, which
+// is size bytes long. Only the segments actually read are decrypted, so
+// seeking to serve a range is cheap.
+func Decrypt(src io.ReadSeeker, size int64, key []byte) (io.ReadSeeker, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plainSize, err := PlaintextSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, h); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if !bytes.Equal(h, header()) {
+		return nil, ErrInvalidFormat
+	}
+
+	segments := plainSize/SegmentSize + 1
+	if plainSize > 0 && plainSize%SegmentSize == 0 {
+		segments--
+	}
+	return &decrypter{
+		src:      src,
+		aead:     aead,
+		header:   h,
+		size:     plainSize,
+		segments: segments,
+		loaded:   -1,
+		sealed:   make([]byte, SegmentSize+tagSize),
+	}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.offset / SegmentSize
+	if index != d.loaded {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.offset-index*SegmentSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *decrypter) load(index int64) error {
+	if _, err := d.src.Seek(int64(headerSize)+index*(SegmentSize+tagSize), io.SeekStart); err != nil {
+		return err
+	}
+
+	length := d.size - index*SegmentSize
+	if length > SegmentSize {
+		length = SegmentSize
+	}
+	sealed := d.sealed[:length+tagSize]
+	if _, err := io.ReadFull(d.src, sealed); err != nil {
+		return fmt.Errorf("failed to read segment: %w", err)
+	}
+
+	plain, err := d.aead.Open(d.plain[:0], segmentNonce(index, index == d.segments-1), sealed, d.header)
+	if err != nil {
+		d.loaded = -1
+		return ErrDecrypt
+	}
+	d.plain = plain
+	d.loaded = index
+	return nil
+}
+
+func (d *decrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("encryption: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encryption: negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
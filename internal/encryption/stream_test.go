@@ -0,0 +1,164 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func seal(t *testing.T, plain, key []byte) []byte {
+	t.Helper()
+	r, err := Encrypt(bytes.NewReader(plain), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A small buffer makes the encrypter hand out segments in pieces.
+	var blob bytes.Buffer
+	if _, err := io.CopyBuffer(&blob, struct{ io.Reader }{r}, make([]byte, 1000)); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return blob.Bytes()
+}
+
+func open(t *testing.T, blob, key []byte) io.ReadSeeker {
+	t.Helper()
+	r, err := Decrypt(bytes.NewReader(blob), int64(len(blob)), key)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	return r
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17} {
+		plain := randomBytes(t, size)
+		blob := seal(t, plain, key)
+
+		segments := size/SegmentSize + 1
+		if size > 0 && size%SegmentSize == 0 {
+			segments--
+		}
+		if want := headerSize + size + segments*tagSize; len(blob) != want {
+			t.Errorf("%d bytes: blob of %d bytes, want %d", size, len(blob), want)
+		}
+		if n, err := PlaintextSize(int64(len(blob))); err != nil || n != int64(size) {
+			t.Errorf("%d bytes: PlaintextSize = %d, %v", size, n, err)
+		}
+
+		got, err := io.ReadAll(open(t, blob, key))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: plaintext differs after the round trip", size)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	key := newKey(t)
+	plain := randomBytes(t, 3*SegmentSize+500)
+	r := open(t, seal(t, plain, key), key)
+
+	for _, rng := range []struct{ start, end int64 }{
+		{100, 200},                                 // within the first segment
+		{SegmentSize - 10, SegmentSize + 10},       // across a boundary
+		{SegmentSize / 2, 2*SegmentSize + 1234},    // mid-segment to mid-segment
+		{3*SegmentSize + 100, 3*SegmentSize + 500}, // to the end
+		{0, 1},
+	} {
+		if _, err := r.Seek(rng.start, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, rng.end-rng.start)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("reading %d-%d: %v", rng.start, rng.end, err)
+		}
+		if !bytes.Equal(got, plain[rng.start:rng.end]) {
+			t.Errorf("bytes %d-%d differ", rng.start, rng.end)
+		}
+	}
+
+	if pos, err := r.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(plain))-10 {
+		t.Fatalf("Seek from the end = %d, %v", pos, err)
+	}
+	if pos, err := r.Seek(-SegmentSize, io.SeekCurrent); err != nil || pos != int64(len(plain))-10-SegmentSize {
+		t.Fatalf("Seek back = %d, %v", pos, err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(rest, plain[len(plain)-10-SegmentSize:]) {
+		t.Errorf("reading after seeking back: %v", err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seeking before the start succeeded")
+	}
+}
+
+func TestTamperDetection(t *testing.T) {
+	key := newKey(t)
+	plain := randomBytes(t, 2*SegmentSize+100)
+	blob := seal(t, plain, key)
+	sealedSegment := SegmentSize + tagSize
+
+	flipped := append([]byte(nil), blob...)
+	flipped[headerSize+sealedSegment+5] ^= 1
+
+	// Dropping the final segment leaves a blob whose last segment was not
+	// sealed as the final one.
+	dropped := blob[:headerSize+2*sealedSegment]
+
+	swapped := append([]byte(nil), blob[:headerSize]...)
+	swapped = append(swapped, blob[headerSize+sealedSegment:headerSize+2*sealedSegment]...)
+	swapped = append(swapped, blob[headerSize:headerSize+sealedSegment]...)
+	swapped = append(swapped, blob[headerSize+2*sealedSegment:]...)
+
+	truncated := blob[:len(blob)-1]
+
+	otherKey := newKey(t)
+
+	for name, c := range map[string]struct {
+		blob []byte
+		key  []byte
+	}{
+		"flipped byte":          {flipped, key},
+		"dropped final segment": {dropped, key},
+		"swapped segments":      {swapped, key},
+		"truncated":             {truncated, key},
+		"wrong key":             {blob, otherKey},
+	} {
+		_, err := io.ReadAll(open(t, c.blob, c.key))
+		if !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: err = %v, want ErrDecrypt", name, err)
+		}
+	}
+
+	badHeader := append([]byte(nil), blob...)
+	badHeader[0] = 'X'
+	if _, err := Decrypt(bytes.NewReader(badHeader), int64(len(badHeader)), key); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("bad header: err = %v, want ErrInvalidFormat", err)
+	}
+	if _, err := Decrypt(bytes.NewReader(blob[:headerSize+tagSize-1]), int64(headerSize+tagSize-1), key); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("too short: err = %v, want ErrInvalidFormat", err)
+	}
+}
@@ -0,0 +1,83 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Stats describes what the whole instance stores. Bytes counts every file
+// at its full size, while StoredBytes is what is left after files with the
+// same content share a blob.
+type Stats struct {
+	Files          int64       `json:"files"`
+	Bytes          int64       `json:"bytes"`
+	AnonymousFiles int64       `json:"anonymous_files"`
+	AnonymousBytes int64       `json:"anonymous_bytes"`
+	Blobs          int64       `json:"blobs"`
+	StoredBytes    int64       `json:"stored_bytes"`
+	ShareLinks     int64       `json:"share_links"`
+	PendingUploads int64       `json:"pending_uploads"`
+	TopUsers       []UserUsage `json:"top_users"`
+}
+
+type UserUsage struct {
+	UserID    int   `json:"user_id"`
+	UsedBytes int64 `json:"used_bytes"`
+	FileCount int64 `json:"file_count"`
+}
+
+// The methods below are for administrators and do not check who owns a
+// file.
+
+func (s *Service) ListAllFiles(limit, offset int) ([]*File, error) {
+	return s.repo.ListAllFiles(limit, offset)
+}
+
+func (s *Service) GetStats(topUsers int) (*Stats, error) {
+	return s.repo.Stats(topUsers)
+}
+
+// RemoveFile deletes anyone's file.
+func (s *Service) RemoveFile(fileID string) error {
+	return s.removeFile(fileID)
+}
+
+// ExpireFile makes the file and all of its share links expire now. The file
+// itself is deleted by the next cleanup.
+func (s *Service) ExpireFile(fileID string) (*File, error) {
+	now := formatTimestamp(time.Now().Add(-time.Second))
+	if err := s.repo.SetExpiry(fileID, &now); err != nil {
+		return nil, fmt.Errorf("failed to update expiry: %w", err)
+	}
+	return s.repo.GetFile(fileID)
+}
+
+// DeleteUserFiles deletes everything the user has stored, including their
+// unfinished uploads, before their account is deleted.
+func (s *Service) DeleteUserFiles(userID int) error {
+	if userID == 0 {
+		return errors.New("anonymous uploads have no owner to delete")
+	}
+
+	uploads, err := s.repo.ListUserUploads(userID)
+	if err != nil {
+		return fmt.Errorf("failed to list uploads: %w", err)
+	}
+	for _, id := range uploads {
+		if err := s.removeUpload(id); err != nil && !errors.Is(err, ErrUploadNotFound) {
+			return fmt.Errorf("failed to delete upload: %w", err)
+		}
+	}
+
+	files, err := s.repo.ListFiles(userID)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	for _, file := range files {
+		if err := s.removeFile(file.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
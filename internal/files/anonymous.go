@@ -0,0 +1,64 @@
+package files
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidManageToken = errors.New("invalid management token")
+
+// UploadAnonymousFile stores a file that belongs to no account. The returned
+// management token is the only way to delete the file or change its settings
+// later; only its hash is kept, so it cannot be recovered once lost.
+func (s *Service) UploadAnonymousFile(meta FileMetadata, r io.Reader, maxSize int64, settings FileSettings) (*File, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("failed to generate management token: %w", err)
+	}
+	manageToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	file, err := s.uploadFile(0, meta, r, maxSize, settings, s.anonPolicy, hashManageToken(manageToken))
+	if err != nil {
+		return nil, "", err
+	}
+	return file, manageToken, nil
+}
+
+func (s *Service) GetFileByManageToken(manageToken string) (*File, error) {
+	file, err := s.repo.GetFileByManageTokenHash(hashManageToken(manageToken))
+	if err != nil {
+		return nil, ErrInvalidManageToken
+	}
+	if expired(file.ExpiresAt) {
+		return nil, ErrInvalidManageToken
+	}
+	return file, nil
+}
+
+// UpdateAnonymousFile changes the settings of an anonymous upload within the
+// limits of the anonymous ExpiryPolicy.
+func (s *Service) UpdateAnonymousFile(manageToken string, settings FileSettings) (*File, error) {
+	file, err := s.GetFileByManageToken(manageToken)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateFileSettings(file, settings, s.anonPolicy)
+}
+
+func (s *Service) DeleteAnonymousFile(manageToken string) error {
+	file, err := s.GetFileByManageToken(manageToken)
+	if err != nil {
+		return err
+	}
+	return s.removeFile(file.ID)
+}
+
+func hashManageToken(manageToken string) string {
+	sum := sha256.Sum256([]byte(manageToken))
+	return hex.EncodeToString(sum[:])
+}
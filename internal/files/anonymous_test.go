@@ -0,0 +1,94 @@
+package files
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"anonlink/internal/storage"
+)
+
+func uploadAnonymous(t *testing.T, s *Service, content string, settings FileSettings) (*File, string) {
+	t.Helper()
+	file, manageToken, err := s.UploadAnonymousFile(FileMetadata{OriginalFilename: "cat.gif"}, strings.NewReader(content), 1<<20, settings)
+	if err != nil {
+		t.Fatalf("UploadAnonymousFile: %v", err)
+	}
+	return file, manageToken
+}
+
+func TestAnonymousUpload(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		store, err := storage.NewLocal(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewService(rt.repo, store, Options{
+			Policy:          ExpiryPolicy{DefaultLifetime: 7 * 24 * time.Hour},
+			AnonymousPolicy: ExpiryPolicy{DefaultLifetime: time.Hour, MaxLifetime: 2 * time.Hour},
+			Quota:           unlimited,
+		})
+
+		file, manageToken := uploadAnonymous(t, s, "meow", FileSettings{})
+		if file.UserID != 0 || manageToken == "" {
+			t.Fatalf("uploaded %+v with management token %q", file, manageToken)
+		}
+		// The anonymous policy applies, not the one for users.
+		expiresAt, err := parseTimestamp(*file.ExpiresAt)
+		if err != nil || time.Until(expiresAt) > time.Hour {
+			t.Errorf("expires at %s, want within the anonymous default of an hour", *file.ExpiresAt)
+		}
+		in := 3 * time.Hour
+		if _, _, err := s.UploadAnonymousFile(FileMetadata{}, strings.NewReader("meow"), 1<<20, FileSettings{ExpiresIn: &in}); !errors.Is(err, ErrInvalidSettings) {
+			t.Errorf("past the anonymous maximum: err = %v, want ErrInvalidSettings", err)
+		}
+
+		// Only the hash of the token is stored, so the token itself finds
+		// nothing in the repository.
+		if _, err := rt.repo.GetFileByManageTokenHash(manageToken); err == nil {
+			t.Error("file found by the plain management token")
+		}
+		if stored, err := rt.repo.GetFileByManageTokenHash(hashManageToken(manageToken)); err != nil || stored.ID != file.ID {
+			t.Errorf("GetFileByManageTokenHash = %+v, %v", stored, err)
+		}
+
+		// Files of users have no management token, so an empty one does
+		// not get at them.
+		owned := upload(t, s, rt.newUser(t), "mine")
+		for _, token := range []string{"", "wrong", file.DownloadToken, owned.DownloadToken} {
+			if _, err := s.GetFileByManageToken(token); !errors.Is(err, ErrInvalidManageToken) {
+				t.Errorf("GetFileByManageToken(%q): err = %v, want ErrInvalidManageToken", token, err)
+			}
+			if _, err := s.UpdateAnonymousFile(token, FileSettings{}); !errors.Is(err, ErrInvalidManageToken) {
+				t.Errorf("UpdateAnonymousFile(%q): err = %v, want ErrInvalidManageToken", token, err)
+			}
+			if err := s.DeleteAnonymousFile(token); !errors.Is(err, ErrInvalidManageToken) {
+				t.Errorf("DeleteAnonymousFile(%q): err = %v, want ErrInvalidManageToken", token, err)
+			}
+		}
+		if _, err := s.GetFileByID(owned.ID); err != nil {
+			t.Errorf("user's file after the attempts: %v", err)
+		}
+
+		if got, err := s.GetFileByManageToken(manageToken); err != nil || got.ID != file.ID {
+			t.Fatalf("GetFileByManageToken = %+v, %v", got, err)
+		}
+		once := 1
+		if updated, err := s.UpdateAnonymousFile(manageToken, FileSettings{MaxDownloads: &once}); err != nil || updated.MaxDownloads != 1 {
+			t.Errorf("UpdateAnonymousFile = %+v, %v", updated, err)
+		}
+		if _, err := s.UpdateAnonymousFile(manageToken, FileSettings{ExpiresIn: &in}); !errors.Is(err, ErrInvalidSettings) {
+			t.Errorf("updating past the anonymous maximum: err = %v, want ErrInvalidSettings", err)
+		}
+		if err := s.DeleteAnonymousFile(manageToken); err != nil {
+			t.Fatalf("DeleteAnonymousFile: %v", err)
+		}
+		if _, err := s.GetFileByManageToken(manageToken); !errors.Is(err, ErrInvalidManageToken) {
+			t.Errorf("after deleting: err = %v, want ErrInvalidManageToken", err)
+		}
+		if _, err := s.GetFileByDownloadToken(file.DownloadToken); err == nil {
+			t.Error("deleted file still downloadable")
+		}
+	})
+}
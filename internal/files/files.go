@@ -1,257 +1,370 @@
 package files
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
-	"os"
 	"path/filepath"
 	"time"
 
+	"anonlink/internal/encryption"
+	"anonlink/internal/storage"
+
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPresignUnsupported = errors.New("storage backend does not support presigned URLs")
+	ErrFileTooLarge       = errors.New("file too large")
+
+	ErrDownloadLimitExceeded = errors.New("download limit exceeded")
 )
 
 type Service struct {
-	db          *sql.DB
-	uploadsPath string
+	repo       FileRepository
+	store      storage.Storage
+	policy     ExpiryPolicy
+	anonPolicy ExpiryPolicy
+	quota      Quota
+	keys       encryption.KeyProvider
 }
 
 type File struct {
-	ID               string    `json:"id"`
-	UserID           int       `json:"user_id"`
-	Filename         string    `json:"filename"`
-	OriginalFilename string    `json:"original_filename"`
-	FileSize         int64     `json:"file_size"`
-	MimeType         string    `json:"mime_type"`
-	DownloadToken    string    `json:"download_token"`
-	DownloadCount    int       `json:"download_count"`
-	MaxDownloads     int       `json:"max_downloads"`
-	ExpiresAt        *string   `json:"expires_at,omitempty"`
-	CreatedAt        string    `json:"created_at"`
+	ID                string  `json:"id"`
+	UserID            int     `json:"user_id"` // 0 for anonymous uploads
+	Filename          string  `json:"filename"`
+	OriginalFilename  string  `json:"original_filename"`
+	FileSize          int64   `json:"file_size"`
+	MimeType          string  `json:"mime_type"`
+	ContentHash       string  `json:"content_hash,omitempty"`
+	DownloadToken     string  `json:"download_token"`
+	DownloadCount     int     `json:"download_count"`
+	MaxDownloads      int     `json:"max_downloads"`
+	ExpiresAt         *string `json:"expires_at,omitempty"`
+	CreatedAt         string  `json:"created_at"`
+	PasswordProtected bool    `json:"password_protected"`
+	Encrypted         bool    `json:"encrypted"`
+	EncryptedMetadata string  `json:"encrypted_metadata,omitempty"`
+
+	// WrappedDataKey is set when the blob is encrypted at rest.
+	WrappedDataKey string `json:"-"`
 }
 
-func NewService(db *sql.DB, uploadsPath string) *Service {
+// FileMetadata describes an upload's content. End-to-end encrypted uploads
+// only carry EncryptedMetadata, an opaque blob the client sealed with the
+// same key as the content; the server never learns the real name or type.
+type FileMetadata struct {
+	OriginalFilename  string
+	MimeType          string
+	Encrypted         bool
+	EncryptedMetadata string
+}
+
+const maxEncryptedMetadataSize = 2048
+
+func (m *FileMetadata) validate() error {
+	if !m.Encrypted {
+		if m.EncryptedMetadata != "" {
+			return invalidSettings("encrypted_metadata is only allowed on encrypted uploads")
+		}
+		return nil
+	}
+	if m.EncryptedMetadata == "" {
+		return invalidSettings("encrypted uploads need encrypted_metadata")
+	}
+	if len(m.EncryptedMetadata) > maxEncryptedMetadataSize {
+		return invalidSettings("encrypted_metadata exceeds %d bytes", maxEncryptedMetadataSize)
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(m.EncryptedMetadata); err != nil {
+		return invalidSettings("encrypted_metadata must be unpadded base64url")
+	}
+
+	// Whatever the client claimed, this is all we may tell downloaders.
+	m.OriginalFilename = ""
+	m.MimeType = "application/octet-stream"
+	return nil
+}
+
+type Options struct {
+	Policy          ExpiryPolicy
+	AnonymousPolicy ExpiryPolicy
+
+	// Quota is the default for users without overrides.
+	Quota Quota
+
+	// Keys enables encryption at rest for new uploads when set.
+	Keys encryption.KeyProvider
+}
+
+func NewService(repo FileRepository, store storage.Storage, opts Options) *Service {
 	return &Service{
-		db:          db,
-		uploadsPath: uploadsPath,
+		repo:       repo,
+		store:      store,
+		policy:     opts.Policy,
+		anonPolicy: opts.AnonymousPolicy,
+		quota:      opts.Quota,
+		keys:       opts.Keys,
 	}
 }
 
-func (s *Service) UploadFile(userID int, fileHeader *multipart.FileHeader) (*File, error) {
-	
+// UploadFile streams r into storage while hashing it. The blob is staged
+// first, so a failed upload never leaves a half-written object behind, and
+// published under a key of its own before its metadata row is written, so a
+// crash in between leaves at worst an object nothing refers to, never a row
+// without its content. If the row cannot be saved, or the same content has
+// been stored before and the new file shares that blob, the published copy
+// is deleted again.
+func (s *Service) UploadFile(userID int, meta FileMetadata, r io.Reader, maxSize int64, settings FileSettings) (*File, error) {
+	return s.uploadFile(userID, meta, r, maxSize, settings, s.policy, "")
+}
+
+func (s *Service) uploadFile(userID int, meta FileMetadata, r io.Reader, maxSize int64,
+	settings FileSettings, policy ExpiryPolicy, manageTokenHash string) (*File, error) {
+	if err := meta.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateMaxDownloads(settings.MaxDownloads); err != nil {
+		return nil, err
+	}
+	expiresAt, _, err := policy.resolveExpiry(settings, time.Now(), true)
+	if err != nil {
+		return nil, err
+	}
+	maxDownloads := -1
+	if settings.MaxDownloads != nil {
+		maxDownloads = *settings.MaxDownloads
+	}
+
 	fileID := uuid.New().String()
 	downloadToken := uuid.New().String()
 
-	
-	ext := filepath.Ext(fileHeader.Filename)
+	ext := filepath.Ext(meta.OriginalFilename)
 	filename := fmt.Sprintf("%s%s", fileID, ext)
-	filePath := filepath.Join(s.uploadsPath, filename)
 
-	
-	src, err := fileHeader.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+	hasher := sha256.New()
+	limited := &sizeLimitedReader{r: r, remaining: maxSize}
+	var src io.Reader = io.TeeReader(limited, hasher)
+
+	var wrappedKey string
+	if s.keys != nil {
+		dataKey, err := encryption.NewDataKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		if wrappedKey, err = s.keys.WrapKey(dataKey); err != nil {
+			return nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		if src, err = encryption.Encrypt(src, dataKey); err != nil {
+			return nil, err
+		}
 	}
-	defer src.Close()
 
-	dst, err := os.Create(filePath)
+	_, staged, err := storage.Stage(s.store, filename, src)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create file: %w", err)
+		if errors.Is(err, ErrFileTooLarge) {
+			return nil, ErrFileTooLarge
+		}
+		return nil, err
 	}
-	defer dst.Close()
+	size := maxSize - limited.remaining
+
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return nil, fmt.Errorf("failed to save file: %w", err)
+	file := &File{
+		ID:                fileID,
+		UserID:            userID,
+		Filename:          filename,
+		OriginalFilename:  meta.OriginalFilename,
+		FileSize:          size,
+		MimeType:          meta.MimeType,
+		ContentHash:       contentHash,
+		DownloadToken:     downloadToken,
+		MaxDownloads:      maxDownloads,
+		ExpiresAt:         expiresAt,
+		Encrypted:         meta.Encrypted,
+		EncryptedMetadata: meta.EncryptedMetadata,
 	}
 
-	
-	expiresAt := time.Now().Add(24 * time.Hour).Format("2006-01-02 15:04:05")
+	var quota *Quota
+	if userID != 0 {
+		q, err := s.quotaFor(userID)
+		if err == nil {
+			// The quota is checked again under a lock when the file is
+			// saved; this only spares copying an upload that cannot fit
+			// into storage.
+			var bytes, count int64
+			if bytes, count, err = s.repo.Usage(userID); err == nil {
+				err = q.Check(bytes, count, size)
+			}
+		}
+		if err != nil {
+			staged.Abort()
+			return nil, err
+		}
+		quota = &q
+	}
 
-	
-	file := &File{
-		ID:               fileID,
-		UserID:           userID,
-		Filename:         filename,
-		OriginalFilename: fileHeader.Filename,
-		FileSize:         fileHeader.Size,
-		MimeType:         fileHeader.Header.Get("Content-Type"),
-		DownloadToken:    downloadToken,
-		MaxDownloads:     -1, 
-		ExpiresAt:        &expiresAt,
-	}
-
-	query := `INSERT INTO files (id, user_id, filename, original_filename, file_size, mime_type, download_token, max_downloads, expires_at) 
-	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
-	
-	_, err = s.db.Exec(query, file.ID, file.UserID, file.Filename, file.OriginalFilename, 
-		file.FileSize, file.MimeType, file.DownloadToken, file.MaxDownloads, file.ExpiresAt)
-	if err != nil {
-		
-		os.Remove(filePath)
-		return nil, fmt.Errorf("failed to save file metadata: %w", err)
+	// The blob is published under its own new key before the file is saved,
+	// so that copying it into storage, which for S3 means uploading all of
+	// it, holds no lock in the database. Nothing can find the key until the
+	// transaction commits.
+	if err := staged.Commit(); err != nil {
+		return nil, err
+	}
+	b := &Blob{Hash: contentHash, StorageKey: filename, Size: size, WrappedDataKey: wrappedKey}
+	if err := s.repo.CreateFile(file, manageTokenHash, b, quota); err != nil {
+		s.store.Delete(filename)
+		return nil, err
+	}
+	if file.Filename != filename {
+		// The content was stored before, and the file shares that blob.
+		s.store.Delete(filename)
 	}
 
 	return s.GetFileByID(fileID)
 }
 
 func (s *Service) GetUserFiles(userID int) ([]*File, error) {
-	query := `SELECT id, user_id, filename, original_filename, file_size, mime_type, 
-	          download_token, download_count, max_downloads, expires_at, created_at 
-	          FROM files WHERE user_id = ? ORDER BY created_at DESC`
-	
-	rows, err := s.db.Query(query, userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user files: %w", err)
-	}
-	defer rows.Close()
-
-	var files []*File
-	for rows.Next() {
-		file := &File{}
-		err := rows.Scan(&file.ID, &file.UserID, &file.Filename, &file.OriginalFilename,
-			&file.FileSize, &file.MimeType, &file.DownloadToken, &file.DownloadCount,
-			&file.MaxDownloads, &file.ExpiresAt, &file.CreatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan file: %w", err)
-		}
-		files = append(files, file)
-	}
-
-	return files, nil
+	return s.repo.ListFiles(userID)
 }
 
 func (s *Service) GetFileByID(fileID string) (*File, error) {
-	file := &File{}
-	query := `SELECT id, user_id, filename, original_filename, file_size, mime_type, 
-	          download_token, download_count, max_downloads, expires_at, created_at 
-	          FROM files WHERE id = ?`
-	
-	err := s.db.QueryRow(query, fileID).Scan(&file.ID, &file.UserID, &file.Filename,
-		&file.OriginalFilename, &file.FileSize, &file.MimeType, &file.DownloadToken,
-		&file.DownloadCount, &file.MaxDownloads, &file.ExpiresAt, &file.CreatedAt)
+	file, err := s.repo.GetFile(fileID)
 	if err != nil {
 		return nil, fmt.Errorf("file not found: %w", err)
 	}
-
 	return file, nil
 }
 
 func (s *Service) GetFileByDownloadToken(token string) (*File, error) {
-	file := &File{}
-	query := `SELECT id, user_id, filename, original_filename, file_size, mime_type, 
-	          download_token, download_count, max_downloads, expires_at, created_at 
-	          FROM files WHERE download_token = ?`
-	
-	err := s.db.QueryRow(query, token).Scan(&file.ID, &file.UserID, &file.Filename,
-		&file.OriginalFilename, &file.FileSize, &file.MimeType, &file.DownloadToken,
-		&file.DownloadCount, &file.MaxDownloads, &file.ExpiresAt, &file.CreatedAt)
+	file, err := s.repo.GetFileByDownloadToken(token)
 	if err != nil {
 		return nil, fmt.Errorf("file not found: %w", err)
 	}
 
-	
-	if file.ExpiresAt != nil {
-		expiresAt, err := time.Parse("2006-01-02 15:04:05", *file.ExpiresAt)
-		if err == nil && time.Now().After(expiresAt) {
-			return nil, fmt.Errorf("file has expired")
-		}
+	if expired(file.ExpiresAt) {
+		return nil, fmt.Errorf("file has expired")
 	}
 
-	
 	if file.MaxDownloads != -1 && file.DownloadCount >= file.MaxDownloads {
-		return nil, fmt.Errorf("download limit exceeded")
+		return nil, ErrDownloadLimitExceeded
 	}
 
 	return file, nil
 }
 
+// IncrementDownloadCount records one download, failing with
+// ErrDownloadLimitExceeded if that would go over max_downloads.
 func (s *Service) IncrementDownloadCount(fileID string) error {
-	query := `UPDATE files SET download_count = download_count + 1 WHERE id = ?`
-	_, err := s.db.Exec(query, fileID)
-	return err
+	return s.repo.RecordDownload(fileID, "")
+}
+
+// ETag returns a strong entity tag for the file's content. Files uploaded
+// before content hashes were recorded fall back to their ID, which is just as
+// stable because blobs are never modified in place.
+func (f *File) ETag() string {
+	if f.ContentHash != "" {
+		return `"` + f.ContentHash + `"`
+	}
+	return `"` + f.ID + `"`
 }
 
 func (s *Service) DeleteFile(userID int, fileID string) error {
-	
-	file := &File{}
-	query := `SELECT filename FROM files WHERE id = ? AND user_id = ?`
-	err := s.db.QueryRow(query, fileID, userID).Scan(&file.Filename)
-	if err != nil {
-		return fmt.Errorf("file not found or access denied: %w", err)
+	if err := s.ownsFile(userID, fileID); err != nil {
+		return err
 	}
+	return s.removeFile(fileID)
+}
 
-	
-	deleteQuery := `DELETE FROM files WHERE id = ? AND user_id = ?`
-	result, err := s.db.Exec(deleteQuery, fileID, userID)
+// removeFile deletes a file and its share links. Its blob is only deleted
+// from storage once no file uses it any more. Callers are responsible for
+// checking that the caller may delete the file.
+func (s *Service) removeFile(fileID string) error {
+	orphan, err := s.repo.DeleteFile(fileID)
+	if errors.Is(err, ErrFileNotFound) {
+		return fmt.Errorf("file not found or access denied")
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete file from database: %w", err)
+		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
+	if orphan != "" {
+		if err := s.store.Delete(orphan); err != nil {
+			fmt.Printf("Warning: failed to delete file from storage: %s\n", err)
+		}
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("file not found or access denied")
+	return nil
+}
+
+// OpenFile opens the file's blob for reading. Blobs encrypted at rest are
+// decrypted on the fly, and info describes the plaintext.
+func (s *Service) OpenFile(file *File) (storage.Object, *storage.ObjectInfo, error) {
+	info, err := s.store.Stat(file.Filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := s.store.Get(file.Filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.WrappedDataKey == "" {
+		return obj, info, nil
 	}
 
-	
-	filePath := filepath.Join(s.uploadsPath, file.Filename)
-	if err := os.Remove(filePath); err != nil {
-		
-		fmt.Printf("Warning: failed to delete file from disk: %s\n", err)
+	if s.keys == nil {
+		obj.Close()
+		return nil, nil, fmt.Errorf("file is encrypted at rest but no encryption key is configured")
+	}
+	dataKey, err := s.keys.UnwrapKey(file.WrappedDataKey)
+	if err != nil {
+		obj.Close()
+		return nil, nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	plaintext, err := encryption.Decrypt(obj, info.Size, dataKey)
+	if err != nil {
+		obj.Close()
+		return nil, nil, err
 	}
 
-	return nil
+	return &decryptedObject{ReadSeeker: plaintext, Closer: obj}, &storage.ObjectInfo{
+		Key:     info.Key,
+		Size:    file.FileSize,
+		ModTime: info.ModTime,
+	}, nil
 }
 
-func (s *Service) GetFilePath(filename string) string {
-	return filepath.Join(s.uploadsPath, filename)
+type decryptedObject struct {
+	io.ReadSeeker
+	io.Closer
 }
 
+// DownloadURL presigns a direct download from the storage backend. Blobs
+// encrypted at rest cannot be handed out that way.
+func (s *Service) DownloadURL(file *File, expires time.Duration) (string, error) {
+	if file.WrappedDataKey != "" {
+		return "", ErrPresignUnsupported
+	}
+	presigner, ok := s.store.(storage.Presigner)
+	if !ok {
+		return "", ErrPresignUnsupported
+	}
+	return presigner.PresignGet(file.Filename, expires, file.OriginalFilename)
+}
 
 func (s *Service) CleanupExpiredFiles() error {
-	
-	query := `SELECT id, filename FROM files WHERE expires_at IS NOT NULL AND expires_at < datetime('now')`
-	
-	rows, err := s.db.Query(query)
+	expiredFiles, err := s.repo.ListExpiredFiles(time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to query expired files: %w", err)
 	}
-	defer rows.Close()
-
-	var expiredFiles []struct {
-		ID       string
-		Filename string
-	}
 
-	for rows.Next() {
-		var file struct {
-			ID       string
-			Filename string
-		}
-		if err := rows.Scan(&file.ID, &file.Filename); err != nil {
-			fmt.Printf("Warning: failed to scan expired file: %s\n", err)
-			continue
-		}
-		expiredFiles = append(expiredFiles, file)
-	}
-
-	
-	for _, file := range expiredFiles {
-		
-		deleteQuery := `DELETE FROM files WHERE id = ?`
-		if _, err := s.db.Exec(deleteQuery, file.ID); err != nil {
-			fmt.Printf("Warning: failed to delete expired file from database: %s\n", err)
-			continue
-		}
-
-		
-		filePath := filepath.Join(s.uploadsPath, file.Filename)
-		if err := os.Remove(filePath); err != nil {
-			fmt.Printf("Warning: failed to delete expired file from disk: %s\n", err)
+	for _, fileID := range expiredFiles {
+		if err := s.removeFile(fileID); err != nil {
+			fmt.Printf("Warning: failed to delete expired file: %s\n", err)
 		}
 	}
 
@@ -262,27 +375,61 @@ func (s *Service) CleanupExpiredFiles() error {
 	return nil
 }
 
-
 func (s *Service) GenerateNewDownloadToken(userID int, fileID string) (*File, error) {
-	
 	file, err := s.GetFileByID(fileID)
 	if err != nil {
 		return nil, fmt.Errorf("file not found: %w", err)
 	}
-	
+
 	if file.UserID != userID {
 		return nil, fmt.Errorf("access denied")
 	}
 
-	
-	newToken := uuid.New().String()
-	
-	
-	query := `UPDATE files SET download_token = ? WHERE id = ?`
-	_, err = s.db.Exec(query, newToken, fileID)
-	if err != nil {
+	if err := s.repo.SetDownloadToken(fileID, uuid.New().String()); err != nil {
 		return nil, fmt.Errorf("failed to update download token: %w", err)
 	}
 
 	return s.GetFileByID(fileID)
 }
+
+// sizeLimitedReader fails with ErrFileTooLarge as soon as more than remaining
+// bytes are read, instead of silently truncating like io.LimitReader.
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		return 0, ErrFileTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// SetSharePassword protects the file's share link with password, or removes
+// the protection when password is empty.
+func (s *Service) SetSharePassword(userID int, fileID, password string) (*File, error) {
+	if err := s.ownsFile(userID, fileID); err != nil {
+		return nil, err
+	}
+
+	hash := ""
+	if password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		hash = string(hashed)
+	}
+
+	if err := s.repo.SetSharePasswordHash(fileID, hash); err != nil {
+		return nil, fmt.Errorf("failed to update share password: %w", err)
+	}
+
+	return s.GetFileByID(fileID)
+}
@@ -0,0 +1,399 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"anonlink/internal/storage"
+)
+
+var unlimited = Quota{MaxBytes: Unlimited, MaxFiles: Unlimited, MaxFileSize: Unlimited}
+
+// newTestService is a Service on a MemoryFileRepository and local storage in
+// a temporary directory.
+func newTestService(t *testing.T) (*Service, storage.Storage) {
+	t.Helper()
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(NewMemoryFileRepository(), store, Options{
+		Policy: ExpiryPolicy{DefaultLifetime: 24 * time.Hour},
+		Quota:  unlimited,
+	}), store
+}
+
+func upload(t *testing.T, s *Service, userID int, content string) *File {
+	t.Helper()
+	file, err := s.UploadFile(userID, FileMetadata{OriginalFilename: "hello.txt", MimeType: "text/plain"},
+		strings.NewReader(content), 1<<20, FileSettings{})
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	return file
+}
+
+func readFile(t *testing.T, s *Service, file *File) string {
+	t.Helper()
+	obj, _, err := s.OpenFile(file)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer obj.Close()
+	content, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	s, _ := newTestService(t)
+
+	file := upload(t, s, 1, "hello, world")
+	if file.FileSize != 12 || file.ExpiresAt == nil || file.MaxDownloads != -1 {
+		t.Errorf("uploaded %+v", file)
+	}
+	if got := readFile(t, s, file); got != "hello, world" {
+		t.Errorf("content %q", got)
+	}
+
+	byToken, err := s.GetFileByDownloadToken(file.DownloadToken)
+	if err != nil || byToken.ID != file.ID {
+		t.Fatalf("GetFileByDownloadToken = %v, %v", byToken, err)
+	}
+	if files, err := s.GetUserFiles(1); err != nil || len(files) != 1 {
+		t.Errorf("GetUserFiles = %v, %v", files, err)
+	}
+	if files, err := s.GetUserFiles(2); err != nil || len(files) != 0 {
+		t.Errorf("GetUserFiles of another user = %v, %v", files, err)
+	}
+
+	if err := s.DeleteFile(2, file.ID); err == nil {
+		t.Error("another user deleted the file")
+	}
+	if err := s.DeleteFile(1, file.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetFileByDownloadToken(file.DownloadToken); err == nil {
+		t.Error("deleted file still downloadable")
+	}
+}
+
+func TestUploadDeduplicates(t *testing.T) {
+	s, store := newTestService(t)
+
+	first := upload(t, s, 1, "same content")
+	second := upload(t, s, 2, "same content")
+	if first.ID == second.ID || first.Filename != second.Filename {
+		t.Fatalf("files %s at %s and %s at %s, want one blob", first.ID, first.Filename, second.ID, second.Filename)
+	}
+
+	if err := s.DeleteFile(1, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, s, second); got != "same content" {
+		t.Errorf("content after deleting the other file %q", got)
+	}
+	if err := s.DeleteFile(2, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(first.Filename); err == nil {
+		t.Error("blob left in storage after its last file was deleted")
+	}
+}
+
+// objects lists the keys in store.
+func objects(t *testing.T, store storage.Storage) []string {
+	t.Helper()
+	list, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range list {
+		keys = append(keys, o.Key)
+	}
+	return keys
+}
+
+func TestUploadCleansUpStorage(t *testing.T) {
+	s, store := newTestService(t)
+
+	first := upload(t, s, 1, "same content")
+	upload(t, s, 2, "same content")
+	if keys := objects(t, store); len(keys) != 1 || keys[0] != first.Filename {
+		t.Errorf("storage holds %v after storing the same content twice, want only %s", keys, first.Filename)
+	}
+
+	failure := errors.New("database is down")
+	broken := NewService(&failingRepository{FileRepository: NewMemoryFileRepository(), err: failure}, store, Options{
+		Policy: ExpiryPolicy{DefaultLifetime: 24 * time.Hour},
+		Quota:  unlimited,
+	})
+	_, err := broken.UploadFile(1, FileMetadata{OriginalFilename: "lost.txt"}, strings.NewReader("lost"), 1<<20, FileSettings{})
+	if !errors.Is(err, failure) {
+		t.Fatalf("err = %v, want the repository's", err)
+	}
+	if keys := objects(t, store); len(keys) != 1 {
+		t.Errorf("storage holds %v after saving the file failed", keys)
+	}
+}
+
+// failingRepository fails to save any file.
+type failingRepository struct {
+	FileRepository
+	err error
+}
+
+func (r *failingRepository) CreateFile(file *File, manageTokenHash string, b *Blob, quota *Quota) error {
+	return r.err
+}
+
+// slowStorage is a Storage that cannot stage, so that uploads are spooled
+// and copied into it on publishing, like S3. Put waits for release.
+type slowStorage struct {
+	storage.Storage
+	putting chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStorage) Put(key string, r io.Reader) (int64, error) {
+	s.putting <- struct{}{}
+	<-s.release
+	return s.Storage.Put(key, r)
+}
+
+// TestUploadPublishesOutsideTransaction checks that copying a blob into
+// storage does not keep other uploads of the same user from being saved.
+func TestUploadPublishesOutsideTransaction(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		local, err := storage.NewLocal(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := &slowStorage{Storage: local, putting: make(chan struct{}), release: make(chan struct{})}
+		s := NewService(rt.repo, store, Options{
+			Policy: ExpiryPolicy{DefaultLifetime: 24 * time.Hour},
+			Quota:  unlimited,
+		})
+		userID := rt.newUser(t)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.UploadFile(userID, FileMetadata{OriginalFilename: "slow.txt"}, strings.NewReader("slow"), 1<<20, FileSettings{})
+			done <- err
+		}()
+		<-store.putting
+
+		saved := make(chan error, 1)
+		go func() {
+			file, b := testFile("quick", userID, 5, "quick")
+			saved <- rt.repo.CreateFile(file, "", b, &unlimited)
+		}()
+		select {
+		case err := <-saved:
+			if err != nil {
+				t.Errorf("saving another file while one is copied: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("saving another file waited for the copy into storage")
+		}
+
+		close(store.release)
+		if err := <-done; err != nil {
+			t.Fatalf("slow upload: %v", err)
+		}
+		if files, err := s.GetUserFiles(userID); err != nil || len(files) != 2 {
+			t.Errorf("GetUserFiles = %d files, %v; want 2", len(files), err)
+		}
+	})
+}
+
+func TestUploadLimits(t *testing.T) {
+	s, _ := newTestService(t)
+
+	_, err := s.UploadFile(1, FileMetadata{OriginalFilename: "big.bin"}, bytes.NewReader(make([]byte, 100)), 99, FileSettings{})
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("file over maxSize: err = %v, want ErrFileTooLarge", err)
+	}
+
+	one := int64(1)
+	if err := s.SetQuotaOverrides(1, QuotaOverrides{MaxFiles: &one}); err != nil {
+		t.Fatal(err)
+	}
+	upload(t, s, 1, "first")
+	_, err = s.UploadFile(1, FileMetadata{OriginalFilename: "second.txt"}, strings.NewReader("second"), 1<<20, FileSettings{})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("file over the quota: err = %v, want ErrQuotaExceeded", err)
+	}
+	usage, err := s.GetUsage(1)
+	if err != nil || usage.FileCount != 1 || usage.UsedBytes != 5 || usage.MaxFiles != 1 {
+		t.Errorf("GetUsage = %+v, %v", usage, err)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	s, _ := newTestService(t)
+	once := 1
+	file, err := s.UploadFile(1, FileMetadata{OriginalFilename: "once.txt"}, strings.NewReader("once"), 1<<20,
+		FileSettings{MaxDownloads: &once})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.IncrementDownloadCount(file.ID); err != nil {
+		t.Fatalf("first download: %v", err)
+	}
+	if err := s.IncrementDownloadCount(file.ID); !errors.Is(err, ErrDownloadLimitExceeded) {
+		t.Errorf("second download: err = %v, want ErrDownloadLimitExceeded", err)
+	}
+	if _, err := s.GetFileByDownloadToken(file.DownloadToken); !errors.Is(err, ErrDownloadLimitExceeded) {
+		t.Errorf("GetFileByDownloadToken: err = %v, want ErrDownloadLimitExceeded", err)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	s, store := newTestService(t)
+	// Another instance behind the same load balancer, sharing the database
+	// and storage.
+	other := NewService(s.repo, store, Options{Policy: s.policy, Quota: unlimited})
+
+	up, err := s.CreateUpload(1, 11, "resumed.txt", "text/plain", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateUpload: %v", err)
+	}
+	if _, err := s.GetUpload(2, up.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("another user's upload: err = %v, want ErrUploadNotFound", err)
+	}
+
+	up, file, err := s.WriteUploadChunk(1, up.ID, 0, strings.NewReader("hello "))
+	if err != nil || file != nil || up.Offset != 6 {
+		t.Fatalf("first chunk: offset %d, file %v, err %v", up.Offset, file, err)
+	}
+	if _, _, err := s.WriteUploadChunk(1, up.ID, 0, strings.NewReader("again")); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("chunk at a stale offset: err = %v, want ErrOffsetMismatch", err)
+	}
+	// Anything past the announced length is ignored.
+	up, file, err = other.WriteUploadChunk(1, up.ID, 6, strings.NewReader("world and more"))
+	if err != nil || file == nil {
+		t.Fatalf("last chunk: file %v, err %v", file, err)
+	}
+	if file.OriginalFilename != "resumed.txt" || readFile(t, s, file) != "hello world" {
+		t.Errorf("completed upload %+v", file)
+	}
+	if _, err := s.GetUpload(1, up.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("upload still there after completing: err = %v", err)
+	}
+	if chunks, _ := store.List(chunkPrefix(up.ID)); len(chunks) != 0 {
+		t.Errorf("chunks left in storage after completing: %v", chunks)
+	}
+}
+
+// brokenReader is a request body whose client went away after sending some
+// of it.
+type brokenReader struct {
+	data string
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestResumableUploadInterrupted(t *testing.T) {
+	s, _ := newTestService(t)
+
+	up, err := s.CreateUpload(1, 11, "resumed.txt", "text/plain", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, _, err = s.WriteUploadChunk(1, up.ID, 0, &brokenReader{data: "hello"})
+	if err == nil || up == nil || up.Offset != 5 {
+		t.Fatalf("interrupted chunk: upload %+v, err %v; want offset 5 and an error", up, err)
+	}
+	_, file, err := s.WriteUploadChunk(1, up.ID, 5, strings.NewReader(" world"))
+	if err != nil || file == nil {
+		t.Fatalf("rest of the upload: file %v, err %v", file, err)
+	}
+	if got := readFile(t, s, file); got != "hello world" {
+		t.Errorf("content %q", got)
+	}
+}
+
+func TestResumableUploadConcurrentWrites(t *testing.T) {
+	s, _ := newTestService(t)
+
+	up, err := s.CreateUpload(1, 100, "raced.txt", "text/plain", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = s.WriteUploadChunk(1, up.ID, 0, strings.NewReader(strings.Repeat(strconv.Itoa(i), 10)))
+		}(i)
+	}
+	wg.Wait()
+
+	won := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && won == -1:
+			won = i
+		case err == nil:
+			t.Errorf("writes %d and %d both succeeded", won, i)
+		case !errors.Is(err, ErrOffsetMismatch):
+			t.Errorf("write %d: err = %v, want ErrOffsetMismatch", i, err)
+		}
+	}
+	if won == -1 {
+		t.Fatal("no write succeeded")
+	}
+
+	_, file, err := s.WriteUploadChunk(1, up.ID, 10, strings.NewReader(strings.Repeat("x", 90)))
+	if err != nil || file == nil {
+		t.Fatalf("rest of the upload: file %v, err %v", file, err)
+	}
+	if got := readFile(t, s, file); got != strings.Repeat(strconv.Itoa(won), 10)+strings.Repeat("x", 90) {
+		t.Errorf("content %q, want the winning write's", got)
+	}
+}
+
+func TestTerminateUpload(t *testing.T) {
+	s, store := newTestService(t)
+
+	up, err := s.CreateUpload(1, 10, "gone.txt", "text/plain", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.WriteUploadChunk(1, up.ID, 0, strings.NewReader("half")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TerminateUpload(2, up.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("another user terminating: err = %v, want ErrUploadNotFound", err)
+	}
+	if err := s.TerminateUpload(1, up.ID); err != nil {
+		t.Fatal(err)
+	}
+	if chunks, _ := store.List(chunkPrefix(up.ID)); len(chunks) != 0 {
+		t.Errorf("chunks left in storage after terminating: %v", chunks)
+	}
+	if _, _, err := s.WriteUploadChunk(1, up.ID, 0, strings.NewReader("x")); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("writing to a terminated upload: err = %v, want ErrUploadNotFound", err)
+	}
+}
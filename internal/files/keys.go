@@ -0,0 +1,30 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RewrapDataKeys re-wraps every data key that is not yet under the current
+// master key. Blobs are left untouched. It returns how many keys were
+// re-wrapped; once it succeeds, older master keys are no longer needed.
+func (s *Service) RewrapDataKeys() (int, error) {
+	if s.keys == nil {
+		return 0, errors.New("no encryption key is configured")
+	}
+
+	return s.repo.RewrapDataKeys(func(wrapped string) (string, bool, error) {
+		if !s.keys.NeedsRewrap(wrapped) {
+			return wrapped, false, nil
+		}
+		dataKey, err := s.keys.UnwrapKey(wrapped)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to unwrap: %w", err)
+		}
+		rewrapped, err := s.keys.WrapKey(dataKey)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to wrap: %w", err)
+		}
+		return rewrapped, true, nil
+	})
+}
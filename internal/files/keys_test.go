@@ -0,0 +1,120 @@
+package files
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"anonlink/internal/encryption"
+	"anonlink/internal/storage"
+)
+
+// masterKeys is a LocalKeys factory whose keys are made on first use, so
+// the same id stands for the same key in every file it writes.
+type masterKeys map[string]string
+
+func (m masterKeys) load(t *testing.T, ids ...string) *encryption.LocalKeys {
+	t.Helper()
+	var lines []string
+	for _, id := range ids {
+		if _, ok := m[id]; !ok {
+			key := make([]byte, encryption.DataKeySize)
+			if _, err := rand.Read(key); err != nil {
+				t.Fatal(err)
+			}
+			m[id] = base64.StdEncoding.EncodeToString(key)
+		}
+		lines = append(lines, id+" "+m[id])
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := encryption.LoadLocalKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func storedBytes(t *testing.T, store storage.Storage, key string) string {
+	t.Helper()
+	obj, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		store, err := storage.NewLocal(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := masterKeys{}
+		service := func(ids ...string) *Service {
+			return NewService(rt.repo, store, Options{
+				Policy: ExpiryPolicy{DefaultLifetime: 24 * time.Hour},
+				Quota:  unlimited,
+				Keys:   keys.load(t, ids...),
+			})
+		}
+
+		old := service("old")
+		file := upload(t, old, rt.newUser(t), "secret content")
+		if file.WrappedDataKey == "" || !strings.HasPrefix(file.WrappedDataKey, "old:") {
+			t.Fatalf("wrapped data key %q, want one under the old master key", file.WrappedDataKey)
+		}
+		blob := storedBytes(t, store, file.Filename)
+		if strings.Contains(blob, "secret content") {
+			t.Fatal("the blob is stored in plaintext")
+		}
+
+		rotated := service("new", "old")
+		n, err := rotated.RewrapDataKeys()
+		if err != nil || n != 1 {
+			t.Fatalf("RewrapDataKeys = %d, %v; want 1", n, err)
+		}
+		if n, err := rotated.RewrapDataKeys(); err != nil || n != 0 {
+			t.Errorf("second RewrapDataKeys = %d, %v; want 0", n, err)
+		}
+
+		file, err = rotated.GetFileByDownloadToken(file.DownloadToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(file.WrappedDataKey, "new:") {
+			t.Errorf("wrapped data key %q after rewrapping, want one under the new master key", file.WrappedDataKey)
+		}
+		if storedBytes(t, store, file.Filename) != blob {
+			t.Error("rewrapping rewrote the blob")
+		}
+
+		// Once rewrapped, the old master key can be dropped, and is no use to
+		// anyone who only has that.
+		if got := readFile(t, service("new"), file); got != "secret content" {
+			t.Errorf("content with the new key %q", got)
+		}
+		if _, _, err := service("old").OpenFile(file); err == nil {
+			t.Error("opened the file with only the old master key")
+		}
+	})
+}
+
+func TestRewrapDataKeysWithoutKeys(t *testing.T) {
+	s, _ := newTestService(t)
+	if _, err := s.RewrapDataKeys(); err == nil {
+		t.Error("RewrapDataKeys succeeded without a master key")
+	}
+}
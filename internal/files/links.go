@@ -0,0 +1,290 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrLinkNotFound = errors.New("share link not found")
+
+// ShareLink is an additional, independently managed download token for a
+// file. The file's own download_token keeps working alongside its links.
+type ShareLink struct {
+	ID                string  `json:"id"`
+	FileID            string  `json:"file_id"`
+	Token             string  `json:"token"`
+	Label             string  `json:"label"`
+	ExpiresAt         *string `json:"expires_at,omitempty"`
+	MaxDownloads      int     `json:"max_downloads"`
+	DownloadCount     int     `json:"download_count"`
+	Revoked           bool    `json:"revoked"`
+	PasswordProtected bool    `json:"password_protected"`
+	CreatedAt         string  `json:"created_at"`
+}
+
+// ShareLinkSettings carries the fields of a create or update request. Nil
+// fields are left unchanged on update; an empty ExpiresAt or Password clears
+// the expiry or password.
+type ShareLinkSettings struct {
+	Label        *string
+	ExpiresAt    *string
+	MaxDownloads *int
+	Password     *string
+	Revoked      *bool
+}
+
+// Share is what a public download token resolves to: the file, plus the
+// share link when the token belongs to one rather than to the file itself.
+type Share struct {
+	File *File
+	Link *ShareLink
+}
+
+func (sh *Share) Token() string {
+	if sh.Link != nil {
+		return sh.Link.Token
+	}
+	return sh.File.DownloadToken
+}
+
+func (sh *Share) PasswordProtected() bool {
+	if sh.Link != nil {
+		return sh.Link.PasswordProtected
+	}
+	return sh.File.PasswordProtected
+}
+
+func (sh *Share) DownloadCount() int {
+	if sh.Link != nil {
+		return sh.Link.DownloadCount
+	}
+	return sh.File.DownloadCount
+}
+
+// ExpiresAt returns whichever of the link and file expiry comes first.
+func (sh *Share) ExpiresAt() *string {
+	if sh.Link == nil || sh.Link.ExpiresAt == nil {
+		return sh.File.ExpiresAt
+	}
+	if sh.File.ExpiresAt == nil {
+		return sh.Link.ExpiresAt
+	}
+	linkExpiry, err1 := parseTimestamp(*sh.Link.ExpiresAt)
+	fileExpiry, err2 := parseTimestamp(*sh.File.ExpiresAt)
+	if err1 == nil && err2 == nil && linkExpiry.Before(fileExpiry) {
+		return sh.Link.ExpiresAt
+	}
+	return sh.File.ExpiresAt
+}
+
+// ResolveShare looks up a public download token, checking the expiry and
+// download limits of both the link and the file behind it.
+func (s *Service) ResolveShare(token string) (*Share, error) {
+	link, err := s.repo.GetShareLinkByToken(token)
+	if errors.Is(err, ErrLinkNotFound) {
+		file, err := s.GetFileByDownloadToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return &Share{File: file}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Revoked {
+		return nil, fmt.Errorf("share link has been revoked")
+	}
+	if expired(link.ExpiresAt) {
+		return nil, fmt.Errorf("share link has expired")
+	}
+	if link.MaxDownloads != -1 && link.DownloadCount >= link.MaxDownloads {
+		return nil, ErrDownloadLimitExceeded
+	}
+
+	file, err := s.GetFileByID(link.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if expired(file.ExpiresAt) {
+		return nil, fmt.Errorf("file has expired")
+	}
+	if file.MaxDownloads != -1 && file.DownloadCount >= file.MaxDownloads {
+		return nil, ErrDownloadLimitExceeded
+	}
+
+	return &Share{File: file, Link: link}, nil
+}
+
+// RecordDownload counts one download against the share and its file, failing
+// with ErrDownloadLimitExceeded if either limit has been reached.
+func (s *Service) RecordDownload(share *Share) error {
+	linkID := ""
+	if share.Link != nil {
+		linkID = share.Link.ID
+	}
+	return s.repo.RecordDownload(share.File.ID, linkID)
+}
+
+// sharePasswordHash returns the hash of the password protecting the share,
+// or "" if it has none.
+func (s *Service) sharePasswordHash(share *Share) (string, error) {
+	if share.Link != nil {
+		return s.repo.ShareLinkPasswordHash(share.Link.ID)
+	}
+	return s.repo.SharePasswordHash(share.File.ID)
+}
+
+func (s *Service) CheckSharePassword(share *Share, password string) bool {
+	hash, err := s.sharePasswordHash(share)
+	if err != nil || hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// SharePasswordFingerprint identifies the password currently protecting the
+// share without giving anything away about it. Every bcrypt hash has its own
+// salt, so the fingerprint changes whenever the password is set, even to
+// the one it was before.
+func (s *Service) SharePasswordFingerprint(share *Share) (string, error) {
+	hash, err := s.sharePasswordHash(share)
+	if err != nil || hash == "" {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(hash))
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
+
+func (s *Service) ownsFile(userID int, fileID string) error {
+	file, err := s.repo.GetFile(fileID)
+	if err != nil || file.UserID != userID || userID == 0 {
+		return fmt.Errorf("file not found or access denied")
+	}
+	return nil
+}
+
+func (s *Service) GetShareLinks(userID int, fileID string) ([]*ShareLink, error) {
+	if err := s.ownsFile(userID, fileID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListShareLinks(fileID)
+}
+
+func (s *Service) GetShareLink(userID int, fileID, linkID string) (*ShareLink, error) {
+	if err := s.ownsFile(userID, fileID); err != nil {
+		return nil, err
+	}
+
+	link, err := s.repo.GetShareLink(linkID)
+	if err != nil || link.FileID != fileID {
+		return nil, ErrLinkNotFound
+	}
+	return link, nil
+}
+
+func (s *Service) CreateShareLink(userID int, fileID string, settings ShareLinkSettings) (*ShareLink, error) {
+	if err := s.ownsFile(userID, fileID); err != nil {
+		return nil, err
+	}
+
+	update, err := settings.update()
+	if err != nil {
+		return nil, err
+	}
+	link := &ShareLink{
+		ID:           uuid.New().String(),
+		FileID:       fileID,
+		Token:        uuid.New().String(),
+		MaxDownloads: -1,
+	}
+	if update.Label != nil {
+		link.Label = *update.Label
+	}
+	if update.ExpiresAt != nil && *update.ExpiresAt != "" {
+		link.ExpiresAt = update.ExpiresAt
+	}
+	if update.MaxDownloads != nil {
+		link.MaxDownloads = *update.MaxDownloads
+	}
+	if update.Revoked != nil {
+		link.Revoked = *update.Revoked
+	}
+	passwordHash := ""
+	if update.PasswordHash != nil {
+		passwordHash = *update.PasswordHash
+	}
+
+	if err := s.repo.CreateShareLink(link, passwordHash); err != nil {
+		return nil, err
+	}
+	return s.repo.GetShareLink(link.ID)
+}
+
+func (s *Service) UpdateShareLink(userID int, fileID, linkID string, settings ShareLinkSettings) (*ShareLink, error) {
+	if _, err := s.GetShareLink(userID, fileID, linkID); err != nil {
+		return nil, err
+	}
+
+	update, err := settings.update()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.UpdateShareLink(linkID, update); err != nil {
+		return nil, err
+	}
+
+	return s.GetShareLink(userID, fileID, linkID)
+}
+
+// update turns the settings into a ShareLinkUpdate, hashing the password.
+func (settings ShareLinkSettings) update() (ShareLinkUpdate, error) {
+	update := ShareLinkUpdate{
+		Label:        settings.Label,
+		ExpiresAt:    settings.ExpiresAt,
+		MaxDownloads: settings.MaxDownloads,
+		Revoked:      settings.Revoked,
+	}
+	if settings.Password != nil {
+		hash := ""
+		if *settings.Password != "" {
+			hashed, err := bcrypt.GenerateFromPassword([]byte(*settings.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return update, fmt.Errorf("failed to hash password: %w", err)
+			}
+			hash = string(hashed)
+		}
+		update.PasswordHash = &hash
+	}
+	return update, nil
+}
+
+func (s *Service) DeleteShareLink(userID int, fileID, linkID string) error {
+	if _, err := s.GetShareLink(userID, fileID, linkID); err != nil {
+		return err
+	}
+	return s.repo.DeleteShareLink(linkID)
+}
+
+// parseTimestamp accepts both the format timestamps are written in and the
+// RFC 3339 form the SQLite driver hands DATETIME columns back as.
+func parseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02 15:04:05", value)
+}
+
+func expired(expiresAt *string) bool {
+	if expiresAt == nil {
+		return false
+	}
+	t, err := parseTimestamp(*expiresAt)
+	return err == nil && time.Now().After(t)
+}
@@ -0,0 +1,214 @@
+package files
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"anonlink/internal/storage"
+)
+
+// newRepoService is a Service on the repository under test.
+func newRepoService(t *testing.T, rt repoTest) *Service {
+	t.Helper()
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(rt.repo, store, Options{
+		Policy: ExpiryPolicy{DefaultLifetime: 24 * time.Hour},
+		Quota:  unlimited,
+	})
+}
+
+func createLink(t *testing.T, s *Service, userID int, fileID string, settings ShareLinkSettings) *ShareLink {
+	t.Helper()
+	link, err := s.CreateShareLink(userID, fileID, settings)
+	if err != nil {
+		t.Fatalf("CreateShareLink: %v", err)
+	}
+	return link
+}
+
+// timestamp formats a time the way expiry times are stored.
+func timestamp(t time.Time) *string {
+	s := t.UTC().Format("2006-01-02 15:04:05")
+	return &s
+}
+
+func TestShareLinks(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		s := newRepoService(t, rt)
+		alice, mallory := rt.newUser(t), rt.newUser(t)
+		file := upload(t, s, alice, "hello")
+
+		label := "for bob"
+		bob := createLink(t, s, alice, file.ID, ShareLinkSettings{Label: &label})
+		carol := createLink(t, s, alice, file.ID, ShareLinkSettings{})
+		if bob.Label != label || bob.MaxDownloads != -1 || bob.ExpiresAt != nil || bob.Revoked || bob.PasswordProtected ||
+			bob.Token == "" || bob.Token == carol.Token || bob.Token == file.DownloadToken {
+			t.Errorf("created %+v", bob)
+		}
+		links, err := s.GetShareLinks(alice, file.ID)
+		if err != nil || len(links) != 2 {
+			t.Fatalf("GetShareLinks = %d links, %v; want 2", len(links), err)
+		}
+
+		// Links are their owner's business only.
+		if _, err := s.GetShareLinks(mallory, file.ID); err == nil {
+			t.Error("someone else listed the links")
+		}
+		if _, err := s.CreateShareLink(mallory, file.ID, ShareLinkSettings{}); err == nil {
+			t.Error("someone else created a link")
+		}
+		revoked := true
+		if _, err := s.UpdateShareLink(mallory, file.ID, bob.ID, ShareLinkSettings{Revoked: &revoked}); err == nil {
+			t.Error("someone else revoked a link")
+		}
+		if err := s.DeleteShareLink(mallory, file.ID, bob.ID); err == nil {
+			t.Error("someone else deleted a link")
+		}
+
+		// Each link, and the file's own token, resolve to the file.
+		for _, token := range []string{bob.Token, carol.Token, file.DownloadToken} {
+			share, err := s.ResolveShare(token)
+			if err != nil || share.File.ID != file.ID || share.Token() != token {
+				t.Fatalf("ResolveShare(%s) = %+v, %v", token, share, err)
+			}
+			if (share.Link != nil) != (token != file.DownloadToken) {
+				t.Errorf("ResolveShare(%s) has link %+v", token, share.Link)
+			}
+		}
+
+		// Revoking one link leaves the others alone.
+		if link, err := s.UpdateShareLink(alice, file.ID, bob.ID, ShareLinkSettings{Revoked: &revoked}); err != nil || !link.Revoked {
+			t.Fatalf("UpdateShareLink = %+v, %v", link, err)
+		}
+		if _, err := s.ResolveShare(bob.Token); err == nil {
+			t.Error("revoked link resolved")
+		}
+		if err := s.RecordDownload(&Share{File: file, Link: bob}); !errors.Is(err, ErrDownloadLimitExceeded) {
+			t.Errorf("download through a revoked link: err = %v, want ErrDownloadLimitExceeded", err)
+		}
+		for _, token := range []string{carol.Token, file.DownloadToken} {
+			if _, err := s.ResolveShare(token); err != nil {
+				t.Errorf("ResolveShare(%s) after revoking another link: %v", token, err)
+			}
+		}
+
+		if err := s.DeleteShareLink(alice, file.ID, carol.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ResolveShare(carol.Token); err == nil {
+			t.Error("deleted link resolved")
+		}
+		if links, err := s.GetShareLinks(alice, file.ID); err != nil || len(links) != 1 {
+			t.Errorf("GetShareLinks after deleting one = %d links, %v", len(links), err)
+		}
+	})
+}
+
+func TestShareLinkLimits(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		s := newRepoService(t, rt)
+		alice := rt.newUser(t)
+		file := upload(t, s, alice, "hello")
+
+		once := 1
+		limited := createLink(t, s, alice, file.ID, ShareLinkSettings{MaxDownloads: &once})
+		unlimited := createLink(t, s, alice, file.ID, ShareLinkSettings{})
+		expired := createLink(t, s, alice, file.ID, ShareLinkSettings{ExpiresAt: timestamp(time.Now().Add(-time.Minute))})
+		soon := createLink(t, s, alice, file.ID, ShareLinkSettings{ExpiresAt: timestamp(time.Now().Add(time.Hour))})
+
+		if _, err := s.ResolveShare(expired.Token); err == nil {
+			t.Error("expired link resolved")
+		}
+		// The link expires before the file, and that is when the share does.
+		share, err := s.ResolveShare(soon.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if share.ExpiresAt() == nil || *share.ExpiresAt() != *share.Link.ExpiresAt {
+			t.Errorf("share expires at %v, want the link's expiry %v", share.ExpiresAt(), *share.Link.ExpiresAt)
+		}
+
+		share, err = s.ResolveShare(limited.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RecordDownload(share); err != nil {
+			t.Fatalf("first download: %v", err)
+		}
+		if _, err := s.ResolveShare(limited.Token); !errors.Is(err, ErrDownloadLimitExceeded) {
+			t.Errorf("ResolveShare after the last download: err = %v, want ErrDownloadLimitExceeded", err)
+		}
+		if err := s.RecordDownload(share); !errors.Is(err, ErrDownloadLimitExceeded) {
+			t.Errorf("second download: err = %v, want ErrDownloadLimitExceeded", err)
+		}
+
+		// Downloads through links count against the file too, and once it is
+		// used up, every link is.
+		if stored, err := s.GetFileByID(file.ID); err != nil || stored.DownloadCount != 1 {
+			t.Fatalf("file download count %+v, %v; want 1", stored, err)
+		}
+		share, err = s.ResolveShare(unlimited.Token)
+		if err != nil {
+			t.Fatalf("other link after the limited one ran out: %v", err)
+		}
+		if err := rt.repo.SetMaxDownloads(file.ID, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RecordDownload(share); err != nil {
+			t.Fatal(err)
+		}
+		for _, token := range []string{unlimited.Token, file.DownloadToken} {
+			if _, err := s.ResolveShare(token); !errors.Is(err, ErrDownloadLimitExceeded) {
+				t.Errorf("ResolveShare(%s) after the file ran out: err = %v, want ErrDownloadLimitExceeded", token, err)
+			}
+		}
+	})
+}
+
+func TestShareLinkPassword(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		s := newRepoService(t, rt)
+		alice := rt.newUser(t)
+		file := upload(t, s, alice, "hello")
+
+		password := "secret"
+		link := createLink(t, s, alice, file.ID, ShareLinkSettings{Password: &password})
+		if !link.PasswordProtected {
+			t.Fatalf("created %+v", link)
+		}
+		share, err := s.ResolveShare(link.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !share.PasswordProtected() || !s.CheckSharePassword(share, "secret") || s.CheckSharePassword(share, "wrong") {
+			t.Error("link password not checked")
+		}
+		// The file's own token is not protected by the link's password.
+		if own, err := s.ResolveShare(file.DownloadToken); err != nil || own.PasswordProtected() || s.CheckSharePassword(own, "secret") {
+			t.Errorf("file's own token: %+v, %v", own, err)
+		}
+
+		before, err := s.SharePasswordFingerprint(share)
+		if err != nil || before == "" {
+			t.Fatalf("SharePasswordFingerprint = %q, %v", before, err)
+		}
+		if _, err := s.UpdateShareLink(alice, file.ID, link.ID, ShareLinkSettings{Password: &password}); err != nil {
+			t.Fatal(err)
+		}
+		if after, err := s.SharePasswordFingerprint(share); err != nil || after == before {
+			t.Errorf("fingerprint %q after setting the password again, was %q (%v)", after, before, err)
+		}
+
+		none := ""
+		if link, err := s.UpdateShareLink(alice, file.ID, link.ID, ShareLinkSettings{Password: &none}); err != nil || link.PasswordProtected {
+			t.Fatalf("removing the password: %+v, %v", link, err)
+		}
+		if share, err := s.ResolveShare(link.Token); err != nil || share.PasswordProtected() {
+			t.Errorf("link after removing its password: %+v, %v", share, err)
+		}
+	})
+}
@@ -0,0 +1,589 @@
+package files
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryFileRepository is a FileRepository that keeps everything in memory,
+// for tests and throwaway instances. It is safe for concurrent use.
+type MemoryFileRepository struct {
+	mu        sync.Mutex
+	files     map[string]*memoryFile
+	blobs     map[string]*memoryBlob
+	links     map[string]*memoryLink
+	uploads   map[string]*Upload
+	chunks    map[string][]string
+	overrides map[int]QuotaOverrides
+}
+
+type memoryFile struct {
+	File
+	manageTokenHash   string
+	sharePasswordHash string
+	blobHash          string
+}
+
+type memoryBlob struct {
+	Blob
+	refCount int
+}
+
+type memoryLink struct {
+	ShareLink
+	passwordHash string
+}
+
+func NewMemoryFileRepository() *MemoryFileRepository {
+	return &MemoryFileRepository{
+		files:     make(map[string]*memoryFile),
+		blobs:     make(map[string]*memoryBlob),
+		links:     make(map[string]*memoryLink),
+		uploads:   make(map[string]*Upload),
+		chunks:    make(map[string][]string),
+		overrides: make(map[int]QuotaOverrides),
+	}
+}
+
+var _ FileRepository = (*MemoryFileRepository)(nil)
+
+// createdAt timestamps new rows. The fixed-width fraction keeps them sorting
+// in creation order as strings, and parseTimestamp still reads them.
+func createdAt() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05.000000000Z07:00")
+}
+
+func (r *MemoryFileRepository) CreateFile(file *File, manageTokenHash string, b *Blob, quota *Quota) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if quota != nil {
+		bytes, count := r.usage(file.UserID)
+		if err := quota.Check(bytes, count, file.FileSize); err != nil {
+			return err
+		}
+	}
+	for _, f := range r.files {
+		if f.DownloadToken == file.DownloadToken || (manageTokenHash != "" && f.manageTokenHash == manageTokenHash) {
+			return fmt.Errorf("failed to save file metadata: duplicate token")
+		}
+	}
+
+	stored, ok := r.blobs[b.Hash]
+	if !ok {
+		stored = &memoryBlob{Blob: *b}
+		r.blobs[b.Hash] = stored
+	}
+	stored.refCount++
+
+	file.Filename = stored.StorageKey
+	f := &memoryFile{File: *file, manageTokenHash: manageTokenHash, blobHash: b.Hash}
+	f.DownloadCount = 0
+	if file.ExpiresAt != nil {
+		expiresAt := *file.ExpiresAt
+		f.ExpiresAt = &expiresAt
+	}
+	f.CreatedAt = createdAt()
+	r.files[file.ID] = f
+	return nil
+}
+
+// file returns a copy of f as the File the service sees.
+func (r *MemoryFileRepository) file(f *memoryFile) *File {
+	file := f.File
+	file.PasswordProtected = f.sharePasswordHash != ""
+	file.WrappedDataKey = ""
+	if b, ok := r.blobs[f.blobHash]; ok {
+		file.WrappedDataKey = b.WrappedDataKey
+	}
+	if f.ExpiresAt != nil {
+		expiresAt := *f.ExpiresAt
+		file.ExpiresAt = &expiresAt
+	}
+	return &file
+}
+
+func (r *MemoryFileRepository) findFile(match func(*memoryFile) bool) (*File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.files {
+		if match(f) {
+			return r.file(f), nil
+		}
+	}
+	return nil, ErrFileNotFound
+}
+
+func (r *MemoryFileRepository) GetFile(fileID string) (*File, error) {
+	return r.findFile(func(f *memoryFile) bool { return f.ID == fileID })
+}
+
+func (r *MemoryFileRepository) GetFileByDownloadToken(token string) (*File, error) {
+	return r.findFile(func(f *memoryFile) bool { return f.DownloadToken == token })
+}
+
+func (r *MemoryFileRepository) GetFileByManageTokenHash(hash string) (*File, error) {
+	return r.findFile(func(f *memoryFile) bool { return f.manageTokenHash != "" && f.manageTokenHash == hash })
+}
+
+func (r *MemoryFileRepository) ListFiles(userID int) ([]*File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var files []*File
+	for _, f := range r.files {
+		if f.UserID == userID && userID != 0 {
+			files = append(files, r.file(f))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt > files[j].CreatedAt })
+	return files, nil
+}
+
+func (r *MemoryFileRepository) ListAllFiles(limit, offset int) ([]*File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := []*File{}
+	for _, f := range r.files {
+		files = append(files, r.file(f))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID < files[j].ID
+	})
+	if offset >= len(files) {
+		return []*File{}, nil
+	}
+	files = files[offset:]
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (r *MemoryFileRepository) ListExpiredFiles(now time.Time) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for _, f := range r.files {
+		if f.ExpiresAt == nil {
+			continue
+		}
+		if t, err := parseTimestamp(*f.ExpiresAt); err == nil && t.Before(now) {
+			ids = append(ids, f.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (r *MemoryFileRepository) updateFile(fileID string, update func(*memoryFile)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.files[fileID]
+	if !ok {
+		return ErrFileNotFound
+	}
+	update(f)
+	return nil
+}
+
+func (r *MemoryFileRepository) SetDownloadToken(fileID, token string) error {
+	return r.updateFile(fileID, func(f *memoryFile) { f.DownloadToken = token })
+}
+
+func (r *MemoryFileRepository) SetExpiry(fileID string, expiresAt *string) error {
+	if expiresAt != nil {
+		value := *expiresAt
+		expiresAt = &value
+	}
+	return r.updateFile(fileID, func(f *memoryFile) { f.ExpiresAt = expiresAt })
+}
+
+func (r *MemoryFileRepository) SetMaxDownloads(fileID string, maxDownloads int) error {
+	return r.updateFile(fileID, func(f *memoryFile) { f.MaxDownloads = maxDownloads })
+}
+
+func (r *MemoryFileRepository) SetSharePasswordHash(fileID, hash string) error {
+	return r.updateFile(fileID, func(f *memoryFile) { f.sharePasswordHash = hash })
+}
+
+func (r *MemoryFileRepository) SharePasswordHash(fileID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.files[fileID]
+	if !ok {
+		return "", ErrFileNotFound
+	}
+	return f.sharePasswordHash, nil
+}
+
+func (r *MemoryFileRepository) RecordDownload(fileID, linkID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.files[fileID]
+	if !ok || (f.MaxDownloads != -1 && f.DownloadCount >= f.MaxDownloads) {
+		return ErrDownloadLimitExceeded
+	}
+	var link *memoryLink
+	if linkID != "" {
+		link, ok = r.links[linkID]
+		if !ok || link.Revoked || (link.MaxDownloads != -1 && link.DownloadCount >= link.MaxDownloads) {
+			return ErrDownloadLimitExceeded
+		}
+		link.DownloadCount++
+	}
+	f.DownloadCount++
+	return nil
+}
+
+func (r *MemoryFileRepository) DeleteFile(fileID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.files[fileID]
+	if !ok {
+		return "", ErrFileNotFound
+	}
+	delete(r.files, fileID)
+	for id, link := range r.links {
+		if link.FileID == fileID {
+			delete(r.links, id)
+		}
+	}
+
+	b, ok := r.blobs[f.blobHash]
+	if !ok {
+		return "", nil
+	}
+	b.refCount--
+	if b.refCount > 0 {
+		return "", nil
+	}
+	delete(r.blobs, f.blobHash)
+	return b.StorageKey, nil
+}
+
+func (r *MemoryFileRepository) usage(userID int) (bytes, count int64) {
+	for _, f := range r.files {
+		if f.UserID == userID {
+			bytes += f.FileSize
+			count++
+		}
+	}
+	return bytes, count
+}
+
+func (r *MemoryFileRepository) Usage(userID int) (int64, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bytes, count := r.usage(userID)
+	return bytes, count, nil
+}
+
+func (r *MemoryFileRepository) Stats(topUsers int) (*Stats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := &Stats{
+		Blobs:          int64(len(r.blobs)),
+		ShareLinks:     int64(len(r.links)),
+		PendingUploads: int64(len(r.uploads)),
+		TopUsers:       []UserUsage{},
+	}
+	users := make(map[int]*UserUsage)
+	for _, f := range r.files {
+		stats.Files++
+		stats.Bytes += f.FileSize
+		if f.UserID == 0 {
+			stats.AnonymousFiles++
+			stats.AnonymousBytes += f.FileSize
+			continue
+		}
+		u, ok := users[f.UserID]
+		if !ok {
+			u = &UserUsage{UserID: f.UserID}
+			users[f.UserID] = u
+		}
+		u.UsedBytes += f.FileSize
+		u.FileCount++
+	}
+	for _, b := range r.blobs {
+		stats.StoredBytes += b.Size
+	}
+
+	for _, u := range users {
+		stats.TopUsers = append(stats.TopUsers, *u)
+	}
+	sort.Slice(stats.TopUsers, func(i, j int) bool {
+		a, b := stats.TopUsers[i], stats.TopUsers[j]
+		if a.UsedBytes != b.UsedBytes {
+			return a.UsedBytes > b.UsedBytes
+		}
+		return a.UserID < b.UserID
+	})
+	if len(stats.TopUsers) > topUsers {
+		stats.TopUsers = stats.TopUsers[:topUsers]
+	}
+	return stats, nil
+}
+
+func (r *MemoryFileRepository) QuotaOverrides(userID int) (QuotaOverrides, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.overrides[userID], nil
+}
+
+func (r *MemoryFileRepository) SetQuotaOverrides(userID int, overrides QuotaOverrides) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.overrides[userID]
+	for _, o := range []struct {
+		value   *int64
+		current **int64
+	}{
+		{overrides.MaxBytes, &current.MaxBytes},
+		{overrides.MaxFiles, &current.MaxFiles},
+		{overrides.MaxFileSize, &current.MaxFileSize},
+	} {
+		switch {
+		case o.value == nil:
+		case *o.value == 0:
+			*o.current = nil
+		default:
+			value := *o.value
+			*o.current = &value
+		}
+	}
+	r.overrides[userID] = current
+	return nil
+}
+
+func (r *MemoryFileRepository) RewrapDataKeys(rewrap func(wrapped string) (string, bool, error)) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rewrapped := 0
+	for hash, b := range r.blobs {
+		if b.WrappedDataKey == "" {
+			continue
+		}
+		wrapped, changed, err := rewrap(b.WrappedDataKey)
+		if err != nil {
+			return rewrapped, fmt.Errorf("data key of blobs %s: %w", hash, err)
+		}
+		if changed {
+			b.WrappedDataKey = wrapped
+			rewrapped++
+		}
+	}
+	return rewrapped, nil
+}
+
+// link returns a copy of l as the ShareLink the service sees.
+func (l *memoryLink) link() *ShareLink {
+	link := l.ShareLink
+	link.PasswordProtected = l.passwordHash != ""
+	if l.ExpiresAt != nil {
+		expiresAt := *l.ExpiresAt
+		link.ExpiresAt = &expiresAt
+	}
+	return &link
+}
+
+func (r *MemoryFileRepository) CreateShareLink(link *ShareLink, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.files[link.FileID]; !ok {
+		return fmt.Errorf("failed to create share link: %w", ErrFileNotFound)
+	}
+	l := &memoryLink{ShareLink: *link, passwordHash: passwordHash}
+	l.DownloadCount = 0
+	if link.ExpiresAt != nil {
+		expiresAt := *link.ExpiresAt
+		l.ExpiresAt = &expiresAt
+	}
+	l.CreatedAt = createdAt()
+	r.links[link.ID] = l
+	return nil
+}
+
+func (r *MemoryFileRepository) GetShareLink(linkID string) (*ShareLink, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.links[linkID]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	return l.link(), nil
+}
+
+func (r *MemoryFileRepository) GetShareLinkByToken(token string) (*ShareLink, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, l := range r.links {
+		if l.Token == token {
+			return l.link(), nil
+		}
+	}
+	return nil, ErrLinkNotFound
+}
+
+func (r *MemoryFileRepository) ListShareLinks(fileID string) ([]*ShareLink, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	links := []*ShareLink{}
+	for _, l := range r.links {
+		if l.FileID == fileID {
+			links = append(links, l.link())
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt > links[j].CreatedAt })
+	return links, nil
+}
+
+func (r *MemoryFileRepository) UpdateShareLink(linkID string, update ShareLinkUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.links[linkID]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	if update.Label != nil {
+		l.Label = *update.Label
+	}
+	if update.ExpiresAt != nil {
+		l.ExpiresAt = nil
+		if *update.ExpiresAt != "" {
+			expiresAt := *update.ExpiresAt
+			l.ExpiresAt = &expiresAt
+		}
+	}
+	if update.MaxDownloads != nil {
+		l.MaxDownloads = *update.MaxDownloads
+	}
+	if update.PasswordHash != nil {
+		l.passwordHash = *update.PasswordHash
+	}
+	if update.Revoked != nil {
+		l.Revoked = *update.Revoked
+	}
+	return nil
+}
+
+func (r *MemoryFileRepository) ShareLinkPasswordHash(linkID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.links[linkID]
+	if !ok {
+		return "", ErrLinkNotFound
+	}
+	return l.passwordHash, nil
+}
+
+func (r *MemoryFileRepository) DeleteShareLink(linkID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.links[linkID]; !ok {
+		return ErrLinkNotFound
+	}
+	delete(r.links, linkID)
+	return nil
+}
+
+func (r *MemoryFileRepository) CreateUpload(upload *Upload) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := *upload
+	u.Offset = 0
+	u.CreatedAt = time.Now().UTC()
+	r.uploads[upload.ID] = &u
+	return nil
+}
+
+func (r *MemoryFileRepository) GetUpload(uploadID string) (*Upload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.uploads[uploadID]
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	upload := *u
+	return &upload, nil
+}
+
+func (r *MemoryFileRepository) AddUploadChunk(uploadID string, offset, size int64, storageKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.uploads[uploadID]
+	if !ok {
+		return ErrUploadNotFound
+	}
+	if u.Offset != offset {
+		return ErrOffsetMismatch
+	}
+	u.Offset += size
+	r.chunks[uploadID] = append(r.chunks[uploadID], storageKey)
+	return nil
+}
+
+func (r *MemoryFileRepository) DeleteUpload(uploadID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.uploads[uploadID]; !ok {
+		return nil, ErrUploadNotFound
+	}
+	chunks := r.chunks[uploadID]
+	delete(r.uploads, uploadID)
+	delete(r.chunks, uploadID)
+	return chunks, nil
+}
+
+func (r *MemoryFileRepository) ListExpiredUploads(now time.Time) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for id, u := range r.uploads {
+		if u.ExpiresAt.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *MemoryFileRepository) ListUserUploads(userID int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for id, u := range r.uploads {
+		if u.UserID == userID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,123 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Unlimited disables a Quota limit.
+const Unlimited = -1
+
+// unlimitedFileSize stands in for Unlimited where a byte count is needed,
+// leaving headroom so that adding to it cannot overflow.
+const unlimitedFileSize = 1 << 62
+
+// Quota limits what a user may store. Each limit is either a positive number
+// or Unlimited.
+type Quota struct {
+	MaxBytes    int64 `json:"max_bytes"`
+	MaxFiles    int64 `json:"max_files"`
+	MaxFileSize int64 `json:"max_file_size"`
+}
+
+// FileSizeLimit is MaxFileSize as a byte count that can be passed to
+// UploadFile.
+func (q Quota) FileSizeLimit() int64 {
+	if q.MaxFileSize == Unlimited {
+		return unlimitedFileSize
+	}
+	return q.MaxFileSize
+}
+
+// QuotaOverrides are the per-user deviations from the server's default
+// Quota. When setting them, nil fields leave the current override alone and
+// a zero value removes it, so the default applies again. When reading them,
+// nil fields are the ones without an override.
+type QuotaOverrides struct {
+	MaxBytes    *int64
+	MaxFiles    *int64
+	MaxFileSize *int64
+}
+
+type Usage struct {
+	UsedBytes int64 `json:"used_bytes"`
+	FileCount int64 `json:"file_count"`
+	Quota
+}
+
+func (s *Service) quotaFor(userID int) (Quota, error) {
+	quota := s.quota
+	overrides, err := s.repo.QuotaOverrides(userID)
+	if err != nil {
+		return quota, err
+	}
+
+	if overrides.MaxBytes != nil {
+		quota.MaxBytes = *overrides.MaxBytes
+	}
+	if overrides.MaxFiles != nil {
+		quota.MaxFiles = *overrides.MaxFiles
+	}
+	if overrides.MaxFileSize != nil {
+		quota.MaxFileSize = *overrides.MaxFileSize
+	}
+	return quota, nil
+}
+
+// GetQuota returns the limits that apply to userID: the server defaults with
+// the user's overrides on top.
+func (s *Service) GetQuota(userID int) (Quota, error) {
+	return s.quotaFor(userID)
+}
+
+func (s *Service) GetUsage(userID int) (*Usage, error) {
+	quota, err := s.quotaFor(userID)
+	if err != nil {
+		return nil, err
+	}
+	bytes, count, err := s.repo.Usage(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &Usage{UsedBytes: bytes, FileCount: count, Quota: quota}, nil
+}
+
+// Check fails with ErrQuotaExceeded or ErrFileTooLarge if a user who already
+// stores count files totalling bytes cannot add another file of size bytes.
+func (q Quota) Check(bytes, count, size int64) error {
+	if q.MaxFileSize != Unlimited && size > q.MaxFileSize {
+		return ErrFileTooLarge
+	}
+	if q.MaxFiles != Unlimited && count+1 > q.MaxFiles {
+		return fmt.Errorf("%w: at most %d files allowed", ErrQuotaExceeded, q.MaxFiles)
+	}
+	if q.MaxBytes != Unlimited && bytes+size > q.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, bytes, q.MaxBytes)
+	}
+	return nil
+}
+
+// checkQuota is Check against userID's current quota and usage.
+func (s *Service) checkQuota(userID int, size int64) error {
+	quota, err := s.quotaFor(userID)
+	if err != nil {
+		return err
+	}
+	bytes, count, err := s.repo.Usage(userID)
+	if err != nil {
+		return err
+	}
+	return quota.Check(bytes, count, size)
+}
+
+// SetQuotaOverrides changes the per-user quota overrides of userID.
+func (s *Service) SetQuotaOverrides(userID int, overrides QuotaOverrides) error {
+	for _, value := range []*int64{overrides.MaxBytes, overrides.MaxFiles, overrides.MaxFileSize} {
+		if value != nil && *value < Unlimited {
+			return fmt.Errorf("quota limits must be positive, %d (unlimited) or 0 (default)", Unlimited)
+		}
+	}
+	return s.repo.SetQuotaOverrides(userID, overrides)
+}
@@ -0,0 +1,103 @@
+package files
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// FileRepository stores everything the files Service keeps track of besides
+// the content itself: files, the blobs they share, share links, resumable
+// uploads and per-user quota overrides. SQLFileRepository is the real one;
+// MemoryFileRepository keeps everything in memory.
+//
+// Lookups fail with ErrFileNotFound, ErrLinkNotFound or ErrUploadNotFound
+// when there is nothing to find.
+type FileRepository interface {
+	// CreateFile adds file and a reference to the blob with b.Hash, which is
+	// created from b if no file has that content yet. Unless quota is nil the
+	// owner's usage is checked against it in the same transaction, failing
+	// with ErrQuotaExceeded or ErrFileTooLarge. The content must already be
+	// stored at b.StorageKey. file.Filename is set to the storage key of the
+	// blob the file ended up with, which is another one if the content was
+	// stored before.
+	CreateFile(file *File, manageTokenHash string, b *Blob, quota *Quota) error
+	GetFile(fileID string) (*File, error)
+	GetFileByDownloadToken(token string) (*File, error)
+	GetFileByManageTokenHash(hash string) (*File, error)
+	ListFiles(userID int) ([]*File, error)
+	// ListAllFiles returns a page of everyone's files, newest first.
+	ListAllFiles(limit, offset int) ([]*File, error)
+	ListExpiredFiles(now time.Time) ([]string, error)
+	SetDownloadToken(fileID, token string) error
+	SetExpiry(fileID string, expiresAt *string) error
+	SetMaxDownloads(fileID string, maxDownloads int) error
+	// SetSharePasswordHash replaces the file's share password; an empty hash
+	// removes it.
+	SetSharePasswordHash(fileID, hash string) error
+	SharePasswordHash(fileID string) (string, error)
+	// RecordDownload counts one download against the file and, unless linkID
+	// is empty, the share link. Either one being at its limit, or the link
+	// being revoked, fails the whole thing with ErrDownloadLimitExceeded.
+	RecordDownload(fileID, linkID string) error
+	// DeleteFile removes the file and its share links and drops its blob
+	// reference. It returns the storage key to delete once nothing uses it.
+	DeleteFile(fileID string) (orphan string, err error)
+
+	Usage(userID int) (bytes, count int64, err error)
+	// Stats sums up what the whole instance stores, listing the topUsers
+	// users who store the most.
+	Stats(topUsers int) (*Stats, error)
+	QuotaOverrides(userID int) (QuotaOverrides, error)
+	SetQuotaOverrides(userID int, overrides QuotaOverrides) error
+
+	// RewrapDataKeys passes every stored data key to rewrap and saves the
+	// result wherever rewrap reports a change. It returns how many changed.
+	RewrapDataKeys(rewrap func(wrapped string) (string, bool, error)) (int, error)
+
+	CreateShareLink(link *ShareLink, passwordHash string) error
+	GetShareLink(linkID string) (*ShareLink, error)
+	GetShareLinkByToken(token string) (*ShareLink, error)
+	ListShareLinks(fileID string) ([]*ShareLink, error)
+	UpdateShareLink(linkID string, update ShareLinkUpdate) error
+	ShareLinkPasswordHash(linkID string) (string, error)
+	DeleteShareLink(linkID string) error
+
+	CreateUpload(upload *Upload) error
+	GetUpload(uploadID string) (*Upload, error)
+	// AddUploadChunk records that the bytes of an upload from offset on,
+	// size of them, are stored under storageKey, and moves its offset past
+	// them. It fails with ErrOffsetMismatch if the offset is no longer
+	// offset, so of two requests writing at the same place only one wins.
+	AddUploadChunk(uploadID string, offset, size int64, storageKey string) error
+	// DeleteUpload deletes an upload and returns the storage keys of its
+	// chunks in order. It fails with ErrUploadNotFound if the upload is
+	// already gone, which makes whoever deletes it the only one to finish it.
+	DeleteUpload(uploadID string) ([]string, error)
+	ListExpiredUploads(now time.Time) ([]string, error)
+	ListUserUploads(userID int) ([]string, error)
+}
+
+// Blob is a piece of stored content, shared by every file whose content has
+// the same SHA-256.
+type Blob struct {
+	Hash           string
+	StorageKey     string
+	Size           int64
+	WrappedDataKey string
+}
+
+// ShareLinkUpdate is a change to a share link. Nil fields are left alone; an
+// empty ExpiresAt or PasswordHash clears it.
+type ShareLinkUpdate struct {
+	Label        *string
+	ExpiresAt    *string
+	MaxDownloads *int
+	PasswordHash *string
+	Revoked      *bool
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,247 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"anonlink/internal/database"
+	"anonlink/internal/database/dbtest"
+)
+
+// repoTest is what a repository test gets: the repository and a way to add
+// a user to it, since files belong to users.
+type repoTest struct {
+	repo    FileRepository
+	newUser func(t *testing.T) int
+}
+
+// eachFileRepository runs test against a MemoryFileRepository and against a
+// SQLFileRepository on every database dialect available, so that they are
+// held to the same behaviour.
+func eachFileRepository(t *testing.T, test func(t *testing.T, rt repoTest)) {
+	t.Run("memory", func(t *testing.T) {
+		n := 0
+		test(t, repoTest{
+			repo:    NewMemoryFileRepository(),
+			newUser: func(t *testing.T) int { n++; return n },
+		})
+	})
+	dbtest.Each(t, func(t *testing.T, db *database.DB) {
+		n := 0
+		test(t, repoTest{
+			repo: NewSQLFileRepository(db),
+			newUser: func(t *testing.T) int {
+				t.Helper()
+				n++
+				var id int
+				query := `INSERT INTO users (username, email, password_hash) VALUES (?, ?, '') RETURNING id`
+				if err := db.QueryRow(query, fmt.Sprintf("user%d", n), fmt.Sprintf("user%d@example.com", n)).Scan(&id); err != nil {
+					t.Fatalf("failed to create user: %v", err)
+				}
+				return id
+			},
+		})
+	})
+}
+
+// testFile is a file of size bytes owned by userID whose content hashes to
+// hash.
+func testFile(id string, userID int, size int64, hash string) (*File, *Blob) {
+	file := &File{
+		ID:               id,
+		UserID:           userID,
+		OriginalFilename: id + ".txt",
+		FileSize:         size,
+		MimeType:         "text/plain",
+		ContentHash:      hash,
+		DownloadToken:    "token-" + id,
+	}
+	return file, &Blob{Hash: hash, StorageKey: "blob-" + id, Size: size}
+}
+
+func TestCreateFileSharesBlobs(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		userID := rt.newUser(t)
+
+		first, b := testFile("f1", userID, 10, "hash")
+		if err := rt.repo.CreateFile(first, "", b, nil); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+		if first.Filename != "blob-f1" {
+			t.Fatalf("stored at %q, want its own blob", first.Filename)
+		}
+
+		second, b := testFile("f2", userID, 10, "hash")
+		if err := rt.repo.CreateFile(second, "", b, nil); err != nil {
+			t.Fatalf("CreateFile with the same content: %v", err)
+		}
+		if second.Filename != "blob-f1" {
+			t.Errorf("second file stored at %q, want the first file's blob", second.Filename)
+		}
+
+		// The blob goes once its last reference does.
+		if orphan, err := rt.repo.DeleteFile("f1"); err != nil || orphan != "" {
+			t.Fatalf("DeleteFile(f1) = %q, %v, want the blob kept", orphan, err)
+		}
+		if orphan, err := rt.repo.DeleteFile("f2"); err != nil || orphan != "blob-f1" {
+			t.Fatalf("DeleteFile(f2) = %q, %v, want blob-f1", orphan, err)
+		}
+		if _, err := rt.repo.GetFile("f1"); !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("GetFile of a deleted file: err = %v", err)
+		}
+
+		// Nothing refers to the content any more, so it is stored anew.
+		third, b := testFile("f3", userID, 10, "hash")
+		if err := rt.repo.CreateFile(third, "", b, nil); err != nil {
+			t.Fatal(err)
+		}
+		if third.Filename != "blob-f3" {
+			t.Errorf("after the blob was released: stored at %q, want its own blob", third.Filename)
+		}
+	})
+}
+
+func TestCreateFileQuota(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		userID := rt.newUser(t)
+		quota := &Quota{MaxBytes: 100, MaxFiles: 2, MaxFileSize: 60}
+
+		for i, size := range []int64{50, 40} {
+			file, b := testFile(fmt.Sprintf("f%d", i), userID, size, fmt.Sprintf("hash%d", i))
+			if err := rt.repo.CreateFile(file, "", b, quota); err != nil {
+				t.Fatalf("file %d: %v", i, err)
+			}
+		}
+
+		file, b := testFile("big", userID, 61, "big")
+		if err := rt.repo.CreateFile(file, "", b, quota); !errors.Is(err, ErrFileTooLarge) {
+			t.Errorf("file over MaxFileSize: err = %v, want ErrFileTooLarge", err)
+		}
+		file, b = testFile("third", userID, 1, "third")
+		if err := rt.repo.CreateFile(file, "", b, quota); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("file over MaxFiles: err = %v, want ErrQuotaExceeded", err)
+		}
+		quota.MaxFiles = Unlimited
+		file, b = testFile("bytes", userID, 11, "bytes")
+		if err := rt.repo.CreateFile(file, "", b, quota); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("file over MaxBytes: err = %v, want ErrQuotaExceeded", err)
+		}
+
+		if bytes, count, err := rt.repo.Usage(userID); err != nil || bytes != 90 || count != 2 {
+			t.Errorf("Usage = %d bytes, %d files, %v; want 90, 2", bytes, count, err)
+		}
+		// Another user's usage is their own.
+		other := rt.newUser(t)
+		file, b = testFile("other", other, 60, "other")
+		if err := rt.repo.CreateFile(file, "", b, quota); err != nil {
+			t.Errorf("other user: %v", err)
+		}
+	})
+}
+
+// TestCreateFileQuotaConcurrently checks that uploads racing each other
+// cannot all pass the quota check on the same old usage.
+func TestCreateFileQuotaConcurrently(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		userID := rt.newUser(t)
+		quota := &Quota{MaxBytes: Unlimited, MaxFiles: 3, MaxFileSize: Unlimited}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, 20)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				file, b := testFile(fmt.Sprintf("f%d", i), userID, 1, fmt.Sprintf("hash%d", i))
+				errs[i] = rt.repo.CreateFile(file, "", b, quota)
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		// Every upload either fits or is turned away for the quota; none
+		// fails because the database was busy.
+		created := 0
+		for i, err := range errs {
+			switch {
+			case err == nil:
+				created++
+			case !errors.Is(err, ErrQuotaExceeded):
+				t.Errorf("upload %d: %v", i, err)
+			}
+		}
+		_, count, err := rt.repo.Usage(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != 3 || count != 3 {
+			t.Errorf("%d uploads succeeded and %d files are stored, want 3", created, count)
+		}
+	})
+}
+
+func TestUploads(t *testing.T) {
+	eachFileRepository(t, func(t *testing.T, rt repoTest) {
+		userID := rt.newUser(t)
+		now := time.Now().In(time.FixedZone("UTC-7", -7*60*60))
+
+		for _, upload := range []*Upload{
+			{ID: "u1", UserID: userID, Length: 100, Filename: "a.txt", MimeType: "text/plain", ExpiresAt: now.Add(time.Hour)},
+			{ID: "u2", UserID: userID, Length: 100, Filename: "b.txt", MimeType: "text/plain", ExpiresAt: now.Add(-time.Hour)},
+		} {
+			if err := rt.repo.CreateUpload(upload); err != nil {
+				t.Fatalf("CreateUpload: %v", err)
+			}
+		}
+
+		if err := rt.repo.AddUploadChunk("u1", 0, 40, "uploads/u1/a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.repo.AddUploadChunk("u1", 0, 10, "uploads/u1/b"); !errors.Is(err, ErrOffsetMismatch) {
+			t.Errorf("chunk at a stale offset: err = %v, want ErrOffsetMismatch", err)
+		}
+		if err := rt.repo.AddUploadChunk("nonsense", 0, 10, "uploads/nonsense/a"); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("chunk of an unknown upload: err = %v, want ErrUploadNotFound", err)
+		}
+		if err := rt.repo.AddUploadChunk("u1", 40, 20, "uploads/u1/c"); err != nil {
+			t.Fatal(err)
+		}
+		upload, err := rt.repo.GetUpload("u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upload.Offset != 60 || upload.Length != 100 || upload.Filename != "a.txt" {
+			t.Errorf("GetUpload = %+v", upload)
+		}
+		if upload.ExpiresAt.Sub(now.Add(time.Hour)).Abs() > time.Second {
+			t.Errorf("ExpiresAt = %v, want %v", upload.ExpiresAt, now.Add(time.Hour).UTC())
+		}
+
+		expired, err := rt.repo.ListExpiredUploads(now)
+		if err != nil || len(expired) != 1 || expired[0] != "u2" {
+			t.Errorf("ListExpiredUploads = %v, %v; want [u2]", expired, err)
+		}
+
+		chunks, err := rt.repo.DeleteUpload("u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != 2 || chunks[0] != "uploads/u1/a" || chunks[1] != "uploads/u1/c" {
+			t.Errorf("DeleteUpload returned chunks %v, want a and c", chunks)
+		}
+		if _, err := rt.repo.GetUpload("u1"); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("GetUpload of a deleted upload: err = %v", err)
+		}
+		if _, err := rt.repo.DeleteUpload("u1"); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("second DeleteUpload: err = %v, want ErrUploadNotFound", err)
+		}
+		if err := rt.repo.AddUploadChunk("u1", 60, 10, "uploads/u1/d"); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("AddUploadChunk of a deleted upload: err = %v", err)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidSettings = errors.New("invalid file settings")
+
+// ExpiryPolicy is the server-side limit on how long files may live.
+type ExpiryPolicy struct {
+	DefaultLifetime  time.Duration
+	MaxLifetime      time.Duration // zero means no limit
+	AllowNeverExpire bool
+}
+
+// FileSettings are the owner-controlled expiry and download limits of a file.
+// Nil fields mean "keep the current value" (or the default, on upload).
+type FileSettings struct {
+	ExpiresIn    *time.Duration
+	ExpiresAt    *time.Time
+	NeverExpire  bool
+	MaxDownloads *int
+}
+
+func invalidSettings(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidSettings, fmt.Sprintf(format, args...))
+}
+
+// resolveExpiry turns settings into the value to store in expires_at for a
+// file created at createdAt. changed is false when the settings leave the
+// expiry alone and there is no default to apply.
+func (p ExpiryPolicy) resolveExpiry(settings FileSettings, createdAt time.Time, applyDefault bool) (expiresAt *string, changed bool, err error) {
+	if settings.NeverExpire {
+		if settings.ExpiresIn != nil || settings.ExpiresAt != nil {
+			return nil, false, invalidSettings("never_expire cannot be combined with an expiry")
+		}
+		if !p.AllowNeverExpire {
+			return nil, false, invalidSettings("files that never expire are not allowed on this server")
+		}
+		return nil, true, nil
+	}
+
+	var t time.Time
+	switch {
+	case settings.ExpiresIn != nil && settings.ExpiresAt != nil:
+		return nil, false, invalidSettings("use either expires_in or expires_at, not both")
+	case settings.ExpiresIn != nil:
+		t = time.Now().Add(*settings.ExpiresIn)
+	case settings.ExpiresAt != nil:
+		t = *settings.ExpiresAt
+	case applyDefault:
+		t = createdAt.Add(p.DefaultLifetime)
+		if p.MaxLifetime > 0 && p.DefaultLifetime > p.MaxLifetime {
+			t = createdAt.Add(p.MaxLifetime)
+		}
+	default:
+		return nil, false, nil
+	}
+
+	if !t.After(time.Now()) {
+		return nil, false, invalidSettings("expiry must be in the future")
+	}
+	if p.MaxLifetime > 0 && t.After(createdAt.Add(p.MaxLifetime)) {
+		return nil, false, invalidSettings("expiry exceeds the maximum lifetime of %s", p.MaxLifetime)
+	}
+
+	formatted := t.UTC().Format("2006-01-02 15:04:05")
+	return &formatted, true, nil
+}
+
+func validateMaxDownloads(maxDownloads *int) error {
+	if maxDownloads != nil && *maxDownloads != -1 && *maxDownloads < 1 {
+		return invalidSettings("max_downloads must be -1 (unlimited) or at least 1")
+	}
+	return nil
+}
+
+// UpdateFileSettings changes the expiry and download limit of a file after
+// it has been uploaded, within the limits of the server's ExpiryPolicy.
+func (s *Service) UpdateFileSettings(userID int, fileID string, settings FileSettings) (*File, error) {
+	file, err := s.GetFileByID(fileID)
+	if err != nil || file.UserID != userID {
+		return nil, fmt.Errorf("file not found or access denied")
+	}
+	return s.updateFileSettings(file, settings, s.policy)
+}
+
+func (s *Service) updateFileSettings(file *File, settings FileSettings, policy ExpiryPolicy) (*File, error) {
+	fileID := file.ID
+	if err := validateMaxDownloads(settings.MaxDownloads); err != nil {
+		return nil, err
+	}
+
+	createdAt, err := parseTimestamp(file.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse creation time: %w", err)
+	}
+	expiresAt, expiryChanged, err := policy.resolveExpiry(settings, createdAt, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiryChanged {
+		if err := s.repo.SetExpiry(fileID, expiresAt); err != nil {
+			return nil, fmt.Errorf("failed to update expiry: %w", err)
+		}
+	}
+	if settings.MaxDownloads != nil {
+		if err := s.repo.SetMaxDownloads(fileID, *settings.MaxDownloads); err != nil {
+			return nil, fmt.Errorf("failed to update download limit: %w", err)
+		}
+	}
+
+	return s.GetFileByID(fileID)
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolveExpiry(t *testing.T) {
+	policy := ExpiryPolicy{DefaultLifetime: 24 * time.Hour, MaxLifetime: 7 * 24 * time.Hour}
+	createdAt := time.Now()
+	duration := func(d time.Duration) *time.Duration { return &d }
+	at := func(d time.Duration) *time.Time { t := createdAt.Add(d); return &t }
+
+	for _, c := range []struct {
+		name         string
+		policy       ExpiryPolicy
+		settings     FileSettings
+		applyDefault bool
+		// want is how long after createdAt the file should expire; -1 means
+		// never.
+		want    time.Duration
+		changed bool
+		invalid bool
+	}{
+		{name: "default", policy: policy, applyDefault: true, want: 24 * time.Hour, changed: true},
+		{name: "no default on update", policy: policy},
+		{name: "default above the maximum", policy: ExpiryPolicy{DefaultLifetime: 30 * 24 * time.Hour, MaxLifetime: time.Hour},
+			applyDefault: true, want: time.Hour, changed: true},
+		{name: "expires_in", policy: policy, settings: FileSettings{ExpiresIn: duration(time.Hour)}, want: time.Hour, changed: true},
+		{name: "expires_at", policy: policy, settings: FileSettings{ExpiresAt: at(48 * time.Hour)}, want: 48 * time.Hour, changed: true},
+		{name: "at the maximum", policy: policy, settings: FileSettings{ExpiresAt: at(7 * 24 * time.Hour)},
+			want: 7 * 24 * time.Hour, changed: true},
+		{name: "past the maximum", policy: policy, settings: FileSettings{ExpiresIn: duration(8 * 24 * time.Hour)}, invalid: true},
+		{name: "no maximum", policy: ExpiryPolicy{DefaultLifetime: time.Hour}, settings: FileSettings{ExpiresIn: duration(1000 * time.Hour)},
+			want: 1000 * time.Hour, changed: true},
+		{name: "in the past", policy: policy, settings: FileSettings{ExpiresAt: at(-time.Minute)}, invalid: true},
+		{name: "both", policy: policy, settings: FileSettings{ExpiresIn: duration(time.Hour), ExpiresAt: at(time.Hour)}, invalid: true},
+		{name: "never, not allowed", policy: policy, settings: FileSettings{NeverExpire: true}, invalid: true},
+		{name: "never", policy: ExpiryPolicy{DefaultLifetime: time.Hour, AllowNeverExpire: true},
+			settings: FileSettings{NeverExpire: true}, applyDefault: true, want: -1, changed: true},
+		{name: "never and an expiry", policy: ExpiryPolicy{AllowNeverExpire: true},
+			settings: FileSettings{NeverExpire: true, ExpiresIn: duration(time.Hour)}, invalid: true},
+	} {
+		expiresAt, changed, err := c.policy.resolveExpiry(c.settings, createdAt, c.applyDefault)
+		if c.invalid {
+			if !errors.Is(err, ErrInvalidSettings) {
+				t.Errorf("%s: err = %v, want ErrInvalidSettings", c.name, err)
+			}
+			continue
+		}
+		if err != nil || changed != c.changed {
+			t.Errorf("%s: changed = %v, %v; want %v", c.name, changed, err, c.changed)
+			continue
+		}
+		switch {
+		case !changed || c.want == -1:
+			if expiresAt != nil {
+				t.Errorf("%s: expires at %s, want nil", c.name, *expiresAt)
+			}
+		case expiresAt == nil:
+			t.Errorf("%s: no expiry, want %s", c.name, c.want)
+		default:
+			got, err := parseTimestamp(*expiresAt)
+			// Timestamps are stored to the second.
+			if want := createdAt.Add(c.want); err != nil || got.Sub(want).Abs() > time.Second {
+				t.Errorf("%s: expires at %s, want %s", c.name, *expiresAt, want.UTC())
+			}
+		}
+	}
+}
+
+func TestValidateMaxDownloads(t *testing.T) {
+	for _, n := range []int{-1, 1, 1000} {
+		if err := validateMaxDownloads(&n); err != nil {
+			t.Errorf("max_downloads %d: %v", n, err)
+		}
+	}
+	if err := validateMaxDownloads(nil); err != nil {
+		t.Errorf("no max_downloads: %v", err)
+	}
+	for _, n := range []int{0, -2} {
+		if err := validateMaxDownloads(&n); !errors.Is(err, ErrInvalidSettings) {
+			t.Errorf("max_downloads %d: err = %v, want ErrInvalidSettings", n, err)
+		}
+	}
+}
+
+func TestUpdateFileSettings(t *testing.T) {
+	s, _ := newTestService(t)
+	file := upload(t, s, 1, "hello")
+
+	if _, err := s.UpdateFileSettings(2, file.ID, FileSettings{}); err == nil {
+		t.Error("someone else changed the settings")
+	}
+	n := 3
+	in := time.Hour
+	updated, err := s.UpdateFileSettings(1, file.ID, FileSettings{MaxDownloads: &n, ExpiresIn: &in})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.MaxDownloads != 3 || updated.ExpiresAt == nil || *updated.ExpiresAt == *file.ExpiresAt {
+		t.Errorf("updated %+v", updated)
+	}
+
+	// Invalid settings change nothing, not even the valid ones with them.
+	zero, five := 0, 5
+	if _, err := s.UpdateFileSettings(1, file.ID, FileSettings{MaxDownloads: &zero}); !errors.Is(err, ErrInvalidSettings) {
+		t.Errorf("max_downloads 0: err = %v, want ErrInvalidSettings", err)
+	}
+	if _, err := s.UpdateFileSettings(1, file.ID, FileSettings{MaxDownloads: &five, NeverExpire: true}); !errors.Is(err, ErrInvalidSettings) {
+		t.Errorf("never_expire: err = %v, want ErrInvalidSettings", err)
+	}
+	if file, err := s.GetFileByID(file.ID); err != nil || file.MaxDownloads != 3 || *file.ExpiresAt != *updated.ExpiresAt {
+		t.Errorf("after invalid updates: %+v, %v", file, err)
+	}
+}
@@ -0,0 +1,745 @@
+package files
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+// SQLFileRepository is the FileRepository backed by the application
+// database.
+type SQLFileRepository struct {
+	db *database.DB
+}
+
+var _ FileRepository = (*SQLFileRepository)(nil)
+
+func NewSQLFileRepository(db *database.DB) *SQLFileRepository {
+	return &SQLFileRepository{db: db}
+}
+
+const fileColumns = `id, COALESCE(user_id, 0), filename, original_filename, file_size, mime_type, COALESCE(content_hash, ''),
+	          download_token, download_count, max_downloads, expires_at, created_at,
+	          share_password_hash IS NOT NULL, encrypted, COALESCE(encrypted_metadata, ''),
+	          COALESCE((SELECT b.wrapped_data_key FROM blobs b WHERE b.hash = blob_hash), wrapped_data_key, '')`
+
+func scanFile(row interface{ Scan(...interface{}) error }) (*File, error) {
+	file := &File{}
+	err := row.Scan(&file.ID, &file.UserID, &file.Filename, &file.OriginalFilename,
+		&file.FileSize, &file.MimeType, &file.ContentHash, &file.DownloadToken, &file.DownloadCount,
+		&file.MaxDownloads, &file.ExpiresAt, &file.CreatedAt, &file.PasswordProtected,
+		&file.Encrypted, &file.EncryptedMetadata, &file.WrappedDataKey)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (r *SQLFileRepository) CreateFile(file *File, manageTokenHash string, b *Blob, quota *Quota) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if quota != nil {
+		// Touching the user's row first makes concurrent uploads by the same
+		// user wait for each other, so they cannot all pass the check on the
+		// same old usage.
+		if _, err := tx.Exec(`UPDATE users SET updated_at = updated_at WHERE id = ?`, file.UserID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+		bytes, count, err := usageOf(tx, file.UserID)
+		if err != nil {
+			return err
+		}
+		if err := quota.Check(bytes, count, file.FileSize); err != nil {
+			return err
+		}
+	}
+
+	stored, err := acquireBlob(tx, b)
+	if err != nil {
+		return err
+	}
+	file.Filename = stored.StorageKey
+
+	query := `INSERT INTO files (id, user_id, filename, original_filename, file_size, mime_type, content_hash, download_token, max_downloads, expires_at, manage_token_hash, encrypted, encrypted_metadata, blob_hash)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(query, file.ID, nullIfZero(file.UserID), file.Filename, file.OriginalFilename,
+		file.FileSize, file.MimeType, file.ContentHash, file.DownloadToken, file.MaxDownloads, file.ExpiresAt,
+		nullIfEmpty(manageTokenHash), file.Encrypted, nullIfEmpty(file.EncryptedMetadata), b.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to save file metadata: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save file metadata: %w", err)
+	}
+	return nil
+}
+
+// acquireBlob adds a reference to the blob with b's hash, creating it from b
+// if it does not exist yet. It returns the blob as stored.
+func acquireBlob(tx *database.Tx, b *Blob) (*Blob, error) {
+	query := `INSERT INTO blobs (hash, storage_key, size, ref_count, wrapped_data_key) VALUES (?, ?, ?, 1, ?)
+	          ON CONFLICT (hash) DO UPDATE SET ref_count = blobs.ref_count + 1`
+	if _, err := tx.Exec(query, b.Hash, b.StorageKey, b.Size, nullIfEmpty(b.WrappedDataKey)); err != nil {
+		return nil, fmt.Errorf("failed to reference blob: %w", err)
+	}
+
+	stored := &Blob{Hash: b.Hash}
+	query = `SELECT storage_key, size, COALESCE(wrapped_data_key, '') FROM blobs WHERE hash = ?`
+	if err := tx.QueryRow(query, b.Hash).Scan(&stored.StorageKey, &stored.Size, &stored.WrappedDataKey); err != nil {
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+
+	return stored, nil
+}
+
+// releaseBlob drops a reference to the blob with the given hash. If that was
+// the last one the blob row is deleted and its storage key returned.
+func releaseBlob(tx *database.Tx, hash string) (string, error) {
+	if _, err := tx.Exec(`UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ?`, hash); err != nil {
+		return "", fmt.Errorf("failed to release blob: %w", err)
+	}
+
+	var storageKey string
+	var refCount int
+	err := tx.QueryRow(`SELECT storage_key, ref_count FROM blobs WHERE hash = ?`, hash).Scan(&storageKey, &refCount)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get blob: %w", err)
+	}
+	if refCount > 0 {
+		return "", nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE hash = ?`, hash); err != nil {
+		return "", fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return storageKey, nil
+}
+
+func (r *SQLFileRepository) getFile(where string, arg interface{}) (*File, error) {
+	file, err := scanFile(r.db.QueryRow(`SELECT `+fileColumns+` FROM files WHERE `+where+` = ?`, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+	return file, nil
+}
+
+func (r *SQLFileRepository) GetFile(fileID string) (*File, error) {
+	return r.getFile("id", fileID)
+}
+
+func (r *SQLFileRepository) GetFileByDownloadToken(token string) (*File, error) {
+	return r.getFile("download_token", token)
+}
+
+func (r *SQLFileRepository) GetFileByManageTokenHash(hash string) (*File, error) {
+	return r.getFile("manage_token_hash", hash)
+}
+
+func (r *SQLFileRepository) ListFiles(userID int) ([]*File, error) {
+	rows, err := r.db.Query(`SELECT `+fileColumns+` FROM files WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []*File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+func (r *SQLFileRepository) ListAllFiles(limit, offset int) ([]*File, error) {
+	rows, err := r.db.Query(`SELECT `+fileColumns+` FROM files ORDER BY created_at DESC, id LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get files: %w", err)
+	}
+	defer rows.Close()
+
+	files := []*File{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+func (r *SQLFileRepository) ListExpiredFiles(now time.Time) ([]string, error) {
+	query := `SELECT id FROM files WHERE expires_at IS NOT NULL AND expires_at < ?`
+	return r.listIDs(query, formatTimestamp(now))
+}
+
+func (r *SQLFileRepository) listIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// exec runs an UPDATE or DELETE of a single row, failing with notFound if
+// there was no such row.
+func (r *SQLFileRepository) exec(notFound error, query string, args ...interface{}) error {
+	result, err := r.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (r *SQLFileRepository) SetDownloadToken(fileID, token string) error {
+	return r.exec(ErrFileNotFound, `UPDATE files SET download_token = ? WHERE id = ?`, token, fileID)
+}
+
+func (r *SQLFileRepository) SetExpiry(fileID string, expiresAt *string) error {
+	return r.exec(ErrFileNotFound, `UPDATE files SET expires_at = ? WHERE id = ?`, expiresAt, fileID)
+}
+
+func (r *SQLFileRepository) SetMaxDownloads(fileID string, maxDownloads int) error {
+	return r.exec(ErrFileNotFound, `UPDATE files SET max_downloads = ? WHERE id = ?`, maxDownloads, fileID)
+}
+
+func (r *SQLFileRepository) SetSharePasswordHash(fileID, hash string) error {
+	return r.exec(ErrFileNotFound, `UPDATE files SET share_password_hash = ? WHERE id = ?`, nullIfEmpty(hash), fileID)
+}
+
+func (r *SQLFileRepository) SharePasswordHash(fileID string) (string, error) {
+	var hash sql.NullString
+	err := r.db.QueryRow(`SELECT share_password_hash FROM files WHERE id = ?`, fileID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFileNotFound
+	}
+	return hash.String, err
+}
+
+// RecordDownload checks the limits and increments the counters in single
+// statements, so concurrent downloads cannot both claim the last slot.
+func (r *SQLFileRepository) RecordDownload(fileID, linkID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type counter struct{ query, id string }
+	counters := []counter{
+		{`UPDATE files SET download_count = download_count + 1
+		  WHERE id = ? AND (max_downloads = -1 OR download_count < max_downloads)`, fileID},
+	}
+	if linkID != "" {
+		counters = append(counters, counter{`UPDATE share_links SET download_count = download_count + 1
+		  WHERE id = ? AND NOT revoked AND (max_downloads = -1 OR download_count < max_downloads)`, linkID})
+	}
+	for _, c := range counters {
+		result, err := tx.Exec(c.query, c.id)
+		if err != nil {
+			return fmt.Errorf("failed to increment download count: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return ErrDownloadLimitExceeded
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *SQLFileRepository) DeleteFile(fileID string) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var filename string
+	var blobHash sql.NullString
+	err = tx.QueryRow(`SELECT filename, blob_hash FROM files WHERE id = ?`, fileID).Scan(&filename, &blobHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFileNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get file: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM files WHERE id = ?`, fileID); err != nil {
+		return "", fmt.Errorf("failed to delete file from database: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM share_links WHERE file_id = ?`, fileID); err != nil {
+		return "", fmt.Errorf("failed to delete share links: %w", err)
+	}
+
+	// Files from before blobs were shared own their storage key outright.
+	orphan := filename
+	if blobHash.Valid {
+		if orphan, err = releaseBlob(tx, blobHash.String); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to delete file from database: %w", err)
+	}
+	return orphan, nil
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func usageOf(q queryRower, userID int) (bytes, count int64, err error) {
+	query := `SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM files WHERE user_id = ?`
+	if err := q.QueryRow(query, userID).Scan(&bytes, &count); err != nil {
+		return 0, 0, fmt.Errorf("failed to get usage: %w", err)
+	}
+	return bytes, count, nil
+}
+
+func (r *SQLFileRepository) Usage(userID int) (int64, int64, error) {
+	return usageOf(r.db, userID)
+}
+
+func (r *SQLFileRepository) Stats(topUsers int) (*Stats, error) {
+	stats := &Stats{TopUsers: []UserUsage{}}
+	var legacyBytes int64
+	for _, q := range []struct {
+		query string
+		dest  []interface{}
+	}{
+		{`SELECT COUNT(*), COALESCE(SUM(file_size), 0) FROM files`, []interface{}{&stats.Files, &stats.Bytes}},
+		{`SELECT COUNT(*), COALESCE(SUM(file_size), 0) FROM files WHERE user_id IS NULL`,
+			[]interface{}{&stats.AnonymousFiles, &stats.AnonymousBytes}},
+		{`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs`, []interface{}{&stats.Blobs, &stats.StoredBytes}},
+		// Files from before blobs were shared take up their own space.
+		{`SELECT COALESCE(SUM(file_size), 0) FROM files WHERE blob_hash IS NULL`, []interface{}{&legacyBytes}},
+		{`SELECT COUNT(*) FROM share_links`, []interface{}{&stats.ShareLinks}},
+		{`SELECT COUNT(*) FROM uploads`, []interface{}{&stats.PendingUploads}},
+	} {
+		if err := r.db.QueryRow(q.query).Scan(q.dest...); err != nil {
+			return nil, fmt.Errorf("failed to get stats: %w", err)
+		}
+	}
+	stats.StoredBytes += legacyBytes
+
+	query := `SELECT user_id, SUM(file_size), COUNT(*) FROM files WHERE user_id IS NOT NULL
+	          GROUP BY user_id ORDER BY SUM(file_size) DESC, user_id LIMIT ?`
+	rows, err := r.db.Query(query, topUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u UserUsage
+		if err := rows.Scan(&u.UserID, &u.UsedBytes, &u.FileCount); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		stats.TopUsers = append(stats.TopUsers, u)
+	}
+	return stats, rows.Err()
+}
+
+func (r *SQLFileRepository) QuotaOverrides(userID int) (QuotaOverrides, error) {
+	var overrides QuotaOverrides
+	var maxBytes, maxFiles, maxFileSize sql.NullInt64
+	query := `SELECT quota_bytes, quota_files, quota_file_size FROM users WHERE id = ?`
+	if err := r.db.QueryRow(query, userID).Scan(&maxBytes, &maxFiles, &maxFileSize); err != nil {
+		return overrides, fmt.Errorf("failed to get quota: %w", err)
+	}
+
+	for _, o := range []struct {
+		value sql.NullInt64
+		field **int64
+	}{
+		{maxBytes, &overrides.MaxBytes},
+		{maxFiles, &overrides.MaxFiles},
+		{maxFileSize, &overrides.MaxFileSize},
+	} {
+		if o.value.Valid {
+			n := o.value.Int64
+			*o.field = &n
+		}
+	}
+	return overrides, nil
+}
+
+func (r *SQLFileRepository) SetQuotaOverrides(userID int, overrides QuotaOverrides) error {
+	var sets []string
+	var args []interface{}
+	for _, o := range []struct {
+		column string
+		value  *int64
+	}{
+		{"quota_bytes", overrides.MaxBytes},
+		{"quota_files", overrides.MaxFiles},
+		{"quota_file_size", overrides.MaxFileSize},
+	} {
+		if o.value == nil {
+			continue
+		}
+		sets = append(sets, o.column+" = ?")
+		if *o.value == 0 {
+			args = append(args, nil)
+		} else {
+			args = append(args, *o.value)
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	query := `UPDATE users SET ` + strings.Join(sets, ", ") + ` WHERE id = ?`
+	if err := r.exec(fmt.Errorf("user %d not found", userID), query, append(args, userID)...); err != nil {
+		return fmt.Errorf("failed to update quota: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLFileRepository) RewrapDataKeys(rewrap func(wrapped string) (string, bool, error)) (int, error) {
+	// Data keys live on blobs, except for files encrypted before blobs were
+	// shared, which still carry their own.
+	tables := []struct{ table, id string }{
+		{"blobs", "hash"},
+		{"files", "id"},
+	}
+
+	rewrapped := 0
+	for _, t := range tables {
+		n, err := r.rewrapTable(t.table, t.id, rewrap)
+		rewrapped += n
+		if err != nil {
+			return rewrapped, err
+		}
+	}
+
+	return rewrapped, nil
+}
+
+func (r *SQLFileRepository) rewrapTable(table, idColumn string, rewrap func(string) (string, bool, error)) (int, error) {
+	query := fmt.Sprintf(`SELECT %s, wrapped_data_key FROM %s WHERE wrapped_data_key IS NOT NULL`, idColumn, table)
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query data keys: %w", err)
+	}
+
+	type wrappedKey struct {
+		id, wrapped string
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err := rows.Scan(&k.id, &k.wrapped); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan data key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	rewrapped := 0
+	for _, k := range keys {
+		wrapped, changed, err := rewrap(k.wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("data key of %s %s: %w", table, k.id, err)
+		}
+		if !changed {
+			continue
+		}
+
+		// Only replace the key we read, in case another rewrap got there first.
+		query := fmt.Sprintf(`UPDATE %s SET wrapped_data_key = ? WHERE %s = ? AND wrapped_data_key = ?`, table, idColumn)
+		if _, err := r.db.Exec(query, wrapped, k.id, k.wrapped); err != nil {
+			return rewrapped, fmt.Errorf("failed to update data key of %s %s: %w", table, k.id, err)
+		}
+		rewrapped++
+	}
+
+	return rewrapped, nil
+}
+
+const shareLinkColumns = `id, file_id, token, label, expires_at, max_downloads, download_count,
+	          revoked, password_hash IS NOT NULL, created_at`
+
+func scanShareLink(row interface{ Scan(...interface{}) error }) (*ShareLink, error) {
+	link := &ShareLink{}
+	err := row.Scan(&link.ID, &link.FileID, &link.Token, &link.Label, &link.ExpiresAt,
+		&link.MaxDownloads, &link.DownloadCount, &link.Revoked, &link.PasswordProtected, &link.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (r *SQLFileRepository) CreateShareLink(link *ShareLink, passwordHash string) error {
+	query := `INSERT INTO share_links (id, file_id, token, label, expires_at, max_downloads, revoked, password_hash)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := r.db.Exec(query, link.ID, link.FileID, link.Token, link.Label, link.ExpiresAt,
+		link.MaxDownloads, link.Revoked, nullIfEmpty(passwordHash))
+	if err != nil {
+		return fmt.Errorf("failed to create share link: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLFileRepository) getShareLink(where string, arg interface{}) (*ShareLink, error) {
+	link, err := scanShareLink(r.db.QueryRow(`SELECT `+shareLinkColumns+` FROM share_links WHERE `+where+` = ?`, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLinkNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share link: %w", err)
+	}
+	return link, nil
+}
+
+func (r *SQLFileRepository) GetShareLink(linkID string) (*ShareLink, error) {
+	return r.getShareLink("id", linkID)
+}
+
+func (r *SQLFileRepository) GetShareLinkByToken(token string) (*ShareLink, error) {
+	return r.getShareLink("token", token)
+}
+
+func (r *SQLFileRepository) ListShareLinks(fileID string) ([]*ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE file_id = ? ORDER BY created_at DESC`
+	rows, err := r.db.Query(query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share links: %w", err)
+	}
+	defer rows.Close()
+
+	links := []*ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan share link: %w", err)
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+func (r *SQLFileRepository) UpdateShareLink(linkID string, update ShareLinkUpdate) error {
+	var sets []string
+	var args []interface{}
+	if update.Label != nil {
+		sets = append(sets, "label = ?")
+		args = append(args, *update.Label)
+	}
+	if update.ExpiresAt != nil {
+		sets = append(sets, "expires_at = ?")
+		args = append(args, nullIfEmpty(*update.ExpiresAt))
+	}
+	if update.MaxDownloads != nil {
+		sets = append(sets, "max_downloads = ?")
+		args = append(args, *update.MaxDownloads)
+	}
+	if update.PasswordHash != nil {
+		sets = append(sets, "password_hash = ?")
+		args = append(args, nullIfEmpty(*update.PasswordHash))
+	}
+	if update.Revoked != nil {
+		sets = append(sets, "revoked = ?")
+		args = append(args, *update.Revoked)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	query := `UPDATE share_links SET ` + strings.Join(sets, ", ") + ` WHERE id = ?`
+	if err := r.exec(ErrLinkNotFound, query, append(args, linkID)...); err != nil {
+		return fmt.Errorf("failed to update share link: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLFileRepository) ShareLinkPasswordHash(linkID string) (string, error) {
+	var hash sql.NullString
+	err := r.db.QueryRow(`SELECT password_hash FROM share_links WHERE id = ?`, linkID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrLinkNotFound
+	}
+	return hash.String, err
+}
+
+func (r *SQLFileRepository) DeleteShareLink(linkID string) error {
+	if err := r.exec(ErrLinkNotFound, `DELETE FROM share_links WHERE id = ?`, linkID); err != nil {
+		return fmt.Errorf("failed to delete share link: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLFileRepository) CreateUpload(upload *Upload) error {
+	query := `INSERT INTO uploads (id, user_id, upload_length, filename, mime_type, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := r.db.Exec(query, upload.ID, upload.UserID, upload.Length, upload.Filename, upload.MimeType,
+		formatTimestamp(upload.ExpiresAt))
+	if err != nil {
+		return fmt.Errorf("failed to save upload metadata: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLFileRepository) GetUpload(uploadID string) (*Upload, error) {
+	upload := &Upload{}
+	query := `SELECT id, user_id, upload_length, upload_offset, filename, mime_type, expires_at, created_at
+	          FROM uploads WHERE id = ?`
+
+	err := r.db.QueryRow(query, uploadID).Scan(&upload.ID, &upload.UserID, &upload.Length,
+		&upload.Offset, &upload.Filename, &upload.MimeType, &upload.ExpiresAt, &upload.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload: %w", err)
+	}
+	return upload, nil
+}
+
+func (r *SQLFileRepository) AddUploadChunk(uploadID string, offset, size int64, storageKey string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE uploads SET upload_offset = ? WHERE id = ? AND upload_offset = ?`,
+		offset+size, uploadID, offset)
+	if err != nil {
+		return fmt.Errorf("failed to update upload offset: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM uploads WHERE id = ?)`, uploadID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to get upload: %w", err)
+		}
+		if !exists {
+			return ErrUploadNotFound
+		}
+		return ErrOffsetMismatch
+	}
+
+	if _, err := tx.Exec(`INSERT INTO upload_chunks (upload_id, upload_offset, storage_key) VALUES (?, ?, ?)`,
+		uploadID, offset, storageKey); err != nil {
+		return fmt.Errorf("failed to save upload chunk: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (r *SQLFileRepository) DeleteUpload(uploadID string) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Touching the upload's row first makes a concurrent delete wait here and
+	// then find nothing, rather than both getting the chunks.
+	result, err := tx.Exec(`UPDATE uploads SET upload_offset = upload_offset WHERE id = ?`, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock upload: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return nil, ErrUploadNotFound
+	}
+
+	rows, err := tx.Query(`SELECT storage_key FROM upload_chunks WHERE upload_id = ? ORDER BY upload_offset`, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upload chunks: %w", err)
+	}
+	var chunks []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan upload chunk: %w", err)
+		}
+		chunks = append(chunks, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM upload_chunks WHERE upload_id = ?`, uploadID); err != nil {
+		return nil, fmt.Errorf("failed to delete upload chunks: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM uploads WHERE id = ?`, uploadID); err != nil {
+		return nil, fmt.Errorf("failed to delete upload from database: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return chunks, nil
+}
+
+func (r *SQLFileRepository) ListExpiredUploads(now time.Time) ([]string, error) {
+	return r.listIDs(`SELECT id FROM uploads WHERE expires_at < ?`, formatTimestamp(now))
+}
+
+func (r *SQLFileRepository) ListUserUploads(userID int) ([]string, error) {
+	return r.listIDs(`SELECT id FROM uploads WHERE user_id = ?`, userID)
+}
+
+func nullIfZero(value int) interface{} {
+	if value == 0 {
+		return nil
+	}
+	return value
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
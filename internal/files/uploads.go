@@ -0,0 +1,242 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"anonlink/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+)
+
+// Upload is a partially received file from the resumable (tus) upload
+// endpoint. Each chunk is kept in storage under uploads/<id>/ until the
+// upload is complete and gets stored as a regular File, so any instance can
+// take the next chunk.
+type Upload struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func chunkPrefix(uploadID string) string {
+	return "uploads/" + uploadID + "/"
+}
+
+// CreateUpload starts a resumable upload. The quota is checked up front so
+// clients do not send a file that could never be stored, and again when the
+// upload completes.
+func (s *Service) CreateUpload(userID int, length int64, filename, mimeType string, ttl time.Duration) (*Upload, error) {
+	if err := s.checkQuota(userID, length); err != nil {
+		return nil, err
+	}
+
+	uploadID := uuid.New().String()
+	upload := &Upload{
+		ID:        uploadID,
+		UserID:    userID,
+		Length:    length,
+		Filename:  filename,
+		MimeType:  mimeType,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.repo.CreateUpload(upload); err != nil {
+		return nil, err
+	}
+
+	return s.GetUpload(userID, uploadID)
+}
+
+func (s *Service) GetUpload(userID int, uploadID string) (*Upload, error) {
+	upload, err := s.repo.GetUpload(uploadID)
+	if err != nil || upload.UserID != userID || !upload.ExpiresAt.After(time.Now()) {
+		return nil, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+// WriteUploadChunk appends r to the upload at offset. Once the last byte has
+// arrived the upload is turned into a File, which is returned alongside the
+// updated Upload. Of two requests writing at the same offset, the one that
+// finishes second fails with ErrOffsetMismatch and its chunk is dropped.
+func (s *Service) WriteUploadChunk(userID int, uploadID string, offset int64, r io.Reader) (*Upload, *File, error) {
+	upload, err := s.GetUpload(userID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset != upload.Offset {
+		return upload, nil, ErrOffsetMismatch
+	}
+
+	// Whatever arrived counts, even if the client went away halfway through
+	// the chunk; that is the whole point of resuming.
+	body := &partialReader{r: io.LimitReader(r, upload.Length-offset)}
+	key := chunkPrefix(uploadID) + uuid.New().String()
+	n, err := s.store.Put(key, body)
+	if err != nil {
+		s.store.Delete(key)
+		return nil, nil, fmt.Errorf("failed to store upload chunk: %w", err)
+	}
+
+	if n > 0 {
+		if err := s.repo.AddUploadChunk(uploadID, offset, n, key); err != nil {
+			s.store.Delete(key)
+			if errors.Is(err, ErrOffsetMismatch) {
+				if current, err := s.GetUpload(userID, uploadID); err == nil {
+					return current, nil, ErrOffsetMismatch
+				}
+				return nil, nil, ErrUploadNotFound
+			}
+			return nil, nil, err
+		}
+		upload.Offset += n
+	} else {
+		s.store.Delete(key)
+	}
+	if body.err != nil {
+		return upload, nil, fmt.Errorf("failed to write upload chunk: %w", body.err)
+	}
+
+	if upload.Offset < upload.Length {
+		return upload, nil, nil
+	}
+
+	file, err := s.completeUpload(upload)
+	if err != nil {
+		return upload, nil, err
+	}
+	return upload, file, nil
+}
+
+// partialReader ends at the first error from r instead of returning it, so
+// that the bytes read before it can still be stored.
+type partialReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// completeUpload stores the chunks of a fully received upload as a File. The
+// upload is gone afterwards even if that fails, since the same bytes would
+// only fail again.
+func (s *Service) completeUpload(upload *Upload) (*File, error) {
+	chunks, err := s.repo.DeleteUpload(upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.deleteChunks(upload.ID)
+
+	src := &chunkReader{store: s.store, keys: chunks}
+	defer src.Close()
+	return s.UploadFile(upload.UserID, FileMetadata{OriginalFilename: upload.Filename, MimeType: upload.MimeType}, src, upload.Length, FileSettings{})
+}
+
+// chunkReader reads the objects under keys one after the other.
+type chunkReader struct {
+	store storage.Storage
+	keys  []string
+	obj   storage.Object
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.obj == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			obj, err := c.store.Get(c.keys[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to open upload chunk: %w", err)
+			}
+			c.obj, c.keys = obj, c.keys[1:]
+		}
+		n, err := c.obj.Read(p)
+		if err == io.EOF {
+			c.obj.Close()
+			c.obj = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.obj != nil {
+		return c.obj.Close()
+	}
+	return nil
+}
+
+func (s *Service) TerminateUpload(userID int, uploadID string) error {
+	if _, err := s.GetUpload(userID, uploadID); err != nil {
+		return err
+	}
+	return s.removeUpload(uploadID)
+}
+
+// removeUpload deletes an upload and its chunks. It fails with
+// ErrUploadNotFound if the upload was completed or removed in the meantime.
+func (s *Service) removeUpload(uploadID string) error {
+	if _, err := s.repo.DeleteUpload(uploadID); err != nil {
+		return err
+	}
+	s.deleteChunks(uploadID)
+	return nil
+}
+
+// deleteChunks deletes everything stored for an upload, including chunks
+// that never made it into the database because their request failed.
+func (s *Service) deleteChunks(uploadID string) {
+	objects, err := s.store.List(chunkPrefix(uploadID))
+	if err != nil {
+		fmt.Printf("Warning: failed to list upload chunks: %s\n", err)
+		return
+	}
+	for _, obj := range objects {
+		if err := s.store.Delete(obj.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			fmt.Printf("Warning: failed to delete upload chunk from storage: %s\n", err)
+		}
+	}
+}
+
+func (s *Service) CleanupExpiredUploads() error {
+	expired, err := s.repo.ListExpiredUploads(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to query expired uploads: %w", err)
+	}
+
+	for _, id := range expired {
+		if err := s.removeUpload(id); err != nil && !errors.Is(err, ErrUploadNotFound) {
+			fmt.Printf("Warning: %s\n", err)
+		}
+	}
+
+	if len(expired) > 0 {
+		fmt.Printf("Cleaned up %d expired partial uploads\n", len(expired))
+	}
+
+	return nil
+}
@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/auth"
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 500
+	statsTopUsers        = 10
+)
+
+type AdminUserUpdateRequest struct {
+	Role      *string `json:"role"`
+	Suspended *bool   `json:"suspended"`
+}
+
+// RequireAdmin lets only administrators through.
+func (h *Handlers) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("role") != auth.RoleAdmin {
+			c.JSON(http.StatusForbidden, Response{
+				Success: false,
+				Error:   "Administrator access required",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func (h *Handlers) AdminListUsers(c *gin.Context) {
+	users, err := h.authService.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get users: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    users,
+	})
+}
+
+func (h *Handlers) AdminGetUser(c *gin.Context) {
+	user, ok := h.adminUser(c)
+	if !ok {
+		return
+	}
+	usage, err := h.fileService.GetUsage(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get usage: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    gin.H{"user": user, "usage": usage},
+	})
+}
+
+func (h *Handlers) AdminUpdateUser(c *gin.Context) {
+	var req AdminUserUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	user, ok := h.adminUser(c)
+	if !ok || !h.notSelf(c, user) {
+		return
+	}
+
+	if req.Role != nil && *req.Role != user.Role {
+		err := h.authService.SetRole(user.ID, *req.Role)
+		if errors.Is(err, auth.ErrInvalidRole) {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to update user: " + err.Error(),
+			})
+			return
+		}
+		h.adminEvent(c, audit.RoleChanged, user.ID, user.Username, "from "+user.Role+" to "+*req.Role)
+	}
+	if req.Suspended != nil && *req.Suspended != user.Suspended {
+		if err := h.authService.SetSuspended(user.ID, *req.Suspended); err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to update user: " + err.Error(),
+			})
+			return
+		}
+		event := audit.UserUnsuspended
+		if *req.Suspended {
+			event = audit.UserSuspended
+		}
+		h.adminEvent(c, event, user.ID, user.Username, "")
+	}
+
+	user, err := h.authService.GetUserByID(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get user: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "User updated",
+		Data:    user,
+	})
+}
+
+// AdminDeleteUser deletes an account along with everything it stores.
+func (h *Handlers) AdminDeleteUser(c *gin.Context) {
+	user, ok := h.adminUser(c)
+	if !ok || !h.notSelf(c, user) {
+		return
+	}
+
+	// Logging them out first keeps them from uploading while their files
+	// are being deleted.
+	if err := h.authService.SetSuspended(user.ID, true); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete user: " + err.Error(),
+		})
+		return
+	}
+	if err := h.fileService.DeleteUserFiles(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete the user's files: " + err.Error(),
+		})
+		return
+	}
+	if err := h.authService.DeleteUser(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete user: " + err.Error(),
+		})
+		return
+	}
+	h.adminEvent(c, audit.UserDeleted, user.ID, user.Username, "")
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "User deleted",
+	})
+}
+
+// adminUser looks up the user named by the :id parameter. On failure it has
+// already written the response.
+func (h *Handlers) adminUser(c *gin.Context) (*auth.User, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "User not found",
+		})
+		return nil, false
+	}
+
+	user, err := h.authService.GetUserByID(id)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "User not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get user: " + err.Error(),
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+// notSelf keeps admins from demoting, suspending or deleting themselves,
+// which could leave nobody to administer the instance.
+func (h *Handlers) notSelf(c *gin.Context, user *auth.User) bool {
+	if user.ID == c.GetInt("userID") {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "You cannot change your own account here",
+		})
+		return false
+	}
+	return true
+}
+
+// adminEvent records in the audit log that the administrator behind c did
+// something to the account or files of userID.
+func (h *Handlers) adminEvent(c *gin.Context, eventType string, userID int, username, detail string) {
+	h.audit.Record(audit.Event{
+		Type:          eventType,
+		UserID:        userID,
+		Username:      username,
+		ActorID:       c.GetInt("userID"),
+		ActorUsername: c.GetString("username"),
+		IPAddress:     c.ClientIP(),
+		Detail:        detail,
+	})
+}
+
+// AdminListFiles lists everyone's files, newest first, or those of one user
+// with ?user_id=.
+func (h *Handlers) AdminListFiles(c *gin.Context) {
+	var list []*files.File
+	var err error
+	if userID := c.Query("user_id"); userID != "" {
+		id, convErr := strconv.Atoi(userID)
+		if convErr != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "user_id must be a number",
+			})
+			return
+		}
+		list, err = h.fileService.GetUserFiles(id)
+	} else {
+		limit, offset, ok := pagination(c)
+		if !ok {
+			return
+		}
+		list, err = h.fileService.ListAllFiles(limit, offset)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get files: " + err.Error(),
+		})
+		return
+	}
+	if list == nil {
+		list = []*files.File{}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// pagination reads ?limit= and ?offset=. On failure it has already written
+// the response.
+func pagination(c *gin.Context) (limit, offset int, ok bool) {
+	limit, offset = defaultAdminPageSize, 0
+	var err error
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAdminPageSize {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "limit must be between 1 and " + strconv.Itoa(maxAdminPageSize),
+			})
+			return 0, 0, false
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "offset must not be negative",
+			})
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
+
+func (h *Handlers) AdminDeleteFile(c *gin.Context) {
+	file, err := h.fileService.GetFileByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "File not found",
+		})
+		return
+	}
+	if err := h.fileService.RemoveFile(file.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete file: " + err.Error(),
+		})
+		return
+	}
+	h.adminEvent(c, audit.FileDeleted, file.UserID, "", "file "+file.ID+" ("+file.OriginalFilename+")")
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File deleted successfully",
+	})
+}
+
+// AdminExpireFile makes a file's download token and share links stop
+// working right away.
+func (h *Handlers) AdminExpireFile(c *gin.Context) {
+	file, err := h.fileService.ExpireFile(c.Param("id"))
+	if errors.Is(err, files.ErrFileNotFound) {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "File not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	h.adminEvent(c, audit.FileExpired, file.UserID, "", "file "+file.ID+" ("+file.OriginalFilename+")")
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File expired, it will be deleted by the next cleanup",
+		Data:    file,
+	})
+}
+
+func (h *Handlers) AdminGetStats(c *gin.Context) {
+	users, err := h.authService.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get users: " + err.Error(),
+		})
+		return
+	}
+	stats, err := h.fileService.GetStats(statsTopUsers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get stats: " + err.Error(),
+		})
+		return
+	}
+
+	roles := make(map[string]int)
+	suspended := 0
+	for _, user := range users {
+		roles[user.Role]++
+		if user.Suspended {
+			suspended++
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: gin.H{
+			"users": gin.H{
+				"total":     len(users),
+				"roles":     roles,
+				"suspended": suspended,
+			},
+			"storage": stats,
+		},
+	})
+}
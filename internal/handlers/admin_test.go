@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/auth"
+)
+
+// loginToken logs in and returns the access token.
+func (s *testServer) loginToken(username, password string) string {
+	s.t.Helper()
+	w := s.login(username, password)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	decode(s.t, w, &data)
+	return data.Token
+}
+
+func (s *testServer) userID(username string) int {
+	s.t.Helper()
+	user, err := s.auth.GetUserByUsername(username)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return user.ID
+}
+
+func (s *testServer) adminEvents(filter audit.Filter) []*audit.Event {
+	s.t.Helper()
+	events, err := s.events.List(filter, 100, 0)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return events
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	// The first account is the admin.
+	root := s.register("root", "correct horse")
+	alice := s.register("alice", "correct horse")
+	_, apiToken, err := s.auth.CreateAPIToken(s.userID("root"), "script", []string{auth.ScopeFilesRead, auth.ScopeFilesWrite, auth.ScopeLinksManage}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(token string) int {
+		return s.do(httptest.NewRequest(http.MethodGet, "/api/v1/admin/users", nil), token).Code
+	}
+	if code := get(root); code != http.StatusOK {
+		t.Errorf("admin: %d", code)
+	}
+	if code := get(alice); code != http.StatusForbidden {
+		t.Errorf("user: %d", code)
+	}
+	// Not even the admin's own API tokens get in.
+	if code := get(apiToken); code != http.StatusForbidden {
+		t.Errorf("admin's API token: %d", code)
+	}
+	if code := get(""); code != http.StatusUnauthorized {
+		t.Errorf("no token: %d", code)
+	}
+
+	aliceID := strconv.Itoa(s.userID("alice"))
+	if w := s.sendJSON(http.MethodPatch, "/api/v1/admin/users/"+aliceID, alice, AdminUserUpdateRequest{Role: ptr(auth.RoleAdmin)}); w.Code != http.StatusForbidden {
+		t.Errorf("user making themselves admin: %d %s", w.Code, w.Body)
+	}
+	if user, _ := s.auth.GetUserByUsername("alice"); user.Role != auth.RoleUser {
+		t.Errorf("alice's role is %s", user.Role)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestAdminCannotChangeThemselves(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	root := s.register("root", "correct horse")
+	rootID := strconv.Itoa(s.userID("root"))
+
+	for _, req := range []AdminUserUpdateRequest{
+		{Role: ptr(auth.RoleUser)},
+		{Suspended: ptr(true)},
+	} {
+		if w := s.sendJSON(http.MethodPatch, "/api/v1/admin/users/"+rootID, root, req); w.Code != http.StatusBadRequest {
+			t.Errorf("updating themselves: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := s.do(httptest.NewRequest(http.MethodDelete, "/api/v1/admin/users/"+rootID, nil), root); w.Code != http.StatusBadRequest {
+		t.Errorf("deleting themselves: %d %s", w.Code, w.Body)
+	}
+
+	user, err := s.auth.GetUserByUsername("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != auth.RoleAdmin || user.Suspended {
+		t.Errorf("root is now %+v", user)
+	}
+	if len(s.adminEvents(audit.Filter{ActorID: user.ID})) != 0 {
+		t.Error("refused changes were recorded")
+	}
+}
+
+func TestAdminActionsAreAudited(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	root := s.register("root", "correct horse")
+	alice := s.register("alice", "correct horse")
+	s.register("bob", "correct horse")
+	rootID, aliceID, bobID := s.userID("root"), s.userID("alice"), s.userID("bob")
+	file := s.upload(alice, "notes.txt", "hello")
+
+	update := func(req AdminUserUpdateRequest) {
+		t.Helper()
+		if w := s.sendJSON(http.MethodPatch, "/api/v1/admin/users/"+strconv.Itoa(aliceID), root, req); w.Code != http.StatusOK {
+			t.Fatalf("update: %d %s", w.Code, w.Body)
+		}
+	}
+	update(AdminUserUpdateRequest{Role: ptr(auth.RoleReadOnly)})
+	update(AdminUserUpdateRequest{Suspended: ptr(true)})
+	update(AdminUserUpdateRequest{Suspended: ptr(false)})
+	// Setting what is already set changes nothing, so is not recorded.
+	update(AdminUserUpdateRequest{Role: ptr(auth.RoleReadOnly), Suspended: ptr(false)})
+	if w := s.do(httptest.NewRequest(http.MethodPost, "/api/v1/admin/files/"+file.ID+"/expire", nil), root); w.Code != http.StatusOK {
+		t.Fatalf("expire: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodDelete, "/api/v1/admin/files/"+file.ID, nil), root); w.Code != http.StatusOK {
+		t.Fatalf("delete file: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodDelete, "/api/v1/admin/users/"+strconv.Itoa(bobID), nil), root); w.Code != http.StatusOK {
+		t.Fatalf("delete user: %d %s", w.Code, w.Body)
+	}
+
+	events := s.adminEvents(audit.Filter{ActorID: rootID})
+	want := []struct {
+		event  string
+		userID int
+		detail string
+	}{
+		{audit.UserDeleted, bobID, ""},
+		{audit.FileDeleted, aliceID, file.ID},
+		{audit.FileExpired, aliceID, file.ID},
+		{audit.UserUnsuspended, aliceID, ""},
+		{audit.UserSuspended, aliceID, ""},
+		{audit.RoleChanged, aliceID, "from user to read-only"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("%d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Type != w.event || e.UserID != w.userID || !strings.Contains(e.Detail, w.detail) ||
+			e.ActorUsername != "root" || e.IPAddress == "" {
+			t.Errorf("event %d = %+v, want %s of user %d", i, e, w.event, w.userID)
+		}
+	}
+
+	// Admins can look them up by who did them.
+	w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/admin/audit?actor_id="+strconv.Itoa(rootID), nil), root)
+	var listed []audit.Event
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit: %d %s", w.Code, w.Body)
+	}
+	if decode(t, w, &listed); len(listed) != len(want) {
+		t.Errorf("audit?actor_id= listed %d events, want %d", len(listed), len(want))
+	}
+}
+
+func TestReadOnlyAccounts(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	s.register("root", "correct horse")
+	alice := s.register("alice", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+	_, apiToken, err := s.auth.CreateAPIToken(s.userID("alice"), "script", []string{auth.ScopeFilesRead, auth.ScopeFilesWrite, auth.ScopeLinksManage}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.auth.SetRole(s.userID("alice"), auth.RoleReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	alice = s.loginToken("alice", "correct horse")
+
+	// They can look at and download their files, with a login or a token.
+	for _, token := range []string{alice, apiToken} {
+		if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files", nil), token); w.Code != http.StatusOK {
+			t.Errorf("files: %d %s", w.Code, w.Body)
+		}
+		if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files/"+file.ID+"/download", nil), token); w.Code != http.StatusOK {
+			t.Errorf("download: %d %s", w.Code, w.Body)
+		}
+		if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files/"+file.ID+"/links", nil), token); w.Code != http.StatusOK {
+			t.Errorf("links: %d %s", w.Code, w.Body)
+		}
+	}
+
+	// But nothing that changes anything, whatever guards the route.
+	for _, r := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, "/api/v1/me/tokens", APITokenRequest{Name: "more", Scopes: []string{auth.ScopeFilesWrite}}},
+		{http.MethodPost, "/api/v1/me/invites", InviteRequest{}},
+		{http.MethodPatch, "/api/v1/files/" + file.ID, map[string]interface{}{"max_downloads": 3}},
+		{http.MethodDelete, "/api/v1/files/" + file.ID, nil},
+		{http.MethodPut, "/api/v1/files/" + file.ID + "/password", map[string]string{"password": "secret"}},
+		{http.MethodPost, "/api/v1/files/" + file.ID + "/links", map[string]string{}},
+	} {
+		for _, token := range []string{alice, apiToken} {
+			if w := s.sendJSON(r.method, r.path, token, r.body); w.Code != http.StatusForbidden {
+				t.Errorf("%s %s: %d %s", r.method, r.path, w.Code, w.Body)
+			}
+		}
+	}
+	if w := s.do(newUploadRequest(t, "more.txt", "more"), alice); w.Code != http.StatusForbidden {
+		t.Errorf("upload: %d %s", w.Code, w.Body)
+	}
+	if w := s.tus(http.MethodPost, "/api/v1/uploads/tus", alice, nil, map[string]string{"Upload-Length": "4"}); w.Code != http.StatusForbidden {
+		t.Errorf("tus upload: %d %s", w.Code, w.Body)
+	}
+	if list, err := s.auth.ListAPITokens(s.userID("alice")); err != nil || len(list) != 1 {
+		t.Errorf("API tokens = %d, %v; want the one", len(list), err)
+	}
+
+	// Looking after their own sign-in is still up to them.
+	if w := s.do(httptest.NewRequest(http.MethodPost, "/api/v1/me/2fa/enroll", nil), alice); w.Code != http.StatusOK {
+		t.Errorf("2fa enroll: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodPost, "/api/v1/logout", nil), alice); w.Code != http.StatusOK {
+		t.Errorf("logout: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files", nil), alice); w.Code != http.StatusUnauthorized {
+		t.Errorf("files after logging out: %d", w.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireAnonymousUploads answers 404, as if the route did not exist, unless
+// ANONYMOUS_UPLOADS is on.
+func (h *Handlers) RequireAnonymousUploads() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.cfg.AnonymousUploads {
+			c.JSON(http.StatusNotFound, Response{
+				Success: false,
+				Error:   "Anonymous uploads are not enabled",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// AnonymousUpload accepts an upload without an account. Besides the file, the
+// response carries a management token that replaces the owner's login for
+// deleting the file or changing its settings.
+func (h *Handlers) AnonymousUpload(c *gin.Context) {
+	ok, retryAfter, err := h.anonymousUploadLimiter.Take(c.ClientIP())
+	if !withinLimit(c, ok, retryAfter, err, "Too many uploads, try again later") {
+		return
+	}
+
+	maxSize := h.cfg.AnonymousMaxFileSize
+	form, ok := h.readUpload(c, maxSize)
+	if !ok {
+		return
+	}
+	defer form.part.Close()
+
+	file, manageToken, err := h.fileService.UploadAnonymousFile(form.meta, form.part, maxSize, form.settings)
+	if err != nil {
+		uploadError(c, err, maxSize)
+		return
+	}
+	if !form.checkTrailingFields(c) {
+		if err := h.fileService.DeleteAnonymousFile(manageToken); err != nil {
+			log.Printf("Failed to delete upload %s: %v", file.ID, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File uploaded successfully",
+		Data: gin.H{
+			"file":         file,
+			"manage_token": manageToken,
+		},
+	})
+}
+
+func (h *Handlers) GetManagedFile(c *gin.Context) {
+	file, err := h.fileService.GetFileByManageToken(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "File not found or expired",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    file,
+	})
+}
+
+func (h *Handlers) UpdateManagedFile(c *gin.Context) {
+	var req FileSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	settings, err := req.settings()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	file, err := h.fileService.UpdateAnonymousFile(c.Param("token"), settings)
+	if err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, files.ErrInvalidSettings) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File updated successfully",
+		Data:    file,
+	})
+}
+
+func (h *Handlers) DeleteManagedFile(c *gin.Context) {
+	if err := h.fileService.DeleteAnonymousFile(c.Param("token")); err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File deleted successfully",
+	})
+}
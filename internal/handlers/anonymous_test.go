@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"anonlink/internal/config"
+	"anonlink/internal/files"
+)
+
+// anonymousConfig is testConfig with anonymous uploads on.
+func anonymousConfig() *config.Config {
+	cfg := testConfig()
+	cfg.AnonymousUploads = true
+	cfg.AnonymousMaxFileSize = 1 << 20
+	cfg.AnonymousUploadsPerWindow = 100
+	cfg.AnonymousUploadWindow = time.Hour
+	return cfg
+}
+
+// uploadAnonymous uploads content without an account and returns the file
+// with its management token.
+func (s *testServer) uploadAnonymous(content string) (*files.File, string) {
+	s.t.Helper()
+	req := newUploadRequest(s.t, "cat.gif", content)
+	req.URL.Path = "/api/v1/anonymous/upload"
+	w := s.do(req, "")
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("anonymous upload: %d %s", w.Code, w.Body)
+	}
+	var data struct {
+		File        files.File `json:"file"`
+		ManageToken string     `json:"manage_token"`
+	}
+	decode(s.t, w, &data)
+	if data.ManageToken == "" {
+		s.t.Fatalf("no management token: %s", w.Body)
+	}
+	return &data.File, data.ManageToken
+}
+
+func TestAnonymousUploadsAreOptIn(t *testing.T) {
+	cfg := anonymousConfig()
+	s := newTestServer(t, cfg)
+	file, manageToken := s.uploadAnonymous("meow")
+
+	// Turned off, the routes are gone, for files uploaded before too.
+	cfg.AnonymousUploads = false
+	req := newUploadRequest(t, "cat.gif", "meow")
+	req.URL.Path = "/api/v1/anonymous/upload"
+	if w := s.do(req, ""); w.Code != http.StatusNotFound {
+		t.Errorf("upload: %d %s", w.Code, w.Body)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodDelete} {
+		if w := s.sendJSON(method, "/api/v1/manage/"+manageToken, "", FileSettingsRequest{}); w.Code != http.StatusNotFound {
+			t.Errorf("%s /manage: %d %s", method, w.Code, w.Body)
+		}
+	}
+	if _, err := s.files.GetFileByID(file.ID); err != nil {
+		t.Errorf("file after turning anonymous uploads off: %v", err)
+	}
+}
+
+func TestManageAnonymousUpload(t *testing.T) {
+	s := newTestServer(t, anonymousConfig())
+	file, manageToken := s.uploadAnonymous("meow")
+	other, _ := s.uploadAnonymous("woof")
+	alice := s.register("alice", "correct horse")
+	owned := s.upload(alice, "notes.txt", "hello")
+
+	// It downloads like any other file.
+	if w := s.get(http.MethodGet, "/api/v1/download/"+file.DownloadToken, nil); w.Code != http.StatusOK || w.Body.String() != "meow" {
+		t.Fatalf("download: %d %s", w.Code, w.Body)
+	}
+
+	// Neither a wrong token, nor the download token, nor anything else gets
+	// at the file or at anyone else's.
+	for _, token := range []string{"wrong", file.DownloadToken, owned.DownloadToken, owned.ID} {
+		path := "/api/v1/manage/" + token
+		if w := s.do(httptest.NewRequest(http.MethodGet, path, nil), ""); w.Code != http.StatusNotFound {
+			t.Errorf("GET with %q: %d %s", token, w.Code, w.Body)
+		}
+		if w := s.sendJSON(http.MethodPatch, path, "", FileSettingsRequest{MaxDownloads: ptr(1)}); w.Code != http.StatusNotFound {
+			t.Errorf("PATCH with %q: %d %s", token, w.Code, w.Body)
+		}
+		if w := s.do(httptest.NewRequest(http.MethodDelete, path, nil), ""); w.Code != http.StatusNotFound {
+			t.Errorf("DELETE with %q: %d %s", token, w.Code, w.Body)
+		}
+	}
+	for _, id := range []string{file.ID, other.ID, owned.ID} {
+		if f, err := s.files.GetFileByID(id); err != nil || f.MaxDownloads != -1 {
+			t.Errorf("file %s after wrong tokens: %+v, %v", id, f, err)
+		}
+	}
+
+	path := "/api/v1/manage/" + manageToken
+	w := s.do(httptest.NewRequest(http.MethodGet, path, nil), "")
+	var got files.File
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", w.Code, w.Body)
+	}
+	if decode(t, w, &got); got.ID != file.ID {
+		t.Errorf("GET returned file %s, want %s", got.ID, file.ID)
+	}
+	if w := s.sendJSON(http.MethodPatch, path, "", FileSettingsRequest{MaxDownloads: ptr(5)}); w.Code != http.StatusOK {
+		t.Errorf("PATCH: %d %s", w.Code, w.Body)
+	}
+	if w := s.sendJSON(http.MethodPatch, path, "", FileSettingsRequest{NeverExpire: true}); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH past the anonymous policy: %d %s", w.Code, w.Body)
+	}
+	if f, err := s.files.GetFileByID(file.ID); err != nil || f.MaxDownloads != 5 {
+		t.Errorf("after PATCH: %+v, %v", f, err)
+	}
+
+	if w := s.do(httptest.NewRequest(http.MethodDelete, path, nil), ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if w := s.get(http.MethodGet, "/api/v1/download/"+file.DownloadToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("download after DELETE: %d", w.Code)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodGet, path, nil), ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: %d", w.Code)
+	}
+	if w := s.get(http.MethodGet, "/api/v1/download/"+other.DownloadToken, nil); w.Code != http.StatusOK {
+		t.Errorf("other anonymous file after DELETE: %d", w.Code)
+	}
+}
+
+func TestAnonymousUploadRateLimit(t *testing.T) {
+	cfg := anonymousConfig()
+	cfg.AnonymousUploadsPerWindow = 2
+	s := newTestServer(t, cfg)
+	s.uploadAnonymous("one")
+	s.uploadAnonymous("two")
+
+	req := newUploadRequest(t, "cat.gif", "three")
+	req.URL.Path = "/api/v1/anonymous/upload"
+	if w := s.do(req, ""); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("third upload: %d %s", w.Code, w.Body)
+	}
+}
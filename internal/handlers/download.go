@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveFile sends file to the client, honouring Range, If-Range,
+// If-None-Match and friends through http.ServeContent. Downloads through a
+// share are counted, but only for requests that transfer the file from its
+// first byte, so resuming a download or seeking in a video does not use up
+// downloads.
+func (h *Handlers) serveFile(c *gin.Context, file *files.File, share *files.Share) {
+	if h.cfg.DownloadMode == "redirect" {
+		url, err := h.fileService.DownloadURL(file, h.cfg.PresignExpiry)
+		if err == nil {
+			if share != nil && !h.countDownload(c, share, "", time.Time{}) {
+				return
+			}
+			c.Redirect(http.StatusFound, url)
+			return
+		}
+		if !errors.Is(err, files.ErrPresignUnsupported) {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to generate download link",
+			})
+			return
+		}
+	}
+
+	obj, info, err := h.fileService.OpenFile(file)
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "File not found",
+		})
+		return
+	}
+	defer obj.Close()
+
+	etag := file.ETag()
+	if share != nil && !h.countDownload(c, share, etag, info.ModTime) {
+		return
+	}
+
+	c.Header("ETag", etag)
+	if file.Encrypted {
+		c.Header("Content-Disposition", "attachment")
+	} else {
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.OriginalFilename}))
+	}
+	c.Header("Content-Type", file.MimeType)
+	http.ServeContent(c.Writer, c.Request, file.OriginalFilename, info.ModTime, obj)
+}
+
+func (h *Handlers) countDownload(c *gin.Context, share *files.Share, etag string, modTime time.Time) bool {
+	if !countsAsDownload(c.Request, etag, modTime) {
+		return true
+	}
+
+	err := h.fileService.RecordDownload(share)
+	if errors.Is(err, files.ErrDownloadLimitExceeded) {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "File not found or expired",
+		})
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to count download of file %s: %v", share.File.ID, err)
+	}
+	return true
+}
+
+// countsAsDownload predicts whether http.ServeContent will answer r with the
+// file's first byte, i.e. a 200 or a 206 whose first range starts at zero.
+// Conditional requests that end in 304 or 412 never count.
+func countsAsDownload(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	if im := r.Header.Get("If-Match"); im != "" && !etagListMatches(im, etag, true) {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagListMatches(inm, etag, false) {
+		return false
+	}
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || !rangeApplies(r.Header.Get("If-Range"), etag, modTime) {
+		return true
+	}
+	return rangeStartsAtZero(rangeHeader)
+}
+
+func rangeApplies(ifRange, etag string, modTime time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !modTime.IsZero() && !modTime.Truncate(time.Second).After(t)
+}
+
+func rangeStartsAtZero(rangeHeader string) bool {
+	spec, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok {
+		return false
+	}
+	first, _, _ := strings.Cut(spec, ",")
+	start, _, _ := strings.Cut(strings.TrimSpace(first), "-")
+	n, err := strconv.ParseInt(start, 10, 64)
+	return err == nil && n == 0
+}
+
+func etagListMatches(list, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if !strong {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"anonlink/internal/config"
+	"anonlink/internal/encryption"
+)
+
+// encryptedConfig is testConfig with encryption at rest.
+func encryptedConfig(t *testing.T) *config.Config {
+	t.Helper()
+	key := make([]byte, encryption.DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.EncryptionKeyFile = filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(cfg.EncryptionKeyFile, []byte("test "+base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func (s *testServer) get(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return s.do(req, "")
+}
+
+func (s *testServer) downloadCount(fileID string) int {
+	s.t.Helper()
+	file, err := s.files.GetFileByID(fileID)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return file.DownloadCount
+}
+
+func TestDownloadRequests(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		name := "plaintext"
+		if encrypted {
+			name = "encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			if encrypted {
+				cfg = encryptedConfig(t)
+			}
+			s := newTestServer(t, cfg)
+			content := strings.Repeat("0123456789", 100)
+			file := s.upload(s.register("alice", "correct horse"), "digits.txt", content)
+			if stored, err := s.files.GetFileByID(file.ID); err != nil || (stored.WrappedDataKey != "") != encrypted {
+				t.Fatalf("stored %+v, %v; want encryption at rest %v", stored, err, encrypted)
+			}
+			path := "/api/v1/download/" + file.DownloadToken
+			stale := `"not-the-etag"`
+
+			count := 0
+			for _, c := range []struct {
+				name    string
+				method  string
+				headers map[string]string
+				status  int
+				body    string
+				counts  bool
+			}{
+				{"plain GET", http.MethodGet, nil, http.StatusOK, content, true},
+				{"HEAD", http.MethodHead, nil, http.StatusOK, "", false},
+				{"range mid-file", http.MethodGet, map[string]string{"Range": "bytes=100-199"}, http.StatusPartialContent, content[100:200], false},
+				{"open-ended range", http.MethodGet, map[string]string{"Range": "bytes=990-"}, http.StatusPartialContent, content[990:], false},
+				{"range from the start", http.MethodGet, map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, content[:10], true},
+				{"If-Range with a stale ETag", http.MethodGet, map[string]string{"Range": "bytes=100-199", "If-Range": stale}, http.StatusOK, content, true},
+				{"If-Range with the ETag", http.MethodGet, map[string]string{"Range": "bytes=100-199", "If-Range": file.ETag()}, http.StatusPartialContent, content[100:200], false},
+				{"If-None-Match", http.MethodGet, map[string]string{"If-None-Match": file.ETag()}, http.StatusNotModified, "", false},
+				{"If-None-Match with another ETag", http.MethodGet, map[string]string{"If-None-Match": stale}, http.StatusOK, content, true},
+				{"If-Match with another ETag", http.MethodGet, map[string]string{"If-Match": stale}, http.StatusPreconditionFailed, "", false},
+			} {
+				w := s.get(c.method, path, c.headers)
+				if w.Code != c.status {
+					t.Errorf("%s: %d, want %d", c.name, w.Code, c.status)
+					continue
+				}
+				if c.body != "" && w.Body.String() != c.body {
+					t.Errorf("%s: got %d bytes, want %d", c.name, w.Body.Len(), len(c.body))
+				}
+				if w.Code == http.StatusOK || w.Code == http.StatusPartialContent || w.Code == http.StatusNotModified {
+					if etag := w.Header().Get("ETag"); etag != file.ETag() {
+						t.Errorf("%s: ETag %q, want %q", c.name, etag, file.ETag())
+					}
+				}
+				if c.counts {
+					count++
+				}
+				if got := s.downloadCount(file.ID); got != count {
+					t.Errorf("%s: download count %d, want %d", c.name, got, count)
+				}
+			}
+
+			w := s.get(http.MethodGet, path, map[string]string{"Range": "bytes=100-199"})
+			if cr := w.Header().Get("Content-Range"); cr != "bytes 100-199/1000" {
+				t.Errorf("Content-Range %q", cr)
+			}
+			w = s.get(http.MethodHead, path, nil)
+			if cl := w.Header().Get("Content-Length"); cl != "1000" {
+				t.Errorf("HEAD Content-Length %q, want the plaintext size", cl)
+			}
+		})
+	}
+}
+
+// A download limit is only used up by downloads that count.
+func TestDownloadLimit(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	token := s.register("alice", "correct horse")
+	file := s.upload(token, "notes.txt", "hello, world")
+	limit := 1
+	if w := s.sendJSON(http.MethodPatch, "/api/v1/files/"+file.ID, token, FileSettingsRequest{MaxDownloads: &limit}); w.Code != http.StatusOK {
+		t.Fatalf("setting the limit: %d %s", w.Code, w.Body)
+	}
+	path := "/api/v1/download/" + file.DownloadToken
+
+	if w := s.get(http.MethodHead, path, nil); w.Code != http.StatusOK {
+		t.Errorf("HEAD: %d", w.Code)
+	}
+	if w := s.get(http.MethodGet, path, map[string]string{"Range": "bytes=5-"}); w.Code != http.StatusPartialContent {
+		t.Errorf("resuming: %d", w.Code)
+	}
+	if w := s.get(http.MethodGet, path, nil); w.Code != http.StatusOK {
+		t.Fatalf("the one download: %d", w.Code)
+	}
+	if w := s.get(http.MethodGet, path, nil); w.Code != http.StatusNotFound {
+		t.Errorf("download past the limit: %d", w.Code)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	file := s.upload(s.register("alice", "correct horse"), `a "quoted"; name.txt`, "hello")
+
+	w := s.get(http.MethodGet, "/api/v1/download/"+file.DownloadToken, nil)
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="a \"quoted\"; name.txt"` {
+		t.Errorf("Content-Disposition %s", cd)
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"anonlink/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// emailsPerWindow limits how many verification or reset emails one
+	// address or account can be sent, so nobody can flood an inbox.
+	emailsPerWindow = 3
+	emailWindow     = time.Hour
+)
+
+type EmailTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// RequireVerifiedEmail keeps users who have not verified their email
+// address from uploading, if REQUIRE_VERIFIED_EMAIL is on.
+func (h *Handlers) RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.cfg.RequireVerifiedEmail {
+			c.Next()
+			return
+		}
+		user, err := h.authService.GetUserByID(c.GetInt("userID"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to get user: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if !user.EmailVerified {
+			c.JSON(http.StatusForbidden, Response{
+				Success: false,
+				Error:   "Verify your email address before uploading",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// sendVerificationEmail is for new accounts. A failure is only logged, since
+// the account exists either way and the user can ask for another email.
+func (h *Handlers) sendVerificationEmail(user *auth.User) {
+	if !h.authService.EmailEnabled() {
+		return
+	}
+	if err := h.authService.SendVerificationEmail(user.ID); err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.Username, err)
+	}
+}
+
+// ResendVerificationEmail mails the logged-in user a new verification link.
+func (h *Handlers) ResendVerificationEmail(c *gin.Context) {
+	userID := c.GetInt("userID")
+	if !h.takeEmail(c, "verify:"+strconv.Itoa(userID)) {
+		return
+	}
+
+	err := h.authService.SendVerificationEmail(userID)
+	if errors.Is(err, auth.ErrEmailAlreadyVerified) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Your email address is already verified",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to send the email, try again later",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "We sent you a new link",
+	})
+}
+
+func (h *Handlers) VerifyEmail(c *gin.Context) {
+	var req EmailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	user, err := h.authService.VerifyEmail(req.Token)
+	if errors.Is(err, auth.ErrInvalidEmailToken) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "The link is invalid, expired or already used",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to verify email: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Your email address is verified",
+		Data:    user,
+	})
+}
+
+// RequestPasswordReset answers the same whether or not there is an account
+// with the address, and sends the email in the background so that the
+// response time does not tell either.
+func (h *Handlers) RequestPasswordReset(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if !h.takeEmail(c, "reset:"+strings.ToLower(req.Email)) {
+		return
+	}
+
+	go func() {
+		if err := h.authService.RequestPasswordReset(req.Email); err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "If there is an account with that address, we sent it a link to reset the password",
+	})
+}
+
+func (h *Handlers) ConfirmPasswordReset(c *gin.Context) {
+	var req PasswordResetConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	err := h.authService.ResetPassword(req.Token, req.Password)
+	if errors.Is(err, auth.ErrInvalidEmailToken) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "The link is invalid, expired or already used",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to reset password: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Your password has been changed, sign in with the new one",
+	})
+}
+
+// takeEmail counts an email against key's allowance. If it is used up, it
+// has already written the response.
+func (h *Handlers) takeEmail(c *gin.Context, key string) bool {
+	ok, retryAfter, err := h.emailLimiter.Take(key)
+	return withinLimit(c, ok, retryAfter, err, "Too many emails, try again later")
+}
@@ -1,24 +1,53 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"anonlink/internal/audit"
 	"anonlink/internal/auth"
+	"anonlink/internal/config"
 	"anonlink/internal/files"
+	"anonlink/internal/oidc"
+	"anonlink/internal/ratelimit"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	multipartOverhead = 1024 * 1024
+	maxFormFieldSize  = 4096
+)
+
 type Handlers struct {
 	authService *auth.Service
 	fileService *files.Service
+	cfg         *config.Config
+	// oidcProvider is nil unless single sign-on is configured.
+	oidcProvider *oidc.Provider
+	audit        *audit.Log
+
+	// ipLimiter counts the failed logins, registrations and share link
+	// passwords of each IP address.
+	ipLimiter              *ratelimit.Backoff
+	sharePasswordLimiter   *ratelimit.Limiter
+	anonymousUploadLimiter *ratelimit.Limiter
+	totpLimiter            *ratelimit.Limiter
+	emailLimiter           *ratelimit.Limiter
 }
 
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required,min=3,max=20"`
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
+	// InviteCode is needed if registration is by invite only.
+	InviteCode string `json:"invite_code"`
 }
 
 type LoginRequest struct {
@@ -33,13 +62,33 @@ type Response struct {
 	Error   string      `json:"error,omitempty"`
 }
 
-func New(authService *auth.Service, fileService *files.Service) *Handlers {
+// New returns the handlers. limits keeps the counters of the rate limits,
+// which replicas share if it is the SQL repository.
+func New(authService *auth.Service, fileService *files.Service, oidcProvider *oidc.Provider, auditLog *audit.Log, limits ratelimit.Repository, cfg *config.Config) *Handlers {
 	return &Handlers{
-		authService: authService,
-		fileService: fileService,
+		authService:  authService,
+		fileService:  fileService,
+		cfg:          cfg,
+		oidcProvider: oidcProvider,
+		audit:        auditLog,
+
+		ipLimiter:              ratelimit.NewBackoff(limits, "ip", cfg.IPMaxAttempts, cfg.LockoutBase, cfg.LockoutMax, ipFailureMemory),
+		sharePasswordLimiter:   ratelimit.New(limits, "share-password", cfg.SharePasswordMaxAttempts, cfg.SharePasswordWindow),
+		anonymousUploadLimiter: ratelimit.New(limits, "anonymous-upload", cfg.AnonymousUploadsPerWindow, cfg.AnonymousUploadWindow),
+		totpLimiter:            ratelimit.New(limits, "totp", cfg.TOTPMaxAttempts, cfg.TOTPAttemptWindow),
+		emailLimiter:           ratelimit.New(limits, "email", emailsPerWindow, emailWindow),
 	}
 }
 
+// registrationRefusals are the errors of a registration the policy does not
+// allow, with what to tell the user.
+var registrationRefusals = map[error]string{
+	auth.ErrRegistrationClosed:    "Registration is closed",
+	auth.ErrInviteRequired:        "An invite code is required to register",
+	auth.ErrInvalidInvite:         "The invite code is invalid, expired or used up",
+	auth.ErrEmailDomainNotAllowed: "Registration is not open to your email domain",
+}
+
 func (h *Handlers) Register(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -49,8 +98,29 @@ func (h *Handlers) Register(c *gin.Context) {
 		})
 		return
 	}
+	if !h.allowIP(c) {
+		return
+	}
 
-	user, err := h.authService.Register(req.Username, req.Email, req.Password)
+	user, err := h.authService.Register(req.Username, req.Email, req.Password, req.InviteCode)
+	if _, refused := registrationRefusals[err]; refused || errors.Is(err, auth.ErrUserExists) {
+		// Guessing invite codes, or which names and addresses are taken,
+		// costs the same as guessing passwords.
+		h.failIP(c)
+		h.audit.Record(audit.Event{
+			Type:      audit.RegisterFailed,
+			Username:  req.Username,
+			IPAddress: c.ClientIP(),
+			Detail:    err.Error(),
+		})
+	}
+	if message, ok := registrationRefusals[err]; ok {
+		c.JSON(http.StatusForbidden, Response{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
@@ -58,8 +128,9 @@ func (h *Handlers) Register(c *gin.Context) {
 		})
 		return
 	}
+	h.sendVerificationEmail(user)
 
-	token, err := h.authService.GenerateToken(user)
+	result, err := h.authService.LoginAs(user, clientInfo(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
@@ -71,10 +142,7 @@ func (h *Handlers) Register(c *gin.Context) {
 	c.JSON(http.StatusCreated, Response{
 		Success: true,
 		Message: "User created successfully",
-		Data: gin.H{
-			"user":  user,
-			"token": token,
-		},
+		Data:    loginResponse(result),
 	})
 }
 
@@ -87,27 +155,80 @@ func (h *Handlers) Login(c *gin.Context) {
 		})
 		return
 	}
+	if !h.allowIP(c) {
+		return
+	}
 
-	user, token, err := h.authService.Login(req.Username, req.Password)
-	if err != nil {
+	// Failures count against the address whatever the account, but
+	// logging in successfully does not clear them, or an attacker could
+	// keep logging in to an account of their own in between guesses.
+	result, err := h.authService.Login(req.Username, req.Password, clientInfo(c))
+	var locked *auth.AccountLockedError
+	if errors.As(err, &locked) {
+		h.failIP(c)
+		h.accountLocked(c, locked)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		h.failIP(c)
 		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
 			Error:   "Invalid credentials",
 		})
 		return
 	}
+	if errors.Is(err, auth.ErrAccountSuspended) {
+		c.JSON(http.StatusForbidden, Response{
+			Success: false,
+			Error:   "This account has been suspended",
+		})
+		return
+	}
+	if errors.Is(err, auth.ErrIdentityEmailUsed) {
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   "An account with your email address already exists, so your directory account cannot be linked to it",
+		})
+		return
+	}
+	if err != nil {
+		// The password may have been wrong as well, so this counts too;
+		// otherwise an outage would be a free pass for guessing.
+		log.Printf("Login failed: %v", err)
+		h.failIP(c)
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to log in",
+		})
+		return
+	}
 
+	message := "Login successful"
+	if result.MFAToken != "" {
+		message = "Two-factor authentication required"
+	}
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Message: "Login successful",
-		Data: gin.H{
-			"user":  user,
-			"token": token,
-		},
+		Message: message,
+		Data:    loginResponse(result),
 	})
 }
 
+// AuthMiddleware lets through requests with an access token or a personal
+// access token. This is where the read-only role is enforced: those accounts
+// may GET and HEAD, and nothing else.
 func (h *Handlers) AuthMiddleware() gin.HandlerFunc {
+	return h.authMiddleware(false)
+}
+
+// AccountAuthMiddleware is AuthMiddleware for the routes with which people
+// look after their own sign-in, such as logging out or setting up two-factor
+// authentication, which read-only accounts need as much as anyone.
+func (h *Handlers) AccountAuthMiddleware() gin.HandlerFunc {
+	return h.authMiddleware(true)
+}
+
+func (h *Handlers) authMiddleware(allowReadOnly bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -129,18 +250,55 @@ func (h *Handlers) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		claims, err := h.authService.ValidateToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, Response{
+		if strings.HasPrefix(tokenString, auth.APITokenPrefix) {
+			user, token, err := h.authService.ValidateAPIToken(tokenString)
+			if errors.Is(err, auth.ErrAccountSuspended) {
+				c.JSON(http.StatusForbidden, Response{
+					Success: false,
+					Error:   "This account has been suspended",
+				})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, Response{
+					Success: false,
+					Error:   "Invalid token",
+				})
+				c.Abort()
+				return
+			}
+
+			c.Set("userID", user.ID)
+			c.Set("username", user.Username)
+			c.Set("role", user.Role)
+			c.Set("apiToken", token)
+		} else {
+			claims, err := h.authService.ValidateToken(tokenString)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, Response{
+					Success: false,
+					Error:   "Invalid token",
+				})
+				c.Abort()
+				return
+			}
+
+			c.Set("userID", claims.UserID)
+			c.Set("username", claims.Username)
+			c.Set("role", claims.Role)
+			c.Set("sessionID", claims.SessionID)
+		}
+
+		method := c.Request.Method
+		if c.GetString("role") == auth.RoleReadOnly && !allowReadOnly && method != http.MethodGet && method != http.MethodHead {
+			c.JSON(http.StatusForbidden, Response{
 				Success: false,
-				Error:   "Invalid token",
+				Error:   "This account is read-only",
 			})
 			c.Abort()
 			return
 		}
-
-		c.Set("userID", claims.UserID)
-		c.Set("username", claims.Username)
 		c.Next()
 	}
 }
@@ -148,37 +306,205 @@ func (h *Handlers) AuthMiddleware() gin.HandlerFunc {
 func (h *Handlers) UploadFile(c *gin.Context) {
 	userID := c.GetInt("userID")
 
-	file, err := c.FormFile("file")
+	quota, err := h.fileService.GetQuota(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get quota: " + err.Error(),
+		})
+		return
+	}
+	maxSize := quota.FileSizeLimit()
+
+	form, ok := h.readUpload(c, maxSize)
+	if !ok {
+		return
+	}
+	defer form.part.Close()
+
+	uploadedFile, err := h.fileService.UploadFile(userID, form.meta, form.part, maxSize, form.settings)
+	if err != nil {
+		uploadError(c, err, maxSize)
+		return
+	}
+	if !form.checkTrailingFields(c) {
+		if err := h.fileService.DeleteFile(userID, uploadedFile.ID); err != nil {
+			log.Printf("Failed to delete upload %s: %v", uploadedFile.ID, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File uploaded successfully",
+		Data:    uploadedFile,
+	})
+}
+
+// uploadFields are the form fields an upload takes besides the file.
+var uploadFields = map[string]bool{
+	"encrypted":          true,
+	"encrypted_metadata": true,
+	"expires_in":         true,
+	"expires_at":         true,
+	"never_expire":       true,
+	"max_downloads":      true,
+}
+
+// formUpload is a multipart upload read up to its file part.
+type formUpload struct {
+	reader   *multipart.Reader
+	part     *multipart.Part
+	meta     files.FileMetadata
+	settings files.FileSettings
+}
+
+// checkTrailingFields reads the rest of the upload once the file part has
+// been stored. Fields sent after the file came too late to be applied, so
+// rather than silently ignoring them it fails the upload with a 400 saying
+// so, and returns false.
+func (u *formUpload) checkTrailingFields(c *gin.Context) bool {
+	for {
+		part, err := u.reader.NextPart()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Malformed upload: " + err.Error(),
+			})
+			return false
+		}
+		name := part.FormName()
+		part.Close()
+		if uploadFields[name] {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   name + " was sent after the file; form fields have to come before the file part",
+			})
+			return false
+		}
+	}
+}
+
+// readUpload advances a multipart upload to its file part, collecting the
+// form fields sent before it as FileMetadata and FileSettings. On failure it
+// has already written the response.
+func (h *Handlers) readUpload(c *gin.Context, maxSize int64) (*formUpload, bool) {
+	// Read the multipart body part by part instead of c.FormFile, which would
+	// buffer the whole upload before we get to see it.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+multipartOverhead)
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
 			Error:   "No file uploaded",
 		})
-		return
+		return nil, false
+	}
+
+	// Settings such as expires_in have to be sent before the file part, since
+	// we never go back once the file has been streamed to storage. Any sent
+	// after it are caught by checkTrailingFields.
+	fields := make(map[string]string)
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "No file uploaded",
+			})
+			return nil, false
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		value, _ := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		fields[part.FormName()] = string(value)
+		part.Close()
+	}
+
+	meta := files.FileMetadata{
+		OriginalFilename:  part.FileName(),
+		MimeType:          part.Header.Get("Content-Type"),
+		EncryptedMetadata: fields["encrypted_metadata"],
+	}
+	if v := fields["encrypted"]; v != "" {
+		meta.Encrypted, err = strconv.ParseBool(v)
+	}
+	settings, settingsErr := fileSettingsFromForm(fields)
+	if err == nil {
+		err = settingsErr
+	}
+	if err != nil {
+		part.Close()
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return nil, false
 	}
 
-	
-	if file.Size > 10*1024*1024 {
+	return &formUpload{reader: reader, part: part, meta: meta, settings: settings}, true
+}
+
+func uploadError(c *gin.Context, err error, maxSize int64) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, files.ErrFileTooLarge) || errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   fmt.Sprintf("File too large (max %s)", formatSize(maxSize)),
+		})
+		return
+	}
+	if errors.Is(err, files.ErrInvalidSettings) {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "File too large (max 10MB)",
+			Error:   err.Error(),
 		})
 		return
 	}
+	if errors.Is(err, files.ErrQuotaExceeded) {
+		c.JSON(http.StatusForbidden, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, Response{
+		Success: false,
+		Error:   "Failed to upload file: " + err.Error(),
+	})
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024 && size%(1024*1024) == 0:
+		return fmt.Sprintf("%dMB", size/(1024*1024))
+	case size >= 1024 && size%1024 == 0:
+		return fmt.Sprintf("%dKB", size/1024)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+func (h *Handlers) GetUsage(c *gin.Context) {
+	userID := c.GetInt("userID")
 
-	uploadedFile, err := h.fileService.UploadFile(userID, file)
+	usage, err := h.fileService.GetUsage(userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Error:   "Failed to upload file: " + err.Error(),
+			Error:   "Failed to get usage: " + err.Error(),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Message: "File uploaded successfully",
-		Data:    uploadedFile,
+		Data:    usage,
 	})
 }
 
@@ -232,16 +558,13 @@ func (h *Handlers) DownloadFile(c *gin.Context) {
 		return
 	}
 
-	filePath := h.fileService.GetFilePath(file.Filename)
-	c.Header("Content-Disposition", "attachment; filename=\""+file.OriginalFilename+"\"")
-	c.Header("Content-Type", file.MimeType)
-	c.File(filePath)
+	h.serveFile(c, file, nil)
 }
 
 func (h *Handlers) PublicDownload(c *gin.Context) {
 	token := c.Param("token")
 
-	file, err := h.fileService.GetFileByDownloadToken(token)
+	share, err := h.fileService.ResolveShare(token)
 	if err != nil {
 		c.JSON(http.StatusNotFound, Response{
 			Success: false,
@@ -250,16 +573,16 @@ func (h *Handlers) PublicDownload(c *gin.Context) {
 		return
 	}
 
-	
-	if err := h.fileService.IncrementDownloadCount(file.ID); err != nil {
-		
-		println("Failed to increment download count:", err.Error())
+	if !h.unlocked(c, share) {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Password required",
+			Data:    gin.H{"password_required": true},
+		})
+		return
 	}
 
-	filePath := h.fileService.GetFilePath(file.Filename)
-	c.Header("Content-Disposition", "attachment; filename=\""+file.OriginalFilename+"\"")
-	c.Header("Content-Type", file.MimeType)
-	c.File(filePath)
+	h.serveFile(c, share.File, share)
 }
 
 func (h *Handlers) GenerateNewShareLink(c *gin.Context) {
@@ -285,7 +608,7 @@ func (h *Handlers) GenerateNewShareLink(c *gin.Context) {
 func (h *Handlers) GetFileInfo(c *gin.Context) {
 	token := c.Param("token")
 
-	file, err := h.fileService.GetFileByDownloadToken(token)
+	share, err := h.fileService.ResolveShare(token)
 	if err != nil {
 		c.JSON(http.StatusNotFound, Response{
 			Success: false,
@@ -294,13 +617,20 @@ func (h *Handlers) GetFileInfo(c *gin.Context) {
 		return
 	}
 
-	
 	fileInfo := gin.H{
-		"original_filename": file.OriginalFilename,
-		"file_size":        file.FileSize,
-		"mime_type":        file.MimeType,
-		"download_count":   file.DownloadCount,
-		"expires_at":       file.ExpiresAt,
+		"file_size":         share.File.FileSize,
+		"download_count":    share.DownloadCount(),
+		"expires_at":        share.ExpiresAt(),
+		"password_required": share.PasswordProtected(),
+		"encrypted":         share.File.Encrypted,
+	}
+	if share.File.Encrypted {
+		// The key is in the URL fragment, which never reaches us; the client
+		// decrypts the name and type itself.
+		fileInfo["encrypted_metadata"] = share.File.EncryptedMetadata
+	} else {
+		fileInfo["original_filename"] = share.File.OriginalFilename
+		fileInfo["mime_type"] = share.File.MimeType
 	}
 
 	c.JSON(http.StatusOK, Response{
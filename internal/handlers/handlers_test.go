@@ -0,0 +1,457 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/auth"
+	"anonlink/internal/config"
+	"anonlink/internal/encryption"
+	"anonlink/internal/files"
+	"anonlink/internal/ratelimit"
+	"anonlink/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testServer is the API on memory repositories and local storage in a
+// temporary directory, with the routes the tests need.
+type testServer struct {
+	t      *testing.T
+	router *gin.Engine
+	auth   *auth.Service
+	files  *files.Service
+	events *audit.MemoryRepository
+	// storage is the directory the local storage keeps files in.
+	storage string
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		LocalAuth:                true,
+		RegistrationMode:         "open",
+		DefaultFileLifetime:      24 * time.Hour,
+		AnonymousDefaultLifetime: time.Hour,
+		MaxStoragePerUser:        files.Unlimited,
+		MaxFilesPerUser:          files.Unlimited,
+		MaxFileSize:              files.Unlimited,
+		IPMaxAttempts:            100,
+		LockoutBase:              time.Minute,
+		LockoutMax:               time.Hour,
+		SharePasswordMaxAttempts: 5,
+		SharePasswordWindow:      time.Minute,
+		UnlockTokenTTL:           10 * time.Minute,
+		TOTPMaxAttempts:          5,
+		TOTPAttemptWindow:        time.Minute,
+		PartialUploadExpiry:      time.Hour,
+	}
+}
+
+func newTestServer(t *testing.T, cfg *config.Config) *testServer {
+	t.Helper()
+	events := audit.NewMemoryRepository()
+	auditLog := audit.New(events)
+	authService := auth.NewService(auth.NewMemoryUserRepository(), auth.NewMemorySessionRepository(),
+		auth.NewMemoryAPITokenRepository(), "test-secret", auth.Options{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 24 * time.Hour,
+			Lockout:         auth.LockoutPolicy{MaxAttempts: cfg.LoginMaxAttempts, Base: cfg.LockoutBase, Max: cfg.LockoutMax},
+			Registration:    auth.RegistrationPolicy{Mode: cfg.RegistrationMode, Domains: strings.Fields(cfg.RegistrationDomains)},
+			Audit:           auditLog,
+		})
+	return newTestServerWith(t, cfg, authService, events)
+}
+
+func newTestServerWith(t *testing.T, cfg *config.Config, authService *auth.Service, events *audit.MemoryRepository) *testServer {
+	t.Helper()
+	root := t.TempDir()
+	store, err := storage.NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := files.Options{
+		Policy: files.ExpiryPolicy{
+			DefaultLifetime:  cfg.DefaultFileLifetime,
+			MaxLifetime:      cfg.MaxFileLifetime,
+			AllowNeverExpire: cfg.AllowNeverExpire,
+		},
+		AnonymousPolicy: files.ExpiryPolicy{
+			DefaultLifetime:  cfg.AnonymousDefaultLifetime,
+			MaxLifetime:      cfg.AnonymousMaxLifetime,
+			AllowNeverExpire: cfg.AnonymousAllowNeverExpire,
+		},
+		Quota: files.Quota{MaxBytes: cfg.MaxStoragePerUser, MaxFiles: cfg.MaxFilesPerUser, MaxFileSize: cfg.MaxFileSize},
+	}
+	if cfg.EncryptionKeyFile != "" {
+		keys, err := encryption.LoadLocalKeys(cfg.EncryptionKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Keys = keys
+	}
+	fileService := files.NewService(files.NewMemoryFileRepository(), store, opts)
+	h := New(authService, fileService, nil, audit.New(events), ratelimit.NewMemoryRepository(), cfg)
+
+	// The routes as cmd/main.go sets them up, but for OIDC and email.
+	r := gin.New()
+	api := r.Group("/api/v1")
+	api.POST("/register", h.Register)
+	api.POST("/login", h.Login)
+	api.POST("/login/mfa", h.LoginMFA)
+	read := h.RequireScope(auth.ScopeFilesRead)
+	write := h.RequireScope(auth.ScopeFilesWrite)
+	links := h.RequireScope(auth.ScopeLinksManage)
+	login := h.RequireLogin()
+
+	account := api.Group("/", h.AccountAuthMiddleware(), login)
+	account.POST("/logout", h.Logout)
+	account.GET("/me/sessions", h.GetSessions)
+	account.DELETE("/me/sessions/:id", h.DeleteSession)
+	account.POST("/me/2fa/enroll", h.EnrollTOTP)
+
+	protected := api.Group("/", h.AuthMiddleware())
+	protected.POST("/me/tokens", login, h.CreateAPIToken)
+	protected.POST("/me/invites", login, h.CreateInvite)
+	protected.POST("/upload", write, h.UploadFile)
+	protected.GET("/files", read, h.GetUserFiles)
+	protected.PATCH("/files/:id", write, h.UpdateFile)
+	protected.DELETE("/files/:id", write, h.DeleteFile)
+	protected.GET("/files/:id/download", read, h.DownloadFile)
+	protected.HEAD("/files/:id/download", read, h.DownloadFile)
+	protected.PUT("/files/:id/password", links, h.SetSharePassword)
+	protected.DELETE("/files/:id/password", links, h.RemoveSharePassword)
+	protected.GET("/files/:id/links", links, h.GetShareLinks)
+	protected.POST("/files/:id/links", links, h.CreateShareLink)
+	protected.PATCH("/files/:id/links/:linkId", links, h.UpdateShareLink)
+	protected.DELETE("/files/:id/links/:linkId", links, h.DeleteShareLink)
+
+	admin := protected.Group("/admin", login, h.RequireAdmin())
+	admin.GET("/users", h.AdminListUsers)
+	admin.PATCH("/users/:id", h.AdminUpdateUser)
+	admin.DELETE("/users/:id", h.AdminDeleteUser)
+	admin.DELETE("/files/:id", h.AdminDeleteFile)
+	admin.POST("/files/:id/expire", h.AdminExpireFile)
+	admin.GET("/audit", h.AdminListAuditEvents)
+
+	tus := api.Group("/uploads/tus", h.TusMiddleware(), h.AuthMiddleware(), write)
+	tus.POST("", h.TusCreate)
+	tus.HEAD("/:id", h.TusHead)
+	tus.PATCH("/:id", h.TusPatch)
+
+	api.GET("/download/:token", h.PublicDownload)
+	api.HEAD("/download/:token", h.PublicDownload)
+	api.POST("/download/:token", h.PasswordDownload)
+	api.POST("/download/:token/unlock", h.UnlockShare)
+	anonymous := api.Group("/", h.RequireAnonymousUploads())
+	anonymous.POST("/anonymous/upload", h.AnonymousUpload)
+	anonymous.GET("/manage/:token", h.GetManagedFile)
+	anonymous.PATCH("/manage/:token", h.UpdateManagedFile)
+	anonymous.DELETE("/manage/:token", h.DeleteManagedFile)
+
+	return &testServer{t: t, router: r, auth: authService, files: fileService, events: events, storage: root}
+}
+
+func (s *testServer) do(req *http.Request, token string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *testServer) postJSON(path string, body interface{}) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.sendJSON(http.MethodPost, path, "", body)
+}
+
+func (s *testServer) sendJSON(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	s.t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return s.do(req, token)
+}
+
+// newUploadRequest is an upload of content as a file called name.
+func newUploadRequest(t *testing.T, name, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, content)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// upload uploads content as a file called name and returns it.
+func (s *testServer) upload(token, name, content string) *files.File {
+	s.t.Helper()
+	w := s.do(newUploadRequest(s.t, name, content), token)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	var file files.File
+	decode(s.t, w, &file)
+	return &file
+}
+
+// decode reads a Response whose Data is decoded into data.
+func decode(t *testing.T, w *httptest.ResponseRecorder, data interface{}) Response {
+	t.Helper()
+	resp := Response{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+// register creates a user and returns their access token.
+func (s *testServer) register(username, password string) string {
+	s.t.Helper()
+	w := s.postJSON("/api/v1/register", RegisterRequest{Username: username, Email: username + "@example.com", Password: password})
+	if w.Code != http.StatusCreated {
+		s.t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	decode(s.t, w, &data)
+	return data.Token
+}
+
+func (s *testServer) login(username, password string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.postJSON("/api/v1/login", LoginRequest{Username: username, Password: password})
+}
+
+func (s *testServer) countEvents(eventType string) int {
+	s.t.Helper()
+	events, err := s.events.List(audit.Filter{Type: eventType}, 100, 0)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return len(events)
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	token := s.register("alice", "correct horse")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, "hello, world")
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	if w := s.do(req, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("upload without a token: %d", w.Code)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body.Bytes()))
+	w := s.do(req, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	var file files.File
+	decode(t, w, &file)
+	if file.OriginalFilename != "hello.txt" || file.FileSize != 12 {
+		t.Errorf("uploaded %+v", file)
+	}
+
+	var list []files.File
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files", nil), token); w.Code != http.StatusOK {
+		t.Fatalf("files: %d %s", w.Code, w.Body)
+	} else if decode(t, w, &list); len(list) != 1 || list[0].ID != file.ID {
+		t.Errorf("files = %+v", list)
+	}
+
+	w = s.do(httptest.NewRequest(http.MethodGet, "/api/v1/download/"+file.DownloadToken, nil), "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello, world" {
+		t.Fatalf("download: %d %q", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/download/nonsense", nil), ""); w.Code != http.StatusNotFound {
+		t.Errorf("download of an unknown token: %d", w.Code)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	s.register("alice", "correct horse")
+
+	if w := s.login("alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	if w := s.login("alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d", w.Code)
+	}
+	if w := s.login("bob", "correct horse"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown user: %d", w.Code)
+	}
+	if w := s.postJSON("/api/v1/login", map[string]string{"username": "alice"}); w.Code != http.StatusBadRequest {
+		t.Errorf("no password: %d", w.Code)
+	}
+}
+
+func TestLoginIPBlocking(t *testing.T) {
+	cfg := testConfig()
+	cfg.IPMaxAttempts = 3
+	s := newTestServer(t, cfg)
+	s.register("alice", "correct horse")
+
+	for i := 0; i < 3; i++ {
+		if w := s.login("alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: %d", i+1, w.Code)
+		}
+	}
+	w := s.login("alice", "correct horse")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("login from a blocked address: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if n := s.countEvents(audit.IPBlocked); n != 1 {
+		t.Errorf("%d IP blocks in the audit log, want 1", n)
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	cfg := testConfig()
+	cfg.LoginMaxAttempts = 2
+	s := newTestServer(t, cfg)
+	s.register("alice", "correct horse")
+
+	if w := s.login("alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("first wrong password: %d", w.Code)
+	}
+	for _, password := range []string{"wrong", "correct horse"} {
+		w := s.login("alice", password)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("login to a locked account: %d %s", w.Code, w.Body)
+		}
+		if retry := w.Header().Get("Retry-After"); retry == "" || retry == "0" {
+			t.Errorf("Retry-After %q", retry)
+		}
+	}
+	if n := s.countEvents(audit.AccountLocked); n != 1 {
+		t.Errorf("%d lockouts in the audit log, want 1", n)
+	}
+}
+
+func (s *testServer) tus(method, path, token string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return s.do(req, token)
+}
+
+func TestTusUpload(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	token := s.register("alice", "correct horse")
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("resumed.txt"))
+
+	w := s.tus(http.MethodPost, tusPath, token, nil, map[string]string{"Upload-Length": "11", "Upload-Metadata": metadata})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, tusPath+"/") {
+		t.Fatalf("Location %q", location)
+	}
+
+	chunk := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	if w := s.tus(http.MethodPatch, location, token, strings.NewReader("hello "), chunk); w.Code != http.StatusNoContent ||
+		w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("first chunk: %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := s.tus(http.MethodPatch, location, token, strings.NewReader("hello "), chunk); w.Code != http.StatusConflict {
+		t.Errorf("chunk at a stale offset: %d", w.Code)
+	}
+	if w := s.tus(http.MethodHead, location, token, nil, nil); w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("HEAD: %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	chunk["Upload-Offset"] = "6"
+	w = s.tus(http.MethodPatch, location, token, strings.NewReader("world"), chunk)
+	if w.Code != http.StatusNoContent || w.Header().Get("Anonlink-File-Id") == "" {
+		t.Fatalf("last chunk: %d, file %q", w.Code, w.Header().Get("Anonlink-File-Id"))
+	}
+	w = s.do(httptest.NewRequest(http.MethodGet, "/api/v1/download/"+w.Header().Get("Anonlink-Download-Token"), nil), "")
+	if w.Body.String() != "hello world" {
+		t.Errorf("downloaded %q", w.Body)
+	}
+
+	if w := s.tus(http.MethodPost, tusPath, token, nil, map[string]string{"Upload-Length": "0", "Upload-Metadata": metadata}); w.Code != http.StatusCreated ||
+		w.Header().Get("Anonlink-File-Id") == "" {
+		t.Errorf("empty upload: %d, file %q", w.Code, w.Header().Get("Anonlink-File-Id"))
+	}
+
+	// With storage gone, an empty upload cannot be stored either.
+	if err := os.RemoveAll(s.storage); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.storage, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := s.tus(http.MethodPost, tusPath, token, nil, map[string]string{"Upload-Length": "0", "Upload-Metadata": metadata}); w.Code != http.StatusInternalServerError {
+		t.Errorf("empty upload with storage broken: %d", w.Code)
+	}
+}
+
+// downAuthenticator stands in for a directory that cannot be reached.
+type downAuthenticator struct{}
+
+func (downAuthenticator) Authenticate(username, password string) (*auth.User, error) {
+	return nil, errors.New("directory is down")
+}
+
+func TestLoginFailureCountsAgainstIP(t *testing.T) {
+	cfg := testConfig()
+	cfg.IPMaxAttempts = 2
+	users := auth.NewMemoryUserRepository()
+	authService := auth.NewService(users, auth.NewMemorySessionRepository(), auth.NewMemoryAPITokenRepository(), "test-secret",
+		auth.Options{
+			AccessTokenTTL:  time.Minute,
+			RefreshTokenTTL: time.Hour,
+			Authenticators:  []auth.Authenticator{downAuthenticator{}},
+		})
+	s := newTestServerWith(t, cfg, authService, audit.NewMemoryRepository())
+
+	for i := 0; i < 2; i++ {
+		if w := s.login("alice", "guess"); w.Code != http.StatusInternalServerError {
+			t.Fatalf("login %d with the directory down: %d", i+1, w.Code)
+		}
+	}
+	if w := s.login("alice", "guess"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("login after failing twice: %d, want the address blocked", w.Code)
+	}
+}
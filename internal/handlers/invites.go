@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"anonlink/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type InviteRequest struct {
+	MaxUses   *int   `json:"max_uses"`
+	ExpiresIn *int64 `json:"expires_in"`
+}
+
+func (h *Handlers) GetInvites(c *gin.Context) {
+	invites, err := h.authService.ListInvites(c.GetInt("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get invites: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    invites,
+	})
+}
+
+// CreateInvite issues an invite code. Admins may always create them, and
+// users only if USER_INVITES is on.
+func (h *Handlers) CreateInvite(c *gin.Context) {
+	if c.GetString("role") != auth.RoleAdmin && !h.cfg.UserInvites {
+		c.JSON(http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Only administrators can create invites",
+		})
+		return
+	}
+
+	var req InviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	maxUses, ttl := 1, auth.DefaultInviteTTL
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	if req.ExpiresIn != nil {
+		ttl = time.Duration(*req.ExpiresIn) * time.Second
+	}
+
+	invite, code, err := h.authService.CreateInvite(c.GetInt("userID"), maxUses, ttl)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Failed to create invite: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Message: "Share this code now, it will not be shown again",
+		Data: gin.H{
+			"code":   code,
+			"invite": invite,
+		},
+	})
+}
+
+func (h *Handlers) DeleteInvite(c *gin.Context) {
+	h.deleteInvite(c, h.authService.DeleteInvite(c.GetInt("userID"), c.Param("id")))
+}
+
+func (h *Handlers) AdminListInvites(c *gin.Context) {
+	invites, err := h.authService.ListAllInvites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get invites: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    invites,
+	})
+}
+
+func (h *Handlers) AdminDeleteInvite(c *gin.Context) {
+	err := h.authService.RevokeInvite(c.Param("id"))
+	if err == nil {
+		log.Printf("Admin %s deleted invite %s", c.GetString("username"), c.Param("id"))
+	}
+	h.deleteInvite(c, err)
+}
+
+func (h *Handlers) deleteInvite(c *gin.Context, err error) {
+	if errors.Is(err, auth.ErrInviteNotFound) {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Invite not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete invite: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Invite deleted",
+	})
+}
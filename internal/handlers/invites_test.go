@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/auth"
+)
+
+func (s *testServer) registerWith(req RegisterRequest) int {
+	s.t.Helper()
+	return s.postJSON("/api/v1/register", req).Code
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	cfg := testConfig()
+	cfg.RegistrationMode = auth.RegistrationClosed
+	s := newTestServer(t, cfg)
+
+	if code := s.registerWith(RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "correct horse"}); code != http.StatusForbidden {
+		t.Errorf("register: %d, want 403", code)
+	}
+	if n := s.countEvents(audit.RegisterFailed); n != 1 {
+		t.Errorf("%d register_failed events, want 1", n)
+	}
+}
+
+func TestRegistrationByInvite(t *testing.T) {
+	cfg := testConfig()
+	cfg.RegistrationMode = auth.RegistrationInvite
+	s := newTestServer(t, cfg)
+	invite, code, err := s.auth.CreateInvite(0, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []string{"", "made-up"} {
+		if got := s.registerWith(RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "correct horse", InviteCode: c}); got != http.StatusForbidden {
+			t.Errorf("invite code %q: %d, want 403", c, got)
+		}
+	}
+	if got := s.registerWith(RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "correct horse", InviteCode: code}); got != http.StatusCreated {
+		t.Fatalf("with the invite: %d", got)
+	}
+	invites, err := s.auth.ListAllInvites()
+	if err != nil || len(invites) != 1 || invites[0].ID != invite.ID || invites[0].Uses != 1 {
+		t.Fatalf("invites = %+v, %v; want the one used once", invites, err)
+	}
+	if got := s.registerWith(RegisterRequest{Username: "bob", Email: "bob@example.com", Password: "correct horse", InviteCode: code}); got != http.StatusForbidden {
+		t.Errorf("used up invite: %d, want 403", got)
+	}
+}
+
+func TestRegistrationByDomain(t *testing.T) {
+	cfg := testConfig()
+	cfg.RegistrationMode = auth.RegistrationDomain
+	cfg.RegistrationDomains = "example.com"
+	s := newTestServer(t, cfg)
+
+	if got := s.registerWith(RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "correct horse"}); got != http.StatusCreated {
+		t.Errorf("allowed domain: %d", got)
+	}
+	w := s.postJSON("/api/v1/register", RegisterRequest{Username: "mallory", Email: "mallory@example.com.evil.example", Password: "correct horse"})
+	if resp := decode(t, w, nil); w.Code != http.StatusForbidden || resp.Error != registrationRefusals[auth.ErrEmailDomainNotAllowed] {
+		t.Errorf("other domain: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ShareLinkRequest struct {
+	Label        *string `json:"label"`
+	ExpiresAt    *string `json:"expires_at"`
+	ExpiresIn    *int64  `json:"expires_in"`
+	MaxDownloads *int    `json:"max_downloads"`
+	Password     *string `json:"password"`
+	Revoked      *bool   `json:"revoked"`
+}
+
+func (req *ShareLinkRequest) settings() (files.ShareLinkSettings, error) {
+	settings := files.ShareLinkSettings{
+		Label:        req.Label,
+		MaxDownloads: req.MaxDownloads,
+		Password:     req.Password,
+		Revoked:      req.Revoked,
+	}
+
+	if req.MaxDownloads != nil && *req.MaxDownloads != -1 && *req.MaxDownloads < 1 {
+		return settings, errors.New("max_downloads must be -1 (unlimited) or at least 1")
+	}
+
+	switch {
+	case req.ExpiresIn != nil:
+		if *req.ExpiresIn <= 0 {
+			return settings, errors.New("expires_in must be a positive number of seconds")
+		}
+		expiresAt := time.Now().UTC().Add(time.Duration(*req.ExpiresIn) * time.Second).Format("2006-01-02 15:04:05")
+		settings.ExpiresAt = &expiresAt
+	case req.ExpiresAt != nil && *req.ExpiresAt == "":
+		settings.ExpiresAt = req.ExpiresAt
+	case req.ExpiresAt != nil:
+		t, err := time.Parse(time.RFC3339, *req.ExpiresAt)
+		if err != nil {
+			return settings, errors.New("expires_at must be an RFC 3339 timestamp")
+		}
+		expiresAt := t.UTC().Format("2006-01-02 15:04:05")
+		settings.ExpiresAt = &expiresAt
+	}
+
+	return settings, nil
+}
+
+func (h *Handlers) GetShareLinks(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	links, err := h.fileService.GetShareLinks(userID, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    links,
+	})
+}
+
+func (h *Handlers) CreateShareLink(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	var req ShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	settings, err := req.settings()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	link, err := h.fileService.CreateShareLink(userID, c.Param("id"), settings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Message: "Share link created",
+		Data:    link,
+	})
+}
+
+func (h *Handlers) UpdateShareLink(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	var req ShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	settings, err := req.settings()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	link, err := h.fileService.UpdateShareLink(userID, c.Param("id"), c.Param("linkId"), settings)
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Share link updated",
+		Data:    link,
+	})
+}
+
+func (h *Handlers) DeleteShareLink(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	if err := h.fileService.DeleteShareLink(userID, c.Param("id"), c.Param("linkId")); err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Share link deleted",
+	})
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"anonlink/internal/files"
+)
+
+// createLink creates a share link for the file through the API.
+func (s *testServer) createLink(token, fileID string, req ShareLinkRequest) *files.ShareLink {
+	s.t.Helper()
+	w := s.sendJSON(http.MethodPost, "/api/v1/files/"+fileID+"/links", token, req)
+	if w.Code != http.StatusCreated {
+		s.t.Fatalf("create link: %d %s", w.Code, w.Body)
+	}
+	var link files.ShareLink
+	decode(s.t, w, &link)
+	return &link
+}
+
+func (s *testServer) listLinks(token, fileID string) []files.ShareLink {
+	s.t.Helper()
+	w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileID+"/links", nil), token)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("list links: %d %s", w.Code, w.Body)
+	}
+	var links []files.ShareLink
+	decode(s.t, w, &links)
+	return links
+}
+
+func TestShareLinks(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	alice := s.register("alice", "correct horse")
+	mallory := s.register("mallory", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+
+	bob := s.createLink(alice, file.ID, ShareLinkRequest{Label: ptr("for bob"), ExpiresIn: ptr(int64(3600))})
+	carol := s.createLink(alice, file.ID, ShareLinkRequest{})
+	if bob.Label != "for bob" || bob.ExpiresAt == nil || bob.MaxDownloads != -1 || bob.Token == carol.Token {
+		t.Errorf("created %+v", bob)
+	}
+	if links := s.listLinks(alice, file.ID); len(links) != 2 {
+		t.Errorf("%d links, want 2", len(links))
+	}
+
+	for _, req := range []ShareLinkRequest{
+		{MaxDownloads: ptr(0)},
+		{MaxDownloads: ptr(-2)},
+		{ExpiresIn: ptr(int64(0))},
+		{ExpiresAt: ptr("tomorrow")},
+	} {
+		if w := s.sendJSON(http.MethodPost, "/api/v1/files/"+file.ID+"/links", alice, req); w.Code != http.StatusBadRequest {
+			t.Errorf("create link with %+v: %d %s", req, w.Code, w.Body)
+		}
+	}
+
+	// Only the owner gets at the links.
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files/"+file.ID+"/links", nil), mallory); w.Code != http.StatusNotFound {
+		t.Errorf("someone else listing: %d %s", w.Code, w.Body)
+	}
+	if w := s.sendJSON(http.MethodPost, "/api/v1/files/"+file.ID+"/links", mallory, ShareLinkRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("someone else creating: %d %s", w.Code, w.Body)
+	}
+	if w := s.sendJSON(http.MethodPatch, "/api/v1/files/"+file.ID+"/links/"+bob.ID, mallory, ShareLinkRequest{Revoked: ptr(true)}); w.Code != http.StatusNotFound {
+		t.Errorf("someone else revoking: %d %s", w.Code, w.Body)
+	}
+
+	download := func(token string) int {
+		t.Helper()
+		return s.get(http.MethodGet, "/api/v1/download/"+token, nil).Code
+	}
+	for _, token := range []string{bob.Token, carol.Token, file.DownloadToken} {
+		if code := download(token); code != http.StatusOK {
+			t.Errorf("download %s: %d", token, code)
+		}
+	}
+
+	// Revoking one link leaves the others working.
+	w := s.sendJSON(http.MethodPatch, "/api/v1/files/"+file.ID+"/links/"+bob.ID, alice, ShareLinkRequest{Revoked: ptr(true)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if code := download(bob.Token); code != http.StatusNotFound {
+		t.Errorf("revoked link: %d", code)
+	}
+	for _, token := range []string{carol.Token, file.DownloadToken} {
+		if code := download(token); code != http.StatusOK {
+			t.Errorf("download %s after revoking another link: %d", token, code)
+		}
+	}
+
+	if w := s.do(httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+file.ID+"/links/"+carol.ID, nil), alice); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if code := download(carol.Token); code != http.StatusNotFound {
+		t.Errorf("deleted link: %d", code)
+	}
+	links := s.listLinks(alice, file.ID)
+	if len(links) != 1 || links[0].ID != bob.ID || !links[0].Revoked {
+		t.Errorf("links after deleting one: %+v", links)
+	}
+}
+
+func TestShareLinkLimits(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	alice := s.register("alice", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+
+	once := s.createLink(alice, file.ID, ShareLinkRequest{MaxDownloads: ptr(1)})
+	expired := s.createLink(alice, file.ID, ShareLinkRequest{ExpiresAt: ptr(time.Now().Add(-time.Minute).Format(time.RFC3339))})
+	open := s.createLink(alice, file.ID, ShareLinkRequest{})
+	download := func(token string) int {
+		t.Helper()
+		return s.get(http.MethodGet, "/api/v1/download/"+token, nil).Code
+	}
+
+	if code := download(expired.Token); code != http.StatusNotFound {
+		t.Errorf("expired link: %d", code)
+	}
+	if code := download(once.Token); code != http.StatusOK {
+		t.Fatalf("first download: %d", code)
+	}
+	if code := download(once.Token); code != http.StatusNotFound {
+		t.Errorf("second download through a single-use link: %d", code)
+	}
+	if code := download(open.Token); code != http.StatusOK {
+		t.Errorf("other link: %d", code)
+	}
+	if n := s.downloadCount(file.ID); n != 2 {
+		t.Errorf("file downloaded %d times, want 2", n)
+	}
+	links := map[string]files.ShareLink{}
+	for _, link := range s.listLinks(alice, file.ID) {
+		links[link.ID] = link
+	}
+	if links[once.ID].DownloadCount != 1 || links[open.ID].DownloadCount != 1 || links[expired.ID].DownloadCount != 0 {
+		t.Errorf("link download counts: %+v", links)
+	}
+
+	// Lifting the limit lets the link be used again; an expiry can be
+	// cleared the same way.
+	if w := s.sendJSON(http.MethodPatch, "/api/v1/files/"+file.ID+"/links/"+once.ID, alice, ShareLinkRequest{MaxDownloads: ptr(-1)}); w.Code != http.StatusOK {
+		t.Fatalf("lift limit: %d %s", w.Code, w.Body)
+	}
+	if code := download(once.Token); code != http.StatusOK {
+		t.Errorf("download after lifting the limit: %d", code)
+	}
+	if w := s.sendJSON(http.MethodPatch, "/api/v1/files/"+file.ID+"/links/"+expired.ID, alice, ShareLinkRequest{ExpiresAt: ptr("")}); w.Code != http.StatusOK {
+		t.Fatalf("clear expiry: %d %s", w.Code, w.Body)
+	}
+	if code := download(expired.Token); code != http.StatusOK {
+		t.Errorf("download after clearing the expiry: %d", code)
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipFailureMemory is how long an IP address's failed attempts count
+// against it.
+const ipFailureMemory = 24 * time.Hour
+
+// allowIP checks that the client's address is not waiting out a block
+// after too many failed logins, registrations or share link passwords. If
+// it is, it has already written the response.
+func (h *Handlers) allowIP(c *gin.Context) bool {
+	ok, retryAfter, err := h.ipLimiter.Allow(c.ClientIP())
+	return withinLimit(c, ok, retryAfter, err, "Too many failed attempts, try again later")
+}
+
+// withinLimit takes what a limiter said about a request and reports whether
+// the request may go on. If not, it has already written a 429 response with
+// message, or a 500 if the limiter failed.
+func withinLimit(c *gin.Context, ok bool, retryAfter time.Duration, err error, message string) bool {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to check rate limit: " + err.Error(),
+		})
+		return false
+	}
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, Response{
+			Success: false,
+			Error:   message,
+		})
+		return false
+	}
+	return true
+}
+
+// failIP counts a failed attempt against the client's address, recording
+// it in the audit log if that blocks the address.
+func (h *Handlers) failIP(c *gin.Context) {
+	ip := c.ClientIP()
+	block, err := h.ipLimiter.Fail(ip)
+	if err != nil {
+		log.Printf("Failed to count failed attempt of %s: %v", ip, err)
+	}
+	if block > 0 {
+		h.audit.Record(audit.Event{
+			Type:      audit.IPBlocked,
+			IPAddress: ip,
+			Detail:    "for " + block.String() + " after failing at " + c.FullPath(),
+		})
+	}
+}
+
+// accountLocked answers a login to a locked account, mailing its owner an
+// unlock link if the login is what locked it.
+func (h *Handlers) accountLocked(c *gin.Context, locked *auth.AccountLockedError) {
+	if locked.NewlyLocked && h.authService.EmailEnabled() {
+		ok, _, err := h.emailLimiter.Take("unlock:" + strconv.Itoa(locked.UserID))
+		if err != nil {
+			log.Printf("Failed to check email rate limit of user %d: %v", locked.UserID, err)
+		}
+		if ok {
+			go func() {
+				if err := h.authService.SendUnlockEmail(locked.UserID); err != nil {
+					log.Printf("Failed to send unlock email to user %d: %v", locked.UserID, err)
+				}
+			}()
+		}
+	}
+
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(locked.Until).Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, Response{
+		Success: false,
+		Error:   "Too many wrong passwords, the account is locked for now",
+	})
+}
+
+// UnlockAccount unlocks an account with the token from the email sent when
+// it was locked.
+func (h *Handlers) UnlockAccount(c *gin.Context) {
+	var req EmailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	_, err := h.authService.UnlockAccount(req.Token, clientInfo(c))
+	if errors.Is(err, auth.ErrInvalidEmailToken) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "The link is invalid, expired or already used",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to unlock account: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Your account is unlocked",
+	})
+}
+
+func (h *Handlers) AdminUnlockUser(c *gin.Context) {
+	user, ok := h.adminUser(c)
+	if !ok {
+		return
+	}
+	if err := h.authService.UnlockUser(user.ID, "admin "+c.GetString("username")); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to unlock user: " + err.Error(),
+		})
+		return
+	}
+
+	user, err := h.authService.GetUserByID(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get user: " + err.Error(),
+		})
+		return
+	}
+	log.Printf("Admin %s unlocked user %s", c.GetString("username"), user.Username)
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "User unlocked",
+		Data:    user,
+	})
+}
+
+// AdminListAuditEvents lists the audit log, newest first, optionally only
+// the events of one ?type=, ?user_id=, ?actor_id= or ?ip=.
+func (h *Handlers) AdminListAuditEvents(c *gin.Context) {
+	filter := audit.Filter{
+		Type:      c.Query("type"),
+		IPAddress: c.Query("ip"),
+	}
+	for param, id := range map[string]*int{"user_id": &filter.UserID, "actor_id": &filter.ActorID} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   param + " must be a number",
+			})
+			return
+		}
+		*id = n
+	}
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return
+	}
+
+	events, err := h.audit.List(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get audit log: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    events,
+	})
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"anonlink/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func mfaError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, auth.ErrInvalidMFAToken), errors.Is(err, auth.ErrInvalidMFACode):
+		status = http.StatusUnauthorized
+	case errors.Is(err, auth.ErrTOTPRequired), errors.Is(err, auth.ErrAccountSuspended):
+		status = http.StatusForbidden
+	case errors.Is(err, auth.ErrTOTPAlreadyEnabled), errors.Is(err, auth.ErrTOTPNotEnabled), errors.Is(err, auth.ErrTOTPNotPending):
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, Response{
+		Success: false,
+		Error:   err.Error(),
+	})
+}
+
+// checkTOTP runs verify, which checks a code from userID, unless they have
+// got too many codes wrong lately.
+func (h *Handlers) checkTOTP(c *gin.Context, userID int, verify func() error) bool {
+	key := strconv.Itoa(userID)
+	ok, retryAfter, err := h.totpLimiter.Allow(key)
+	if !withinLimit(c, ok, retryAfter, err, "Too many wrong codes, try again later") {
+		return false
+	}
+
+	err = verify()
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		if err := h.totpLimiter.Fail(key); err != nil {
+			log.Printf("Failed to count wrong code of user %d: %v", userID, err)
+		}
+	}
+	if err != nil {
+		mfaError(c, err)
+		return false
+	}
+	if err := h.totpLimiter.Reset(key); err != nil {
+		log.Printf("Failed to reset wrong codes of user %d: %v", userID, err)
+	}
+	return true
+}
+
+func (h *Handlers) LoginMFA(c *gin.Context) {
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	challenge, err := h.authService.ParseMFAToken(req.MFAToken)
+	if err != nil {
+		mfaError(c, err)
+		return
+	}
+
+	var result *auth.LoginResult
+	if !h.checkTOTP(c, challenge.UserID, func() (err error) {
+		result, err = h.authService.CompleteMFA(req.MFAToken, req.Code, clientInfo(c))
+		return err
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Login successful",
+		Data:    loginResponse(result),
+	})
+}
+
+func (h *Handlers) LoginMFAEnroll(c *gin.Context) {
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	enrollment, err := h.authService.EnrollTOTPForChallenge(req.MFAToken)
+	if err != nil {
+		mfaError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Add the secret to your authenticator app, then log in with a code from it",
+		Data:    enrollment,
+	})
+}
+
+func (h *Handlers) GetTOTPStatus(c *gin.Context) {
+	status, err := h.authService.GetTOTPStatus(c.GetInt("userID"))
+	if err != nil {
+		mfaError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    status,
+	})
+}
+
+func (h *Handlers) EnrollTOTP(c *gin.Context) {
+	user, err := h.authService.GetUserByID(c.GetInt("userID"))
+	if err != nil {
+		mfaError(c, err)
+		return
+	}
+
+	enrollment, err := h.authService.EnrollTOTP(user)
+	if err != nil {
+		mfaError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Add the secret to your authenticator app and confirm with a code from it",
+		Data:    enrollment,
+	})
+}
+
+func (h *Handlers) ConfirmTOTP(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	var req TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var codes []string
+	if !h.checkTOTP(c, userID, func() (err error) {
+		codes, err = h.authService.ConfirmTOTP(userID, req.Code)
+		return err
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Two-factor authentication enabled. Store the recovery codes somewhere safe",
+		Data:    gin.H{"recovery_codes": codes},
+	})
+}
+
+func (h *Handlers) RegenerateRecoveryCodes(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	var req TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var codes []string
+	if !h.checkTOTP(c, userID, func() (err error) {
+		codes, err = h.authService.RegenerateRecoveryCodes(userID, req.Code)
+		return err
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "New recovery codes generated; the old ones no longer work",
+		Data:    gin.H{"recovery_codes": codes},
+	})
+}
+
+func (h *Handlers) DisableTOTP(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	var req TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if !h.checkTOTP(c, userID, func() error {
+		return h.authService.DisableTOTP(userID, req.Code)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Two-factor authentication disabled",
+	})
+}
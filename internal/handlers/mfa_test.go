@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// totpNow is the code an authenticator app shows for secret right now.
+func totpNow(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+// loginMFA logs in with the password and returns the MFA token the login
+// has to be finished with.
+func (s *testServer) loginMFA(username, password string) string {
+	s.t.Helper()
+	w := s.login(username, password)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	var data map[string]interface{}
+	decode(s.t, w, &data)
+	if _, ok := data["access_token"]; ok {
+		s.t.Fatalf("login handed out tokens without a second factor: %s", w.Body)
+	}
+	token, _ := data["mfa_token"].(string)
+	if data["mfa_required"] != true || token == "" {
+		s.t.Fatalf("login did not ask for a second factor: %s", w.Body)
+	}
+	return token
+}
+
+func TestLoginMFARateLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.TOTPMaxAttempts = 3
+	s := newTestServer(t, cfg)
+	s.register("alice", "correct horse")
+	user, err := s.auth.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollment, err := s.auth.EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := s.auth.ConfirmTOTP(user.ID, totpNow(t, enrollment.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfaToken := s.loginMFA("alice", "correct horse")
+	for i := 0; i < cfg.TOTPMaxAttempts; i++ {
+		w := s.postJSON("/api/v1/login/mfa", MFALoginRequest{MFAToken: mfaToken, Code: "000000"})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+
+	// Once limited, not even a right code is looked at.
+	w := s.postJSON("/api/v1/login/mfa", MFALoginRequest{MFAToken: mfaToken, Code: codes[0]})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("right code after too many wrong ones: %d %s", w.Code, w.Body)
+	}
+	// Nor does a new challenge start the count over.
+	w = s.postJSON("/api/v1/login/mfa", MFALoginRequest{MFAToken: s.loginMFA("alice", "correct horse"), Code: codes[0]})
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("new challenge: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginMFA(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	s.register("alice", "correct horse")
+	user, err := s.auth.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollment, err := s.auth.EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := s.auth.ConfirmTOTP(user.ID, totpNow(t, enrollment.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfaToken := s.loginMFA("alice", "correct horse")
+	if w := s.postJSON("/api/v1/login/mfa", MFALoginRequest{MFAToken: mfaToken, Code: "000000"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code: %d %s", w.Code, w.Body)
+	}
+	w := s.postJSON("/api/v1/login/mfa", MFALoginRequest{MFAToken: mfaToken, Code: codes[0]})
+	if w.Code != http.StatusOK {
+		t.Fatalf("recovery code: %d %s", w.Code, w.Body)
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	decode(t, w, &data)
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files", nil), data.Token); w.Code != http.StatusOK {
+		t.Errorf("files with the token from the second step: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files", nil), mfaToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("files with the MFA token: %d", w.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"anonlink/internal/auth"
+	"anonlink/internal/oidc"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	oidcStateCookie = "anonlink_oidc"
+	// oidcStateTTL is how long someone has to log in at the provider.
+	oidcStateTTL = 10 * time.Minute
+)
+
+// GetAuthMethods tells the web app which ways to log in to offer.
+func (h *Handlers) GetAuthMethods(c *gin.Context) {
+	registration := h.cfg.RegistrationMode
+	if !h.cfg.LocalAuth {
+		registration = auth.RegistrationClosed
+	}
+	methods := gin.H{
+		"local":              h.cfg.LocalAuth,
+		"ldap":               h.cfg.LDAPURL != "",
+		"registration":       registration,
+		"email_verification": h.authService.EmailEnabled(),
+		"password_reset":     h.cfg.LocalAuth && h.authService.EmailEnabled(),
+	}
+	if h.oidcProvider != nil {
+		methods["oidc"] = gin.H{"name": h.cfg.OIDCProviderName}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    methods,
+	})
+}
+
+// OIDCLogin sends the browser to the provider. The state, nonce and PKCE
+// verifier travel along in a signed cookie for OIDCCallback to check.
+func (h *Handlers) OIDCLogin(c *gin.Context) {
+	req, err := oidc.NewAuthRequest()
+	if err != nil {
+		h.oidcFailed(c, "Failed to start single sign-on")
+		return
+	}
+	redirect, err := h.oidcProvider.AuthCodeURL(req)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		h.oidcFailed(c, "The identity provider is not reachable")
+		return
+	}
+	state, err := h.authService.GenerateOIDCStateToken(auth.OIDCState{
+		State:    req.State,
+		Nonce:    req.Nonce,
+		Verifier: req.Verifier,
+	}, oidcStateTTL)
+	if err != nil {
+		h.oidcFailed(c, "Failed to start single sign-on")
+		return
+	}
+
+	h.setOIDCCookie(c, state, int(oidcStateTTL.Seconds()))
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// OIDCCallback finishes a login when the provider sends the browser back,
+// and hands the result to the web app's login page in the URL fragment,
+// which never reaches a server.
+func (h *Handlers) OIDCCallback(c *gin.Context) {
+	cookie, _ := c.Cookie(oidcStateCookie)
+	h.setOIDCCookie(c, "", -1)
+
+	if providerError := c.Query("error"); providerError != "" {
+		message := c.Query("error_description")
+		if message == "" {
+			message = providerError
+		}
+		h.oidcFailed(c, "The identity provider refused the login: "+message)
+		return
+	}
+
+	state, err := h.authService.ParseOIDCStateToken(cookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.State), []byte(c.Query("state"))) != 1 {
+		h.oidcFailed(c, "The login expired or was started in another browser, please try again")
+		return
+	}
+
+	identity, err := h.oidcProvider.Exchange(c.Query("code"), &oidc.AuthRequest{
+		State:    state.State,
+		Nonce:    state.Nonce,
+		Verifier: state.Verifier,
+	})
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		h.oidcFailed(c, "Single sign-on failed")
+		return
+	}
+
+	result, err := h.authService.LoginWithIdentity(auth.ExternalIdentity{
+		Issuer:        identity.Issuer,
+		Subject:       identity.Subject,
+		Email:         identity.Email,
+		EmailVerified: identity.EmailVerified,
+		Username:      identity.PreferredUsername,
+	}, clientInfo(c))
+	switch {
+	case errors.Is(err, auth.ErrNoLinkedAccount):
+		h.oidcFailed(c, "There is no account for you here yet, ask an administrator to create one")
+		return
+	case errors.Is(err, auth.ErrIdentityNoEmail):
+		h.oidcFailed(c, "The identity provider did not share your email address")
+		return
+	case errors.Is(err, auth.ErrAccountSuspended):
+		h.oidcFailed(c, "This account has been suspended")
+		return
+	case errors.Is(err, auth.ErrIdentityAccountProtected):
+		h.oidcFailed(c, "An account with your email address already exists; log in with its password instead")
+		return
+	case errors.Is(err, auth.ErrIdentityEmailUsed):
+		h.oidcFailed(c, "An account with your email address already exists, but the identity provider has not verified the address")
+		return
+	case err != nil:
+		log.Printf("OIDC login failed: %v", err)
+		h.oidcFailed(c, "Single sign-on failed")
+		return
+	}
+
+	data, err := json.Marshal(loginResponse(result))
+	if err != nil {
+		h.oidcFailed(c, "Single sign-on failed")
+		return
+	}
+	h.redirectToLogin(c, url.Values{"oidc": {base64.RawURLEncoding.EncodeToString(data)}})
+}
+
+func (h *Handlers) oidcFailed(c *gin.Context, message string) {
+	h.redirectToLogin(c, url.Values{"error": {message}})
+}
+
+func (h *Handlers) redirectToLogin(c *gin.Context, fragment url.Values) {
+	c.Redirect(http.StatusFound, h.cfg.FrontendURL+"/login#"+fragment.Encode())
+}
+
+// The cookie only goes to the callback. SameSite=Lax still sends it there,
+// since the provider sends the browser back with a top-level GET.
+func (h *Handlers) setOIDCCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	secure := strings.HasPrefix(h.cfg.OIDCRedirectURL, "https://")
+	c.SetCookie(oidcStateCookie, value, maxAge, "/api/v1/auth/oidc", "", secure, true)
+}
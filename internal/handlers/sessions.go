@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonlink/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func clientInfo(c *gin.Context) auth.ClientInfo {
+	return auth.ClientInfo{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+func tokenResponse(tokens *auth.Tokens) gin.H {
+	return gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}
+}
+
+// loginResponse holds either tokens or, when a second factor is needed, the
+// MFA token to continue at /login/mfa with.
+func loginResponse(result *auth.LoginResult) gin.H {
+	if result.MFAToken != "" {
+		return gin.H{
+			"mfa_required":        true,
+			"mfa_token":           result.MFAToken,
+			"enrollment_required": result.MustEnroll,
+		}
+	}
+
+	data := tokenResponse(result.Tokens)
+	data["user"] = result.User
+	if result.RecoveryCodes != nil {
+		data["recovery_codes"] = result.RecoveryCodes
+	}
+	return data
+}
+
+func (h *Handlers) RefreshToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	tokens, err := h.authService.Refresh(req.RefreshToken)
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused from %s; session revoked", c.ClientIP())
+	}
+	if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid refresh token",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to refresh token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    tokenResponse(tokens),
+	})
+}
+
+func (h *Handlers) Logout(c *gin.Context) {
+	if err := h.authService.Logout(c.GetString("sessionID")); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to log out: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Logged out",
+	})
+}
+
+func (h *Handlers) LogoutAll(c *gin.Context) {
+	count, err := h.authService.LogoutAll(c.GetInt("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to log out: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Logged out of all sessions",
+		Data:    gin.H{"sessions": count},
+	})
+}
+
+func (h *Handlers) GetSessions(c *gin.Context) {
+	sessions, err := h.authService.ListSessions(c.GetInt("userID"), c.GetString("sessionID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get sessions: " + err.Error(),
+		})
+		return
+	}
+	if sessions == nil {
+		sessions = []*auth.Session{}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    sessions,
+	})
+}
+
+func (h *Handlers) DeleteSession(c *gin.Context) {
+	err := h.authService.RevokeSession(c.GetInt("userID"), c.Param("id"))
+	if errors.Is(err, auth.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Session not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to revoke session: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Session revoked",
+	})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FileSettingsRequest is accepted as JSON by PATCH /files/:id and as form
+// fields by the upload endpoints, where they have to come before the file
+// part.
+type FileSettingsRequest struct {
+	ExpiresIn    *int64  `json:"expires_in"`
+	ExpiresAt    *string `json:"expires_at"`
+	NeverExpire  bool    `json:"never_expire"`
+	MaxDownloads *int    `json:"max_downloads"`
+}
+
+func (req *FileSettingsRequest) settings() (files.FileSettings, error) {
+	settings := files.FileSettings{
+		NeverExpire:  req.NeverExpire,
+		MaxDownloads: req.MaxDownloads,
+	}
+
+	if req.ExpiresIn != nil {
+		if *req.ExpiresIn <= 0 {
+			return settings, errors.New("expires_in must be a positive number of seconds")
+		}
+		d := time.Duration(*req.ExpiresIn) * time.Second
+		settings.ExpiresIn = &d
+	}
+	if req.ExpiresAt != nil {
+		t, err := time.Parse(time.RFC3339, *req.ExpiresAt)
+		if err != nil {
+			return settings, errors.New("expires_at must be an RFC 3339 timestamp")
+		}
+		settings.ExpiresAt = &t
+	}
+
+	return settings, nil
+}
+
+func fileSettingsFromForm(values map[string]string) (files.FileSettings, error) {
+	var req FileSettingsRequest
+
+	if v, ok := values["expires_in"]; ok && v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return files.FileSettings{}, errors.New("expires_in must be a number of seconds")
+		}
+		req.ExpiresIn = &n
+	}
+	if v, ok := values["expires_at"]; ok && v != "" {
+		req.ExpiresAt = &v
+	}
+	if v, ok := values["never_expire"]; ok && v != "" {
+		never, err := strconv.ParseBool(v)
+		if err != nil {
+			return files.FileSettings{}, errors.New("never_expire must be true or false")
+		}
+		req.NeverExpire = never
+	}
+	if v, ok := values["max_downloads"]; ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return files.FileSettings{}, errors.New("max_downloads must be a number")
+		}
+		req.MaxDownloads = &n
+	}
+
+	return req.settings()
+}
+
+func (h *Handlers) UpdateFile(c *gin.Context) {
+	userID := c.GetInt("userID")
+	fileID := c.Param("id")
+
+	var req FileSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	settings, err := req.settings()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	file, err := h.fileService.UpdateFileSettings(userID, fileID, settings)
+	if err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, files.ErrInvalidSettings) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "File updated successfully",
+		Data:    file,
+	})
+}
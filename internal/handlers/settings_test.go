@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"bytes"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"anonlink/internal/files"
+)
+
+// formField is one form field of a multipart upload.
+type formField struct{ name, value string }
+
+// newFormUploadRequest is an upload to path of content as a file called
+// name, with the form fields before and after the file part.
+func newFormUploadRequest(t *testing.T, path string, before []formField, name, content string, after []formField) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	write := func(fields []formField) {
+		for _, f := range fields {
+			if err := mw.WriteField(f.name, f.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(before)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	write(after)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestUploadSettings(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxFileLifetime = 48 * time.Hour
+	s := newTestServer(t, cfg)
+	alice := s.register("alice", "correct horse")
+
+	w := s.do(newFormUploadRequest(t, "/api/v1/upload", []formField{{"expires_in", "3600"}, {"max_downloads", "2"}, {"note", "ignored"}},
+		"notes.txt", "hello", []formField{{"submit", "Upload"}}), alice)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	var file files.File
+	decode(t, w, &file)
+	expiresAt, err := time.Parse("2006-01-02 15:04:05", *file.ExpiresAt)
+	if err != nil || file.MaxDownloads != 2 || time.Until(expiresAt) > time.Hour || time.Until(expiresAt) < 59*time.Minute {
+		t.Errorf("uploaded %+v", file)
+	}
+
+	for name, fields := range map[string][]formField{
+		"expires_in of 0":         {{"expires_in", "0"}},
+		"expires_in not a number": {{"expires_in", "soon"}},
+		"expires_at not RFC 3339": {{"expires_at", "tomorrow"}},
+		"past the maximum":        {{"expires_in", "172801"}},
+		"never_expire":            {{"never_expire", "true"}},
+		"max_downloads of 0":      {{"max_downloads", "0"}},
+	} {
+		if w := s.do(newFormUploadRequest(t, "/api/v1/upload", fields, "notes.txt", "hello", nil), alice); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestUploadFieldsAfterTheFile(t *testing.T) {
+	s := newTestServer(t, anonymousConfig())
+	alice := s.register("alice", "correct horse")
+
+	for _, path := range []string{"/api/v1/upload", "/api/v1/anonymous/upload"} {
+		req := newFormUploadRequest(t, path, nil, "notes.txt", "hello", []formField{{"max_downloads", "1"}})
+		w := s.do(req, alice)
+		if w.Code != http.StatusBadRequest || !bytes.Contains(w.Body.Bytes(), []byte("max_downloads was sent after the file")) {
+			t.Errorf("%s with a setting after the file: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	// Neither upload was kept.
+	if w := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/files", nil), alice); w.Code != http.StatusOK || bytes.Contains(w.Body.Bytes(), []byte("notes.txt")) {
+		t.Errorf("files: %d %s", w.Code, w.Body)
+	}
+	err := filepath.WalkDir(s.storage, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("%s left in storage", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxFileLifetime = 48 * time.Hour
+	s := newTestServer(t, cfg)
+	alice := s.register("alice", "correct horse")
+	mallory := s.register("mallory", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+	path := "/api/v1/files/" + file.ID
+
+	w := s.sendJSON(http.MethodPatch, path, alice, FileSettingsRequest{ExpiresIn: ptr(int64(7200)), MaxDownloads: ptr(5)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	var updated files.File
+	decode(t, w, &updated)
+	if updated.MaxDownloads != 5 || updated.ExpiresAt == nil || *updated.ExpiresAt == *file.ExpiresAt {
+		t.Errorf("updated %+v", updated)
+	}
+
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	if w := s.sendJSON(http.MethodPatch, path, alice, FileSettingsRequest{ExpiresAt: &expiresAt}); w.Code != http.StatusOK {
+		t.Errorf("update expires_at: %d %s", w.Code, w.Body)
+	}
+
+	for name, req := range map[string]FileSettingsRequest{
+		"expires_in of 0":         {ExpiresIn: ptr(int64(0))},
+		"expires_at not RFC 3339": {ExpiresAt: ptr("tomorrow")},
+		"past the maximum":        {ExpiresIn: ptr(int64(3 * 24 * 3600))},
+		"both":                    {ExpiresIn: ptr(int64(60)), ExpiresAt: &expiresAt},
+		"never_expire":            {NeverExpire: true},
+		"max_downloads of 0":      {MaxDownloads: ptr(0)},
+	} {
+		if w := s.sendJSON(http.MethodPatch, path, alice, req); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	if w := s.sendJSON(http.MethodPatch, path, mallory, FileSettingsRequest{MaxDownloads: ptr(-1)}); w.Code != http.StatusNotFound {
+		t.Errorf("someone else's file: %d %s", w.Code, w.Body)
+	}
+
+	stored, err := s.files.GetFileByID(file.ID)
+	if err != nil || stored.MaxDownloads != 5 {
+		t.Errorf("after the refused updates: %+v, %v", stored, err)
+	}
+}
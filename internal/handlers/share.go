@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"anonlink/internal/audit"
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SharePasswordRequest struct {
+	Password string `json:"password" form:"password" binding:"required"`
+}
+
+func (h *Handlers) SetSharePassword(c *gin.Context) {
+	userID := c.GetInt("userID")
+	fileID := c.Param("id")
+
+	var req SharePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	file, err := h.fileService.SetSharePassword(userID, fileID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Share link password set",
+		Data:    file,
+	})
+}
+
+func (h *Handlers) RemoveSharePassword(c *gin.Context) {
+	userID := c.GetInt("userID")
+	fileID := c.Param("id")
+
+	file, err := h.fileService.SetSharePassword(userID, fileID, "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Share link password removed",
+		Data:    file,
+	})
+}
+
+// UnlockShare trades the password of a protected link for a short-lived
+// unlock token that can be passed to GET /download/:token, which keeps plain
+// links (and range requests from download managers) working.
+func (h *Handlers) UnlockShare(c *gin.Context) {
+	token := c.Param("token")
+
+	share, ok := h.passwordProtectedShare(c, token)
+	if !ok {
+		return
+	}
+
+	fingerprint, err := h.fileService.SharePasswordFingerprint(share)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate unlock token",
+		})
+		return
+	}
+	unlockToken, expiresAt, err := h.authService.GenerateUnlockToken(token, fingerprint, h.cfg.UnlockTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate unlock token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: gin.H{
+			"unlock_token": unlockToken,
+			"expires_at":   expiresAt.UTC().Format(time.RFC3339),
+			"download_url": "/api/v1/download/" + share.Token() + "?unlock=" + unlockToken,
+		},
+	})
+}
+
+// PasswordDownload serves a protected file directly from a POSTed password.
+func (h *Handlers) PasswordDownload(c *gin.Context) {
+	share, ok := h.passwordProtectedShare(c, c.Param("token"))
+	if !ok {
+		return
+	}
+
+	h.serveFile(c, share.File, share)
+}
+
+// passwordProtectedShare resolves token and checks the password in the
+// request body, writing the error response itself when that fails.
+func (h *Handlers) passwordProtectedShare(c *gin.Context, token string) (*files.Share, bool) {
+	share, err := h.fileService.ResolveShare(token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "File not found or expired",
+		})
+		return nil, false
+	}
+	if !share.PasswordProtected() {
+		return share, true
+	}
+
+	var req SharePasswordRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Password required",
+		})
+		return nil, false
+	}
+
+	if !h.allowIP(c) {
+		return nil, false
+	}
+	ok, retryAfter, err := h.sharePasswordLimiter.Allow(token)
+	if !withinLimit(c, ok, retryAfter, err, "Too many wrong passwords, try again later") {
+		return nil, false
+	}
+
+	if !h.fileService.CheckSharePassword(share, req.Password) {
+		if err := h.sharePasswordLimiter.Fail(token); err != nil {
+			log.Printf("Failed to count wrong password for file %s: %v", share.File.ID, err)
+		}
+		h.failIP(c)
+		h.audit.Record(audit.Event{
+			Type:      audit.SharePasswordFailed,
+			UserID:    share.File.UserID,
+			IPAddress: c.ClientIP(),
+			Detail:    "file " + share.File.ID,
+		})
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Wrong password",
+		})
+		return nil, false
+	}
+
+	if err := h.sharePasswordLimiter.Reset(token); err != nil {
+		log.Printf("Failed to reset wrong passwords for file %s: %v", share.File.ID, err)
+	}
+	return share, true
+}
+
+func (h *Handlers) unlocked(c *gin.Context, share *files.Share) bool {
+	if !share.PasswordProtected() {
+		return true
+	}
+
+	unlockToken := c.Query("unlock")
+	if unlockToken == "" {
+		unlockToken = c.GetHeader("X-Unlock-Token")
+	}
+	if unlockToken == "" {
+		return false
+	}
+	fingerprint, err := h.fileService.SharePasswordFingerprint(share)
+	if err != nil {
+		log.Printf("Failed to look up the password of file %s: %v", share.File.ID, err)
+		return false
+	}
+	return h.authService.ValidateUnlockToken(unlockToken, share.Token(), fingerprint) == nil
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"anonlink/internal/audit"
+)
+
+// unlock trades password for an unlock token for the download token,
+// returning "" with the response when that fails.
+func (s *testServer) unlock(downloadToken, password string) (string, *httptest.ResponseRecorder) {
+	s.t.Helper()
+	w := s.postJSON("/api/v1/download/"+downloadToken+"/unlock", SharePasswordRequest{Password: password})
+	if w.Code != http.StatusOK {
+		return "", w
+	}
+	var data struct {
+		UnlockToken string `json:"unlock_token"`
+		DownloadURL string `json:"download_url"`
+	}
+	decode(s.t, w, &data)
+	if data.UnlockToken == "" || data.DownloadURL != "/api/v1/download/"+downloadToken+"?unlock="+data.UnlockToken {
+		s.t.Fatalf("unlock: %s", w.Body)
+	}
+	return data.UnlockToken, w
+}
+
+func TestUnlockShare(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	alice := s.register("alice", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+	other := s.upload(alice, "other.txt", "other")
+	for _, f := range []string{file.ID, other.ID} {
+		if w := s.sendJSON(http.MethodPut, "/api/v1/files/"+f+"/password", alice, SharePasswordRequest{Password: "secret"}); w.Code != http.StatusOK {
+			t.Fatalf("set password: %d %s", w.Code, w.Body)
+		}
+	}
+	path := "/api/v1/download/" + file.DownloadToken
+	download := func(unlockToken string, header bool) int {
+		t.Helper()
+		if header {
+			return s.get(http.MethodGet, path, map[string]string{"X-Unlock-Token": unlockToken}).Code
+		}
+		return s.get(http.MethodGet, path+"?unlock="+unlockToken, nil).Code
+	}
+
+	if code := s.get(http.MethodGet, path, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("download without unlocking: %d", code)
+	}
+	if _, w := s.unlock(file.DownloadToken, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unlock with the wrong password: %d %s", w.Code, w.Body)
+	}
+	unlockToken, w := s.unlock(file.DownloadToken, "secret")
+	if unlockToken == "" {
+		t.Fatalf("unlock: %d %s", w.Code, w.Body)
+	}
+	if code := download(unlockToken, false); code != http.StatusOK {
+		t.Errorf("download with ?unlock=: %d", code)
+	}
+	if code := download(unlockToken, true); code != http.StatusOK {
+		t.Errorf("download with X-Unlock-Token: %d", code)
+	}
+	if code := download("nonsense", false); code != http.StatusUnauthorized {
+		t.Errorf("download with a made-up unlock token: %d", code)
+	}
+
+	// A token only unlocks the link it was issued for, even with the same
+	// password on another.
+	if code := s.get(http.MethodGet, "/api/v1/download/"+other.DownloadToken+"?unlock="+unlockToken, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("other file with this file's unlock token: %d", code)
+	}
+
+	// Or posting the password itself.
+	if w := s.postJSON(path, SharePasswordRequest{Password: "secret"}); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("download with the password: %d %s", w.Code, w.Body)
+	}
+	if w := s.postJSON(path, SharePasswordRequest{Password: "wrong"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("download with the wrong password: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUnlockTokenFollowsThePassword(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	alice := s.register("alice", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+	path := "/api/v1/download/" + file.DownloadToken
+	setPassword := func(password string) {
+		t.Helper()
+		w := s.sendJSON(http.MethodPut, "/api/v1/files/"+file.ID+"/password", alice, SharePasswordRequest{Password: password})
+		if w.Code != http.StatusOK {
+			t.Fatalf("set password: %d %s", w.Code, w.Body)
+		}
+	}
+	unlock := func(password string) string {
+		t.Helper()
+		unlockToken, w := s.unlock(file.DownloadToken, password)
+		if unlockToken == "" {
+			t.Fatalf("unlock: %d %s", w.Code, w.Body)
+		}
+		return unlockToken
+	}
+
+	setPassword("first")
+	first := unlock("first")
+	setPassword("second")
+	if code := s.get(http.MethodGet, path+"?unlock="+first, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("token for the old password after changing it: %d", code)
+	}
+	second := unlock("second")
+	if code := s.get(http.MethodGet, path+"?unlock="+second, nil).Code; code != http.StatusOK {
+		t.Errorf("token for the new password: %d", code)
+	}
+
+	// Setting the same password again still shuts out the tokens handed out
+	// before, as does removing it and putting it back.
+	setPassword("second")
+	if code := s.get(http.MethodGet, path+"?unlock="+second, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("token after setting the same password again: %d", code)
+	}
+	third := unlock("second")
+	if w := s.do(httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+file.ID+"/password", nil), alice); w.Code != http.StatusOK {
+		t.Fatalf("remove password: %d %s", w.Code, w.Body)
+	}
+	if code := s.get(http.MethodGet, path, nil).Code; code != http.StatusOK {
+		t.Errorf("download without a password: %d", code)
+	}
+	setPassword("second")
+	if code := s.get(http.MethodGet, path+"?unlock="+third, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("token from before the password was removed: %d", code)
+	}
+}
+
+func TestUnlockLinkPassword(t *testing.T) {
+	s := newTestServer(t, testConfig())
+	alice := s.register("alice", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+	w := s.sendJSON(http.MethodPost, "/api/v1/files/"+file.ID+"/links", alice, ShareLinkRequest{Password: ptr("secret")})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create link: %d %s", w.Code, w.Body)
+	}
+	var link struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	decode(t, w, &link)
+
+	// The file's own link has no password; the new one has.
+	if code := s.get(http.MethodGet, "/api/v1/download/"+file.DownloadToken, nil).Code; code != http.StatusOK {
+		t.Errorf("file's own link: %d", code)
+	}
+	unlockToken, w := s.unlock(link.Token, "secret")
+	if unlockToken == "" {
+		t.Fatalf("unlock: %d %s", w.Code, w.Body)
+	}
+	if code := s.get(http.MethodGet, "/api/v1/download/"+link.Token+"?unlock="+unlockToken, nil).Code; code != http.StatusOK {
+		t.Errorf("link with its unlock token: %d", code)
+	}
+
+	if w := s.sendJSON(http.MethodPatch, "/api/v1/files/"+file.ID+"/links/"+link.ID, alice, ShareLinkRequest{Password: ptr("changed")}); w.Code != http.StatusOK {
+		t.Fatalf("change link password: %d %s", w.Code, w.Body)
+	}
+	if code := s.get(http.MethodGet, "/api/v1/download/"+link.Token+"?unlock="+unlockToken, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("link with an unlock token for its old password: %d", code)
+	}
+}
+
+func TestUnlockRateLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.SharePasswordMaxAttempts = 3
+	s := newTestServer(t, cfg)
+	alice := s.register("alice", "correct horse")
+	file := s.upload(alice, "notes.txt", "hello")
+	other := s.upload(alice, "other.txt", "other")
+	for _, f := range []string{file.ID, other.ID} {
+		if w := s.sendJSON(http.MethodPut, "/api/v1/files/"+f+"/password", alice, SharePasswordRequest{Password: "secret"}); w.Code != http.StatusOK {
+			t.Fatalf("set password: %d %s", w.Code, w.Body)
+		}
+	}
+
+	for i := 0; i < cfg.SharePasswordMaxAttempts; i++ {
+		if _, w := s.unlock(file.DownloadToken, "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	if n := s.countEvents(audit.SharePasswordFailed); n != cfg.SharePasswordMaxAttempts {
+		t.Errorf("%d share_password_failed events, want %d", n, cfg.SharePasswordMaxAttempts)
+	}
+
+	// Once limited, not even the right password is looked at, whichever way
+	// it comes in.
+	if _, w := s.unlock(file.DownloadToken, "secret"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unlock with the right password: %d %s", w.Code, w.Body)
+	}
+	if w := s.postJSON("/api/v1/download/"+file.DownloadToken, SharePasswordRequest{Password: "secret"}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("download with the right password: %d %s", w.Code, w.Body)
+	}
+
+	// The limit is per link, so the other file is not held up.
+	if unlockToken, w := s.unlock(other.DownloadToken, "secret"); unlockToken == "" {
+		t.Errorf("unlocking another file: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"anonlink/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APITokenRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Scopes    []string `json:"scopes" binding:"required"`
+	ExpiresAt *string  `json:"expires_at"`
+	ExpiresIn *int64   `json:"expires_in"`
+}
+
+// RequireScope lets requests authenticated with a personal access token
+// through only if the token has scope. Logins may do anything their role
+// allows, which AuthMiddleware has already checked.
+func (h *Handlers) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("apiToken")
+		if !ok {
+			c.Next()
+			return
+		}
+		if !value.(*auth.APIToken).HasScope(scope) {
+			c.JSON(http.StatusForbidden, Response{
+				Success: false,
+				Error:   "Token lacks the " + scope + " scope",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireLogin keeps personal access tokens away from routes that manage the
+// account itself, such as creating more tokens.
+func (h *Handlers) RequireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("apiToken"); ok {
+			c.JSON(http.StatusForbidden, Response{
+				Success: false,
+				Error:   "This endpoint cannot be used with an API token",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func (h *Handlers) GetAPITokens(c *gin.Context) {
+	tokens, err := h.authService.ListAPITokens(c.GetInt("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get API tokens: " + err.Error(),
+		})
+		return
+	}
+	if tokens == nil {
+		tokens = []*auth.APIToken{}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    tokens,
+	})
+}
+
+func (h *Handlers) CreateAPIToken(c *gin.Context) {
+	var req APITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var expiresAt *time.Time
+	switch {
+	case req.ExpiresIn != nil:
+		if *req.ExpiresIn <= 0 {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "expires_in must be a positive number of seconds",
+			})
+			return
+		}
+		t := time.Now().Add(time.Duration(*req.ExpiresIn) * time.Second)
+		expiresAt = &t
+	case req.ExpiresAt != nil && *req.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, *req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "expires_at must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		expiresAt = &t
+	}
+
+	token, secret, err := h.authService.CreateAPIToken(c.GetInt("userID"), req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Failed to create API token: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Message: "Store this token now, it will not be shown again",
+		Data: gin.H{
+			"token":     secret,
+			"api_token": token,
+		},
+	})
+}
+
+func (h *Handlers) DeleteAPIToken(c *gin.Context) {
+	err := h.authService.DeleteAPIToken(c.GetInt("userID"), c.Param("id"))
+	if errors.Is(err, auth.ErrAPITokenNotFound) {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "API token not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete API token: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "API token deleted",
+	})
+}
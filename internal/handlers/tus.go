@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"anonlink/internal/files"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusPath       = "/api/v1/uploads/tus"
+)
+
+// TusMiddleware implements the version negotiation every tus request except
+// OPTIONS has to go through.
+func (h *Handlers) TusMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		if c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.JSON(http.StatusPreconditionFailed, Response{
+				Success: false,
+				Error:   "Unsupported tus version",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func (h *Handlers) TusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if h.cfg.MaxFileSize != files.Unlimited {
+		c.Header("Tus-Max-Size", strconv.FormatInt(h.cfg.MaxFileSize, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handlers) TusCreate(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid or missing Upload-Length",
+		})
+		return
+	}
+	quota, err := h.fileService.GetQuota(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to get quota: " + err.Error(),
+		})
+		return
+	}
+	if length > quota.FileSizeLimit() {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Success: false,
+			Error:   fmt.Sprintf("File too large (max %s)", formatSize(quota.MaxFileSize)),
+		})
+		return
+	}
+
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid Upload-Metadata",
+		})
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Upload-Metadata must include a filename",
+		})
+		return
+	}
+	mimeType := metadata["filetype"]
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	upload, err := h.fileService.CreateUpload(userID, length, filename, mimeType, h.cfg.PartialUploadExpiry)
+	if errors.Is(err, files.ErrQuotaExceeded) {
+		c.JSON(http.StatusForbidden, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create upload: " + err.Error(),
+		})
+		return
+	}
+
+	// An empty file is complete the moment it is created.
+	if length == 0 {
+		_, file, err := h.fileService.WriteUploadChunk(userID, upload.ID, 0, http.NoBody)
+		if errors.Is(err, files.ErrQuotaExceeded) {
+			c.JSON(http.StatusForbidden, Response{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to store upload: " + err.Error(),
+			})
+			return
+		}
+		setTusFileHeaders(c, file)
+	}
+
+	c.Header("Location", tusPath+"/"+upload.ID)
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+func (h *Handlers) TusHead(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	upload, err := h.fileService.GetUpload(userID, c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+func (h *Handlers) TusPatch(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, Response{
+			Success: false,
+			Error:   "Content-Type must be application/offset+octet-stream",
+		})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid or missing Upload-Offset",
+		})
+		return
+	}
+
+	upload, file, err := h.fileService.WriteUploadChunk(userID, c.Param("id"), offset, c.Request.Body)
+	switch {
+	case errors.Is(err, files.ErrUploadNotFound):
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Upload not found or expired",
+		})
+		return
+	case errors.Is(err, files.ErrOffsetMismatch):
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   fmt.Sprintf("Upload-Offset does not match current offset %d", upload.Offset),
+		})
+		return
+	case errors.Is(err, files.ErrQuotaExceeded):
+		c.JSON(http.StatusForbidden, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to write upload: " + err.Error(),
+		})
+		return
+	}
+
+	if file != nil {
+		setTusFileHeaders(c, file)
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handlers) TusDelete(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	err := h.fileService.TerminateUpload(userID, c.Param("id"))
+	switch {
+	case errors.Is(err, files.ErrUploadNotFound):
+		c.Status(http.StatusNotFound)
+	case err != nil:
+		c.Status(http.StatusInternalServerError)
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// setTusFileHeaders tells the client which file its finished upload became,
+// since tus itself has no notion of a result.
+func setTusFileHeaders(c *gin.Context, file *files.File) {
+	c.Header("Anonlink-File-Id", file.ID)
+	c.Header("Anonlink-Download-Token", file.DownloadToken)
+}
+
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,194 @@
+// Package mail sends the emails Anonlink writes to its users over SMTP,
+// rendered from plain-text templates.
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How the connection to the SMTP server is secured.
+const (
+	// TLSStartTLS connects in plaintext and upgrades with STARTTLS, which
+	// the server must offer. This is the usual setup on port 587.
+	TLSStartTLS = "starttls"
+	// TLSImplicit speaks TLS from the start, usually on port 465.
+	TLSImplicit = "tls"
+	// TLSNone never encrypts, for SMTP sinks on the local machine.
+	TLSNone = "none"
+)
+
+// sendTimeout bounds a whole conversation with the SMTP server.
+const sendTimeout = 30 * time.Second
+
+//go:embed templates/*.txt
+var defaultTemplates embed.FS
+
+type Config struct {
+	Host string
+	Port int
+	// Username and Password are sent with PLAIN auth, which Go only allows
+	// over TLS or to localhost. Without a username there is no auth.
+	Username string
+	Password string
+	// From is the sender, such as "Anonlink <noreply@example.com>".
+	From string
+	TLS  string
+	// TemplatesDir replaces the built-in templates with the files of the
+	// same name in that directory.
+	TemplatesDir string
+}
+
+// Mailer sends templated emails. Each template starts with a "Subject:"
+// line, followed by a blank line and the body.
+type Mailer struct {
+	cfg       Config
+	from      *netmail.Address
+	templates *template.Template
+}
+
+func New(cfg Config) (*Mailer, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("no SMTP host")
+	}
+	switch cfg.TLS {
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q (available: %s, %s, %s)", cfg.TLS, TLSStartTLS, TLSImplicit, TLSNone)
+	}
+	from, err := netmail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", cfg.From, err)
+	}
+
+	var files fs.FS = defaultTemplates
+	pattern := "templates/*.txt"
+	if cfg.TemplatesDir != "" {
+		files, pattern = os.DirFS(cfg.TemplatesDir), "*.txt"
+	}
+	templates, err := template.ParseFS(files, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email templates: %w", err)
+	}
+
+	return &Mailer{cfg: cfg, from: from, templates: templates}, nil
+}
+
+// Send renders the template called name, such as "password-reset.txt", with
+// data and sends it to one address.
+func (m *Mailer) Send(to, name string, data interface{}) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("invalid recipient")
+	}
+	message, err := m.render(to, name, data)
+	if err != nil {
+		return err
+	}
+
+	client, err := m.dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if m.cfg.TLS == TLSStartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: m.cfg.Host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return fmt.Errorf("failed to log in to the SMTP server: %w", err)
+		}
+	}
+	if err := client.Mail(m.from.Address); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return client.Quit()
+}
+
+func (m *Mailer) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	dialer := &net.Dialer{Timeout: sendTimeout}
+
+	var conn net.Conn
+	var err error
+	if m.cfg.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: m.cfg.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// render builds the whole message, headers included.
+func (m *Mailer) render(to, name string, data interface{}) ([]byte, error) {
+	var text bytes.Buffer
+	if err := m.templates.ExecuteTemplate(&text, name, data); err != nil {
+		return nil, fmt.Errorf("failed to render email: %w", err)
+	}
+	header, body, ok := strings.Cut(strings.ReplaceAll(text.String(), "\r\n", "\n"), "\n\n")
+	subject, found := strings.CutPrefix(header, "Subject:")
+	if !ok || !found || strings.Contains(subject, "\n") {
+		return nil, fmt.Errorf("email template %s must start with a Subject: line and a blank line", name)
+	}
+
+	domain := m.from.Address[strings.LastIndex(m.from.Address, "@")+1:]
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@%s>\r\n", uuid.New().String(), domain)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&message)
+	if _, err := w.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
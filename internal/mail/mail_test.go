@@ -0,0 +1,245 @@
+package mail
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpServer accepts SMTP conversations on 127.0.0.1 and keeps the
+// messages, with just enough of the protocol for net/smtp.
+type smtpServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu          sync.Mutex
+	connections int
+	messages    []smtpMessage
+	wg          sync.WaitGroup
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{t: t, listener: listener}
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		io.WriteString(conn, line+"\r\n")
+	}
+	reply("220 localhost ESMTP test")
+
+	var message smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			message = smtpMessage{from: arg}
+			reply("250 OK")
+		case "RCPT":
+			message.to = append(message.to, arg)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			message.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Unknown command")
+		}
+	}
+}
+
+func (s *smtpServer) received() ([]smtpMessage, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...), s.connections
+}
+
+func newTestMailer(t *testing.T, server *smtpServer) *Mailer {
+	t.Helper()
+	m, err := New(Config{
+		Host: "127.0.0.1",
+		Port: server.port(),
+		From: "Anonlink <noreply@anonlink.example>",
+		TLS:  TLSNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSend(t *testing.T) {
+	server := newSMTPServer(t)
+	m := newTestMailer(t, server)
+
+	// Long enough that quoted-printable has to break the line.
+	link := "https://anonlink.example/reset-password#token=" + strings.Repeat("aB3_-", 9)
+	err := m.Send("zoe@example.com", "password-reset.txt", map[string]string{
+		"Username": "Zoë",
+		"Link":     link,
+		"ValidFor": "1 hour",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	messages, _ := server.received()
+	if len(messages) != 1 {
+		t.Fatalf("server got %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if got.from != "FROM:<noreply@anonlink.example>" {
+		t.Errorf("MAIL %s, want the sender's bare address", got.from)
+	}
+	if len(got.to) != 1 || got.to[0] != "TO:<zoe@example.com>" {
+		t.Errorf("RCPT %v, want zoe@example.com", got.to)
+	}
+
+	msg, err := netmail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatalf("parsing the message: %v", err)
+	}
+	for header, want := range map[string]string{
+		"From":                      `"Anonlink" <noreply@anonlink.example>`,
+		"To":                        "zoe@example.com",
+		"Subject":                   "Reset your password",
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+	} {
+		value := msg.Header.Get(header)
+		if header == "Subject" {
+			value, _ = new(mime.WordDecoder).DecodeHeader(value)
+		}
+		if value != want {
+			t.Errorf("%s: %q, want %q", header, value, want)
+		}
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@anonlink.example>") {
+		t.Errorf("Message-ID %q, want one in the sender's domain", id)
+	}
+
+	raw, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("encoded line of %d characters: %q", len(line), line)
+		}
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(raw))))
+	if err != nil {
+		t.Fatalf("decoding the body: %v", err)
+	}
+	if !strings.Contains(string(body), "Hi Zoë,") {
+		t.Errorf("body does not greet the user:\n%s", body)
+	}
+	if !strings.Contains(string(body), "\r\n"+link+"\r\n") {
+		t.Errorf("body does not have the link %s on a line of its own:\n%s", link, body)
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	server := newSMTPServer(t)
+	m := newTestMailer(t, server)
+
+	for _, to := range []string{
+		"victim@example.com\r\nBcc: everyone@example.com",
+		"victim@example.com\nBcc: everyone@example.com",
+		"victim@example.com\r",
+	} {
+		err := m.Send(to, "verify-email.txt", map[string]string{"Username": "x", "Link": "y", "ValidFor": "z"})
+		if err == nil || !strings.Contains(err.Error(), "invalid recipient") {
+			t.Errorf("Send(%q) = %v, want invalid recipient", to, err)
+		}
+	}
+	if messages, connections := server.received(); connections != 0 || len(messages) != 0 {
+		t.Errorf("server got %d connections and %d messages, want none", connections, len(messages))
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"no host":     {From: "noreply@example.com", TLS: TLSNone},
+		"unknown TLS": {Host: "localhost", From: "noreply@example.com", TLS: "ssl"},
+		"bad sender":  {Host: "localhost", From: "not an address", TLS: TLSNone},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
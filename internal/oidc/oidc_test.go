@@ -0,0 +1,351 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientID = "anonlink"
+
+// fakeProvider is an OpenID Connect provider serving discovery, its key set
+// and a token endpoint that hands out whatever ID token the test set up,
+// after checking the PKCE verifier against the challenge.
+type fakeProvider struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	idToken   string
+	form      url.Values
+	basicAuth [2]string
+	jwksHits  int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeProvider{rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.server.URL,
+			"authorization_endpoint": f.server.URL + "/authorize",
+			"token_endpoint":         f.server.URL + "/token",
+			"jwks_uri":               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.jwksHits++
+		f.mu.Unlock()
+		b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "OKP", "kid": "unknown", "crv": "Ed25519", "x": "AA"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		r.ParseForm()
+		f.form = r.PostForm
+		f.basicAuth[0], f.basicAuth[1], _ = r.BasicAuth()
+
+		w.Header().Set("Content-Type", "application/json")
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "x", "token_type": "Bearer", "id_token": f.idToken})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeProvider) provider(t *testing.T, secret string) *Provider {
+	t.Helper()
+	p, err := NewProvider(Config{
+		Issuer:       f.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: secret,
+		RedirectURL:  "https://anonlink.example/api/v1/auth/oidc/callback",
+		Scopes:       []string{"email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// claims are the ID token claims of a valid login with nonce.
+func (f *fakeProvider) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":                f.server.URL,
+		"sub":                "user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"email":              "alice@example.org",
+		"email_verified":     true,
+		"preferred_username": "alice",
+		"name":               "Alice",
+	}
+}
+
+func (f *fakeProvider) sign(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	var key interface{} = f.rsaKey
+	switch method.(type) {
+	case *jwt.SigningMethodECDSA:
+		key = f.ecKey
+	case *jwt.SigningMethodHMAC:
+		// What an attacker would try: the public key, or anything else,
+		// as an HMAC secret.
+		key = []byte("anything")
+	}
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// login goes through AuthCodeURL and Exchange with the ID token made by
+// idToken for the request's nonce.
+func (f *fakeProvider) login(t *testing.T, p *Provider, idToken func(nonce string) string) (*Identity, error) {
+	t.Helper()
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("state") != req.State || q.Get("nonce") != req.Nonce || q.Get("code_challenge_method") != "S256" ||
+		q.Get("scope") != "openid email" || q.Get("client_id") != testClientID {
+		t.Fatalf("authorization URL %s", authURL)
+	}
+
+	f.mu.Lock()
+	f.challenge = q.Get("code_challenge")
+	f.idToken = idToken(req.Nonce)
+	f.mu.Unlock()
+	return p.Exchange("the-code", req)
+}
+
+func TestExchange(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.provider(t, "")
+
+	identity, err := f.login(t, p, func(nonce string) string {
+		claims := f.claims(nonce)
+		claims["email_verified"] = "true"
+		return f.sign(t, jwt.SigningMethodRS256, "rsa", claims)
+	})
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	want := Identity{Issuer: f.server.URL, Subject: "user-1", Email: "alice@example.org", EmailVerified: true,
+		PreferredUsername: "alice", Name: "Alice"}
+	if *identity != want {
+		t.Errorf("identity %+v, want %+v", *identity, want)
+	}
+	// A public client names itself in the form.
+	if f.form.Get("client_id") != testClientID || f.form.Get("grant_type") != "authorization_code" ||
+		f.form.Get("redirect_uri") != p.cfg.RedirectURL {
+		t.Errorf("token request %v", f.form)
+	}
+
+	identity, err = f.login(t, p, func(nonce string) string {
+		return f.sign(t, jwt.SigningMethodES256, "ec", f.claims(nonce))
+	})
+	if err != nil || identity.Subject != "user-1" {
+		t.Errorf("ES256 token: %+v, %v", identity, err)
+	}
+}
+
+func TestExchangeConfidentialClient(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.provider(t, "s3cret/+")
+
+	if _, err := f.login(t, p, func(nonce string) string {
+		return f.sign(t, jwt.SigningMethodRS256, "rsa", f.claims(nonce))
+	}); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if f.basicAuth != [2]string{testClientID, url.QueryEscape("s3cret/+")} || f.form.Has("client_id") {
+		t.Errorf("client authenticated with %q and form %v", f.basicAuth, f.form)
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.provider(t, "")
+
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AuthCodeURL(req); err != nil {
+		t.Fatal(err)
+	}
+	f.challenge = "not the challenge"
+	if _, err := p.Exchange("the-code", req); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("err = %v, want the provider's invalid_grant", err)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.provider(t, "")
+	meta, err := p.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(jwt.MapClaims)
+		method jwt.SigningMethod
+		kid    string
+	}{
+		{name: "wrong issuer", modify: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }},
+		{name: "wrong audience", modify: func(c jwt.MapClaims) { c["aud"] = "someone-else" }},
+		{name: "expired", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }},
+		{name: "no expiry", modify: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "issued in the future", modify: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{name: "no subject", modify: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "other nonce", modify: func(c jwt.MapClaims) { c["nonce"] = "replayed" }},
+		{name: "no nonce", modify: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "HS256", method: jwt.SigningMethodHS256},
+		{name: "unsigned", method: jwt.SigningMethodNone},
+		{name: "unknown key", kid: "nope"},
+		{name: "encryption key", kid: "enc"},
+		{name: "azp of another client", modify: func(c jwt.MapClaims) { c["azp"] = "someone-else" }},
+		{name: "several audiences without azp", modify: func(c jwt.MapClaims) {
+			c["aud"] = []string{testClientID, "someone-else"}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := f.claims("the-nonce")
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			method, kid := tt.method, tt.kid
+			if method == nil {
+				method = jwt.SigningMethodRS256
+			}
+			if kid == "" {
+				kid = "rsa"
+			}
+
+			var raw string
+			if method == jwt.SigningMethodNone {
+				var err error
+				raw, err = jwt.NewWithClaims(method, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				raw = f.sign(t, method, kid, claims)
+			}
+			if _, err := p.verifyIDToken(meta, raw, "the-nonce"); !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+
+	claims := f.claims("the-nonce")
+	claims["aud"] = []string{testClientID, "someone-else"}
+	claims["azp"] = testClientID
+	if _, err := p.verifyIDToken(meta, f.sign(t, jwt.SigningMethodRS256, "rsa", claims), "the-nonce"); err != nil {
+		t.Errorf("several audiences with our azp: %v", err)
+	}
+}
+
+func TestKeyRefetch(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.provider(t, "")
+	meta, err := p.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := f.sign(t, jwt.SigningMethodRS256, "rsa", f.claims("n"))
+	if _, err := p.verifyIDToken(meta, valid, "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens with made-up key IDs do not send us to the provider every time.
+	for i := 0; i < 3; i++ {
+		p.verifyIDToken(meta, f.sign(t, jwt.SigningMethodRS256, "made-up", f.claims("n")), "n")
+	}
+	if f.jwksHits != 1 {
+		t.Errorf("key set fetched %d times, want once", f.jwksHits)
+	}
+
+	// Once the interval has passed, an unknown key ID is looked up again, as
+	// the provider may have rotated its keys.
+	p.keysFetch = time.Now().Add(-2 * keysRefetchInterval)
+	p.verifyIDToken(meta, f.sign(t, jwt.SigningMethodRS256, "made-up", f.claims("n")), "n")
+	if f.jwksHits != 2 {
+		t.Errorf("key set fetched %d times, want twice", f.jwksHits)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	f := newFakeProvider(t)
+	p, err := NewProvider(Config{
+		Issuer:      f.server.URL + "/",
+		ClientID:    testClientID,
+		RedirectURL: "https://anonlink.example/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AuthCodeURL(&AuthRequest{}); err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("err = %v, want an issuer mismatch", err)
+	}
+}
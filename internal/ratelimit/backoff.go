@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Backoff counts failed attempts per key. The max-th failure blocks the key
+// for base, and every failure after that for twice as long as the one
+// before, up to ceiling. A key is forgotten once it has had no failures for
+// forget, or when Reset is called.
+type Backoff struct {
+	repo    Repository
+	scope   string
+	max     int
+	base    time.Duration
+	ceiling time.Duration
+	forget  time.Duration
+}
+
+// NewBackoff returns a Backoff that keeps its counters in repo under scope,
+// like New.
+func NewBackoff(repo Repository, scope string, max int, base, ceiling, forget time.Duration) *Backoff {
+	return &Backoff{
+		repo:    repo,
+		scope:   scope,
+		max:     max,
+		base:    base,
+		ceiling: ceiling,
+		forget:  forget,
+	}
+}
+
+// Allow reports whether key may make another attempt, and if not, how long
+// it has to wait.
+func (b *Backoff) Allow(key string) (bool, time.Duration, error) {
+	now := time.Now()
+	c, err := b.repo.Get(b.scope, key, now)
+	if err != nil {
+		return false, 0, err
+	}
+	if wait := c.BlockedUntil.Sub(now); wait > 0 {
+		return false, wait, nil
+	}
+	return true, 0, nil
+}
+
+// Fail records a failed attempt and returns how long key is now blocked
+// for, or 0 if it may still fail without being blocked.
+func (b *Backoff) Fail(key string) (time.Duration, error) {
+	now := time.Now()
+	c, err := b.repo.Add(b.scope, key, now, b.forget, true)
+	if err != nil {
+		return 0, err
+	}
+
+	block := Delay(c.Attempts, b.max, b.base, b.ceiling)
+	if block > 0 {
+		if err := b.repo.Block(b.scope, key, now.Add(block)); err != nil {
+			return 0, err
+		}
+	}
+	return block, nil
+}
+
+func (b *Backoff) Reset(key string) error {
+	return b.repo.Delete(b.scope, key)
+}
+
+// Delay is how long the failures-th failure in a row blocks for when the
+// max-th one is the first to block: nothing before that, then base,
+// doubling with every failure up to ceiling. A max below 1 never blocks.
+func Delay(failures, max int, base, ceiling time.Duration) time.Duration {
+	if max < 1 || failures < max {
+		return 0
+	}
+	delay := base
+	for i := max; i < failures && delay < ceiling; i++ {
+		delay *= 2
+	}
+	if delay > ceiling {
+		delay = ceiling
+	}
+	return delay
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Limiter counts failed attempts per key and blocks a key once it has failed
+// max times within window. Successful attempts should call Reset.
+type Limiter struct {
+	repo   Repository
+	scope  string
+	max    int
+	window time.Duration
+}
+
+// New returns a Limiter that keeps its counters in repo under scope, which
+// must be different for every limiter sharing repo.
+func New(repo Repository, scope string, max int, window time.Duration) *Limiter {
+	return &Limiter{
+		repo:   repo,
+		scope:  scope,
+		max:    max,
+		window: window,
+	}
+}
+
+// Allow reports whether key may make another attempt, and if not, how long
+// it has to wait.
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	now := time.Now()
+	c, err := l.repo.Get(l.scope, key, now)
+	if err != nil {
+		return false, 0, err
+	}
+	if c.Attempts > 0 && c.Attempts >= l.max {
+		return false, c.ExpiresAt.Sub(now), nil
+	}
+	return true, 0, nil
+}
+
+// Take is Allow followed by Fail in one step, for limiting how often
+// something may be done at all rather than how often it may go wrong.
+func (l *Limiter) Take(key string) (bool, time.Duration, error) {
+	now := time.Now()
+	c, err := l.repo.Add(l.scope, key, now, l.window, false)
+	if err != nil {
+		return false, 0, err
+	}
+	if c.Attempts > l.max {
+		return false, c.ExpiresAt.Sub(now), nil
+	}
+	return true, 0, nil
+}
+
+func (l *Limiter) Fail(key string) error {
+	_, err := l.repo.Add(l.scope, key, time.Now(), l.window, false)
+	return err
+}
+
+func (l *Limiter) Reset(key string) error {
+	return l.repo.Delete(l.scope, key)
+}
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"anonlink/internal/database"
+	"anonlink/internal/database/dbtest"
+)
+
+func TestLimiter(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		l := New(repo, "share", 3, time.Hour)
+
+		for i := 0; i < 3; i++ {
+			if ok, _, err := l.Allow("token"); !ok || err != nil {
+				t.Fatalf("Allow after %d failures = %v, %v", i, ok, err)
+			}
+			if err := l.Fail("token"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ok, wait, err := l.Allow("token")
+		if ok || err != nil {
+			t.Fatalf("Allow after 3 failures = %v, %v; want a block", ok, err)
+		}
+		if wait <= 58*time.Minute || wait > time.Hour {
+			t.Errorf("wait %v, want about an hour", wait)
+		}
+		if ok, _, _ := l.Allow("other"); !ok {
+			t.Error("another key is blocked too")
+		}
+
+		if err := l.Reset("token"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _, _ := l.Allow("token"); !ok {
+			t.Error("still blocked after Reset")
+		}
+	})
+}
+
+func TestLimiterTake(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		l := New(repo, "email", 2, time.Hour)
+
+		for i := 0; i < 2; i++ {
+			if ok, _, err := l.Take("alice"); !ok || err != nil {
+				t.Fatalf("Take #%d = %v, %v", i+1, ok, err)
+			}
+		}
+		if ok, wait, err := l.Take("alice"); ok || err != nil || wait <= 0 {
+			t.Errorf("Take #3 = %v, %v, %v; want a wait", ok, wait, err)
+		}
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		b := NewBackoff(repo, "ip", 2, time.Minute, 3*time.Minute, 24*time.Hour)
+
+		for _, want := range []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+			block, err := b.Fail("192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block != want {
+				t.Errorf("Fail blocks for %v, want %v", block, want)
+			}
+		}
+		ok, wait, err := b.Allow("192.0.2.1")
+		if ok || err != nil || wait <= 2*time.Minute || wait > 3*time.Minute {
+			t.Errorf("Allow = %v, %v, %v; want a wait of about 3m", ok, wait, err)
+		}
+
+		if err := b.Reset("192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _, _ := b.Allow("192.0.2.1"); !ok {
+			t.Error("still blocked after Reset")
+		}
+	})
+}
+
+// Replicas sharing a database share their counters.
+func TestSharedAcrossReplicas(t *testing.T) {
+	dbtest.Each(t, func(t *testing.T, db *database.DB) {
+		first := NewBackoff(NewSQLRepository(db), "ip", 3, time.Minute, time.Hour, 24*time.Hour)
+		second := NewBackoff(NewSQLRepository(db), "ip", 3, time.Minute, time.Hour, 24*time.Hour)
+
+		for _, b := range []*Backoff{first, second, first} {
+			if _, err := b.Fail("192.0.2.1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ok, _, err := second.Allow("192.0.2.1"); ok || err != nil {
+			t.Errorf("Allow on the other replica = %v, %v; want a block", ok, err)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"anonlink/internal/database"
+)
+
+// Counter is what a Repository keeps for a key: the attempts counted since
+// the counter started, when it runs out and when a block of the key ends.
+type Counter struct {
+	Attempts     int
+	ExpiresAt    time.Time
+	BlockedUntil time.Time
+}
+
+// Repository stores the counters of the limiters, each under a scope of its
+// own. SQLRepository keeps them in the application database, so that every
+// replica sharing it counts the same attempts; MemoryRepository keeps them
+// in memory, for tests and throwaway instances.
+type Repository interface {
+	// Get returns the counter of key, or the zero Counter if there is none
+	// or it has run out by now.
+	Get(scope, key string, now time.Time) (Counter, error)
+	// Add counts an attempt and returns the counter. A counter that has
+	// run out by now starts over at one, expiring ttl from now. If sliding
+	// is set, every attempt pushes the expiry back to ttl from now;
+	// otherwise the counter runs out ttl after its first attempt.
+	Add(scope, key string, now time.Time, ttl time.Duration, sliding bool) (Counter, error)
+	// Block blocks key until then, keeping its counter at least as long.
+	Block(scope, key string, until time.Time) error
+	Delete(scope, key string) error
+	// DeleteExpired removes the counters that have run out.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// SQLRepository is the Repository backed by the application database.
+type SQLRepository struct {
+	db *database.DB
+}
+
+var _ Repository = (*SQLRepository)(nil)
+
+func NewSQLRepository(db *database.DB) *SQLRepository {
+	return &SQLRepository{db: db}
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (r *SQLRepository) Get(scope, key string, now time.Time) (Counter, error) {
+	var c Counter
+	var blockedUntil sql.NullTime
+	query := `SELECT attempts, expires_at, blocked_until FROM rate_limits WHERE scope = ? AND subject = ? AND expires_at > ?`
+	err := r.db.QueryRow(query, scope, key, formatTimestamp(now)).Scan(&c.Attempts, &c.ExpiresAt, &blockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Counter{}, nil
+	}
+	if err != nil {
+		return Counter{}, fmt.Errorf("failed to get rate limit: %w", err)
+	}
+	c.BlockedUntil = blockedUntil.Time
+	return c, nil
+}
+
+func (r *SQLRepository) Add(scope, key string, now time.Time, ttl time.Duration, sliding bool) (Counter, error) {
+	// The SET expressions all see the row as it was before the update.
+	query := `INSERT INTO rate_limits (scope, subject, attempts, expires_at) VALUES (?, ?, 1, ?)
+	          ON CONFLICT (scope, subject) DO UPDATE SET
+	          attempts = CASE WHEN rate_limits.expires_at > ? THEN rate_limits.attempts + 1 ELSE 1 END,
+	          expires_at = CASE WHEN rate_limits.expires_at > ? AND NOT ? THEN rate_limits.expires_at ELSE excluded.expires_at END
+	          RETURNING attempts, expires_at, blocked_until`
+	var c Counter
+	var blockedUntil sql.NullTime
+	err := r.db.QueryRow(query, scope, key, formatTimestamp(now.Add(ttl)), formatTimestamp(now), formatTimestamp(now), sliding).
+		Scan(&c.Attempts, &c.ExpiresAt, &blockedUntil)
+	if err != nil {
+		return Counter{}, fmt.Errorf("failed to count attempt: %w", err)
+	}
+	c.BlockedUntil = blockedUntil.Time
+	return c, nil
+}
+
+func (r *SQLRepository) Block(scope, key string, until time.Time) error {
+	query := `UPDATE rate_limits SET blocked_until = ?,
+	          expires_at = CASE WHEN expires_at < ? THEN ? ELSE expires_at END
+	          WHERE scope = ? AND subject = ?`
+	_, err := r.db.Exec(query, formatTimestamp(until), formatTimestamp(until), formatTimestamp(until), scope, key)
+	if err != nil {
+		return fmt.Errorf("failed to block: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) Delete(scope, key string) error {
+	if _, err := r.db.Exec(`DELETE FROM rate_limits WHERE scope = ? AND subject = ?`, scope, key); err != nil {
+		return fmt.Errorf("failed to reset rate limit: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLRepository) DeleteExpired(now time.Time) (int, error) {
+	result, err := r.db.Exec(`DELETE FROM rate_limits WHERE expires_at <= ?`, formatTimestamp(now))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired rate limits: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return int(n), nil
+}
+
+// MemoryRepository is a Repository that keeps counters in memory. It is
+// safe for concurrent use.
+type MemoryRepository struct {
+	mu       sync.Mutex
+	counters map[memoryKey]*Counter
+}
+
+type memoryKey struct {
+	scope, key string
+}
+
+var _ Repository = (*MemoryRepository)(nil)
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{counters: make(map[memoryKey]*Counter)}
+}
+
+func (r *MemoryRepository) Get(scope, key string, now time.Time) (Counter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.counters[memoryKey{scope, key}]
+	if !ok || !c.ExpiresAt.After(now) {
+		return Counter{}, nil
+	}
+	return *c, nil
+}
+
+func (r *MemoryRepository) Add(scope, key string, now time.Time, ttl time.Duration, sliding bool) (Counter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.counters[memoryKey{scope, key}]
+	if !ok {
+		c = &Counter{}
+		r.counters[memoryKey{scope, key}] = c
+	}
+	if c.ExpiresAt.After(now) {
+		c.Attempts++
+	} else {
+		c.Attempts = 1
+	}
+	if sliding || !c.ExpiresAt.After(now) {
+		c.ExpiresAt = now.Add(ttl)
+	}
+	return *c, nil
+}
+
+func (r *MemoryRepository) Block(scope, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.counters[memoryKey{scope, key}]; ok {
+		c.BlockedUntil = until
+		if c.ExpiresAt.Before(until) {
+			c.ExpiresAt = until
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) Delete(scope, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.counters, memoryKey{scope, key})
+	return nil
+}
+
+func (r *MemoryRepository) DeleteExpired(now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for k, c := range r.counters {
+		if !c.ExpiresAt.After(now) {
+			delete(r.counters, k)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"anonlink/internal/database"
+	"anonlink/internal/database/dbtest"
+)
+
+// eachRepository runs test against the memory repository and against the
+// SQL one on every database dialect available.
+func eachRepository(t *testing.T, test func(t *testing.T, repo Repository)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryRepository())
+	})
+	dbtest.Each(t, func(t *testing.T, db *database.DB) {
+		test(t, NewSQLRepository(db))
+	})
+}
+
+// notUTC is a zone timestamps passed to repositories must not leak into the
+// comparisons with stored ones.
+var notUTC = time.FixedZone("UTC+5", 5*60*60)
+
+func TestRepositoryFixedWindow(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		now := time.Now().In(notUTC).Truncate(time.Second)
+
+		if c, err := repo.Get("share", "a", now); err != nil || c != (Counter{}) {
+			t.Fatalf("Get of a new key = %+v, %v; want the zero Counter", c, err)
+		}
+		for want := 1; want <= 3; want++ {
+			c, err := repo.Add("share", "a", now.Add(time.Duration(want)*time.Minute), time.Hour, false)
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if c.Attempts != want || !c.ExpiresAt.Equal(now.Add(61*time.Minute)) {
+				t.Errorf("Add #%d = %+v, want %d attempts expiring an hour after the first", want, c, want)
+			}
+		}
+		if c, err := repo.Get("share", "a", now.Add(30*time.Minute)); err != nil || c.Attempts != 3 {
+			t.Errorf("Get = %+v, %v; want 3 attempts", c, err)
+		}
+		if c, err := repo.Get("share", "b", now); err != nil || c.Attempts != 0 {
+			t.Errorf("Get of another key = %+v, %v; want none", c, err)
+		}
+		if c, err := repo.Get("totp", "a", now); err != nil || c.Attempts != 0 {
+			t.Errorf("Get of the key in another scope = %+v, %v; want none", c, err)
+		}
+
+		later := now.Add(61 * time.Minute)
+		if c, err := repo.Get("share", "a", later); err != nil || c.Attempts != 0 {
+			t.Errorf("Get after the window = %+v, %v; want none", c, err)
+		}
+		c, err := repo.Add("share", "a", later, time.Hour, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Attempts != 1 || !c.ExpiresAt.Equal(later.Add(time.Hour)) {
+			t.Errorf("Add after the window = %+v, want a new counter", c)
+		}
+
+		if err := repo.Delete("share", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if c, err := repo.Get("share", "a", later); err != nil || c.Attempts != 0 {
+			t.Errorf("Get after Delete = %+v, %v; want none", c, err)
+		}
+	})
+}
+
+func TestRepositorySlidingWindow(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		now := time.Now().In(notUTC).Truncate(time.Second)
+
+		for i := 0; i < 3; i++ {
+			if _, err := repo.Add("ip", "192.0.2.1", now.Add(time.Duration(i)*50*time.Minute), time.Hour, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := repo.Get("ip", "192.0.2.1", now.Add(150*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Attempts != 3 || !c.ExpiresAt.Equal(now.Add(160*time.Minute)) {
+			t.Errorf("Get = %+v, want 3 attempts expiring an hour after the last", c)
+		}
+
+		until := now.Add(5 * time.Hour)
+		if err := repo.Block("ip", "192.0.2.1", until); err != nil {
+			t.Fatal(err)
+		}
+		// The block outlives the counter it belongs to.
+		c, err = repo.Get("ip", "192.0.2.1", now.Add(4*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.BlockedUntil.Equal(until) {
+			t.Errorf("BlockedUntil = %v, want %v", c.BlockedUntil, until)
+		}
+	})
+}
+
+func TestRepositoryDeleteExpired(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repo Repository) {
+		now := time.Now().In(notUTC).Truncate(time.Second)
+
+		for _, key := range []string{"a", "b", "c"} {
+			if _, err := repo.Add("ip", key, now, time.Hour, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := repo.Block("ip", "b", now.Add(3*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.Add("ip", "c", now.Add(30*time.Minute), time.Hour, true); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := repo.DeleteExpired(now.Add(time.Hour)); err != nil || n != 1 {
+			t.Errorf("DeleteExpired = %d, %v; want 1", n, err)
+		}
+		if n, err := repo.DeleteExpired(now.Add(3 * time.Hour)); err != nil || n != 2 {
+			t.Errorf("DeleteExpired later = %d, %v; want 2", n, err)
+		}
+	})
+}
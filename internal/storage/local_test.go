@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLocal(t *testing.T, root string) *Local {
+	t.Helper()
+	l, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// files lists the regular files under root, relative to it.
+func files(t *testing.T, root string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failingReader hands out some data, then fails.
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestLocalStage(t *testing.T) {
+	root := t.TempDir()
+	l := newLocal(t, root)
+
+	n, staged, err := l.Stage("a/b/staged", strings.NewReader("staged content"))
+	if err != nil || n != 14 {
+		t.Fatalf("Stage = %d, %v", n, err)
+	}
+	// The data sits in a hidden file next to where it is going, so that
+	// publishing it is a rename within the directory.
+	names := files(t, root)
+	if len(names) != 1 || !strings.HasPrefix(names[0], "a/b/"+tempPrefix) {
+		t.Fatalf("while staged: %v", names)
+	}
+	if _, err := l.Stat("a/b/staged"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("staged object visible before Commit: err = %v", err)
+	}
+	if objects, err := l.List(""); err != nil || len(objects) != 0 {
+		t.Errorf("List while staged = %+v, %v", objects, err)
+	}
+
+	if err := staged.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, l, "a/b/staged"); got != "staged content" {
+		t.Errorf("committed object %q", got)
+	}
+	if names := files(t, root); len(names) != 1 || names[0] != "a/b/staged" {
+		t.Errorf("after Commit: %v", names)
+	}
+	if err := staged.Abort(); err != nil {
+		t.Errorf("Abort after Commit: %v", err)
+	}
+
+	_, staged, err = l.Stage("aborted", strings.NewReader("aborted content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := staged.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Stat("aborted"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("aborted object stored: err = %v", err)
+	}
+
+	// A failed upload leaves nothing behind either.
+	if _, _, err := l.Stage("failed", &failingReader{n: 1000}); err == nil {
+		t.Error("Stage of a failing reader succeeded")
+	}
+	if _, err := l.Put("failed", &failingReader{n: 1000}); err == nil {
+		t.Error("Put of a failing reader succeeded")
+	}
+	if names := files(t, root); len(names) != 1 || names[0] != "a/b/staged" {
+		t.Errorf("after Abort and failed uploads: %v", names)
+	}
+}
+
+func TestLocalPutReplacesAtomically(t *testing.T) {
+	l := newLocal(t, t.TempDir())
+	if _, err := l.Put("key", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := l.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+
+	if _, err := l.Put("key", strings.NewReader("new content")); err != nil {
+		t.Fatal(err)
+	}
+	// Readers that had the old object open keep reading it whole.
+	if old, err := io.ReadAll(obj); err != nil || string(old) != "old" {
+		t.Errorf("open object read %q, %v", old, err)
+	}
+	if got := readAll(t, l, "key"); got != "new content" {
+		t.Errorf("after replacing: %q", got)
+	}
+}
+
+func TestLocalRemovesStaleTemp(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	for name, modTime := range map[string]time.Time{
+		tempPrefix + "stale":          old,
+		"a/b/" + tempPrefix + "stale": old,
+		tempPrefix + "fresh":          time.Now(),
+		"a/object":                    old,
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only temporary files old enough that no upload can still be writing
+	// them go; objects are never touched, however old.
+	newLocal(t, root)
+	if got, want := strings.Join(files(t, root), " "), tempPrefix+"fresh a/object"; got != want {
+		t.Errorf("after starting: %s, want %s", got, want)
+	}
+}
+
+func TestLocalKeys(t *testing.T) {
+	root := t.TempDir()
+	l := newLocal(t, root)
+
+	for _, key := range []string{"", "/", "../outside", "a/../../outside"} {
+		if _, err := l.Put(key, strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "outside")); err == nil {
+		t.Error("wrote outside the root")
+	}
+
+	for _, key := range []string{"a/b/1", "a/b/2", "a/c", "d"} {
+		if _, err := l.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := l.List("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	if strings.Join(keys, " ") != "a/b/1 a/b/2 a/c" {
+		t.Errorf("List(a/) = %v", keys)
+	}
+
+	// Deleting the last key in a directory takes the directory along, but
+	// never the root.
+	for _, key := range []string{"a/b/1", "a/b/2"} {
+		if err := l.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "a", "b")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("empty directory left behind: %v", err)
+	}
+	if err := l.Delete("a/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("root removed: %v", err)
+	}
+	if err := l.Delete("d"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a missing key: err = %v, want ErrNotFound", err)
+	}
+}
+
+// plainStorage hides the Stage method of the storage it wraps, as for a
+// backend that cannot stage objects itself.
+type plainStorage struct{ Storage }
+
+func TestSpooledStage(t *testing.T) {
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	root := t.TempDir()
+	s := plainStorage{newLocal(t, root)}
+
+	n, staged, err := Stage(s, "spooled", onlyReader{strings.NewReader("spooled content")})
+	if err != nil || n != 15 {
+		t.Fatalf("Stage = %d, %v", n, err)
+	}
+	if _, ok := staged.(*spooled); !ok {
+		t.Fatalf("staged a %T, want it spooled", staged)
+	}
+	if names := files(t, spool); len(names) != 1 {
+		t.Errorf("spooled to %v", names)
+	}
+	if _, err := s.Stat("spooled"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("spooled object visible before Commit: err = %v", err)
+	}
+	if err := staged.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, "spooled"); got != "spooled content" {
+		t.Errorf("committed object %q", got)
+	}
+
+	_, staged, err = Stage(s, "aborted", strings.NewReader("aborted content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := staged.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("aborted"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("aborted object stored: err = %v", err)
+	}
+
+	if _, _, err := Stage(s, "failed", &failingReader{n: 1000}); err == nil {
+		t.Error("Stage of a failing reader succeeded")
+	}
+	// The spool files are gone however staging ended.
+	if names := files(t, spool); len(names) != 0 {
+		t.Errorf("left in the spool directory: %v", names)
+	}
+	if names := files(t, root); len(names) != 1 || names[0] != "spooled" {
+		t.Errorf("stored %v", names)
+	}
+}
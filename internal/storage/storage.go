@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is the blob store behind files.Service. Keys are flat, slash
+// separated names generated by the service; callers never pass user input.
+type Storage interface {
+	Put(key string, r io.Reader) (int64, error)
+	Get(key string) (Object, error)
+	Stat(key string) (*ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// Staged is an object that has been fully written but is not visible under
+// its key until Commit is called.
+type Staged interface {
+	Commit() error
+	Abort() error
+}
+
+// Stager is implemented by backends that can write an object first and
+// publish it atomically later.
+type Stager interface {
+	Stage(key string, r io.Reader) (int64, Staged, error)
+}
+
+// Stage writes r so that it can be published under key later. Backends
+// without native support get the data spooled to a local temporary file that
+// is uploaded on Commit.
+func Stage(s Storage, key string, r io.Reader) (int64, Staged, error) {
+	if stager, ok := s.(Stager); ok {
+		return stager.Stage(key, r)
+	}
+
+	tmp, err := os.CreateTemp("", "anonlink-stage-*")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, nil, fmt.Errorf("failed to save file: %w", err)
+	}
+	return n, &spooled{store: s, key: key, tmp: tmp}, nil
+}
+
+type spooled struct {
+	store Storage
+	key   string
+	tmp   *os.File
+}
+
+func (sp *spooled) Commit() error {
+	defer sp.Abort()
+	if _, err := sp.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := sp.store.Put(sp.key, sp.tmp)
+	return err
+}
+
+func (sp *spooled) Abort() error {
+	sp.tmp.Close()
+	return os.Remove(sp.tmp.Name())
+}